@@ -0,0 +1,71 @@
+package db
+
+import (
+	"encoding/json"
+)
+
+// GetAdvisories method returns security advisories of the package
+func (pb *PocketBase) GetAdvisories(name string) (advisories []*Advisory) {
+	raw := pb.store.GetEntry("Advisories", name)
+	if raw == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, &advisories); err != nil {
+		dbLog.Warnf("Failed to decode advisories: %s %v", name, err)
+		return nil
+	}
+
+	return
+}
+
+// PutAdvisories method merges advisories of the package into existing ones by ID
+//
+// Advisories without vulnerable versions are skipped, since an empty range
+// would match every version.
+func (pb *PocketBase) PutAdvisories(name string, advisories []*Advisory) error {
+	merged := pb.GetAdvisories(name)
+	for _, advisory := range advisories {
+		if advisory.VulnerableVersions == "" {
+			dbLog.Warnf("Skipping advisory without vulnerable versions: %s %s", name, advisory.ID)
+			continue
+		}
+		replaced := false
+		for i, existing := range merged {
+			if existing.ID == advisory.ID {
+				merged[i] = advisory
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, advisory)
+		}
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+
+	return pb.store.PutEntry("Advisories", name, raw)
+}
+
+// ClearAdvisories method removes all advisories from the database
+func (pb *PocketBase) ClearAdvisories() (count int) {
+	var names []string
+	pb.store.ForEachEntry("Advisories", "", func(name string, _ []byte) bool {
+		names = append(names, name)
+		return true
+	})
+
+	for _, name := range names {
+		if err := pb.store.DeleteEntry("Advisories", name); err != nil {
+			dbLog.Warnf("Failed to delete advisories: %s %v", name, err)
+			continue
+		}
+		count++
+	}
+
+	return
+}
@@ -0,0 +1,742 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// badgerStore keeps the buckets of boltStore in a single LSM tree where
+// every key is prefixed by its bucket name, so writes during the first run
+// are appended instead of rebalancing a B+tree
+type badgerStore struct {
+	db     *badger.DB
+	config *DatabaseConfig
+	quit   chan struct{}
+	done   chan struct{}
+
+	// writes changing counters are serialized like in bolt since
+	// concurrent badger transactions updating a counter would conflict
+	writeMu sync.Mutex
+}
+
+// badgerTx wraps a write transaction of badger
+//
+// Writes are never split into several transactions, so a transaction that
+// grows beyond the limits of badger fails with badger.ErrTxnTooBig. Bulk
+// writes where partial progress is safe use a write batch or chunked
+// transactions instead, see PutPackages and Orphans.
+type badgerTx struct {
+	db     *badger.DB
+	txn    *badger.Txn
+	unlock func()
+}
+
+func (base *badgerTx) set(key []byte, value []byte) error {
+	return base.txn.Set(key, value)
+}
+
+func (base *badgerTx) get(key []byte) []byte {
+	item, err := base.txn.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	// an empty value has to be distinguished from a missing key
+	value, _ := item.ValueCopy([]byte{})
+	return value
+}
+
+// addCounters applies the deltas to the counters
+//
+// Databases created before the counters were introduced have no counters until they are recounted.
+func (base *badgerTx) addCounters(deltas counterDeltas) error {
+	if base.get(badgerKey("Counters", "Packages")) == nil {
+		return nil
+	}
+
+	for name, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		count := decodeCounter(base.get(badgerKey("Counters", name))) + delta
+		if err := base.set(badgerKey("Counters", name), encodeCounter(count)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (base *badgerTx) release() {
+	if base.unlock != nil {
+		base.unlock()
+		base.unlock = nil
+	}
+}
+
+func (base *badgerTx) Commit() error {
+	defer base.release()
+	return base.txn.Commit()
+}
+
+func (base *badgerTx) Rollback() error {
+	defer base.release()
+	base.txn.Discard()
+	return nil
+}
+
+// badgerFixBatchSize is the number of packages fixed in a transaction, which
+// keeps transactions of a check or a cleanup below the limits of badger
+const badgerFixBatchSize = 1000
+
+// badgerKey returns the key of the item in the bucket
+func badgerKey(bucket string, key string) []byte {
+	return []byte(bucket + "\x00" + key)
+}
+
+// badgerPrefix returns the prefix shared by all keys of the bucket
+func badgerPrefix(bucket string) []byte {
+	return []byte(bucket + "\x00")
+}
+
+func newBadgerStore(config *DatabaseConfig) PocketStore {
+	store := &badgerStore{
+		config: config,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	return store
+}
+
+func (store *badgerStore) Connect() error {
+	var err error
+	opts := badger.DefaultOptions(store.config.Path.(string)).
+		WithSyncWrites(false).
+		WithTruncate(true).
+		WithLogger(dbLog.WithField("store", "badger"))
+	store.db, err = badger.Open(opts)
+	if err != nil {
+		dbLog.Fatalf("Failed to load database directory: %v", err)
+		return err
+	}
+
+	go store.collectGarbage()
+
+	return nil
+}
+
+// collectGarbage reclaims space of the value log left by overwritten documents
+func (store *badgerStore) collectGarbage() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	defer close(store.done)
+
+	for {
+		select {
+		case <-ticker.C:
+			for store.db.RunValueLogGC(0.5) == nil {
+			}
+		case <-store.quit:
+			return
+		}
+	}
+}
+
+func (store *badgerStore) Close() {
+	close(store.quit)
+	<-store.done
+	store.db.Close()
+}
+
+func (store *badgerStore) Init() {
+	store.db.Update(func(txn *badger.Txn) error {
+		for _, name := range append(counterBuckets, "mark:"+MarkComplete, "mark:"+MarkIncomplete) {
+			if err := txn.Set(badgerKey("Counters", name), encodeCounter(0)); err != nil {
+				return err
+			}
+		}
+
+		defaultSequence := make([]byte, 4)
+		binary.LittleEndian.PutUint32(defaultSequence, 0)
+		return txn.Set(badgerKey("Globals", "sequence"), defaultSequence)
+	})
+}
+
+func (store *badgerStore) IsInitialized() bool {
+	initialized := false
+	store.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(badgerKey("Globals", "sequence"))
+		initialized = err == nil
+		return nil
+	})
+
+	return initialized
+}
+
+// scan calls fn with keys (without the bucket prefix) and values of the bucket
+func (store *badgerStore) scan(txn *badger.Txn, bucket string, prefix string, values bool, fn func([]byte, []byte) bool) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = values
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	bucketPrefix := badgerPrefix(bucket)
+	seek := append(bucketPrefix, prefix...)
+	for it.Seek(seek); it.ValidForPrefix(seek); it.Next() {
+		item := it.Item()
+		var value []byte
+		if values {
+			value, _ = item.ValueCopy(nil)
+		}
+		if !fn(item.KeyCopy(nil)[len(bucketPrefix):], value) {
+			break
+		}
+	}
+}
+
+// getCounter returns the counter, or false if the database has no counters
+func (store *badgerStore) getCounter(name string) (count int, ok bool) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		if value := tx.get(badgerKey("Counters", name)); value != nil {
+			count, ok = int(decodeCounter(value)), true
+		}
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetItemCount(name string) (count int) {
+	if count, ok := store.getCounter(name); ok {
+		return count
+	}
+
+	store.db.View(func(txn *badger.Txn) error {
+		store.scan(txn, name, "", false, func(_ []byte, _ []byte) bool {
+			count++
+			return true
+		})
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetSequence() (sequence int) {
+	store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(badgerKey("Globals", "sequence"))
+		if err != nil {
+			return err
+		}
+		v, _ := item.ValueCopy(nil)
+		sequence = int(binary.LittleEndian.Uint32(v))
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) SetSequence(seq int) {
+	store.db.Update(func(txn *badger.Txn) error {
+		byteSequence := make([]byte, 4)
+		binary.LittleEndian.PutUint32(byteSequence, uint32(seq))
+		return txn.Set(badgerKey("Globals", "sequence"), byteSequence)
+	})
+}
+
+func (store *badgerStore) GetCountOfMarks(cond string) (count int) {
+	if count, ok := store.getCounter("mark:" + cond); ok {
+		return count
+	}
+
+	store.db.View(func(txn *badger.Txn) error {
+		store.scan(txn, "Marks", "", true, func(_ []byte, v []byte) bool {
+			if string(v) == cond {
+				count++
+			}
+			return true
+		})
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetIncompletePackages() (packages []*BarePackage) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		store.scan(txn, "Marks", "", true, func(k []byte, v []byte) bool {
+			if string(v) == MarkIncomplete {
+				revision := tx.get(badgerKey("Packages", string(k)))
+				pack := &BarePackage{
+					ID:       string(k),
+					Revision: string(revision),
+				}
+
+				packages = append(packages, pack)
+			}
+			return true
+		})
+
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetRevision(id string) (rev string) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		rev = string(tx.get(badgerKey("Packages", id)))
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetDocument(id string, withfiles bool) (document string, rawfiles []byte, err error) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+
+		mark := tx.get(badgerKey("Marks", id))
+		if mark == nil {
+			err = errors.New("Package does not exist")
+			return nil
+		}
+
+		documentBytes := tx.get(badgerKey("Documents", id))
+
+		if len(documentBytes) == 0 && string(mark) == MarkIncomplete {
+			err = errors.New("Package has not been downloaded yet")
+			return nil
+		}
+
+		documentBytes, err = decompressValue(documentBytes)
+		if err != nil {
+			return nil
+		}
+		document = string(documentBytes)
+
+		if withfiles {
+			rawfiles, err = decompressValue(tx.get(badgerKey("Files", id)))
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) GetAllFiles() (all map[string][]*url.URL) {
+	all = map[string][]*url.URL{}
+	store.db.View(func(txn *badger.Txn) error {
+		store.scan(txn, "Files", "", true, func(k []byte, v []byte) bool {
+			var filelist []*url.URL
+			raw, err := decompressValue(v)
+			if err != nil {
+				dbLog.Errorf("Failed to decompress files: %s %v", k, err)
+				return true
+			}
+			dec := gob.NewDecoder(bytes.NewReader(raw))
+			dec.Decode(&filelist)
+
+			all[string(k)] = filelist
+			return true
+		})
+
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) AcquireTx() transactionable {
+	store.writeMu.Lock()
+	return &badgerTx{db: store.db, txn: store.db.NewTransaction(true), unlock: store.writeMu.Unlock}
+}
+
+func (store *badgerStore) PutPackage(tr transactionable, id string, rev string, mark bool, overwrite bool) error {
+	tx := tr.(*badgerTx)
+
+	// Check if package's already exists
+	existing := tx.get(badgerKey("Packages", id))
+	if existing != nil && !overwrite {
+		return nil
+	}
+
+	deltas := counterDeltas{}
+	deltas.item("Packages", existing != nil)
+	err := tx.set(badgerKey("Packages", id), []byte(rev))
+	if err != nil {
+		return err
+	}
+
+	marked := MarkIncomplete
+	if mark {
+		marked = MarkComplete
+	}
+	deltas.mark(tx.get(badgerKey("Marks", id)), marked)
+	if err := tx.set(badgerKey("Marks", id), []byte(marked)); err != nil {
+		return err
+	}
+
+	return tx.addCounters(deltas)
+}
+
+// PutPackages method writes incomplete packages with a write batch, which
+// skips conflict detection and splits the writes into as many transactions as needed
+//
+// Counters are updated after the batch has been flushed, so they have to be
+// recounted if the process stops in between.
+func (store *badgerStore) PutPackages(packages []*BarePackage) error {
+	store.writeMu.Lock()
+	defer store.writeMu.Unlock()
+
+	deltas := counterDeltas{}
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		for _, pack := range packages {
+			deltas.item("Packages", tx.get(badgerKey("Packages", pack.ID)) != nil)
+			deltas.mark(tx.get(badgerKey("Marks", pack.ID)), MarkIncomplete)
+		}
+		return nil
+	})
+
+	wb := store.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, pack := range packages {
+		if err := wb.Set(badgerKey("Packages", pack.ID), []byte(pack.Revision)); err != nil {
+			return err
+		}
+		if err := wb.Set(badgerKey("Marks", pack.ID), []byte(MarkIncomplete)); err != nil {
+			return err
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	tx := &badgerTx{db: store.db, txn: store.db.NewTransaction(true)}
+	defer tx.Rollback()
+	if err := tx.addCounters(deltas); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (store *badgerStore) DeletePackage(id string) {
+	tx := store.AcquireTx().(*badgerTx)
+	defer tx.Rollback()
+
+	deltas := counterDeltas{}
+	for _, bucket := range counterBuckets {
+		deltas.remove(bucket, tx.get(badgerKey(bucket, id)))
+		tx.txn.Delete(badgerKey(bucket, id))
+	}
+	if err := tx.addCounters(deltas); err != nil {
+		dbLog.Errorf("Failed to update counters: %s %v", id, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		dbLog.Errorf("Failed to delete a package: %s %v", id, err)
+	}
+}
+
+func (store *badgerStore) Orphans(remove bool) (orphans []string, err error) {
+	found := map[string]bool{}
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		for _, name := range counterBuckets[1:] {
+			store.scan(txn, name, "", false, func(k []byte, _ []byte) bool {
+				id := string(k)
+				if !found[id] && tx.get(badgerKey("Packages", id)) == nil {
+					found[id] = true
+					orphans = append(orphans, id)
+				}
+				return true
+			})
+		}
+		return nil
+	})
+	sort.Strings(orphans)
+	if !remove {
+		return
+	}
+
+	// orphans are removed in chunks, since a single transaction removing
+	// all of them would grow beyond the limits of badger
+	for i := 0; i < len(orphans); i += badgerFixBatchSize {
+		end := i + badgerFixBatchSize
+		if end > len(orphans) {
+			end = len(orphans)
+		}
+		if err = store.removeOrphans(orphans[i:end]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// removeOrphans deletes the entries of the orphans in a transaction
+func (store *badgerStore) removeOrphans(orphans []string) error {
+	tx := store.AcquireTx().(*badgerTx)
+	defer tx.Rollback()
+
+	deltas := counterDeltas{}
+	for _, id := range orphans {
+		// the package may have been added since the scan
+		if tx.get(badgerKey("Packages", id)) != nil {
+			continue
+		}
+		for _, name := range counterBuckets[1:] {
+			deltas.remove(name, tx.get(badgerKey(name, id)))
+			if err := tx.txn.Delete(badgerKey(name, id)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.addCounters(deltas); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *badgerStore) PutCompleted(tr transactionable, pack *BarePackage, document string, rev string, downloads []*url.URL) bool {
+	tx := tr.(*badgerTx)
+
+	deltas := counterDeltas{}
+	existing := tx.get(badgerKey("Packages", pack.ID))
+
+	// if revision does not match
+	if pack.Revision != rev || existing == nil {
+		deltas.item("Packages", existing != nil)
+		err := tx.set(badgerKey("Packages", pack.ID), []byte(rev))
+		if err != nil {
+			return false
+		}
+	}
+	deltas.item("Documents", tx.get(badgerKey("Documents", pack.ID)) != nil)
+	deltas.item("Files", tx.get(badgerKey("Files", pack.ID)) != nil)
+	deltas.mark(tx.get(badgerKey("Marks", pack.ID)), MarkComplete)
+
+	codec := store.config.compression()
+	err := tx.set(badgerKey("Documents", pack.ID), compressValue(codec, []byte(document)))
+	if err != nil {
+		return false
+	}
+
+	// encode downloads(interface) directly into a byte array
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err = enc.Encode(downloads)
+	if err != nil {
+		return false
+	}
+
+	err = tx.set(badgerKey("Files", pack.ID), compressValue(codec, buf.Bytes()))
+	if err != nil {
+		return false
+	}
+
+	err = tx.set(badgerKey("Marks", pack.ID), []byte(MarkComplete))
+	if err != nil {
+		return false
+	}
+
+	return tx.addCounters(deltas) == nil
+}
+
+func (store *badgerStore) Recount() error {
+	counts := map[string]int64{"mark:" + MarkComplete: 0, "mark:" + MarkIncomplete: 0}
+
+	// buckets are counted in a read transaction, which has no size limit
+	store.writeMu.Lock()
+	defer store.writeMu.Unlock()
+	store.db.View(func(txn *badger.Txn) error {
+		for _, name := range counterBuckets {
+			counts[name] = 0
+			store.scan(txn, name, "", name == "Marks", func(_ []byte, v []byte) bool {
+				counts[name]++
+				if name == "Marks" {
+					counts["mark:"+string(v)]++
+				}
+				return true
+			})
+		}
+		return nil
+	})
+
+	return store.db.Update(func(txn *badger.Txn) error {
+		for name, count := range counts {
+			if err := txn.Set(badgerKey("Counters", name), encodeCounter(count)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *badgerStore) GetEntry(bucket string, key string) (value []byte) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		value = tx.get(badgerKey(bucket, key))
+		return nil
+	})
+
+	return
+}
+
+func (store *badgerStore) PutEntry(bucket string, key string, value []byte) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(badgerKey(bucket, key), value)
+	})
+}
+
+func (store *badgerStore) DeleteEntry(bucket string, key string) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(badgerKey(bucket, key))
+	})
+}
+
+func (store *badgerStore) ForEachEntry(bucket string, prefix string, fn func(string, []byte) bool) {
+	store.db.View(func(txn *badger.Txn) error {
+		store.scan(txn, bucket, prefix, true, func(k []byte, v []byte) bool {
+			return fn(string(k), v)
+		})
+		return nil
+	})
+}
+
+func (store *badgerStore) ForEachEntryAfter(bucket string, after string, fn func(string, []byte) bool) {
+	store.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := badgerPrefix(bucket)
+		for it.Seek(badgerKey(bucket, after)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := string(item.KeyCopy(nil)[len(prefix):])
+			if key == after {
+				continue
+			}
+
+			value, _ := item.ValueCopy(nil)
+			if !fn(key, value) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (store *badgerStore) WriteEntries(writes []EntryWrite) error {
+	tx := store.AcquireTx().(*badgerTx)
+	defer tx.Rollback()
+
+	if err := store.PutEntries(tx, writes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *badgerStore) PutEntries(tr transactionable, writes []EntryWrite) error {
+	tx := tr.(*badgerTx)
+	for _, write := range writes {
+		var err error
+		if write.Value == nil {
+			err = tx.txn.Delete(badgerKey(write.Bucket, write.Key))
+		} else {
+			err = tx.set(badgerKey(write.Bucket, write.Key), write.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *badgerStore) ReplaceEntries(bucket string, prefix string, entries map[string][]byte) error {
+	tx := store.AcquireTx().(*badgerTx)
+	defer tx.Rollback()
+
+	var stale [][]byte
+	store.scan(tx.txn, bucket, prefix, false, func(k []byte, _ []byte) bool {
+		if _, ok := entries[string(k)]; !ok {
+			stale = append(stale, badgerKey(bucket, string(k)))
+		}
+		return true
+	})
+	for _, k := range stale {
+		if err := tx.txn.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range entries {
+		if err := tx.set(badgerKey(bucket, key), value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *badgerStore) ForEachPackage(after string, fn func(*PackageRecord) bool) {
+	store.db.View(func(txn *badger.Txn) error {
+		tx := &badgerTx{db: store.db, txn: txn}
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := badgerPrefix("Packages")
+		for it.Seek(badgerKey("Packages", after)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			id := string(item.Key()[len(prefix):])
+			if id == after {
+				continue
+			}
+
+			rev, _ := item.ValueCopy(nil)
+			rawDocument, rawFiles := tx.get(badgerKey("Documents", id)), tx.get(badgerKey("Files", id))
+			document, err := decompressValue(rawDocument)
+			if err != nil {
+				dbLog.Errorf("Failed to decompress document: %s %v", id, err)
+			}
+			filelist, err := decompressValue(rawFiles)
+			if err != nil {
+				dbLog.Errorf("Failed to decompress files: %s %v", id, err)
+			}
+
+			pack := &PackageRecord{
+				ID:         id,
+				Revision:   string(rev),
+				Marked:     string(tx.get(badgerKey("Marks", id))) == MarkComplete,
+				Document:   string(document),
+				Files:      filelist,
+				Codec:      valueCodec(rawDocument),
+				StoredSize: len(rawDocument) + len(rawFiles),
+			}
+			if !fn(pack) {
+				break
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,45 @@
+package db
+
+// blobPrefix returns the prefix of the url paths of the tarballs of a package
+func blobPrefix(name string) string {
+	return "/" + name + "/-/"
+}
+
+// GetBlob method returns the shasum of the content-addressed tarball at the
+// url path, or an empty string if the tarball is stored at its url path
+func (pb *PocketBase) GetBlob(path string) string {
+	return string(pb.store.GetEntry("Blobs", path))
+}
+
+// GetBlobs method returns the shasums of the content-addressed tarballs of the package by url path
+func (pb *PocketBase) GetBlobs(name string) map[string]string {
+	blobs := map[string]string{}
+	pb.store.ForEachEntry("Blobs", blobPrefix(name), func(path string, shasum []byte) bool {
+		blobs[path] = string(shasum)
+		return true
+	})
+
+	return blobs
+}
+
+// PutBlob method stores the shasum of a content-addressed tarball
+func (pb *PocketBase) PutBlob(path string, shasum string) error {
+	return pb.store.PutEntry("Blobs", path, []byte(shasum))
+}
+
+// PutBlobs method replaces the shasums of the content-addressed tarballs of the package
+func (pb *PocketBase) PutBlobs(name string, blobs map[string]string) error {
+	entries := make(map[string][]byte, len(blobs))
+	for path, shasum := range blobs {
+		entries[path] = []byte(shasum)
+	}
+
+	return pb.store.ReplaceEntries("Blobs", blobPrefix(name), entries)
+}
+
+// ForEachBlob method calls fn with the url path and the shasum of every content-addressed tarball
+func (pb *PocketBase) ForEachBlob(fn func(string, string) bool) {
+	pb.store.ForEachEntry("Blobs", "", func(path string, shasum []byte) bool {
+		return fn(path, string(shasum))
+	})
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"encoding/json"
+)
+
+// GetBlockEntries method returns blocklist entries of the package
+func (pb *PocketBase) GetBlockEntries(name string) (entries []*BlockEntry) {
+	dec := pb.getCacheDecoder(blockedCacheKey(name))
+	if dec != nil {
+		decerr := dec.Decode(&entries)
+		if decerr == nil {
+			return
+		}
+	}
+
+	if raw := pb.store.GetEntry("Blocklist", name); raw != nil {
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			dbLog.Warnf("Failed to decode blocklist: %s %v", name, err)
+		}
+	}
+
+	pb.setCache(blockedCacheKey(name), entries)
+	return
+}
+
+// GetBlocklist method returns all blocklist entries
+func (pb *PocketBase) GetBlocklist() (entries []*BlockEntry) {
+	pb.store.ForEachEntry("Blocklist", "", func(name string, raw []byte) bool {
+		var items []*BlockEntry
+		if err := json.Unmarshal(raw, &items); err != nil {
+			dbLog.Warnf("Failed to decode blocklist: %s %v", name, err)
+			return true
+		}
+
+		entries = append(entries, items...)
+		return true
+	})
+
+	return
+}
+
+// AddBlockEntry method adds an entry to the blocklist, replacing the one with the same range
+func (pb *PocketBase) AddBlockEntry(entry *BlockEntry) error {
+	defer pb.delCache(blockedCacheKey(entry.Name))
+
+	entries := []*BlockEntry{entry}
+	for _, existing := range pb.GetBlockEntries(entry.Name) {
+		if existing.Range != entry.Range {
+			entries = append(entries, existing)
+		}
+	}
+
+	return pb.putBlockEntries(entry.Name, entries)
+}
+
+// RemoveBlockEntry method removes an entry from the blocklist and returns whether it existed
+func (pb *PocketBase) RemoveBlockEntry(name string, versions string) (bool, error) {
+	defer pb.delCache(blockedCacheKey(name))
+
+	var entries []*BlockEntry
+	removed := false
+	for _, existing := range pb.GetBlockEntries(name) {
+		if existing.Range == versions {
+			removed = true
+			continue
+		}
+		entries = append(entries, existing)
+	}
+
+	if !removed {
+		return false, nil
+	}
+
+	return true, pb.putBlockEntries(name, entries)
+}
+
+func (pb *PocketBase) putBlockEntries(name string, entries []*BlockEntry) error {
+	if len(entries) == 0 {
+		return pb.store.DeleteEntry("Blocklist", name)
+	}
+
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return pb.store.PutEntry("Blocklist", name, raw)
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
-	"log"
 	"net/url"
+	"sort"
 
 	"github.com/boltdb/bolt"
 )
@@ -28,7 +28,7 @@ func (store *boltStore) Connect() error {
 	var err error
 	store.db, err = bolt.Open(store.config.Path.(string), 0600, nil)
 	if err != nil {
-		log.Fatalf("Failed to load database file: %v", err)
+		dbLog.Fatalf("Failed to load database file: %v", err)
 		return err
 	}
 
@@ -46,6 +46,7 @@ func (store *boltStore) Init() {
 		tx.CreateBucketIfNotExists([]byte("Marks"))
 		tx.CreateBucketIfNotExists([]byte("Documents"))
 		tx.CreateBucketIfNotExists([]byte("Files"))
+		tx.CreateBucketIfNotExists([]byte("Counters"))
 
 		defaultSequence := make([]byte, 4)
 		binary.LittleEndian.PutUint32(defaultSequence, 0)
@@ -68,7 +69,46 @@ func (store *boltStore) IsInitialized() bool {
 	return initialized
 }
 
+// addCounters applies the deltas to the counters
+//
+// Databases created before the counters were introduced have no counters until they are recounted.
+func addCounters(tx *bolt.Tx, deltas counterDeltas) error {
+	counters := tx.Bucket([]byte("Counters"))
+	if counters == nil {
+		return nil
+	}
+
+	for name, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		count := decodeCounter(counters.Get([]byte(name))) + delta
+		if err := counters.Put([]byte(name), encodeCounter(count)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getCounter returns the counter, or false if the database has no counters
+func (store *boltStore) getCounter(name string) (count int, ok bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		counters := tx.Bucket([]byte("Counters"))
+		if counters != nil {
+			count, ok = int(decodeCounter(counters.Get([]byte(name)))), true
+		}
+		return nil
+	})
+
+	return
+}
+
 func (store *boltStore) GetItemCount(name string) (count int) {
+	if count, ok := store.getCounter(name); ok {
+		return count
+	}
+
 	store.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
 		c := b.Cursor()
@@ -107,6 +147,10 @@ func (store *boltStore) SetSequence(seq int) {
 }
 
 func (store *boltStore) GetCountOfMarks(cond string) (count int) {
+	if count, ok := store.getCounter("mark:" + cond); ok {
+		return count
+	}
+
 	store.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Marks"))
 		c := b.Cursor()
@@ -182,10 +226,14 @@ func (store *boltStore) GetDocument(id string, withfiles bool) (document string,
 			return nil
 		}
 
+		documentBytes, err = decompressValue(documentBytes)
+		if err != nil {
+			return nil
+		}
 		document = string(documentBytes)
 
 		if withfiles {
-			rawfiles = files.Get(key)
+			rawfiles, err = decompressValue(files.Get(key))
 		}
 
 		return nil
@@ -195,6 +243,7 @@ func (store *boltStore) GetDocument(id string, withfiles bool) (document string,
 }
 
 func (store *boltStore) GetAllFiles() (all map[string][]*url.URL) {
+	all = map[string][]*url.URL{}
 	store.db.View(func(tx *bolt.Tx) error {
 		files := tx.Bucket([]byte("Files"))
 		cursor := files.Cursor()
@@ -202,7 +251,12 @@ func (store *boltStore) GetAllFiles() (all map[string][]*url.URL) {
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
 			var filelist []*url.URL
 			var buf bytes.Buffer
-			buf.Write(v)
+			raw, err := decompressValue(v)
+			if err != nil {
+				dbLog.Printf("Failed to decompress files: %s %v", k, err)
+				continue
+			}
+			buf.Write(raw)
 			dec := gob.NewDecoder(&buf)
 			dec.Decode(&filelist)
 
@@ -227,43 +281,80 @@ func (store *boltStore) PutPackage(tr transactionable, id string, rev string, ma
 	key := []byte(id)
 
 	// Check if package's already exists
-	if value := packages.Get(key); value != nil && !overwrite {
+	existing := packages.Get(key)
+	if existing != nil && !overwrite {
 		return nil
 	}
 
+	deltas := counterDeltas{}
+	deltas.item("Packages", existing != nil)
 	err := packages.Put(key, []byte(rev))
 	if err != nil {
 		return err
 	}
 
-	marked := []byte(MarkIncomplete)
+	marked := MarkIncomplete
 	if mark {
-		marked = []byte(MarkComplete)
+		marked = MarkComplete
 	}
-	err = marks.Put(key, marked)
+	deltas.mark(marks.Get(key), marked)
+	err = marks.Put(key, []byte(marked))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return addCounters(tx, deltas)
 }
 
 func (store *boltStore) DeletePackage(id string) {
 	key := []byte(id)
 
 	store.db.Update(func(tx *bolt.Tx) error {
+		deltas := counterDeltas{}
+		for _, name := range counterBuckets {
+			b := tx.Bucket([]byte(name))
+			deltas.remove(name, b.Get(key))
+			b.Delete(key)
+		}
+
+		return addCounters(tx, deltas)
+	})
+}
+
+func (store *boltStore) Orphans(remove bool) (orphans []string, err error) {
+	found := map[string]bool{}
+	err = store.db.Update(func(tx *bolt.Tx) error {
 		packages := tx.Bucket([]byte("Packages"))
-		documents := tx.Bucket([]byte("Documents"))
-		files := tx.Bucket([]byte("Files"))
-		marks := tx.Bucket([]byte("Marks"))
+		for _, name := range counterBuckets[1:] {
+			c := tx.Bucket([]byte(name)).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				if packages.Get(k) == nil && !found[string(k)] {
+					found[string(k)] = true
+					orphans = append(orphans, string(k))
+				}
+			}
+		}
+		if !remove {
+			return nil
+		}
 
-		packages.Delete(key)
-		documents.Delete(key)
-		files.Delete(key)
-		marks.Delete(key)
+		deltas := counterDeltas{}
+		for _, id := range orphans {
+			key := []byte(id)
+			for _, name := range counterBuckets[1:] {
+				b := tx.Bucket([]byte(name))
+				deltas.remove(name, b.Get(key))
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
 
-		return nil
+		return addCounters(tx, deltas)
 	})
+	sort.Strings(orphans)
+
+	return
 }
 
 func (store *boltStore) PutCompleted(tr transactionable, pack *BarePackage, document string, rev string, downloads []*url.URL) bool {
@@ -275,15 +366,22 @@ func (store *boltStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 	files := tx.Bucket([]byte("Files"))
 	marks := tx.Bucket([]byte("Marks"))
 
+	deltas := counterDeltas{}
+
 	// if revision does not match
-	if pack.Revision != rev {
+	if pack.Revision != rev || packages.Get(key) == nil {
+		deltas.item("Packages", packages.Get(key) != nil)
 		err := packages.Put(key, []byte(rev))
 		if err != nil {
 			return false
 		}
 	}
+	deltas.item("Documents", documents.Get(key) != nil)
+	deltas.item("Files", files.Get(key) != nil)
+	deltas.mark(marks.Get(key), MarkComplete)
 
-	err := documents.Put(key, []byte(document))
+	codec := store.config.compression()
+	err := documents.Put(key, compressValue(codec, []byte(document)))
 	if err != nil {
 		return false
 	}
@@ -296,7 +394,7 @@ func (store *boltStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 		return false
 	}
 
-	err = files.Put(key, buf.Bytes())
+	err = files.Put(key, compressValue(codec, buf.Bytes()))
 	if err != nil {
 		return false
 	}
@@ -306,5 +404,223 @@ func (store *boltStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 		return false
 	}
 
-	return true
+	return addCounters(tx, deltas) == nil
+}
+
+func (store *boltStore) Recount() error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		counters, err := tx.CreateBucketIfNotExists([]byte("Counters"))
+		if err != nil {
+			return err
+		}
+
+		counts := map[string]int64{"mark:" + MarkComplete: 0, "mark:" + MarkIncomplete: 0}
+		for _, name := range counterBuckets {
+			counts[name] = 0
+			c := tx.Bucket([]byte(name)).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				counts[name]++
+				if name == "Marks" {
+					counts["mark:"+string(v)]++
+				}
+			}
+		}
+
+		for name, count := range counts {
+			if err := counters.Put([]byte(name), encodeCounter(count)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *boltStore) GetEntry(bucket string, key string) (value []byte) {
+	store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get([]byte(key)); v != nil {
+			value = make([]byte, len(v))
+			copy(value, v)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (store *boltStore) PutEntry(bucket string, key string, value []byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (store *boltStore) DeleteEntry(bucket string, key string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+func (store *boltStore) ForEachEntry(bucket string, prefix string, fn func(string, []byte) bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			value := make([]byte, len(v))
+			copy(value, v)
+			if !fn(string(k), value) {
+				break
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *boltStore) ForEachEntryAfter(bucket string, after string, fn func(string, []byte) bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			value := make([]byte, len(v))
+			copy(value, v)
+			if !fn(string(k), value) {
+				break
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *boltStore) WriteEntries(writes []EntryWrite) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return store.PutEntries(tx, writes)
+	})
+}
+
+func (store *boltStore) PutEntries(tr transactionable, writes []EntryWrite) error {
+	tx := tr.(*bolt.Tx)
+	for _, write := range writes {
+		b, err := tx.CreateBucketIfNotExists([]byte(write.Bucket))
+		if err != nil {
+			return err
+		}
+
+		if write.Value == nil {
+			err = b.Delete([]byte(write.Key))
+		} else {
+			err = b.Put([]byte(write.Key), write.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *boltStore) ReplaceEntries(bucket string, prefix string, entries map[string][]byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		// keys are collected first since deleting moves the cursor
+		var stale [][]byte
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			if _, ok := entries[string(k)]; !ok {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for key, value := range entries {
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *boltStore) ForEachPackage(after string, fn func(*PackageRecord) bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		packages := tx.Bucket([]byte("Packages"))
+		documents := tx.Bucket([]byte("Documents"))
+		files := tx.Bucket([]byte("Files"))
+		marks := tx.Bucket([]byte("Marks"))
+
+		c := packages.Cursor()
+		k, v := c.First()
+		if after != "" {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			rawDocument, rawFiles := documents.Get(k), files.Get(k)
+			document, err := decompressValue(rawDocument)
+			if err != nil {
+				dbLog.Printf("Failed to decompress document: %s %v", k, err)
+			}
+			filelist, err := decompressValue(rawFiles)
+			if err != nil {
+				dbLog.Printf("Failed to decompress files: %s %v", k, err)
+			}
+
+			pack := &PackageRecord{
+				ID:         string(k),
+				Revision:   string(v),
+				Marked:     string(marks.Get(k)) == MarkComplete,
+				Document:   string(document),
+				Files:      filelist,
+				Codec:      valueCodec(rawDocument),
+				StoredSize: len(rawDocument) + len(rawFiles),
+			}
+			if !fn(pack) {
+				break
+			}
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Change represents an entry of the change log, which other mirrors follow
+// like the _changes feed of CouchDB
+type Change struct {
+	Sequence int    `json:"seq"`
+	ID       string `json:"id"`
+	Revision string `json:"rev"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// changeKey returns the key of a change in the Changes bucket, which sorts by sequence
+func changeKey(seq int) string {
+	return fmt.Sprintf("%016d", seq)
+}
+
+// GetChangeSequence method returns the sequence of the last change
+func (pb *PocketBase) GetChangeSequence() int {
+	seq, _ := strconv.Atoi(string(pb.store.GetEntry("Globals", "changes")))
+	return seq
+}
+
+// changeWrites returns the writes appending a change to the log and removing
+// the previous change of the package, so that the log is never longer than
+// the list of packages
+func (pb *PocketBase) changeWrites(change *Change) []EntryWrite {
+	raw, _ := json.Marshal(change)
+	writes := []EntryWrite{
+		{Bucket: "Changes", Key: changeKey(change.Sequence), Value: raw},
+		{Bucket: "ChangeIndex", Key: change.ID, Value: []byte(changeKey(change.Sequence))},
+		{Bucket: "Globals", Key: "changes", Value: []byte(strconv.Itoa(change.Sequence))},
+	}
+	if previous := pb.store.GetEntry("ChangeIndex", change.ID); previous != nil {
+		writes = append(writes, EntryWrite{Bucket: "Changes", Key: string(previous)})
+	}
+
+	return writes
+}
+
+// lastChange returns the last change of the package in the change log
+func (pb *PocketBase) lastChange(id string) *Change {
+	key := pb.store.GetEntry("ChangeIndex", id)
+	if key == nil {
+		return nil
+	}
+
+	var change Change
+	if err := json.Unmarshal(pb.store.GetEntry("Changes", string(key)), &change); err != nil {
+		return nil
+	}
+	return &change
+}
+
+// recordChange appends a change of the package to the change log, and an
+// entry with the versions added and removed to the journal
+//
+// Both are written at once. Updates which change neither the revision nor
+// the versions, such as packages mirrored again after a reset, are not journaled
+// and nil is returned.
+func (pb *PocketBase) recordChange(id string, rev string, deleted bool, added []string, removed []string) *JournalEntry {
+	pb.changeMu.Lock()
+	defer pb.changeMu.Unlock()
+
+	writes, entry := pb.recordWrites(id, rev, deleted, added, removed)
+	if err := pb.store.WriteEntries(writes); err != nil {
+		dbLog.Errorf("Failed to record a change: %s %v", id, err)
+		return nil
+	}
+
+	return entry
+}
+
+// recordWrites returns the writes of a change and its journal entry like
+// recordChange, so that they can be written with other writes
+//
+// changeMu must be held until they are written.
+func (pb *PocketBase) recordWrites(id string, rev string, deleted bool, added []string, removed []string) ([]EntryWrite, *JournalEntry) {
+	change := &Change{
+		Sequence: pb.GetChangeSequence() + 1,
+		ID:       id,
+		Revision: rev,
+		Deleted:  deleted,
+	}
+	entry := &JournalEntry{
+		Action:      JournalMirrored,
+		ID:          id,
+		NewRevision: rev,
+		Added:       added,
+		Removed:     removed,
+	}
+	if last := pb.lastChange(id); last != nil && !last.Deleted {
+		entry.Action = JournalUpdated
+		entry.OldRevision = last.Revision
+	}
+	if deleted {
+		entry.Action = JournalDeleted
+		entry.NewRevision = ""
+		if entry.OldRevision == "" {
+			entry.OldRevision = rev
+		}
+	}
+
+	writes := pb.changeWrites(change)
+	if entry.Action == JournalUpdated && entry.OldRevision == rev && len(added)+len(removed) == 0 {
+		entry = nil
+	} else {
+		writes = append(writes, pb.journalWrites(entry)...)
+	}
+
+	return writes, entry
+}
+
+// ForEachChange method calls fn with every change after the sequence in order
+func (pb *PocketBase) ForEachChange(since int, fn func(*Change) bool) {
+	pb.store.ForEachEntryAfter("Changes", changeKey(since), func(key string, raw []byte) bool {
+		var change Change
+		if err := json.Unmarshal(raw, &change); err != nil {
+			dbLog.Warnf("Failed to decode a change: %s %v", key, err)
+			return true
+		}
+
+		return fn(&change)
+	})
+}
+
+// BackfillChanges method records a change for every completed package if the
+// change log is empty, so that databases created by older versions can be
+// followed by other mirrors
+func (pb *PocketBase) BackfillChanges(batchSize int) (int, error) {
+	pb.changeMu.Lock()
+	defer pb.changeMu.Unlock()
+
+	if pb.GetChangeSequence() > 0 {
+		return 0, nil
+	}
+
+	var changes []*Change
+	pb.store.ForEachPackage("", func(pack *PackageRecord) bool {
+		if pack.Marked && pack.Document != "" {
+			changes = append(changes, &Change{
+				Sequence: len(changes) + 1,
+				ID:       pack.ID,
+				Revision: pack.Revision,
+			})
+		}
+		return true
+	})
+
+	for i := 0; i < len(changes); i += batchSize {
+		end := i + batchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+
+		var writes []EntryWrite
+		for _, change := range changes[i:end] {
+			writes = append(writes, pb.changeWrites(change)...)
+		}
+		if err := pb.store.WriteEntries(writes); err != nil {
+			return i, err
+		}
+	}
+
+	return len(changes), nil
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	pbar "gopkg.in/cheggaaa/pb.v1"
+)
+
+// Compression codecs for documents and file lists
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// compressedHeader marks compressed values and is followed by a byte for the codec.
+// Neither JSON documents nor gob encoded file lists can start with it.
+var compressedHeader = []byte{0xff, 'P', 'N'}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compression returns the codec configured for new values
+func (config *DatabaseConfig) compression() string {
+	if config.Compression == "" {
+		return CompressionZstd
+	}
+
+	return config.Compression
+}
+
+// ValidateCompression returns an error if the codec is not supported
+func ValidateCompression(codec string) error {
+	switch codec {
+	case "", CompressionNone, CompressionZstd, CompressionGzip:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown compression: %s", codec)
+}
+
+// compressValue compresses the value with the codec and prepends the header
+func compressValue(codec string, value []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(compressedHeader)
+
+	switch codec {
+	case CompressionZstd:
+		buf.WriteByte('z')
+		return zstdEncoder.EncodeAll(value, buf.Bytes())
+	case CompressionGzip:
+		buf.WriteByte('g')
+		w := gzip.NewWriter(&buf)
+		w.Write(value)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	return value
+}
+
+// valueCodec returns the codec of a stored value, or CompressionNone if it is not compressed
+func valueCodec(value []byte) string {
+	if len(value) <= len(compressedHeader) || !bytes.HasPrefix(value, compressedHeader) {
+		return CompressionNone
+	}
+
+	switch value[len(compressedHeader)] {
+	case 'z':
+		return CompressionZstd
+	case 'g':
+		return CompressionGzip
+	}
+
+	return CompressionNone
+}
+
+// decompressValue returns a copy of the original value
+func decompressValue(value []byte) ([]byte, error) {
+	body := value
+	if len(value) > len(compressedHeader) {
+		body = value[len(compressedHeader)+1:]
+	}
+
+	switch valueCodec(value) {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(body, nil)
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	return append([]byte(nil), value...), nil
+}
+
+// columnValue returns the value stored in a binary column of the gorm store
+//
+// Columns were text before, holding base64 encoded file lists and compressed
+// documents. Neither JSON documents, gob encoded file lists nor compressed
+// values are valid base64, so those values are told apart from newer ones.
+func columnValue(value []byte) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	if raw, err := base64.StdEncoding.DecodeString(string(value)); err == nil {
+		return raw
+	}
+
+	return value
+}
+
+// decompressColumn returns the original value of a binary column
+func decompressColumn(value []byte) ([]byte, error) {
+	return decompressValue(columnValue(value))
+}
+
+// CompressionReport shows how much space the compression saves
+type CompressionReport struct {
+	Packages     int            `json:"packages"`
+	Documents    int            `json:"documents"`
+	OriginalSize int64          `json:"original_size"`
+	StoredSize   int64          `json:"stored_size"`
+	Codecs       map[string]int `json:"codecs"`
+}
+
+// Saved returns the ratio of the space saved
+func (report *CompressionReport) Saved() float64 {
+	if report.OriginalSize == 0 {
+		return 0
+	}
+
+	return 1 - float64(report.StoredSize)/float64(report.OriginalSize)
+}
+
+func (report *CompressionReport) add(pack *PackageRecord) {
+	report.Packages++
+	if pack.Document == "" {
+		return
+	}
+
+	report.Documents++
+	report.OriginalSize += int64(len(pack.Document) + len(pack.Files))
+	report.StoredSize += int64(pack.StoredSize)
+	report.Codecs[pack.Codec]++
+}
+
+// GetCompressionReport method returns the sizes of all documents and file lists
+func (pb *PocketBase) GetCompressionReport() *CompressionReport {
+	report := &CompressionReport{Codecs: map[string]int{}}
+	pb.store.ForEachPackage("", func(pack *PackageRecord) bool {
+		report.add(pack)
+		return true
+	})
+
+	return report
+}
+
+// Recompress method rewrites documents and file lists which are not stored with
+// the configured compression, committing a batch at a time and sleeping in between
+// so that it can run next to the mirror and the server
+func (pb *PocketBase) Recompress(batchSize int, pause time.Duration) (int, error) {
+	codec := pb.config.compression()
+	bar := pbar.StartNew(pb.store.GetItemCount("Packages"))
+	defer bar.Finish()
+
+	count := 0
+	last := ""
+	for {
+		var batch []*PackageRecord
+		scanned := 0
+		pb.store.ForEachPackage(last, func(pack *PackageRecord) bool {
+			last = pack.ID
+			scanned++
+			if pack.Document != "" && pack.Codec != codec {
+				batch = append(batch, pack)
+			}
+			return len(batch) < batchSize
+		})
+		if scanned == 0 {
+			break
+		}
+
+		if len(batch) > 0 {
+			tx := pb.store.AcquireTx()
+			for _, pack := range batch {
+				if err := putRecord(pb.store, tx, pack); err != nil {
+					tx.Rollback()
+					return count, err
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			time.Sleep(pause)
+		}
+
+		bar.Add(scanned)
+	}
+
+	return count, nil
+}
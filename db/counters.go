@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/binary"
+)
+
+// counterBuckets lists the buckets whose items are counted
+var counterBuckets = []string{"Packages", "Marks", "Documents", "Files"}
+
+// counterDeltas contains changes of counters made by a write
+//
+// Keys are bucket names and "mark:" followed by a mark.
+type counterDeltas map[string]int64
+
+// item counts an item put into the bucket where it did not exist before
+func (deltas counterDeltas) item(bucket string, existed bool) {
+	if !existed {
+		deltas[bucket]++
+	}
+}
+
+// mark counts the change of a mark from old (nil if there was none) to mark
+func (deltas counterDeltas) mark(old []byte, mark string) {
+	if old == nil {
+		deltas["Marks"]++
+	} else {
+		deltas["mark:"+string(old)]--
+	}
+	deltas["mark:"+mark]++
+}
+
+// remove counts items deleted from the package buckets
+func (deltas counterDeltas) remove(bucket string, old []byte) {
+	if old == nil {
+		return
+	}
+
+	deltas[bucket]--
+	if bucket == "Marks" {
+		deltas["mark:"+string(old)]--
+	}
+}
+
+func encodeCounter(count int64) []byte {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(count))
+	return value
+}
+
+func decodeCounter(value []byte) int64 {
+	if len(value) != 8 {
+		return 0
+	}
+
+	return int64(binary.LittleEndian.Uint64(value))
+}
+
+// Recount method rebuilds the counters of the store
+func (pb *PocketBase) Recount() error {
+	defer pb.delCache("count:Packages")
+	defer pb.delCache("count:Documents")
+	defer pb.delCache("count:Files")
+	defer pb.delCache("count:Marks")
+	defer pb.delCache("mark:0")
+	defer pb.delCache("mark:1")
+
+	return pb.store.Recount()
+}
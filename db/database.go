@@ -3,7 +3,8 @@ package db
 import (
 	"fmt"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	"net/url"
@@ -13,33 +14,60 @@ import (
 
 	"github.com/allegro/bigcache"
 	"github.com/boltdb/bolt"
-	"github.com/sirupsen/logrus"
 	pbar "gopkg.in/cheggaaa/pb.v1"
 
-	"encoding/base64"
-
 	"github.com/ssut/pocketnpm/log"
 )
 
+// dbLog logs the messages of the database
+var dbLog = log.Component(log.ComponentDB)
+
 // PocketBase type is a frontend for BoltDB
 type PocketBase struct {
-	db    *bolt.DB
-	store PocketStore
-	cache *bigcache.BigCache
+	db     *bolt.DB
+	store  PocketStore
+	cache  *bigcache.BigCache
+	config *DatabaseConfig
+
+	// changeMu serializes writes to the change log
+	changeMu sync.Mutex
+	// downloadMu serializes additions to the download counts
+	downloadMu sync.Mutex
+	// distTagsMu serializes updates of the dist-tags of a package
+	distTagsMu keyedMutex
 }
 
-// NewPocketBase creates a new PocketBase object
-func NewPocketBase(config *DatabaseConfig) *PocketBase {
+// openStore creates and connects the store of the configured type
+func openStore(config *DatabaseConfig) (PocketStore, error) {
+	if err := ValidateCompression(config.Compression); err != nil {
+		return nil, err
+	}
+
 	var store PocketStore
-	if config.Type == "bolt" {
+	switch config.Type {
+	case "bolt":
 		config.Path, _ = filepath.Abs(config.Path.(string))
 		store = newBoltStore(config)
-	} else if config.Type == "gorm" {
+	case "gorm":
 		store = newGormStore(config)
+	case "badger":
+		config.Path, _ = filepath.Abs(config.Path.(string))
+		store = newBadgerStore(config)
+	case "sqlite":
+		config.Path, _ = filepath.Abs(config.Path.(string))
+		store = newSqliteStore(config)
+	default:
+		return nil, fmt.Errorf("Unknown database type: %s", config.Type)
 	}
-	err := store.Connect()
+
+	return store, store.Connect()
+}
+
+// NewPocketBase creates a new PocketBase object
+func NewPocketBase(config *DatabaseConfig) *PocketBase {
+	store, err := openStore(config)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		dbLog.Fatalf("Failed to connect to database: %v", err)
 	}
 
 	cacheConfig := bigcache.DefaultConfig(time.Duration(config.CacheLifetime) * time.Minute)
@@ -47,14 +75,15 @@ func NewPocketBase(config *DatabaseConfig) *PocketBase {
 	cacheConfig.HardMaxCacheSize = config.MaxCacheSize
 	cache, err := bigcache.NewBigCache(cacheConfig)
 	if err != nil {
-		log.Fatalf("Failed to initialize in-memory cache: %v", err)
+		dbLog.Fatalf("Failed to initialize in-memory cache: %v", err)
 	}
 
 	gob.Register([]*url.URL{})
 
 	pb := &PocketBase{
-		store: store,
-		cache: cache,
+		store:  store,
+		cache:  cache,
+		config: config,
 	}
 
 	return pb
@@ -63,6 +92,7 @@ func NewPocketBase(config *DatabaseConfig) *PocketBase {
 // Close method closes database connection
 func (pb *PocketBase) Close() {
 	pb.store.Close()
+	pb.cache.Close()
 }
 
 // LogStats method logs database stats every 10 seconds
@@ -76,7 +106,7 @@ func (pb *PocketBase) LogStats() {
 		cached := pb.cache.Len()
 		diff := stats.Sub(&prev)
 
-		log.WithFields(logrus.Fields{
+		dbLog.WithFields(log.Fields{
 			"memcached":    cached,
 			"openTxN":      diff.OpenTxN,
 			"pendingPageN": stats.PendingPageN,
@@ -102,50 +132,126 @@ func (pb *PocketBase) IsInitialized() bool {
 	return pb.store.IsInitialized()
 }
 
-// Check method checks redundancy for the buckets
-func (pb *PocketBase) Check() {
-	tx, err := pb.db.Begin(false)
-	if err != nil {
-		log.Panic(err)
+// CheckReport contains the result of a consistency check of the database
+type CheckReport struct {
+	Checked int `json:"checked"`
+	// Inconsistent contains packages marked as completed without a revision, a document or files
+	Inconsistent map[string]string `json:"inconsistent"`
+	// Orphans contains packages that have a document, files or a mark but no revision
+	Orphans []string `json:"orphans"`
+	Fixed   bool     `json:"fixed"`
+}
+
+// checkBatchSize is the number of packages fixed in a transaction by Check
+const checkBatchSize = 1000
+
+// Check method checks that completed packages have a revision, a document and files
+//
+// If fix is set, inconsistent packages are marked as incomplete to be mirrored
+// again and orphan entries are deleted.
+func (pb *PocketBase) Check(fix bool) (*CheckReport, error) {
+	report := &CheckReport{
+		Inconsistent: map[string]string{},
+		Fixed:        fix,
+	}
+	if fix {
+		defer pb.delCache("count:Documents")
+		defer pb.delCache("count:Files")
+		defer pb.delCache("count:Marks")
+		defer pb.delCache("mark:0")
+		defer pb.delCache("mark:1")
 	}
-	defer tx.Commit()
 
-	packages := tx.Bucket([]byte("Packages"))
-	documents := tx.Bucket([]byte("Documents"))
-	files := tx.Bucket([]byte("Files"))
-	marks := tx.Bucket([]byte("Marks"))
+	count := pb.store.GetItemCount("Packages")
+	dbLog.Infof("Checking consistency for %d items", count)
+	bar := pbar.StartNew(count)
+	pb.store.ForEachPackage("", func(pack *PackageRecord) bool {
+		report.Checked++
+		if pack.Marked {
+			if pack.Revision == "" {
+				report.Inconsistent[pack.ID] = "rev"
+			} else if pack.Document == "" {
+				report.Inconsistent[pack.ID] = "doc"
+			} else if pack.Files == nil {
+				report.Inconsistent[pack.ID] = "file"
+			}
+		}
+		bar.Increment()
+		return true
+	})
+	bar.Finish()
+
+	orphans, err := pb.store.Orphans(fix)
+	if err != nil {
+		return report, err
+	}
+	report.Orphans = orphans
+	dbLog.Infof("%d errors and %d orphans found in database", len(report.Inconsistent), len(report.Orphans))
 
-	// 1. get all marked items
-	var availables [][]byte
-	marksCursor := marks.Cursor()
+	if !fix || len(report.Inconsistent) == 0 {
+		return report, nil
+	}
 
-	for k, v := marksCursor.First(); k != nil; k, v = marksCursor.Next() {
-		if string(v) == MarkComplete {
-			availables = append(availables, k)
+	var ids []string
+	for id := range report.Inconsistent {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// packages are fixed in chunks, since a single transaction may grow
+	// beyond the limits of the store (such as badger.ErrTxnTooBig)
+	for i := 0; i < len(ids); i += checkBatchSize {
+		end := i + checkBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := pb.resetPackages(ids[i:end]); err != nil {
+			return report, err
 		}
 	}
 
-	var inconsistencies []string
+	return report, nil
+}
 
-	// 2. check marked items have a revision, a document, and a file
-	count := len(availables)
-	log.Infof("Checking consistency for %d items", count)
-	bar := pbar.StartNew(count)
-	for _, key := range availables {
-		if rev := packages.Get(key); rev == nil || len(rev) == 0 {
-			inconsistencies = append(inconsistencies, string(key)+" (rev)")
-		} else if doc := documents.Get(key); doc == nil || len(doc) == 0 {
-			inconsistencies = append(inconsistencies, string(key)+" (doc)")
-		} else if file := files.Get(key); file == nil {
-			inconsistencies = append(inconsistencies, string(key)+" (file)")
+// resetPackages marks the packages as incomplete in a transaction
+func (pb *PocketBase) resetPackages(ids []string) error {
+	revisions := map[string]string{}
+	for _, id := range ids {
+		revisions[id] = pb.store.GetRevision(id)
+	}
+
+	tx := pb.store.AcquireTx()
+	defer tx.Rollback()
+	for _, id := range ids {
+		if err := pb.PutPackage(tx, id, revisions[id], false, true); err != nil {
+			return err
 		}
-		bar.Increment()
 	}
-	bar.Finish()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		pb.PurgeCache(id)
+	}
 
-	// 3. print errors
-	log.Infof("%d errors found in database", len(inconsistencies))
-	log.Error(strings.Join(inconsistencies[:], ", "))
+	return nil
+}
+
+// cache keys of the entries cached per package
+func documentCacheKey(name string) string { return name }
+func revisionCacheKey(name string) string { return name + ":rev" }
+func distTagsCacheKey(name string) string { return name + ":tags" }
+func reviewsCacheKey(name string) string  { return name + ":reviews" }
+func blockedCacheKey(name string) string  { return name + ":blocked" }
+
+// packageCacheKeys lists the builders of every cache key of a package, which
+// PurgeCache drops
+var packageCacheKeys = []func(string) string{
+	documentCacheKey,
+	revisionCacheKey,
+	distTagsCacheKey,
+	reviewsCacheKey,
+	blockedCacheKey,
 }
 
 func (pb *PocketBase) getCacheDecoder(key string) *gob.Decoder {
@@ -168,7 +274,7 @@ func (pb *PocketBase) setCache(key string, value interface{}) {
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(value)
 	if err != nil {
-		log.Debug(err)
+		dbLog.Debug(err)
 		return
 	}
 
@@ -179,6 +285,23 @@ func (pb *PocketBase) delCache(key string) {
 	pb.cache.Set(key, []byte{})
 }
 
+// PurgeCache method drops cached entries of the package, or the entire cache if the name is empty
+func (pb *PocketBase) PurgeCache(name string) {
+	if name == "" {
+		pb.cache.Reset()
+		return
+	}
+
+	for _, key := range packageCacheKeys {
+		pb.cache.Delete(key(name))
+	}
+}
+
+// CacheLen method returns the number of entries in the in-memory cache
+func (pb *PocketBase) CacheLen() int {
+	return pb.cache.Len()
+}
+
 // GetItemCount method returns the count of items in the bucket
 func (pb *PocketBase) GetItemCount(name string) (count int) {
 	dec := pb.getCacheDecoder("count:" + name)
@@ -267,7 +390,7 @@ func (pb *PocketBase) GetIncompletePackages() []*BarePackage {
 
 // GetRevision method returns a revision of document
 func (pb *PocketBase) GetRevision(id string) (rev string) {
-	dec := pb.getCacheDecoder(id + ":rev")
+	dec := pb.getCacheDecoder(revisionCacheKey(id))
 	if dec != nil {
 		var cache interface{}
 		decerr := dec.Decode(&cache)
@@ -280,23 +403,31 @@ func (pb *PocketBase) GetRevision(id string) (rev string) {
 	rev = pb.store.GetRevision(id)
 
 	if rev != "" {
-		pb.setCache(id+":rev", rev)
+		pb.setCache(revisionCacheKey(id), rev)
 	}
 	return
 }
 
 // GetDocument method returns a document by given name
 func (pb *PocketBase) GetDocument(id string, withfiles bool) (document string, filelist []*url.URL, err error) {
+	document, filelist, _, err = pb.GetCachedDocument(id, withfiles)
+	return
+}
+
+// GetCachedDocument method returns a document like GetDocument, and whether it
+// was taken from the cache
+func (pb *PocketBase) GetCachedDocument(id string, withfiles bool) (document string, filelist []*url.URL, cached bool, err error) {
 	document = "{}"
 	filelist = nil
 
-	dec := pb.getCacheDecoder(id)
+	dec := pb.getCacheDecoder(documentCacheKey(id))
 	if dec != nil {
 		var caches []interface{}
 		decerr := dec.Decode(&caches)
 		if decerr == nil {
 			document = caches[0].(string)
 			filelist = caches[1].([]*url.URL)
+			cached = true
 			return
 		}
 	}
@@ -313,7 +444,7 @@ func (pb *PocketBase) GetDocument(id string, withfiles bool) (document string, f
 		decerr := dec.Decode(&filelist)
 		if decerr != nil {
 			err = fmt.Errorf("Internal error: %v", decerr)
-			return "", nil, nil
+			return "", nil, false, nil
 		}
 	}
 
@@ -322,7 +453,7 @@ func (pb *PocketBase) GetDocument(id string, withfiles bool) (document string, f
 			document,
 			filelist,
 		}
-		pb.setCache(id, caches)
+		pb.setCache(documentCacheKey(id), caches)
 	}
 
 	return
@@ -345,23 +476,53 @@ func (pb *PocketBase) PutPackage(tx transactionable, id string, rev string, mark
 
 // PutPackages method is a bulk method of PutPackage
 func (pb *PocketBase) PutPackages(allDocs []*BarePackage) {
+	if bulk, ok := pb.store.(bulkStore); ok {
+		defer pb.delCache("count:Packages")
+		defer pb.delCache("count:Marks")
+		defer pb.delCache("mark:0")
+		defer pb.delCache("mark:1")
+
+		if err := bulk.PutPackages(allDocs); err != nil {
+			dbLog.Fatal(err)
+		}
+		return
+	}
+
 	tx := pb.store.AcquireTx()
 	defer tx.Rollback()
 
 	for _, doc := range allDocs {
 		err := pb.PutPackage(tx, doc.ID, doc.Revision, false, true)
 		if err != nil {
-			log.Error(err)
+			dbLog.Error(err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		log.Fatal(err)
+		dbLog.Fatal(err)
+	}
+}
+
+// ResetPackage method marks a package as incomplete so that it will be mirrored again
+func (pb *PocketBase) ResetPackage(name string) error {
+	tx := pb.store.AcquireTx()
+	defer tx.Rollback()
+
+	err := pb.PutPackage(tx, name, pb.GetRevision(name), false, true)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+	pb.PurgeCache(name)
+
+	return nil
 }
 
-// DeletePackage method deletes a package
-func (pb *PocketBase) DeletePackage(name string) {
+// DeletePackage method deletes a package and returns the entry appended to the journal
+func (pb *PocketBase) DeletePackage(name string) *JournalEntry {
 	defer pb.delCache("count:Packages")
 	defer pb.delCache("count:Documents")
 	defer pb.delCache("count:Files")
@@ -369,102 +530,76 @@ func (pb *PocketBase) DeletePackage(name string) {
 	defer pb.delCache("mark:0")
 	defer pb.delCache("mark:1")
 
+	rev := pb.store.GetRevision(name)
+	var removed []string
+	for _, info := range pb.GetVersions(name) {
+		removed = append(removed, info.Version)
+	}
 	pb.store.DeletePackage(name)
+	entry := pb.recordChange(name, rev, true, nil, removed)
+	if err := pb.store.ReplaceEntries("Versions", name+"@", nil); err != nil {
+		dbLog.Errorf("Failed to delete versions: %s %v", name, err)
+	}
+	if err := pb.PutBlobs(name, nil); err != nil {
+		dbLog.Errorf("Failed to delete blobs: %s %v", name, err)
+	}
+
+	return entry
 }
 
 // PutCompleted method inserts a completed package into the appropriate buckets
-func (pb *PocketBase) PutCompleted(pack *BarePackage, document string, rev string, downloads []*url.URL) (succeed bool) {
-	defer pb.delCache(document)
-	defer pb.delCache(document + ":rev")
+//
+// The versions of the document are stored as well, with tarball sizes by url path,
+// and the change is appended to the change log and the journal.
+func (pb *PocketBase) PutCompleted(pack *BarePackage, document string, rev string, downloads []*url.URL, sizes map[string]int64) bool {
+	_, succeed := pb.PutCompletedEntry(pack, document, rev, downloads, sizes)
+	return succeed
+}
+
+// PutCompletedEntry method works like PutCompleted, and also returns the entry
+// appended to the journal (nil if nothing changed)
+func (pb *PocketBase) PutCompletedEntry(pack *BarePackage, document string, rev string, downloads []*url.URL, sizes map[string]int64) (entry *JournalEntry, succeed bool) {
+	defer pb.delCache(documentCacheKey(pack.ID))
+	defer pb.delCache(revisionCacheKey(pack.ID))
 	defer pb.delCache("count:Packages")
 	defer pb.delCache("count:Documents")
 	defer pb.delCache("count:Files")
 	defer pb.delCache("count:Marks")
 
-	tx := pb.store.AcquireTx()
-	defer tx.Rollback()
-
-	succeed = pb.store.PutCompleted(tx, pack, document, rev, downloads)
-
-	if err := tx.Commit(); err != nil {
-		succeed = false
-		return
-	}
-
-	return
-}
+	// the versions, the change and the journal entry are written in the
+	// transaction of the document, so that none of them can be missed
+	pb.changeMu.Lock()
+	defer pb.changeMu.Unlock()
 
-func (pb *PocketBase) Migrate(boltPath string) {
-	if !pb.IsInitialized() {
-		log.Info("Database has not been initialized. Init..")
-		pb.Init()
+	var writes []EntryWrite
+	versions, err := parseVersions(pack.ID, document, sizes)
+	if err != nil {
+		dbLog.Warnf("Failed to parse versions: %s %v", pack.ID, err)
+		writes, entry = pb.recordWrites(pack.ID, rev, false, nil, nil)
 	} else {
-		log.Info("Database has already been initialized.")
+		stored := pb.GetVersions(pack.ID)
+		added, removed := diffVersions(stored, versions)
+		writes, entry = pb.recordWrites(pack.ID, rev, false, added, removed)
+		if versioned, err := versionWrites(pack.ID, stored, versions); err != nil {
+			dbLog.Errorf("Failed to store versions: %s %v", pack.ID, err)
+		} else {
+			writes = append(writes, versioned...)
+		}
 	}
 
-	if !pb.IsInitialized() {
-		log.Fatalf("Failed to initialize database")
-	}
+	tx := pb.store.AcquireTx()
+	defer tx.Rollback()
 
-	config := &DatabaseConfig{
-		Type: "bolt",
-		Path: boltPath,
+	if !pb.store.PutCompleted(tx, pack, document, rev, downloads) {
+		return nil, false
 	}
-	boltStore := newBoltStore(config)
-	if err := boltStore.Connect(); err != nil {
-		log.Fatalf("Failed to open bolt database file: %v", err)
+	if err := pb.store.PutEntries(tx, writes); err != nil {
+		dbLog.Errorf("Failed to record a change: %s %v", pack.ID, err)
+		return nil, false
 	}
-	selfStore := pb.store.(*gormStore)
-
-	// acquire transactions
-	selfTx := selfStore.db
-	tx := boltStore.AcquireTx().(*bolt.Tx)
-	defer selfTx.Rollback()
-	defer tx.Rollback()
-
-	// set max allowed packet size
-	selfTx.Raw("SET GLOBAL max_allowed_packet = 1024 * 1048576;")
-
-	count := boltStore.GetItemCount("Packages")
-	seq := boltStore.GetSequence()
-
-	packages := tx.Bucket([]byte("Packages"))
-	documents := tx.Bucket([]byte("Documents"))
-	files := tx.Bucket([]byte("Files"))
-	marks := tx.Bucket([]byte("Marks"))
-
-	cursor := packages.Cursor()
-
-	bar := pbar.StartNew(count)
-	for id, rev := cursor.First(); id != nil; id, rev = cursor.Next() {
-		idStr := string(id)
-		doc := string(documents.Get(id))
-		files := base64.StdEncoding.EncodeToString(files.Get(id))
-		markstr := string(marks.Get(id))
-		marked := false
-		if markstr == MarkComplete {
-			marked = true
-		}
-
-		pack := gormPackage{
-			ID:       idStr,
-			Revision: string(rev),
-			Document: doc,
-			Marked:   marked,
-			Files:    files,
-		}
-		err := selfTx.Where(gormPackage{ID: idStr}).Assign(pack).FirstOrCreate(&pack).Error
-		if err != nil {
-			log.Warnf("Failed to insert a package: %s %v", idStr, err)
-		}
-
-		bar.Increment()
+	if err := tx.Commit(); err != nil {
+		return nil, false
 	}
-	bar.Finish()
 
-	pb.SetSequence(seq)
-	if err := selfTx.Commit(); err != nil {
-		log.Errorf("Failed to commit transaction: %v", err)
-	}
-	tx.Commit()
+	return entry, true
 }
@@ -1,143 +1,878 @@
 package db
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dgraph-io/badger"
 )
 
 // ensure that database is initialized
 func TestInit(t *testing.T) {
-	pb := testbase(false)
-	defer pb.Close()
-	pb.Init()
+	forEachStore(t, false, func(t *testing.T, pb *PocketBase) {
+		pb.Init()
 
-	if !pb.IsInitialized() {
-		t.Error("TestInit: database is not initialized")
-	}
+		if !pb.IsInitialized() {
+			t.Error("TestInit: database is not initialized")
+		}
+	})
 }
 
 func TestGetStats(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
-
-	stats := pb.GetStats()
-	if stats.Packages != 0 {
-		t.Errorf("TestGetStats: unexpected package count %d", stats.Packages)
-	}
-	if stats.Marks != 0 {
-		t.Errorf("TestGetStats: unexpected mark count %d", stats.Marks)
-	}
-	if stats.Documents != 0 {
-		t.Errorf("TestGetStats: unexpected document count %d", stats.Documents)
-	}
-	if stats.Files != 0 {
-		t.Errorf("TestGetStats: unexpected file count %d", stats.Files)
-	}
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		stats := pb.GetStats()
+		if stats.Packages != 0 {
+			t.Errorf("TestGetStats: unexpected package count %d", stats.Packages)
+		}
+		if stats.Marks != 0 {
+			t.Errorf("TestGetStats: unexpected mark count %d", stats.Marks)
+		}
+		if stats.Documents != 0 {
+			t.Errorf("TestGetStats: unexpected document count %d", stats.Documents)
+		}
+		if stats.Files != 0 {
+			t.Errorf("TestGetStats: unexpected file count %d", stats.Files)
+		}
+	})
 }
 
 func TestSetSequence(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
-
-	expected := 100
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		expected := 100
 
-	pb.SetSequence(expected)
-	actual := pb.GetSequence()
+		pb.SetSequence(expected)
+		actual := pb.GetSequence()
 
-	if actual != expected {
-		t.Errorf("TestSetSequence: unexpected sequence number %d", actual)
-	}
+		if actual != expected {
+			t.Errorf("TestSetSequence: unexpected sequence number %d", actual)
+		}
+	})
 }
 
 func TestGetSetCache(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
-	key := "key"
-	value := "value"
-
-	// set cache
-	pb.setCache(key, value)
-
-	// get cache decoder
-	decoder := pb.getCacheDecoder(key)
-	var actual string
-	err := decoder.Decode(&actual)
-	if err != nil {
-		t.Errorf("TestGetSetCache: unexpected error %v", err)
-	}
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		key := "key"
+		value := "value"
 
-	if actual != value {
-		t.Errorf("TestGetSetCache: unexpected value %s", actual)
-	}
+		// set cache
+		pb.setCache(key, value)
+
+		// get cache decoder
+		decoder := pb.getCacheDecoder(key)
+		var actual string
+		err := decoder.Decode(&actual)
+		if err != nil {
+			t.Errorf("TestGetSetCache: unexpected error %v", err)
+		}
+
+		if actual != value {
+			t.Errorf("TestGetSetCache: unexpected value %s", actual)
+		}
+	})
+}
+
+func TestPurgeCache(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		for _, key := range packageCacheKeys {
+			pb.setCache(key("test"), "value")
+			pb.setCache(key("other"), "value")
+		}
+
+		pb.PurgeCache("test")
+		for _, key := range packageCacheKeys {
+			if pb.getCacheDecoder(key("test")) != nil {
+				t.Errorf("TestPurgeCache: %s was not purged", key("test"))
+			}
+			if pb.getCacheDecoder(key("other")) == nil {
+				t.Errorf("TestPurgeCache: %s was purged", key("other"))
+			}
+		}
+	})
 }
 
 func TestPutIncompletePackages(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
-	allDocs := []*BarePackage{
-		{
-			ID:       "Test",
-			Revision: "Revision",
-		},
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{
+				ID:       "Test",
+				Revision: "Revision",
+			},
+			{
+				ID:       "Test2",
+				Revision: "Revision",
+			},
+		}
+
+		pb.PutPackages(allDocs)
+
+		actual := pb.GetIncompletePackages()
+		if !reflect.DeepEqual(actual, allDocs) {
+			t.Errorf("TestPutIncompletePackages: expected %q actual %q", allDocs, actual)
+		}
+	})
+}
+
+func TestDeletePackage(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{
+				ID:       "Test",
+				Revision: "Revision",
+			},
+			{
+				ID:       "Test2",
+				Revision: "Revision",
+			},
+		}
+
+		pb.PutPackages(allDocs)
+		pb.DeletePackage("Test2")
+
+		actual := pb.GetRevision("Test2")
+		if actual != "" {
+			t.Error("TestDeletePackage: unexpected behavior")
+		}
+	})
+}
+
+func TestPutCompletedPackage(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{
+				ID:       "Test",
+				Revision: "Revision",
+			},
+			{
+				ID:       "Test2",
+				Revision: "Revision",
+			},
+		}
+
+		pb.PutPackages(allDocs)
+
+		doc := `{"_id":"Test","rev":"Revision"}`
+		files := []*url.URL{
+			{
+				Scheme: "http",
+				Host:   "localhost",
+				Path:   "test/-/test-0.0.1.tgz",
+			},
+		}
+		pb.PutCompleted(allDocs[0], doc, "Revision", files, nil)
+
+		count := pb.GetCountOfMarks(true)
+		if count != 1 {
+			t.Errorf("TestPutCompletedPackage: expected count 1 actual %d", count)
+		}
+
+		actualDoc, actualFiles, err := pb.GetDocument("Test", true)
+		if err != nil {
+			t.Errorf("TestPutCompletedPackage: unexpected error %v", err)
+		}
+		if actualDoc != doc {
+			t.Errorf("TestPutCompletedPackage: expected doc %s actual %s", doc, actualDoc)
+		}
+		if fmt.Sprintf("%v", actualFiles) != fmt.Sprintf("%v", files) {
+			t.Errorf("TestPutCompletedPackage: expected files %q actual %q", files, actualFiles)
+		}
+		if cachedDoc, _, cached, err := pb.GetCachedDocument("Test", true); err != nil || !cached || cachedDoc != doc {
+			t.Errorf("TestPutCompletedPackage: expected the cached doc actual %s (cached %v)", cachedDoc, cached)
+		}
+	})
+}
+
+func TestPutAdvisories(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		pb.PutAdvisories("Test", []*Advisory{
+			{ID: "GHSA-1", VulnerableVersions: "<1.0.0"},
+			{ID: "GHSA-2", VulnerableVersions: "<2.0.0"},
+		})
+		pb.PutAdvisories("Test", []*Advisory{
+			{ID: "GHSA-2", VulnerableVersions: "<2.0.1"},
+			{ID: "GHSA-3", VulnerableVersions: ""},
+		})
+
+		actual := pb.GetAdvisories("Test")
+		if len(actual) != 2 || actual[1].VulnerableVersions != "<2.0.1" {
+			t.Errorf("TestPutAdvisories: unexpected advisories %v", actual)
+		}
+
+		if count := pb.ClearAdvisories(); count != 1 {
+			t.Errorf("TestPutAdvisories: expected count 1 actual %d", count)
+		}
+		if actual := pb.GetAdvisories("Test"); actual != nil {
+			t.Errorf("TestPutAdvisories: unexpected advisories after clear %v", actual)
+		}
+	})
+}
+
+func TestDistTags(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		// concurrent updates of a package must not overwrite each other
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				pb.GetDistTags("Test")
+				pb.SetDistTag("Test", fmt.Sprintf("tag%d", i), "1.0.0")
+			}(i)
+		}
+		wg.Wait()
+
+		if tags := pb.GetDistTags("Test"); len(tags) != 20 {
+			t.Errorf("TestDistTags: expected 20 tags actual %v", tags)
+		}
+
+		pb.DeleteDistTag("Test", "tag0", true)
+		pb.DeleteDistTag("Test", "tag1", false)
+		tags := pb.GetDistTags("Test")
+		if version, ok := tags["tag0"]; !ok || version != "" || len(tags) != 19 {
+			t.Errorf("TestDistTags: unexpected tags after delete %v", tags)
+		}
+	})
+}
+
+func TestBlocklist(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		if entries := pb.GetBlockEntries("Test"); len(entries) != 0 {
+			t.Errorf("TestBlocklist: unexpected entries %v", entries)
+		}
+
+		pb.AddBlockEntry(&BlockEntry{Name: "Test", Range: "<1.0.0", Reason: "Reason", Author: "Author"})
+		pb.AddBlockEntry(&BlockEntry{Name: "Test", Range: "", Reason: "Reason", Author: "Author"})
+		pb.AddBlockEntry(&BlockEntry{Name: "Test2", Range: "", Reason: "Reason", Author: "Author"})
+
+		if entries := pb.GetBlockEntries("Test"); len(entries) != 2 {
+			t.Errorf("TestBlocklist: expected 2 entries actual %d", len(entries))
+		}
+		if entries := pb.GetBlocklist(); len(entries) != 3 {
+			t.Errorf("TestBlocklist: expected 3 entries in total actual %d", len(entries))
+		}
+
+		removed, err := pb.RemoveBlockEntry("Test", "<1.0.0")
+		if !removed || err != nil {
+			t.Errorf("TestBlocklist: unexpected result %v %v", removed, err)
+		}
+		if entries := pb.GetBlockEntries("Test"); len(entries) != 1 || entries[0].Range != "" {
+			t.Errorf("TestBlocklist: unexpected entries after removal %v", entries)
+		}
+	})
+}
+
+func TestForEachEntry(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		for _, key := range []string{"a_b", "a_b:1", "aXb", "A_b", "b"} {
+			pb.store.PutEntry("Test", key, []byte(key))
+		}
+
+		var actual []string
+		pb.store.ForEachEntry("Test", "a_b", func(key string, value []byte) bool {
+			actual = append(actual, key)
+			return true
+		})
+
+		expected := []string{"a_b", "a_b:1"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("TestForEachEntry: expected %v actual %v", expected, actual)
+		}
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	from := config("bolt")
+	src := NewPocketBase(from)
+	src.Init()
+	src.PutPackages([]*BarePackage{
+		{ID: "Test", Revision: "Revision"},
+		{ID: "Test2", Revision: "Revision"},
+		{ID: "Test3", Revision: "Revision"},
+	})
+	files := []*url.URL{
 		{
-			ID:       "Test2",
-			Revision: "Revision",
+			Scheme: "http",
+			Host:   "localhost",
+			Path:   "test/-/test-0.0.1.tgz",
 		},
 	}
+	src.PutCompleted(&BarePackage{ID: "Test", Revision: "Revision"}, `{"_id":"Test"}`, "Revision2", files, nil)
+	src.SetSequence(100)
+	src.AddBlockEntry(&BlockEntry{Name: "Test", Reason: "Reason", Author: "Author"})
+	src.BackfillVersions(10, nil)
+	src.Close()
 
-	pb.PutPackages(allDocs)
+	for _, storeType := range []string{"badger", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			to := config(storeType)
+			if err := Migrate(from, to, 2, false); err != nil {
+				t.Fatalf("TestMigrate: unexpected error %v", err)
+			}
 
-	actual := pb.GetIncompletePackages()
-	if !reflect.DeepEqual(actual, allDocs) {
-		t.Errorf("TestPutIncompletePackages: expected %q actual %q", allDocs, actual)
+			pb := NewPocketBase(to)
+			if seq := pb.GetSequence(); seq != 100 {
+				t.Errorf("TestMigrate: unexpected sequence %d", seq)
+			}
+			if count := pb.GetCountOfMarks(false); count != 2 {
+				t.Errorf("TestMigrate: expected 2 incomplete packages actual %d", count)
+			}
+			doc, actualFiles, err := pb.GetDocument("Test", true)
+			if err != nil || doc != `{"_id":"Test"}` || pb.GetRevision("Test") != "Revision2" {
+				t.Errorf("TestMigrate: unexpected document %s %v", doc, err)
+			}
+			if fmt.Sprintf("%v", actualFiles) != fmt.Sprintf("%v", files) {
+				t.Errorf("TestMigrate: expected files %v actual %v", files, actualFiles)
+			}
+			if entries := pb.GetBlockEntries("Test"); len(entries) != 1 {
+				t.Errorf("TestMigrate: unexpected blocklist %v", entries)
+			}
+			if pb.store.GetEntry("Globals", "versions") == nil {
+				t.Error("TestMigrate: expected the versions to be marked as backfilled")
+			}
+
+			// a stopped migration continues after the last batch of packages and entries
+			pb.store.PutEntry("Migration", "state", []byte(`{"source":"bolt:`+from.Path.(string)+`","last":"Test3","copied":3,"entries":{"Blocklist":{"last":"Test","copied":1,"done":true}}}`))
+			pb.DeletePackage("Test")
+			pb.store.WriteEntries([]EntryWrite{{Bucket: "Blocklist", Key: "Test"}})
+			pb.Close()
+			if err := Migrate(from, to, 2, false); err != nil {
+				t.Fatalf("TestMigrate: unexpected error %v", err)
+			}
+			pb = NewPocketBase(to)
+			defer pb.Close()
+			if rev := pb.GetRevision("Test"); rev != "" {
+				t.Errorf("TestMigrate: resumed migration copied a package again %s", rev)
+			}
+			if entries := pb.GetBlockEntries("Test"); len(entries) != 0 {
+				t.Errorf("TestMigrate: resumed migration copied entries again %v", entries)
+			}
+		})
 	}
 }
 
-func TestDeletePackage(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
-	allDocs := []*BarePackage{
-		{
-			ID:       "Test",
-			Revision: "Revision",
-		},
-		{
-			ID:       "Test2",
-			Revision: "Revision",
-		},
+func TestBackfillVersions(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		pack := &BarePackage{ID: "Test", Revision: "Revision"}
+		pb.PutPackages([]*BarePackage{pack, {ID: "Test2", Revision: "Revision"}})
+		pb.PutCompleted(pack, `{"_id":"Test","versions":{"1.0.0":{"dist":{"tarball":"http://localhost/Test/-/Test-1.0.0.tgz"}}}}`, "Revision", nil, nil)
+		// packages mirrored before versions were stored
+		pb.store.ReplaceEntries("Versions", "Test@", nil)
+		if versions := pb.LookupVersions("Test"); len(versions) != 1 || versions[0].Version != "1.0.0" {
+			t.Errorf("TestBackfillVersions: expected versions parsed from the document actual %v", versions)
+		}
+
+		count, err := pb.BackfillVersions(1, func(path string) int64 { return 100 })
+		if count != 1 || err != nil {
+			t.Errorf("TestBackfillVersions: unexpected result %d %v", count, err)
+		}
+		if info := pb.GetVersion("Test", "1.0.0"); info == nil || info.Size != 100 {
+			t.Errorf("TestBackfillVersions: unexpected version %+v", info)
+		}
+
+		// the pass runs once
+		pb.store.ReplaceEntries("Versions", "Test@", nil)
+		if count, err := pb.BackfillVersions(1, nil); count != 0 || err != nil {
+			t.Errorf("TestBackfillVersions: unexpected second pass %d %v", count, err)
+		}
+	})
+}
+
+func TestCompressValue(t *testing.T) {
+	value := []byte(`{"_id":"Test","rev":"Revision"}`)
+	for _, codec := range []string{CompressionNone, CompressionZstd, CompressionGzip} {
+		compressed := compressValue(codec, value)
+		if actual := valueCodec(compressed); actual != codec {
+			t.Errorf("TestCompressValue: expected codec %s actual %s", codec, actual)
+		}
+		if actual, err := decompressValue(compressed); err != nil || !reflect.DeepEqual(actual, value) {
+			t.Errorf("TestCompressValue: unexpected value %s %v", actual, err)
+		}
+
+		// values of text columns were base64 encoded
+		text := []byte(base64.StdEncoding.EncodeToString(compressed))
+		if actual := valueCodec(columnValue(text)); actual != codec {
+			t.Errorf("TestCompressValue: expected column codec %s actual %s", codec, actual)
+		}
+		for _, column := range [][]byte{compressed, text} {
+			if actual, err := decompressColumn(column); err != nil || !reflect.DeepEqual(actual, value) {
+				t.Errorf("TestCompressValue: unexpected column %s %v", actual, err)
+			}
+		}
 	}
 
-	pb.PutPackages(allDocs)
-	pb.DeletePackage("Test2")
+	var files bytes.Buffer
+	gob.NewEncoder(&files).Encode([]*url.URL{{Scheme: "http", Host: "localhost", Path: "/test/-/test-0.0.1.tgz"}})
+	if actual := columnValue(files.Bytes()); !bytes.Equal(actual, files.Bytes()) {
+		t.Errorf("TestCompressValue: unexpected file list %v", actual)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		doc := `{"_id":"Test","description":"` + strings.Repeat("x", 1024) + `"}`
+		pack := &BarePackage{ID: "Test", Revision: "Revision"}
+		pb.PutPackages([]*BarePackage{pack})
+
+		// uncompressed data has to be readable after enabling the compression
+		pb.config.Compression = CompressionNone
+		pb.PutCompleted(pack, doc, "Revision", nil, nil)
+		pb.config.Compression = CompressionZstd
 
-	actual := pb.GetRevision("Test2")
-	if actual != "" {
-		t.Error("TestDeletePackage: unexpected behavior")
+		if actual, _, err := pb.store.GetDocument("Test", false); err != nil || actual != doc {
+			t.Errorf("TestRecompress: unexpected document %s %v", actual, err)
+		}
+
+		count, err := pb.Recompress(1, 0)
+		if count != 1 || err != nil {
+			t.Errorf("TestRecompress: unexpected result %d %v", count, err)
+		}
+
+		report := pb.GetCompressionReport()
+		if report.Codecs[CompressionZstd] != 1 || report.StoredSize >= report.OriginalSize {
+			t.Errorf("TestRecompress: unexpected report %+v", report)
+		}
+		if actual, _, err := pb.store.GetDocument("Test", false); err != nil || actual != doc {
+			t.Errorf("TestRecompress: unexpected document after recompression %s %v", actual, err)
+		}
+	})
+}
+
+func TestVersions(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		pack := &BarePackage{ID: "Test", Revision: "Revision"}
+		pb.PutPackages([]*BarePackage{pack, {ID: "Test2", Revision: "Revision"}})
+
+		doc := `{"_id":"Test","versions":{` +
+			`"1.0.0":{"dist":{"shasum":"a","tarball":"http://localhost/Test/-/Test-1.0.0.tgz"},"deprecated":"use 2.0.0"},` +
+			`"2.0.0":{"dist":{"shasum":"b","integrity":"sha512-b","tarball":"http://localhost/Test/-/Test-2.0.0.tgz"},"dependencies":{"Test2":"^1.0.0"}}},` +
+			`"dist-tags":{"latest":"2.0.0","next":"2.0.0"},` +
+			`"time":{"1.0.0":"2017-01-01T00:00:00.000Z","2.0.0":"2018-01-01T00:00:00.000Z"}}`
+		pb.PutCompleted(pack, doc, "Revision", nil, map[string]int64{"/Test/-/Test-2.0.0.tgz": 100})
+		pb.PutCompleted(&BarePackage{ID: "Test2", Revision: "Revision"}, `{"_id":"Test2","versions":{"1.0.0":{}}}`, "Revision", nil, nil)
+
+		if versions := pb.GetVersions("Test"); len(versions) != 2 {
+			t.Errorf("TestVersions: expected 2 versions actual %d", len(versions))
+		}
+		info := pb.GetVersion("Test", "2.0.0")
+		expected := &VersionInfo{
+			Name:         "Test",
+			Version:      "2.0.0",
+			Published:    time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+			Shasum:       "b",
+			Integrity:    "sha512-b",
+			Tarball:      "/Test/-/Test-2.0.0.tgz",
+			Size:         100,
+			Dependencies: map[string]string{"Test2": "^1.0.0"},
+			Tags:         []string{"latest", "next"},
+		}
+		if manifest := `{"dist":{"shasum":"b","integrity":"sha512-b","tarball":"http://localhost/Test/-/Test-2.0.0.tgz"},"dependencies":{"Test2":"^1.0.0"}}`; info == nil || string(info.Manifest) != manifest {
+			t.Errorf("TestVersions: expected manifest %s actual %+v", manifest, info)
+		} else {
+			info.Manifest = nil
+		}
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("TestVersions: expected %+v actual %+v", expected, info)
+		}
+		if info := pb.GetVersion("Test", "1.0.0"); info == nil || !info.Deprecated {
+			t.Errorf("TestVersions: expected a deprecated version actual %+v", info)
+		}
+
+		// unpublished versions are removed
+		pb.PutCompleted(pack, `{"_id":"Test","versions":{"2.0.0":{}}}`, "Revision", nil, nil)
+		if info := pb.GetVersion("Test", "1.0.0"); info != nil {
+			t.Errorf("TestVersions: unexpected version %+v", info)
+		}
+
+		pb.DeletePackage("Test")
+		if versions := pb.GetVersions("Test"); len(versions) != 0 {
+			t.Errorf("TestVersions: unexpected versions after deletion %v", versions)
+		}
+		if versions := pb.GetVersions("Test2"); len(versions) != 1 {
+			t.Errorf("TestVersions: expected 1 version of another package actual %d", len(versions))
+		}
+	})
+}
+
+func TestCounters(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{ID: "Test", Revision: "Revision"},
+			{ID: "Test2", Revision: "Revision"},
+			{ID: "Test3", Revision: "Revision"},
+		}
+		pb.PutPackages(allDocs)
+		pb.PutPackages(allDocs[:1])
+		pb.PutCompleted(allDocs[0], `{"_id":"Test"}`, "Revision", nil, nil)
+		pb.PutCompleted(allDocs[1], `{"_id":"Test2"}`, "Revision2", nil, nil)
+		pb.PutCompleted(allDocs[1], `{"_id":"Test2"}`, "Revision2", nil, nil)
+		pb.DeletePackage("Test3")
+		pb.ResetPackage("Test2")
+
+		expected := &DatabaseStats{Packages: 2, Marks: 2, Documents: 2, Files: 2}
+		check := func(when string) {
+			// the store is queried directly to bypass the in-memory cache
+			actual := &DatabaseStats{
+				Packages:  pb.store.GetItemCount("Packages"),
+				Marks:     pb.store.GetItemCount("Marks"),
+				Documents: pb.store.GetItemCount("Documents"),
+				Files:     pb.store.GetItemCount("Files"),
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("TestCounters: %s expected %+v actual %+v", when, expected, actual)
+			}
+			complete, incomplete := pb.store.GetCountOfMarks(MarkComplete), pb.store.GetCountOfMarks(MarkIncomplete)
+			if complete != 1 || incomplete != 1 {
+				t.Errorf("TestCounters: %s unexpected marks %d %d", when, complete, incomplete)
+			}
+		}
+
+		check("before recount")
+		if err := pb.Recount(); err != nil {
+			t.Errorf("TestCounters: unexpected error %v", err)
+		}
+		check("after recount")
+	})
+}
+
+func TestChanges(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{ID: "Test", Revision: "1"},
+			{ID: "Test2", Revision: "1"},
+			{ID: "Test3", Revision: "1"},
+		}
+		pb.PutPackages(allDocs)
+		pb.PutCompleted(allDocs[0], `{"_id":"Test"}`, "1", nil, nil)
+		pb.PutCompleted(allDocs[1], `{"_id":"Test2"}`, "1", nil, nil)
+		pb.PutCompleted(allDocs[0], `{"_id":"Test"}`, "2", nil, nil)
+		pb.DeletePackage("Test2")
+
+		var changes []*Change
+		pb.ForEachChange(0, func(change *Change) bool {
+			changes = append(changes, change)
+			return true
+		})
+		expected := []*Change{
+			{Sequence: 3, ID: "Test", Revision: "2"},
+			{Sequence: 4, ID: "Test2", Revision: "1", Deleted: true},
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("TestChanges: expected %+v actual %+v", expected, changes)
+		}
+		if seq := pb.GetChangeSequence(); seq != 4 {
+			t.Errorf("TestChanges: expected sequence 4 actual %d", seq)
+		}
+
+		changes = nil
+		pb.ForEachChange(3, func(change *Change) bool {
+			changes = append(changes, change)
+			return true
+		})
+		if len(changes) != 1 || changes[0].ID != "Test2" {
+			t.Errorf("TestChanges: unexpected changes since 3 %+v", changes)
+		}
+
+		// nothing is recorded once the log has been written
+		if count, _ := pb.BackfillChanges(100); count != 0 {
+			t.Errorf("TestChanges: unexpected backfill of %d packages", count)
+		}
+	})
+}
+
+func TestBackfillChanges(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		pb.PutPackages([]*BarePackage{{ID: "Test", Revision: "1"}, {ID: "Test2", Revision: "1"}})
+
+		// a database written before the change log
+		tx := pb.store.AcquireTx()
+		pb.store.PutCompleted(tx, &BarePackage{ID: "Test", Revision: "1"}, `{"_id":"Test"}`, "1", nil)
+		tx.Commit()
+
+		count, err := pb.BackfillChanges(1)
+		if err != nil || count != 1 {
+			t.Errorf("TestBackfillChanges: unexpected result %d %v", count, err)
+		}
+
+		var changes []*Change
+		pb.ForEachChange(0, func(change *Change) bool {
+			changes = append(changes, change)
+			return true
+		})
+		expected := []*Change{{Sequence: 1, ID: "Test", Revision: "1"}}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("TestBackfillChanges: expected %+v actual %+v", expected, changes)
+		}
+	})
+}
+
+func TestJournal(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		pack := &BarePackage{ID: "Test", Revision: "1"}
+		pb.PutPackages([]*BarePackage{pack})
+		pb.SetSequence(10)
+		pb.PutCompleted(pack, `{"_id":"Test","versions":{"1.0.0":{},"1.0.1":{}}}`, "1", nil, nil)
+		// mirrored again without any change
+		pb.PutCompleted(pack, `{"_id":"Test","versions":{"1.0.0":{},"1.0.1":{}}}`, "1", nil, nil)
+		pb.SetSequence(20)
+		pb.PutCompleted(pack, `{"_id":"Test","versions":{"1.0.1":{},"2.0.0":{}}}`, "2", nil, nil)
+		pb.DeletePackage("Test")
+
+		var entries []*JournalEntry
+		pb.QueryJournal(&JournalQuery{}, func(entry *JournalEntry) bool {
+			entry.Time = time.Time{}
+			entries = append(entries, entry)
+			return true
+		})
+		expected := []*JournalEntry{
+			{Sequence: 1, Upstream: 10, Action: JournalMirrored, ID: "Test", NewRevision: "1", Added: []string{"1.0.0", "1.0.1"}},
+			{Sequence: 2, Upstream: 20, Action: JournalUpdated, ID: "Test", OldRevision: "1", NewRevision: "2", Added: []string{"2.0.0"}, Removed: []string{"1.0.0"}},
+			{Sequence: 3, Upstream: 20, Action: JournalDeleted, ID: "Test", OldRevision: "2", Removed: []string{"1.0.1", "2.0.0"}},
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Errorf("TestJournal: expected %+v actual %+v", expected, entries)
+		}
+
+		entries = nil
+		pb.QueryJournal(&JournalQuery{Since: 1, Limit: 1}, func(entry *JournalEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if len(entries) != 1 || entries[0].Sequence != 2 {
+			t.Errorf("TestJournal: unexpected entries since 1 %+v", entries)
+		}
+
+		after := pb.journalEntry(2).Time
+		entries = nil
+		pb.QueryJournal(&JournalQuery{After: after}, func(entry *JournalEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if len(entries) < 2 || entries[0].Sequence > 2 || entries[0].Time.Before(after) {
+			t.Errorf("TestJournal: unexpected entries since %v %+v", after, entries)
+		}
+
+		entries = nil
+		pb.QueryJournal(&JournalQuery{After: time.Now().Add(time.Hour)}, func(entry *JournalEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if len(entries) != 0 {
+			t.Errorf("TestJournal: unexpected entries in the future %+v", entries)
+		}
+	})
+}
+
+func TestParseJournalSince(t *testing.T) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	cases := map[string]JournalQuery{
+		"":                     {},
+		"42":                   {Since: 42},
+		"6h":                   {After: time.Date(2020, 1, 2, 6, 0, 0, 0, time.UTC)},
+		"2020-01-01":           {After: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"2020-01-01T10:00:00Z": {After: time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for value, expected := range cases {
+		query, err := ParseJournalSince(value, now)
+		if err != nil || !query.After.Equal(expected.After) || query.Since != expected.Since {
+			t.Errorf("TestParseJournalSince: %q expected %+v actual %+v %v", value, expected, query, err)
+		}
+	}
+
+	if _, err := ParseJournalSince("yesterday", now); err == nil {
+		t.Error("TestParseJournalSince: expected an error")
 	}
 }
 
-func TestPutCompletedPackage(t *testing.T) {
-	pb := testbase(true)
-	defer pb.Close()
+func TestDownloads(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		for _, id := range []string{"a", "@s/b", "unused"} {
+			pack := &BarePackage{ID: id, Revision: "1"}
+			pb.PutPackages([]*BarePackage{pack})
+			pb.PutCompleted(pack, `{"_id":"`+id+`","versions":{"1.0.0":{}}}`, "1", nil, nil)
+		}
 
-	allDocs := []*BarePackage{
-		{
-			ID:       "Test",
-			Revision: "Revision",
-		},
-		{
-			ID:       "Test2",
-			Revision: "Revision",
-		},
+		pb.AddDownloads(map[DownloadKey]int{
+			{Name: "a", Version: "1.0.0", Day: "2020-01-01"}:    2,
+			{Name: "a", Version: "1.0.0", Day: "2020-01-02"}:    1,
+			{Name: "@s/b", Version: "1.0.0", Day: "2020-01-02"}: 1,
+		})
+		pb.AddDownloads(map[DownloadKey]int{
+			{Name: "a", Version: "2.0.0", Day: "2020-01-02"}: 3,
+			{Name: "a", Version: "1.0.0", Day: "2020-01-03"}: 1,
+		})
+
+		expected := map[string]map[string]int{"2020-01-02": {"1.0.0": 1, "2.0.0": 3}, "2020-01-03": {"1.0.0": 1}}
+		if days := pb.GetDownloads("a", "2020-01-02", "2020-01-03"); !reflect.DeepEqual(days, expected) {
+			t.Errorf("TestDownloads: expected %v actual %v", expected, days)
+		}
+		if totals := pb.GetTotalDownloads("2020-01-02", "2020-01-02"); totals["2020-01-02"] != 5 || len(totals) != 1 {
+			t.Errorf("TestDownloads: unexpected totals %v", totals)
+		}
+
+		report := pb.GetDownloadReport("2020-01-02", "2020-01-03", 1, true)
+		if report.Downloads != 6 || len(report.Top) != 1 || report.Top[0].Name != "a" || report.Top[0].Downloads != 5 ||
+			report.Unused != 1 || !reflect.DeepEqual(report.UnusedPackages, []string{"unused"}) {
+			t.Errorf("TestDownloads: unexpected report %+v", report)
+		}
+	})
+}
+
+func TestParseDownloadPeriod(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string][2]string{
+		"last-day":              {"2020-03-01", "2020-03-01"},
+		"last-week":             {"2020-02-24", "2020-03-01"},
+		"2020-01-01":            {"2020-01-01", "2020-01-01"},
+		"2020-01-01:2020-01-31": {"2020-01-01", "2020-01-31"},
+	}
+	for period, expected := range cases {
+		start, end, err := ParseDownloadPeriod(period, now)
+		if err != nil || start != expected[0] || end != expected[1] {
+			t.Errorf("TestParseDownloadPeriod: %q expected %v actual %s %s %v", period, expected, start, end, err)
+		}
+	}
+
+	for _, period := range []string{"yesterday", "2020-01-31:2020-01-01", "2000-01-01:2020-01-01"} {
+		if _, _, err := ParseDownloadPeriod(period, now); err == nil {
+			t.Errorf("TestParseDownloadPeriod: %q expected an error", period)
+		}
 	}
+}
+
+// deletePackageRow removes only the revision of a package to leave orphan entries behind
+func deletePackageRow(pb *PocketBase, id string) bool {
+	switch store := pb.store.(type) {
+	case *boltStore:
+		store.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("Packages")).Delete([]byte(id))
+		})
+	case *badgerStore:
+		store.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(badgerKey("Packages", id))
+		})
+	default:
+		return false
+	}
+
+	return true
+}
 
-	pb.PutPackages(allDocs)
+func TestCheck(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		allDocs := []*BarePackage{
+			{ID: "Test", Revision: "Revision"},
+			{ID: "Test2", Revision: "Revision"},
+			{ID: "Test3", Revision: "Revision"},
+		}
+		pb.PutPackages(allDocs)
+		pb.PutCompleted(allDocs[0], `{"_id":"Test"}`, "Revision", nil, nil)
+		pb.PutCompleted(allDocs[2], `{"_id":"Test3"}`, "Revision", nil, nil)
 
-	doc := `{"_id":"Test","rev":"Revision"}`
+		// marked as completed without a document
+		tx := pb.store.AcquireTx()
+		pb.PutPackage(tx, "Test2", "Revision", true, true)
+		tx.Commit()
+
+		orphans := []string{}
+		if deletePackageRow(pb, "Test3") {
+			orphans = []string{"Test3"}
+		}
+
+		report, err := pb.Check(false)
+		if err != nil {
+			t.Fatalf("TestCheck: unexpected error %v", err)
+		}
+		expected := map[string]string{"Test2": "doc"}
+		if !reflect.DeepEqual(report.Inconsistent, expected) {
+			t.Errorf("TestCheck: expected %v actual %v", expected, report.Inconsistent)
+		}
+		if len(report.Orphans) != len(orphans) || (len(orphans) > 0 && report.Orphans[0] != orphans[0]) {
+			t.Errorf("TestCheck: expected orphans %v actual %v", orphans, report.Orphans)
+		}
+		if pb.store.GetCountOfMarks(MarkComplete) != 3 {
+			t.Errorf("TestCheck: database changed without fix")
+		}
+
+		if _, err := pb.Check(true); err != nil {
+			t.Fatalf("TestCheck: unexpected error %v", err)
+		}
+		report, _ = pb.Check(false)
+		if len(report.Inconsistent) != 0 || len(report.Orphans) != 0 {
+			t.Errorf("TestCheck: not fixed %+v", report)
+		}
+		incomplete := pb.GetIncompletePackages()
+		if len(incomplete) != 1 || incomplete[0].ID != "Test2" {
+			t.Errorf("TestCheck: expected Test2 to be incomplete, actual %v", incomplete)
+		}
+		if len(orphans) > 0 && pb.store.GetItemCount("Documents") != 1 {
+			t.Errorf("TestCheck: expected orphan document to be removed")
+		}
+	})
+}
+
+func TestCheckBatches(t *testing.T) {
+	forEachStore(t, true, func(t *testing.T, pb *PocketBase) {
+		// more inconsistent packages and orphans than fixed in a transaction
+		inconsistent := checkBatchSize + 1
+		tx := pb.store.AcquireTx()
+		for i := 0; i < inconsistent; i++ {
+			pb.PutPackage(tx, fmt.Sprintf("Test%d", i), "Revision", true, true)
+		}
+		tx.Commit()
+
+		var orphans []*BarePackage
+		switch pb.store.(type) {
+		case *boltStore, *badgerStore:
+			for i := 0; i < badgerFixBatchSize+1; i++ {
+				orphans = append(orphans, &BarePackage{ID: fmt.Sprintf("Orphan%d", i), Revision: "Revision"})
+			}
+			pb.PutPackages(orphans)
+			for _, pack := range orphans {
+				deletePackageRow(pb, pack.ID)
+			}
+		}
+
+		report, err := pb.Check(true)
+		if err != nil {
+			t.Fatalf("TestCheckBatches: unexpected error %v", err)
+		}
+		if len(report.Inconsistent) != inconsistent || len(report.Orphans) != len(orphans) {
+			t.Errorf("TestCheckBatches: unexpected report %d %d", len(report.Inconsistent), len(report.Orphans))
+		}
+		report, _ = pb.Check(false)
+		if len(report.Inconsistent) != 0 || len(report.Orphans) != 0 {
+			t.Errorf("TestCheckBatches: not fixed %d %d", len(report.Inconsistent), len(report.Orphans))
+		}
+		if count := len(pb.GetIncompletePackages()); count != inconsistent {
+			t.Errorf("TestCheckBatches: expected %d incomplete packages actual %d", inconsistent, count)
+		}
+		if err := pb.store.Recount(); err != nil {
+			t.Errorf("TestCheckBatches: unexpected error %v", err)
+		}
+		if count := pb.store.GetItemCount("Marks"); count != inconsistent {
+			t.Errorf("TestCheckBatches: expected %d marks actual %d", inconsistent, count)
+		}
+	})
+}
+
+// benchmarkDocument returns a document about the size of a popular package
+func benchmarkDocument() string {
+	return `{"_id":"Test","description":"` + strings.Repeat("x", 512*1024) + `"}`
+}
+
+func BenchmarkPutCompleted(b *testing.B) {
+	doc := benchmarkDocument()
 	files := []*url.URL{
 		{
 			Scheme: "http",
@@ -145,28 +880,72 @@ func TestPutCompletedPackage(t *testing.T) {
 			Path:   "test/-/test-0.0.1.tgz",
 		},
 	}
-	pb.PutCompleted(allDocs[0], doc, "Revision", files)
 
-	count := pb.GetCountOfMarks(true)
-	if count != 1 {
-		t.Errorf("TestPutCompletedPackage: expected count 1 actual %d", count)
-	}
+	for _, storeType := range []string{"bolt", "badger"} {
+		b.Run(storeType, func(b *testing.B) {
+			pb := testbase(storeType, true)
+			defer pb.Close()
 
-	actualDoc, actualFiles, err := pb.GetDocument("Test", true)
-	if err != nil {
-		t.Errorf("TestPutCompletedPackage: unexpected error %v", err)
+			allDocs := make([]*BarePackage, b.N)
+			for i := range allDocs {
+				allDocs[i] = &BarePackage{ID: "Test" + strconv.Itoa(i), Revision: "Revision"}
+			}
+			pb.PutPackages(allDocs)
+
+			b.SetBytes(int64(len(doc)))
+			b.ResetTimer()
+			for _, pack := range allDocs {
+				if !pb.PutCompleted(pack, doc, "Revision", files, nil) {
+					b.Fatal("BenchmarkPutCompleted: failed to put")
+				}
+			}
+		})
 	}
-	if actualDoc != doc {
-		t.Errorf("TestPutCompletedPackage: expected doc %s actual %s", doc, actualDoc)
+}
+
+func BenchmarkGetDocument(b *testing.B) {
+	doc := benchmarkDocument()
+	const count = 100
+
+	for _, storeType := range []string{"bolt", "badger"} {
+		b.Run(storeType, func(b *testing.B) {
+			pb := testbase(storeType, true)
+			defer pb.Close()
+
+			allDocs := make([]*BarePackage, count)
+			for i := range allDocs {
+				allDocs[i] = &BarePackage{ID: "Test" + strconv.Itoa(i), Revision: "Revision"}
+			}
+			pb.PutPackages(allDocs)
+			for _, pack := range allDocs {
+				pb.PutCompleted(pack, doc, "Revision", nil, nil)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// bypass the in-memory cache to measure the store
+				if _, _, err := pb.store.GetDocument(allDocs[i%count].ID, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
-	if fmt.Sprintf("%v", actualFiles) != fmt.Sprintf("%v", files) {
-		t.Errorf("TestPutCompletedPackage: expected files %q actual %q", files, actualFiles)
+}
+
+// forEachStore runs the test against a new database of every store type
+func forEachStore(t *testing.T, init bool, fn func(t *testing.T, pb *PocketBase)) {
+	for _, storeType := range []string{"bolt", "badger", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			pb := testbase(storeType, init)
+			defer pb.Close()
+			fn(t, pb)
+		})
 	}
 }
 
-func testbase(init bool) *PocketBase {
-	conf := config()
-	pb := NewPocketBase(conf, false)
+func testbase(storeType string, init bool) *PocketBase {
+	conf := config(storeType)
+	pb := NewPocketBase(conf)
 	if init {
 		pb.Init()
 	}
@@ -174,9 +953,10 @@ func testbase(init bool) *PocketBase {
 }
 
 // config returns a config set for tests
-func config() *DatabaseConfig {
+func config(storeType string) *DatabaseConfig {
 	temp := tempfile()
 	return &DatabaseConfig{
+		Type:          storeType,
 		Path:          temp,
 		MaxCacheSize:  1024,
 		CacheLifetime: 60,
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// GetDistTags method returns local dist-tag overrides of the package
+//
+// An empty version means that the tag has been removed locally.
+func (pb *PocketBase) GetDistTags(name string) (tags map[string]string) {
+	dec := pb.getCacheDecoder(distTagsCacheKey(name))
+	if dec != nil {
+		decerr := dec.Decode(&tags)
+		if decerr == nil {
+			return
+		}
+	}
+
+	tags = pb.readDistTags(name)
+	pb.setCache(distTagsCacheKey(name), tags)
+	return
+}
+
+// SetDistTag method overrides a dist-tag of the package
+func (pb *PocketBase) SetDistTag(name string, tag string, version string) error {
+	defer pb.distTagsMu.lock(name)()
+	defer pb.delCache(distTagsCacheKey(name))
+
+	tags := pb.readDistTags(name)
+	tags[tag] = version
+
+	return pb.putDistTags(name, tags)
+}
+
+// DeleteDistTag method removes the local override of a dist-tag
+//
+// If hide is true, the tag is kept as removed so that the upstream value is hidden as well.
+func (pb *PocketBase) DeleteDistTag(name string, tag string, hide bool) error {
+	defer pb.distTagsMu.lock(name)()
+	defer pb.delCache(distTagsCacheKey(name))
+
+	tags := pb.readDistTags(name)
+	if hide {
+		tags[tag] = ""
+	} else {
+		delete(tags, tag)
+	}
+
+	return pb.putDistTags(name, tags)
+}
+
+// readDistTags returns the overrides from the store, since the cache may be
+// filled by a reader with the overrides before a concurrent update
+func (pb *PocketBase) readDistTags(name string) map[string]string {
+	tags := map[string]string{}
+	if raw := pb.store.GetEntry("DistTags", name); raw != nil {
+		if err := json.Unmarshal(raw, &tags); err != nil {
+			dbLog.Warnf("Failed to decode dist-tags: %s %v", name, err)
+		}
+	}
+
+	return tags
+}
+
+func (pb *PocketBase) putDistTags(name string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return pb.store.DeleteEntry("DistTags", name)
+	}
+
+	raw, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	return pb.store.PutEntry("DistTags", name, raw)
+}
+
+// keyedMutex serializes operations per key, such as updates of a package
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the key and returns the function unlocking it
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.waiters++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		m.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
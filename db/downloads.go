@@ -0,0 +1,231 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DayFormat is the format of the days downloads are counted by
+const DayFormat = "2006-01-02"
+
+// maxDownloadDays limits the days of a period like the npm downloads api (18 months)
+const maxDownloadDays = 549
+
+// DownloadKey identifies the downloads of a version on a day
+type DownloadKey struct {
+	Name    string
+	Version string
+	Day     string
+}
+
+// PackageDownloads is the number of downloads of a package
+type PackageDownloads struct {
+	Name      string `json:"package"`
+	Downloads int    `json:"downloads"`
+}
+
+// DownloadReport summarizes the downloads of a period for retention decisions
+type DownloadReport struct {
+	Start     string              `json:"start"`
+	End       string              `json:"end"`
+	Downloads int                 `json:"downloads"`
+	Top       []*PackageDownloads `json:"top"`
+	// Unused is the number of mirrored packages never downloaded in the period
+	Unused         int      `json:"unused"`
+	UnusedPackages []string `json:"unused_packages,omitempty"`
+}
+
+// ParseDownloadPeriod parses a period of the npm downloads api ("last-day",
+// "last-week", "last-month", "last-year", "2006-01-02" or
+// "2006-01-02:2006-01-31") into its first and last days
+//
+// Unlike npm, whose counts lag by a day, the periods end today.
+func ParseDownloadPeriod(period string, now time.Time) (start string, end string, err error) {
+	today := now.UTC()
+	days := map[string]int{"last-day": 1, "last-week": 7, "last-month": 30, "last-year": 365}
+	if n, ok := days[period]; ok {
+		return today.AddDate(0, 0, 1-n).Format(DayFormat), today.Format(DayFormat), nil
+	}
+
+	parts := strings.SplitN(period, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	first, err := time.Parse(DayFormat, parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid period: %s", period)
+	}
+	last, err := time.Parse(DayFormat, parts[1])
+	if err != nil || last.Before(first) {
+		return "", "", fmt.Errorf("Invalid period: %s", period)
+	}
+	if last.Sub(first) >= maxDownloadDays*24*time.Hour {
+		return "", "", fmt.Errorf("Period is longer than %d days: %s", maxDownloadDays, period)
+	}
+
+	return first.Format(DayFormat), last.Format(DayFormat), nil
+}
+
+// downloadsKey returns the key of the downloads of a package on a day
+//
+// Every version downloaded on the day is counted in the value so that a
+// period of a package is read by a prefix scan of "name@".
+func downloadsKey(name string, day string) string {
+	return name + "@" + day
+}
+
+// splitDownloadsKey returns the name and the day of a downloads key
+func splitDownloadsKey(key string) (name string, day string) {
+	i := strings.LastIndex(key, "@")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// decodeDownloads decodes the downloads of versions on a day
+func decodeDownloads(key string, raw []byte) map[string]int {
+	versions := map[string]int{}
+	if raw != nil {
+		if err := json.Unmarshal(raw, &versions); err != nil {
+			dbLog.Warnf("Failed to decode downloads: %s %v", key, err)
+		}
+	}
+	return versions
+}
+
+// AddDownloads method adds the counts to the downloads stored
+//
+// Counts are added to the stored ones, so they must be taken once from
+// memory; processes sharing a store may lose counts flushed at the same time.
+func (pb *PocketBase) AddDownloads(counts map[DownloadKey]int) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	pb.downloadMu.Lock()
+	defer pb.downloadMu.Unlock()
+
+	days := map[string]map[string]int{}
+	totals := map[string]int{}
+	for key, count := range counts {
+		id := downloadsKey(key.Name, key.Day)
+		if days[id] == nil {
+			days[id] = decodeDownloads(id, pb.store.GetEntry("Downloads", id))
+		}
+		days[id][key.Version] += count
+		totals[key.Day] += count
+	}
+
+	writes := make([]EntryWrite, 0, len(days)+len(totals))
+	for id, versions := range days {
+		raw, err := json.Marshal(versions)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, EntryWrite{Bucket: "Downloads", Key: id, Value: raw})
+	}
+	for day, count := range totals {
+		var total int
+		json.Unmarshal(pb.store.GetEntry("DownloadTotals", day), &total)
+		raw, _ := json.Marshal(total + count)
+		writes = append(writes, EntryWrite{Bucket: "DownloadTotals", Key: day, Value: raw})
+	}
+
+	return pb.store.WriteEntries(writes)
+}
+
+// GetDownloads method returns the downloads of versions of a package by day
+// between the first and the last day
+func (pb *PocketBase) GetDownloads(name string, start string, end string) map[string]map[string]int {
+	days := map[string]map[string]int{}
+	pb.store.ForEachEntry("Downloads", name+"@", func(key string, raw []byte) bool {
+		_, day := splitDownloadsKey(key)
+		if day > end {
+			return false
+		}
+		if day >= start {
+			days[day] = decodeDownloads(key, raw)
+		}
+		return true
+	})
+
+	return days
+}
+
+// GetTotalDownloads method returns the downloads of all packages by day
+// between the first and the last day
+func (pb *PocketBase) GetTotalDownloads(start string, end string) map[string]int {
+	totals := map[string]int{}
+	pb.store.ForEachEntry("DownloadTotals", "", func(day string, raw []byte) bool {
+		if day < start || day > end {
+			return true
+		}
+
+		var total int
+		json.Unmarshal(raw, &total)
+		totals[day] = total
+		return true
+	})
+
+	return totals
+}
+
+// SumDownloads method returns the downloads of every package downloaded
+// between the first and the last day
+func (pb *PocketBase) SumDownloads(start string, end string) map[string]int {
+	sums := map[string]int{}
+	pb.store.ForEachEntry("Downloads", "", func(key string, raw []byte) bool {
+		name, day := splitDownloadsKey(key)
+		if day < start || day > end {
+			return true
+		}
+
+		for _, count := range decodeDownloads(key, raw) {
+			sums[name] += count
+		}
+		return true
+	})
+
+	return sums
+}
+
+// GetDownloadReport method returns the most downloaded packages of the
+// period and the mirrored packages never downloaded in the period
+//
+// The names of unused packages are listed only if listUnused is set since
+// most of a full mirror is never downloaded.
+func (pb *PocketBase) GetDownloadReport(start string, end string, top int, listUnused bool) *DownloadReport {
+	report := &DownloadReport{Start: start, End: end, Top: []*PackageDownloads{}}
+	sums := pb.SumDownloads(start, end)
+	for name, count := range sums {
+		report.Downloads += count
+		report.Top = append(report.Top, &PackageDownloads{Name: name, Downloads: count})
+	}
+	sort.Slice(report.Top, func(i, j int) bool {
+		if report.Top[i].Downloads != report.Top[j].Downloads {
+			return report.Top[i].Downloads > report.Top[j].Downloads
+		}
+		return report.Top[i].Name < report.Top[j].Name
+	})
+	if top > 0 && len(report.Top) > top {
+		report.Top = report.Top[:top]
+	}
+
+	pb.store.ForEachPackage("", func(pack *PackageRecord) bool {
+		if pack.Document == "" || sums[pack.ID] > 0 {
+			return true
+		}
+
+		report.Unused++
+		if listUnused {
+			report.UnusedPackages = append(report.UnusedPackages, pack.ID)
+		}
+		return true
+	})
+
+	return report
+}
@@ -2,15 +2,14 @@ package db
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/jinzhu/gorm"
-	"github.com/ssut/pocketnpm/log"
 
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -26,12 +25,20 @@ type gormGlobal struct {
 	Value string
 }
 
+// gormPackage stores documents and file lists in binary columns (longblob
+// on MySQL, bytea on PostgreSQL) as they are compressed
 type gormPackage struct {
 	ID       string `gorm:"primary_key"`
 	Revision string
-	Document string `sql:"type:mediumtext"`
-	Marked   bool   `gorm:"index"`
-	Files    string `sql:"type:mediumtext"`
+	Document []byte
+	Marked   bool `gorm:"index"`
+	Files    []byte
+}
+
+type gormEntry struct {
+	Bucket string `gorm:"primary_key"`
+	Key    string `gorm:"primary_key"`
+	Value  []byte
 }
 
 type gormTx struct {
@@ -68,13 +75,73 @@ func (store *gormStore) Connect() error {
 	attributes := store.config.Path.([]interface{})
 	store.db, err = gorm.Open(attributes[0].(string), attributes[1].(string))
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		dbLog.Fatalf("Failed to connect to database: %v", err)
+		return err
+	}
+
+	// entries are created lazily so they have to exist for databases initialized before
+	err = store.db.AutoMigrate(&gormEntry{}).Error
+	if err != nil {
+		dbLog.Fatalf("Failed to execute auto migration: %v", err)
+		return err
+	}
+
+	err = store.migrateColumns()
+	if err != nil {
+		dbLog.Fatalf("Failed to migrate the columns of packages: %v", err)
 		return err
 	}
 
 	return nil
 }
 
+// migrateColumns changes the text columns of documents and file lists, which
+// truncated documents over 16 MB on MySQL, to binary columns
+//
+// The values are kept as they are and read by columnValue.
+func (store *gormStore) migrateColumns() error {
+	if !store.db.HasTable(&gormPackage{}) {
+		return nil
+	}
+
+	table := store.db.NewScope(&gormPackage{}).TableName()
+	var query, binary string
+	var alter func(column string) string
+	switch store.db.Dialect().GetName() {
+	case "mysql":
+		query = "SELECT data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+		binary = "longblob"
+		alter = func(column string) string {
+			return fmt.Sprintf("MODIFY %s LONGBLOB", column)
+		}
+	case "postgres":
+		query = "SELECT data_type FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = ? AND column_name = ?"
+		binary = "bytea"
+		alter = func(column string) string {
+			return fmt.Sprintf("ALTER COLUMN %s TYPE bytea USING convert_to(%s::text, 'UTF8')", column, column)
+		}
+	default:
+		return nil
+	}
+
+	var changes []string
+	for _, column := range []string{"document", "files"} {
+		var dataType string
+		if err := store.db.Raw(query, table, column).Row().Scan(&dataType); err != nil {
+			return err
+		}
+		if strings.ToLower(dataType) != binary {
+			changes = append(changes, alter(column))
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	dbLog.Infof("Changing the columns of %s to %s, which may take a while", table, binary)
+	return store.db.Exec(fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(changes, ", "))).Error
+}
+
 func (store *gormStore) Close() {
 	store.db.Close()
 }
@@ -83,14 +150,14 @@ func (store *gormStore) Init() {
 	hasGlobals := store.db.HasTable(&gormGlobal{})
 	err := store.db.AutoMigrate(&gormGlobal{}, &gormPackage{}).Error
 	if err != nil {
-		log.Fatalf("Failed to execute auto migration: %v", err)
+		dbLog.Fatalf("Failed to execute auto migration: %v", err)
 	}
 
 	if !hasGlobals {
 		sequence := gormGlobal{Key: "sequence", Value: "0"}
 		err = store.db.Create(&sequence).Error
 		if err != nil {
-			log.Fatalf("Failed to initialize: %v", err)
+			dbLog.Fatalf("Failed to initialize: %v", err)
 		}
 	}
 }
@@ -142,7 +209,7 @@ func (store *gormStore) GetCountOfMarks(cond string) (count int) {
 func (store *gormStore) GetIncompletePackages() (packages []*BarePackage) {
 	rows, err := store.db.Model(&gormPackage{}).Select("id, revision, marked").Where("marked = ?", false).Rows()
 	if err != nil {
-		log.Fatalf("Failed to get all incomplete packages: %v", err)
+		dbLog.Fatalf("Failed to get all incomplete packages: %v", err)
 		return
 	}
 
@@ -180,27 +247,36 @@ func (store *gormStore) GetDocument(id string, withfiles bool) (document string,
 		return
 	}
 
-	document = item.Document
-	if withfiles {
-		rawfiles, _ = base64.StdEncoding.DecodeString(item.Files)
+	if len(item.Document) == 0 && !item.Marked {
+		err = errors.New("Package has not been downloaded yet")
+		return
 	}
 
-	if document == "" && !item.Marked {
-		err = errors.New("Package has not been downloaded yet")
+	raw, err := decompressColumn(item.Document)
+	if err != nil {
 		return
 	}
+	document = string(raw)
+	if withfiles {
+		rawfiles, err = decompressColumn(item.Files)
+	}
 
 	return
 }
 
 func (store *gormStore) GetAllFiles() (all map[string][]*url.URL) {
+	all = map[string][]*url.URL{}
 	rows, _ := store.db.Where(&gormPackage{}).Rows()
 
 	for rows.Next() {
 		var item gormPackage
 		store.db.ScanRows(rows, &item)
 
-		files, _ := base64.StdEncoding.DecodeString(item.Files)
+		files, err := decompressColumn(item.Files)
+		if err != nil {
+			dbLog.Errorf("Failed to decompress files: %s %v", item.ID, err)
+			continue
+		}
 		var filelist []*url.URL
 		var buf bytes.Buffer
 		buf.Write(files)
@@ -255,8 +331,9 @@ func (store *gormStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 		return false
 	}
 
+	codec := store.config.compression()
 	item.Revision = rev
-	item.Document = document
+	item.Document = compressValue(codec, []byte(document))
 	item.Marked = true
 
 	// encode files
@@ -266,9 +343,7 @@ func (store *gormStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 	if err != nil {
 		return false
 	}
-	files := base64.StdEncoding.EncodeToString(buf.Bytes())
-
-	item.Files = files
+	item.Files = compressValue(codec, buf.Bytes())
 
 	err = tx.Save(&item).Error
 	if err != nil {
@@ -277,3 +352,175 @@ func (store *gormStore) PutCompleted(tr transactionable, pack *BarePackage, docu
 
 	return true
 }
+
+func (store *gormStore) GetEntry(bucket string, key string) []byte {
+	var item gormEntry
+	notFound := store.db.Where(&gormEntry{Bucket: bucket, Key: key}).First(&item).RecordNotFound()
+	if notFound {
+		return nil
+	}
+
+	return item.Value
+}
+
+func (store *gormStore) PutEntry(bucket string, key string, value []byte) error {
+	item := gormEntry{Bucket: bucket, Key: key, Value: value}
+	return store.db.Save(&item).Error
+}
+
+func (store *gormStore) DeleteEntry(bucket string, key string) error {
+	return store.db.Delete(&gormEntry{Bucket: bucket, Key: key}).Error
+}
+
+func (store *gormStore) ForEachEntry(bucket string, prefix string, fn func(string, []byte) bool) {
+	column := store.db.Dialect().Quote("key")
+	rows, err := store.db.Model(&gormEntry{}).Where("bucket = ? AND "+column+" LIKE ? ESCAPE '!'", bucket, likePrefix(prefix)).Order(column).Rows()
+	if err != nil {
+		dbLog.Errorf("Failed to iterate entries: %s %v", bucket, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item gormEntry
+		store.db.ScanRows(rows, &item)
+		// LIKE is case-insensitive in some databases
+		if !strings.HasPrefix(item.Key, prefix) {
+			continue
+		}
+		if !fn(item.Key, item.Value) {
+			break
+		}
+	}
+}
+
+func (store *gormStore) ForEachEntryAfter(bucket string, after string, fn func(string, []byte) bool) {
+	column := store.db.Dialect().Quote("key")
+	rows, err := store.db.Model(&gormEntry{}).Where("bucket = ? AND "+column+" > ?", bucket, after).Order(column).Rows()
+	if err != nil {
+		dbLog.Errorf("Failed to iterate entries: %s %v", bucket, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item gormEntry
+		store.db.ScanRows(rows, &item)
+		if !fn(item.Key, item.Value) {
+			break
+		}
+	}
+}
+
+func (store *gormStore) WriteEntries(writes []EntryWrite) error {
+	tx := store.AcquireTx()
+	if err := store.PutEntries(tx, writes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *gormStore) PutEntries(tr transactionable, writes []EntryWrite) error {
+	tx := tr.(*gormTx).Tx
+	for _, write := range writes {
+		item := &gormEntry{Bucket: write.Bucket, Key: write.Key, Value: write.Value}
+
+		var err error
+		if write.Value == nil {
+			err = tx.Delete(item).Error
+		} else {
+			err = tx.Save(item).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Orphans returns nothing since documents and files are stored in the rows of packages
+func (store *gormStore) Orphans(remove bool) ([]string, error) {
+	return nil, nil
+}
+
+// Recount does nothing since counts are queried from the tables
+func (store *gormStore) Recount() error {
+	return nil
+}
+
+// likePrefix returns a LIKE pattern matching values beginning with the prefix
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
+func (store *gormStore) ReplaceEntries(bucket string, prefix string, entries map[string][]byte) error {
+	tx := store.db.Begin()
+	defer tx.Rollback()
+
+	// LIKE is case-insensitive in some databases so keys are compared here
+	column := store.db.Dialect().Quote("key")
+	var stale []string
+	var items []gormEntry
+	err := tx.Select(column).Where("bucket = ? AND "+column+" LIKE ? ESCAPE '!'", bucket, likePrefix(prefix)).Find(&items).Error
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, ok := entries[item.Key]; !ok && strings.HasPrefix(item.Key, prefix) {
+			stale = append(stale, item.Key)
+		}
+	}
+	if len(stale) > 0 {
+		if err := tx.Where("bucket = ? AND "+column+" IN (?)", bucket, stale).Delete(&gormEntry{}).Error; err != nil {
+			return err
+		}
+	}
+
+	for key, value := range entries {
+		item := gormEntry{Bucket: bucket, Key: key, Value: value}
+		if err := tx.Save(&item).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+func (store *gormStore) ForEachPackage(after string, fn func(*PackageRecord) bool) {
+	rows, err := store.db.Model(&gormPackage{}).Where("id > ?", after).Order("id").Rows()
+	if err != nil {
+		dbLog.Errorf("Failed to iterate packages: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item gormPackage
+		store.db.ScanRows(rows, &item)
+
+		document, err := decompressColumn(item.Document)
+		if err != nil {
+			dbLog.Errorf("Failed to decompress document: %s %v", item.ID, err)
+		}
+		files, err := decompressColumn(item.Files)
+		if err != nil {
+			dbLog.Errorf("Failed to decompress files: %s %v", item.ID, err)
+		}
+
+		pack := &PackageRecord{
+			ID:         item.ID,
+			Revision:   item.Revision,
+			Marked:     item.Marked,
+			Document:   string(document),
+			Files:      files,
+			Codec:      valueCodec(columnValue(item.Document)),
+			StoredSize: len(item.Document) + len(item.Files),
+		}
+		if !fn(pack) {
+			break
+		}
+	}
+}
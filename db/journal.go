@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Actions of journal entries
+const (
+	JournalMirrored = "mirrored"
+	JournalUpdated  = "updated"
+	JournalDeleted  = "deleted"
+)
+
+// JournalEntry records a package mirrored, updated or deleted
+//
+// Unlike the change log, the journal is never compacted. Upstream is the
+// sequence of the upstream registry when the entry was written, so it is
+// approximate: the change itself may have an earlier sequence.
+type JournalEntry struct {
+	Sequence    int       `json:"seq"`
+	Upstream    int       `json:"upstream_seq"`
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	ID          string    `json:"id"`
+	OldRevision string    `json:"old_rev,omitempty"`
+	NewRevision string    `json:"new_rev,omitempty"`
+	Added       []string  `json:"added,omitempty"`
+	Removed     []string  `json:"removed,omitempty"`
+}
+
+// JournalQuery selects journal entries after a sequence or since a time
+type JournalQuery struct {
+	Since int
+	After time.Time
+	Limit int
+}
+
+// ParseJournalSince parses a sequence ("1234"), a duration before now ("24h")
+// or a time ("2006-01-02" or RFC 3339) into a query
+func ParseJournalSince(value string, now time.Time) (*JournalQuery, error) {
+	query := &JournalQuery{}
+	if value == "" {
+		return query, nil
+	}
+
+	if seq, err := strconv.Atoi(value); err == nil {
+		query.Since = seq
+	} else if d, err := time.ParseDuration(value); err == nil {
+		query.After = now.Add(-d)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		query.After = t
+	} else if t, err := time.ParseInLocation("2006-01-02", value, now.Location()); err == nil {
+		query.After = t
+	} else {
+		return nil, fmt.Errorf("Invalid since: %s (expected a sequence, a duration or a time)", value)
+	}
+
+	return query, nil
+}
+
+// diffVersions returns the versions added and removed between the lists
+func diffVersions(old []*VersionInfo, new []*VersionInfo) (added []string, removed []string) {
+	versions := map[string]bool{}
+	for _, info := range old {
+		versions[info.Version] = true
+	}
+	for _, info := range new {
+		if !versions[info.Version] {
+			added = append(added, info.Version)
+		}
+		delete(versions, info.Version)
+	}
+	for version := range versions {
+		removed = append(removed, version)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return
+}
+
+// GetJournalSequence method returns the sequence of the last journal entry
+func (pb *PocketBase) GetJournalSequence() int {
+	seq, _ := strconv.Atoi(string(pb.store.GetEntry("Globals", "journal")))
+	return seq
+}
+
+// journalWrites returns the writes appending the entry to the journal
+func (pb *PocketBase) journalWrites(entry *JournalEntry) []EntryWrite {
+	entry.Sequence = pb.GetJournalSequence() + 1
+	entry.Upstream = pb.store.GetSequence()
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	raw, _ := json.Marshal(entry)
+	return []EntryWrite{
+		{Bucket: "Journal", Key: changeKey(entry.Sequence), Value: raw},
+		{Bucket: "Globals", Key: "journal", Value: []byte(strconv.Itoa(entry.Sequence))},
+	}
+}
+
+// journalEntry returns the journal entry of the sequence, or nil if it can not be read
+func (pb *PocketBase) journalEntry(seq int) *JournalEntry {
+	var entry JournalEntry
+	if err := json.Unmarshal(pb.store.GetEntry("Journal", changeKey(seq)), &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// journalStart returns the sequence after which the entries selected by the query start
+//
+// Entries are appended in time order, so the first entry since the time is
+// found with a binary search instead of scanning the journal from the start.
+func (pb *PocketBase) journalStart(query *JournalQuery) int {
+	if query.After.IsZero() {
+		return query.Since
+	}
+
+	count := pb.GetJournalSequence() - query.Since
+	if count <= 0 {
+		return query.Since
+	}
+	return query.Since + sort.Search(count, func(i int) bool {
+		entry := pb.journalEntry(query.Since + 1 + i)
+		return entry == nil || !entry.Time.Before(query.After)
+	})
+}
+
+// QueryJournal method calls fn with the journal entries selected by the query in order
+func (pb *PocketBase) QueryJournal(query *JournalQuery, fn func(*JournalEntry) bool) {
+	count := 0
+	pb.store.ForEachEntryAfter("Journal", changeKey(pb.journalStart(query)), func(key string, raw []byte) bool {
+		var entry JournalEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			dbLog.Warnf("Failed to decode a journal entry: %s %v", key, err)
+			return true
+		}
+		if entry.Time.Before(query.After) {
+			return true
+		}
+
+		count++
+		return fn(&entry) && (query.Limit <= 0 || count < query.Limit)
+	})
+}
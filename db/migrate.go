@@ -0,0 +1,363 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	pbar "gopkg.in/cheggaaa/pb.v1"
+)
+
+// entryBuckets lists the buckets of entries, which are copied by Migrate
+var entryBuckets = []string{"Advisories", "DistTags", "Reviews", "Blocklist", "Versions", "Blobs", "Changes", "ChangeIndex", "Journal", "Webhooks", "Deliveries", "Downloads", "DownloadTotals"}
+
+// migrationState is stored in the destination after every batch so that
+// an interrupted migration can be resumed
+type migrationState struct {
+	Source   string `json:"source"`
+	Last     string `json:"last"`
+	Copied   int    `json:"copied"`
+	Checksum string `json:"checksum"`
+	// Entries holds the progress of each bucket of entries
+	Entries map[string]*entryState `json:"entries,omitempty"`
+	Done    bool                   `json:"done"`
+}
+
+// entryState is the progress of copying a bucket of entries
+type entryState struct {
+	Last     string `json:"last"`
+	Copied   int    `json:"copied"`
+	Checksum string `json:"checksum"`
+	Done     bool   `json:"done"`
+}
+
+// migrationGlobals lists the counters and markers of the Globals bucket copied by Migrate
+var migrationGlobals = []string{"changes", "journal", "deliveries", "versions"}
+
+// ParseStoreSpec parses a store given as "type:path" such as "bolt:npm.db"
+// or "gorm:mysql:user:password@tcp(host:port)/dbname"
+func ParseStoreSpec(spec string) (*DatabaseConfig, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid store: %s (expected type:path)", spec)
+	}
+
+	config := &DatabaseConfig{Type: parts[0]}
+	switch config.Type {
+	case "bolt", "badger", "sqlite":
+		config.Path, _ = filepath.Abs(parts[1])
+	case "gorm":
+		attributes := strings.SplitN(parts[1], ":", 2)
+		if len(attributes) != 2 {
+			return nil, fmt.Errorf("Invalid store: %s (expected gorm:dialect:dsn)", spec)
+		}
+		config.Path = []interface{}{attributes[0], attributes[1]}
+	default:
+		return nil, fmt.Errorf("Unknown database type: %s", config.Type)
+	}
+
+	return config, nil
+}
+
+// recordChecksum returns a checksum of the package which does not depend on how the store encodes it
+func recordChecksum(pack *PackageRecord) []byte {
+	var files []*url.URL
+	if len(pack.Files) > 0 {
+		gob.NewDecoder(bytes.NewReader(pack.Files)).Decode(&files)
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%t\x00%s\x00", pack.ID, pack.Revision, pack.Marked, pack.Document)
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\x00", file.String())
+	}
+
+	return h.Sum(nil)
+}
+
+// xorChecksum adds the checksum of a package to the checksum of all packages copied so far
+func xorChecksum(sum []byte, checksum []byte) []byte {
+	if sum == nil {
+		sum = make([]byte, sha1.Size)
+	}
+	for i := range sum {
+		sum[i] ^= checksum[i]
+	}
+
+	return sum
+}
+
+// putRecord writes the package to the store as it is
+func putRecord(store PocketStore, tx transactionable, pack *PackageRecord) error {
+	if pack.Document == "" {
+		return store.PutPackage(tx, pack.ID, pack.Revision, pack.Marked, true)
+	}
+
+	if err := store.PutPackage(tx, pack.ID, pack.Revision, false, true); err != nil {
+		return err
+	}
+
+	var files []*url.URL
+	if len(pack.Files) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(pack.Files)).Decode(&files); err != nil {
+			return fmt.Errorf("Failed to decode files: %s %v", pack.ID, err)
+		}
+	}
+	bare := &BarePackage{ID: pack.ID, Revision: pack.Revision}
+	if !store.PutCompleted(tx, bare, pack.Document, pack.Revision, files) {
+		return fmt.Errorf("Failed to put document: %s", pack.ID)
+	}
+
+	// PutCompleted always marks the package as completed
+	if !pack.Marked {
+		return store.PutPackage(tx, pack.ID, pack.Revision, false, true)
+	}
+
+	return nil
+}
+
+// entryChecksum returns a checksum of an entry
+func entryChecksum(key string, value []byte) []byte {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00", key)
+	h.Write(value)
+
+	return h.Sum(nil)
+}
+
+// verifyEntries compares the checksums of the copied entries with the entries in the destination
+func verifyEntries(store PocketStore, bucket string, after string, checksums map[string][]byte) error {
+	remaining := len(checksums)
+	store.ForEachEntryAfter(bucket, after, func(key string, value []byte) bool {
+		expected, ok := checksums[key]
+		if !ok {
+			return true
+		}
+		if bytes.Equal(expected, entryChecksum(key, value)) {
+			delete(checksums, key)
+		}
+		remaining--
+		return remaining > 0
+	})
+
+	for key := range checksums {
+		return fmt.Errorf("Checksum mismatch: %s/%s", bucket, key)
+	}
+
+	return nil
+}
+
+// saveMigration stores the state of a migration in the destination
+func saveMigration(dst PocketStore, state *migrationState) error {
+	raw, _ := json.Marshal(state)
+	return dst.PutEntry("Migration", "state", raw)
+}
+
+// migrateEntries copies a bucket of entries in batches like the packages
+func migrateEntries(src PocketStore, dst PocketStore, bucket string, batchSize int, state *migrationState) error {
+	progress := state.Entries[bucket]
+	if progress == nil {
+		progress = &entryState{}
+		state.Entries[bucket] = progress
+	}
+	if progress.Done {
+		return nil
+	}
+	if progress.Copied > 0 {
+		dbLog.Infof("Resuming %s after %s (%d entries copied)", bucket, progress.Last, progress.Copied)
+	}
+
+	sum, _ := hex.DecodeString(progress.Checksum)
+	if len(sum) != sha1.Size {
+		sum = nil
+	}
+
+	bar := pbar.New(0)
+	bar.Prefix(bucket + " ")
+	bar.Start()
+	bar.Set(progress.Copied)
+	defer bar.Finish()
+
+	for {
+		var writes []EntryWrite
+		src.ForEachEntryAfter(bucket, progress.Last, func(key string, value []byte) bool {
+			writes = append(writes, EntryWrite{Bucket: bucket, Key: key, Value: value})
+			return len(writes) < batchSize
+		})
+		if len(writes) == 0 {
+			break
+		}
+
+		if err := dst.WriteEntries(writes); err != nil {
+			return fmt.Errorf("Failed to copy entries of %s after %s: %v", bucket, progress.Last, err)
+		}
+
+		checksums := make(map[string][]byte, len(writes))
+		for _, write := range writes {
+			checksums[write.Key] = entryChecksum(write.Key, write.Value)
+			sum = xorChecksum(sum, checksums[write.Key])
+		}
+		if err := verifyEntries(dst, bucket, progress.Last, checksums); err != nil {
+			return err
+		}
+
+		progress.Last = writes[len(writes)-1].Key
+		progress.Copied += len(writes)
+		progress.Checksum = hex.EncodeToString(sum)
+		if err := saveMigration(dst, state); err != nil {
+			return err
+		}
+
+		bar.Add(len(writes))
+	}
+
+	progress.Done = true
+	if err := saveMigration(dst, state); err != nil {
+		return err
+	}
+
+	dbLog.Infof("Copied %d entries of %s (checksum %s)", progress.Copied, bucket, progress.Checksum)
+	return nil
+}
+
+// verifyBatch compares the checksums of the copied packages with the packages in the destination
+func verifyBatch(store PocketStore, after string, checksums map[string][]byte) error {
+	remaining := len(checksums)
+	store.ForEachPackage(after, func(pack *PackageRecord) bool {
+		expected, ok := checksums[pack.ID]
+		if !ok {
+			return true
+		}
+		if bytes.Equal(expected, recordChecksum(pack)) {
+			delete(checksums, pack.ID)
+		}
+		remaining--
+		return remaining > 0
+	})
+
+	for id := range checksums {
+		return fmt.Errorf("Checksum mismatch: %s", id)
+	}
+
+	return nil
+}
+
+// Migrate copies packages, documents, marks, files, entries and globals
+// from one store to another in batches
+//
+// Every batch is verified with checksums. Unless restart is set, a migration
+// from the same source that stopped partway continues after the last batch.
+func Migrate(from *DatabaseConfig, to *DatabaseConfig, batchSize int, restart bool) error {
+	source := fmt.Sprintf("%s:%v", from.Type, from.Path)
+
+	src, err := openStore(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if !src.IsInitialized() {
+		return fmt.Errorf("Source database is not initialized: %s", source)
+	}
+
+	dst, err := openStore(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if !dst.IsInitialized() {
+		dst.Init()
+	}
+
+	var state migrationState
+	if raw := dst.GetEntry("Migration", "state"); raw != nil && !restart {
+		json.Unmarshal(raw, &state)
+	}
+	if state.Source != source || state.Done {
+		state = migrationState{Source: source}
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*entryState{}
+	}
+	if state.Copied > 0 {
+		dbLog.Infof("Resuming migration after %s (%d packages copied)", state.Last, state.Copied)
+	}
+
+	sum, _ := hex.DecodeString(state.Checksum)
+	if len(sum) != sha1.Size {
+		sum = nil
+	}
+
+	bar := pbar.StartNew(src.GetItemCount("Packages"))
+	bar.Set(state.Copied)
+
+	for {
+		var batch []*PackageRecord
+		src.ForEachPackage(state.Last, func(pack *PackageRecord) bool {
+			batch = append(batch, pack)
+			return len(batch) < batchSize
+		})
+		if len(batch) == 0 {
+			break
+		}
+
+		tx := dst.AcquireTx()
+		checksums := make(map[string][]byte, len(batch))
+		for _, pack := range batch {
+			if err := putRecord(dst, tx, pack); err != nil {
+				tx.Rollback()
+				return err
+			}
+			checksums[pack.ID] = recordChecksum(pack)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("Failed to commit a batch after %s: %v", state.Last, err)
+		}
+
+		for _, checksum := range checksums {
+			sum = xorChecksum(sum, checksum)
+		}
+		if err := verifyBatch(dst, state.Last, checksums); err != nil {
+			return err
+		}
+
+		state.Last = batch[len(batch)-1].ID
+		state.Copied += len(batch)
+		state.Checksum = hex.EncodeToString(sum)
+		if err := saveMigration(dst, &state); err != nil {
+			return err
+		}
+
+		bar.Add(len(batch))
+	}
+	bar.Finish()
+
+	for _, bucket := range entryBuckets {
+		if err := migrateEntries(src, dst, bucket, batchSize, &state); err != nil {
+			return err
+		}
+	}
+
+	// the sequence is copied last so that a partial copy is never taken for an up-to-date mirror
+	dst.SetSequence(src.GetSequence())
+	for _, key := range migrationGlobals {
+		if value := src.GetEntry("Globals", key); value != nil {
+			if err := dst.PutEntry("Globals", key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	state.Done = true
+	if err := saveMigration(dst, &state); err != nil {
+		return err
+	}
+
+	dbLog.Infof("Migrated %d packages (checksum %s)", state.Copied, state.Checksum)
+	return nil
+}
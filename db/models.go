@@ -1,18 +1,28 @@
 package db
 
-import "net/url"
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+)
 
 const (
 	MarkIncomplete = "0"
 	MarkComplete   = "1"
 )
 
+const (
+	ReviewApproved = "approved"
+	ReviewBlocked  = "blocked"
+)
+
 // DatabaseConfig defines config for database
 type DatabaseConfig struct {
 	Type          string      `toml:"type"`
 	Path          interface{} `toml:"path"`
 	MaxCacheSize  int         `toml:"max_cache_size"`
 	CacheLifetime int         `toml:"cache_lifetime"`
+	Compression   string      `toml:"compression"`
 }
 
 // DatabaseStats represents the count of each bucket
@@ -29,6 +39,93 @@ type BarePackage struct {
 	Revision string
 }
 
+// Advisory represents a security advisory affecting a package
+type Advisory struct {
+	ID                 string    `json:"id"`
+	CVEs               []string  `json:"cves"`
+	CWEs               []string  `json:"cwe"`
+	Title              string    `json:"title"`
+	Overview           string    `json:"overview"`
+	Severity           string    `json:"severity"`
+	URL                string    `json:"url"`
+	VulnerableVersions string    `json:"vulnerable_versions"`
+	PatchedVersions    string    `json:"patched_versions"`
+	Created            time.Time `json:"created"`
+	Updated            time.Time `json:"updated"`
+}
+
+// VersionReview represents an admin decision on a version held by the quarantine policy
+type VersionReview struct {
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason"`
+	Updated time.Time `json:"updated"`
+}
+
+// BlockEntry represents a blocked package or a blocked range of its versions
+type BlockEntry struct {
+	Name    string    `json:"name"`
+	Range   string    `json:"range"`
+	Reason  string    `json:"reason"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+// Webhook represents a subscription to changes of packages
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Patterns are globs of package names such as "@scope/*" (all packages if empty)
+	Patterns []string `json:"patterns,omitempty"`
+	// Events are the event types to deliver (all events if empty)
+	Events  []string  `json:"events,omitempty"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookDelivery represents an attempt to deliver an event to a webhook
+type WebhookDelivery struct {
+	ID         int       `json:"id"`
+	Webhook    string    `json:"webhook"`
+	Events     []string  `json:"events"`
+	Package    string    `json:"package"`
+	Journal    int       `json:"journal_seq"`
+	Time       time.Time `json:"time"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// VersionInfo represents a published version of a package
+type VersionInfo struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Published    time.Time         `json:"published"`
+	Shasum       string            `json:"shasum"`
+	Integrity    string            `json:"integrity,omitempty"`
+	Tarball      string            `json:"tarball"`
+	Size         int64             `json:"size"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+	Deprecated   bool              `json:"deprecated"`
+	// Tags contains the dist-tags pointing at the version upstream
+	Tags []string `json:"tags,omitempty"`
+	// Manifest is the manifest of the version in the document
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+}
+
+// PackageRecord represents everything stored for a package
+type PackageRecord struct {
+	ID       string
+	Revision string
+	Marked   bool
+	Document string
+	Files    []byte
+	// Codec is the compression of the stored document
+	Codec string
+	// StoredSize is the size of the document and the file list as stored
+	StoredSize int
+}
+
 type transactionable interface {
 	Commit() error
 	Rollback() error
@@ -52,6 +149,30 @@ type PocketStore interface {
 	PutPackage(transactionable, string, string, bool, bool) error
 	DeletePackage(string)
 	PutCompleted(transactionable, *BarePackage, string, string, []*url.URL) bool
+	GetEntry(string, string) []byte
+	PutEntry(string, string, []byte) error
+	DeleteEntry(string, string) error
+	ForEachEntry(string, string, func(string, []byte) bool)
+	ForEachEntryAfter(string, string, func(string, []byte) bool)
+	WriteEntries([]EntryWrite) error
+	PutEntries(transactionable, []EntryWrite) error
+	ReplaceEntries(string, string, map[string][]byte) error
+	ForEachPackage(string, func(*PackageRecord) bool)
+	Orphans(bool) ([]string, error)
+	Recount() error
+}
+
+// EntryWrite puts an entry, or deletes it if Value is nil
+type EntryWrite struct {
+	Bucket string
+	Key    string
+	Value  []byte
+}
+
+// bulkStore is implemented by stores that can write many packages faster
+// than a single transaction of PutPackage calls
+type bulkStore interface {
+	PutPackages([]*BarePackage) error
 }
 
 // StoreType represents the type for database store
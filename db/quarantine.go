@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// GetVersionReviews method returns admin decisions on versions of the package
+func (pb *PocketBase) GetVersionReviews(name string) (reviews map[string]*VersionReview) {
+	dec := pb.getCacheDecoder(reviewsCacheKey(name))
+	if dec != nil {
+		decerr := dec.Decode(&reviews)
+		if decerr == nil {
+			return
+		}
+	}
+
+	reviews = map[string]*VersionReview{}
+	if raw := pb.store.GetEntry("Reviews", name); raw != nil {
+		if err := json.Unmarshal(raw, &reviews); err != nil {
+			dbLog.Warnf("Failed to decode reviews: %s %v", name, err)
+		}
+	}
+
+	pb.setCache(reviewsCacheKey(name), reviews)
+	return
+}
+
+// SetVersionReview method approves or blocks a version of the package
+func (pb *PocketBase) SetVersionReview(name string, version string, status string, reason string) error {
+	defer pb.delCache(reviewsCacheKey(name))
+
+	reviews := pb.GetVersionReviews(name)
+	reviews[version] = &VersionReview{
+		Status:  status,
+		Reason:  reason,
+		Updated: time.Now().UTC(),
+	}
+
+	return pb.putVersionReviews(name, reviews)
+}
+
+// DeleteVersionReview method removes the decision on a version so the default policy applies again
+func (pb *PocketBase) DeleteVersionReview(name string, version string) error {
+	defer pb.delCache(reviewsCacheKey(name))
+
+	reviews := pb.GetVersionReviews(name)
+	delete(reviews, version)
+
+	return pb.putVersionReviews(name, reviews)
+}
+
+func (pb *PocketBase) putVersionReviews(name string, reviews map[string]*VersionReview) error {
+	if len(reviews) == 0 {
+		return pb.store.DeleteEntry("Reviews", name)
+	}
+
+	raw, err := json.Marshal(reviews)
+	if err != nil {
+		return err
+	}
+
+	return pb.store.PutEntry("Reviews", name, raw)
+}
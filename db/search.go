@@ -0,0 +1,67 @@
+package db
+
+import "strings"
+
+// searchBatchSize is the number of names collected from the change index at a time
+const searchBatchSize = 1000
+
+// SearchPackages method returns the names of mirrored packages containing the
+// text, the names starting with it first
+//
+// Names are taken from the change log, which has an entry per package that
+// has been mirrored or deleted, so that documents are not read.
+func (pb *PocketBase) SearchPackages(text string, limit int) []string {
+	text = strings.ToLower(text)
+	names := []string{}
+	found := map[string]bool{}
+	full := func() bool {
+		return limit > 0 && len(names) >= limit
+	}
+	add := func(name string) {
+		if !full() && !found[name] && pb.GetRevision(name) != "" {
+			found[name] = true
+			names = append(names, name)
+		}
+	}
+
+	// names are collected a batch at a time and their revisions are read
+	// after the iteration, which must not nest another transaction
+	scan := func(after string, match func(name string) (matched bool, more bool)) {
+		for !full() {
+			var batch []string
+			scanned, done := 0, false
+			pb.store.ForEachEntryAfter("ChangeIndex", after, func(name string, _ []byte) bool {
+				matched, more := match(name)
+				if !more {
+					done = true
+					return false
+				}
+				after = name
+				scanned++
+				if matched {
+					batch = append(batch, name)
+				}
+				return len(batch) < searchBatchSize
+			})
+			for _, name := range batch {
+				add(name)
+			}
+			if done || scanned == 0 {
+				return
+			}
+		}
+	}
+
+	if pb.store.GetEntry("ChangeIndex", text) != nil {
+		add(text)
+	}
+	scan(text, func(name string) (bool, bool) {
+		prefixed := strings.HasPrefix(name, text)
+		return prefixed, prefixed
+	})
+	scan("", func(name string) (bool, bool) {
+		return strings.Contains(name, text), true
+	})
+
+	return names
+}
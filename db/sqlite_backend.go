@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// sqliteStore shares the schema and queries of gormStore but manages
+// a local database file in WAL mode, so the mirror and several server
+// processes can use one file at the same time
+type sqliteStore struct {
+	*gormStore
+}
+
+func newSqliteStore(config *DatabaseConfig) PocketStore {
+	store := &sqliteStore{
+		gormStore: &gormStore{
+			config: config,
+		},
+	}
+
+	return store
+}
+
+func (store *sqliteStore) Connect() error {
+	var err error
+	// write transactions take the lock up front instead of failing to upgrade
+	// a read lock when another process is writing
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=10000&_txlock=immediate", store.config.Path.(string))
+	store.db, err = gorm.Open("sqlite3", dsn)
+	if err != nil {
+		dbLog.Fatalf("Failed to connect to database: %v", err)
+		return err
+	}
+
+	err = store.db.AutoMigrate(&gormEntry{}).Error
+	if err != nil {
+		dbLog.Fatalf("Failed to execute auto migration: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (store *sqliteStore) Init() {
+	store.gormStore.Init()
+
+	// covers GetIncompletePackages and GetCountOfMarks without reading documents
+	err := store.db.Exec("CREATE INDEX IF NOT EXISTS idx_gorm_packages_marked_revision ON gorm_packages (marked, id, revision)").Error
+	if err != nil {
+		dbLog.Fatalf("Failed to create index: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// versionKey returns the key of the version in the Versions bucket
+func versionKey(name string, version string) string {
+	return name + "@" + version
+}
+
+// parseVersions extracts the versions of a document
+//
+// sizes contains the size of each downloaded tarball by its url path.
+func parseVersions(name string, document string, sizes map[string]int64) ([]*VersionInfo, error) {
+	var doc struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+		DistTags map[string]string          `json:"dist-tags"`
+		Time     map[string]string          `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return nil, err
+	}
+
+	tags := map[string][]string{}
+	for tag, version := range doc.DistTags {
+		tags[version] = append(tags[version], tag)
+	}
+
+	versions := make([]*VersionInfo, 0, len(doc.Versions))
+	for version, raw := range doc.Versions {
+		var manifest struct {
+			Dist struct {
+				Shasum    string `json:"shasum"`
+				Integrity string `json:"integrity"`
+				Tarball   string `json:"tarball"`
+			} `json:"dist"`
+			Dependencies map[string]string `json:"dependencies"`
+			Deprecated   interface{}       `json:"deprecated"`
+		}
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return nil, err
+		}
+
+		info := &VersionInfo{
+			Name:         name,
+			Version:      version,
+			Shasum:       manifest.Dist.Shasum,
+			Integrity:    manifest.Dist.Integrity,
+			Dependencies: manifest.Dependencies,
+			Tags:         tags[version],
+			Manifest:     raw,
+		}
+		sort.Strings(info.Tags)
+		info.Published, _ = time.Parse(time.RFC3339, doc.Time[version])
+		if tarball, err := url.Parse(manifest.Dist.Tarball); err == nil {
+			info.Tarball = tarball.Path
+			info.Size = sizes[tarball.Path]
+		}
+
+		switch deprecated := manifest.Deprecated.(type) {
+		case string:
+			info.Deprecated = deprecated != ""
+		case bool:
+			info.Deprecated = deprecated
+		}
+
+		versions = append(versions, info)
+	}
+
+	return versions, nil
+}
+
+// versionWrites returns the writes replacing the stored versions of the package
+func versionWrites(name string, stored []*VersionInfo, versions []*VersionInfo) ([]EntryWrite, error) {
+	writes := make([]EntryWrite, 0, len(stored)+len(versions))
+	current := make(map[string]bool, len(versions))
+	for _, info := range versions {
+		raw, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		current[info.Version] = true
+		writes = append(writes, EntryWrite{Bucket: "Versions", Key: versionKey(name, info.Version), Value: raw})
+	}
+	for _, info := range stored {
+		if !current[info.Version] {
+			writes = append(writes, EntryWrite{Bucket: "Versions", Key: versionKey(name, info.Version)})
+		}
+	}
+
+	return writes, nil
+}
+
+// GetVersions method returns all versions of the package
+func (pb *PocketBase) GetVersions(name string) (versions []*VersionInfo) {
+	pb.store.ForEachEntry("Versions", name+"@", func(key string, raw []byte) bool {
+		var info VersionInfo
+		if err := json.Unmarshal(raw, &info); err != nil {
+			dbLog.Warnf("Failed to decode a version: %s %v", key, err)
+			return true
+		}
+
+		versions = append(versions, &info)
+		return true
+	})
+
+	return
+}
+
+// GetVersion method returns the version of the package, or nil if it does not exist
+func (pb *PocketBase) GetVersion(name string, version string) *VersionInfo {
+	raw := pb.store.GetEntry("Versions", versionKey(name, version))
+	if raw == nil {
+		return nil
+	}
+
+	var info VersionInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		dbLog.Warnf("Failed to decode a version: %s@%s %v", name, version, err)
+		return nil
+	}
+
+	return &info
+}
+
+// LookupVersions method returns the versions of the package like GetVersions,
+// or parses them from its document if they have not been backfilled yet
+func (pb *PocketBase) LookupVersions(name string) []*VersionInfo {
+	if versions := pb.GetVersions(name); len(versions) > 0 {
+		return versions
+	}
+
+	document, _, err := pb.GetDocument(name, false)
+	if err != nil || document == "" || document == "{}" {
+		return nil
+	}
+	versions, err := parseVersions(name, document, nil)
+	if err != nil {
+		dbLog.Warnf("Failed to parse versions: %s %v", name, err)
+		return nil
+	}
+
+	return versions
+}
+
+// versionsFormat is the format of the stored versions, which is increased when
+// they have to be backfilled again such as when manifests were added
+const versionsFormat = "2"
+
+// BackfillVersions method stores the versions of every completed package once
+// for each format, so that databases created before versions were stored can
+// be queried like newer ones
+//
+// size returns the size of a tarball by its url path and may be nil. Sizes
+// which have already been stored are kept.
+func (pb *PocketBase) BackfillVersions(batchSize int, size func(path string) int64) (int, error) {
+	if string(pb.store.GetEntry("Globals", "versions")) == versionsFormat {
+		return 0, nil
+	}
+
+	count := 0
+	last := ""
+	for {
+		var batch []*PackageRecord
+		scanned := 0
+		pb.store.ForEachPackage(last, func(pack *PackageRecord) bool {
+			last = pack.ID
+			scanned++
+			if pack.Marked && pack.Document != "" {
+				batch = append(batch, pack)
+			}
+			return len(batch) < batchSize
+		})
+		if scanned == 0 {
+			break
+		}
+
+		var writes []EntryWrite
+		for _, pack := range batch {
+			versions, err := parseVersions(pack.ID, pack.Document, nil)
+			if err != nil {
+				dbLog.Warnf("Failed to parse versions: %s %v", pack.ID, err)
+				continue
+			}
+
+			sizes := map[string]int64{}
+			for _, info := range pb.GetVersions(pack.ID) {
+				sizes[info.Tarball] = info.Size
+			}
+			for _, info := range versions {
+				if info.Size = sizes[info.Tarball]; info.Size == 0 && size != nil && info.Tarball != "" {
+					info.Size = size(info.Tarball)
+				}
+				raw, err := json.Marshal(info)
+				if err != nil {
+					return count, err
+				}
+				writes = append(writes, EntryWrite{Bucket: "Versions", Key: versionKey(pack.ID, info.Version), Value: raw})
+			}
+		}
+		if len(writes) > 0 {
+			if err := pb.store.WriteEntries(writes); err != nil {
+				return count, err
+			}
+		}
+		count += len(batch)
+	}
+
+	return count, pb.store.PutEntry("Globals", "versions", []byte(versionsFormat))
+}
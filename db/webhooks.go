@@ -0,0 +1,141 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// GetWebhooks method returns all webhooks
+//
+// Webhooks are not cached since the server process may change them while
+// another process is mirroring.
+func (pb *PocketBase) GetWebhooks() (hooks []*Webhook) {
+	pb.store.ForEachEntry("Webhooks", "", func(id string, raw []byte) bool {
+		var hook Webhook
+		if err := json.Unmarshal(raw, &hook); err != nil {
+			dbLog.Warnf("Failed to decode webhook: %s %v", id, err)
+			return true
+		}
+
+		hooks = append(hooks, &hook)
+		return true
+	})
+
+	return
+}
+
+// GetWebhook method returns the webhook with the id, or nil if it does not exist
+func (pb *PocketBase) GetWebhook(id string) *Webhook {
+	raw := pb.store.GetEntry("Webhooks", id)
+	if raw == nil {
+		return nil
+	}
+
+	var hook Webhook
+	if err := json.Unmarshal(raw, &hook); err != nil {
+		dbLog.Warnf("Failed to decode webhook: %s %v", id, err)
+		return nil
+	}
+	return &hook
+}
+
+// PutWebhook method adds or replaces a webhook
+func (pb *PocketBase) PutWebhook(hook *Webhook) error {
+	raw, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+
+	return pb.store.PutEntry("Webhooks", hook.ID, raw)
+}
+
+// RemoveWebhook method removes a webhook with its deliveries and returns whether it existed
+func (pb *PocketBase) RemoveWebhook(id string) (bool, error) {
+	if pb.store.GetEntry("Webhooks", id) == nil {
+		return false, nil
+	}
+
+	writes := []EntryWrite{{Bucket: "Webhooks", Key: id}}
+	pb.store.ForEachEntry("Deliveries", id+"/", func(key string, raw []byte) bool {
+		writes = append(writes, EntryWrite{Bucket: "Deliveries", Key: key})
+		return true
+	})
+
+	return true, pb.store.WriteEntries(writes)
+}
+
+// NextDeliveryID method reserves an id for a delivery
+func (pb *PocketBase) NextDeliveryID() int {
+	pb.changeMu.Lock()
+	defer pb.changeMu.Unlock()
+
+	id, _ := strconv.Atoi(string(pb.store.GetEntry("Globals", "deliveries")))
+	id++
+	if err := pb.store.PutEntry("Globals", "deliveries", []byte(strconv.Itoa(id))); err != nil {
+		dbLog.Errorf("Failed to reserve a delivery id: %v", err)
+	}
+
+	return id
+}
+
+// PutDelivery method appends a delivery to the history of its webhook, which
+// keeps the last keep deliveries
+func (pb *PocketBase) PutDelivery(delivery *WebhookDelivery, keep int) error {
+	raw, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	prefix := delivery.Webhook + "/"
+	writes := []EntryWrite{{Bucket: "Deliveries", Key: prefix + changeKey(delivery.ID), Value: raw}}
+	if keep > 0 {
+		var keys []string
+		pb.store.ForEachEntry("Deliveries", prefix, func(key string, raw []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		// keys sort by id
+		for i := 0; i < len(keys)+1-keep; i++ {
+			writes = append(writes, EntryWrite{Bucket: "Deliveries", Key: keys[i]})
+		}
+	}
+
+	return pb.store.WriteEntries(writes)
+}
+
+// GetDeliveries method returns the deliveries of a webhook, the latest first
+func (pb *PocketBase) GetDeliveries(id string) (deliveries []*WebhookDelivery) {
+	pb.store.ForEachEntry("Deliveries", id+"/", func(key string, raw []byte) bool {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(raw, &delivery); err != nil {
+			dbLog.Warnf("Failed to decode delivery: %s %v", key, err)
+			return true
+		}
+
+		deliveries = append(deliveries, &delivery)
+		return true
+	})
+
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return
+}
+
+// GetWebhookCursor method returns the sequence of the journal entry up to which
+// all webhooks have been delivered, or false if webhooks have never been dispatched
+func (pb *PocketBase) GetWebhookCursor() (int, bool) {
+	raw := pb.store.GetEntry("Globals", "webhooks")
+	if raw == nil {
+		return 0, false
+	}
+
+	seq, _ := strconv.Atoi(string(raw))
+	return seq, true
+}
+
+// SetWebhookCursor method stores the sequence of the journal entry up to which
+// all webhooks have been delivered
+func (pb *PocketBase) SetWebhookCursor(seq int) error {
+	return pb.store.PutEntry("Globals", "webhooks", []byte(strconv.Itoa(seq)))
+}
@@ -68,7 +68,7 @@ func (fi bindataFileInfo) Sys() interface{} {
 	return nil
 }
 
-var _defaultToml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x64\x53\x5b\x8b\xf3\x38\x0c\x7d\xf7\xaf\x10\x29\x2c\x2d\x7c\x89\xfb\x0d\x7d\x18\x0a\x66\x2f\xef\xfb\xb2\xcc\xc3\xc2\x50\x8a\xe3\xa8\x89\xa7\xbe\xad\xa5\xf4\x32\xbf\x7e\xb1\xa7\x29\x03\x1f\x01\x23\x4b\x27\x47\x27\x3a\xca\xfb\xa0\x59\xf7\x9a\xf0\x20\x56\xb0\xc4\xc0\xf7\x84\xb0\xee\xa3\xe3\x1f\x30\xc6\xec\x37\xa2\x66\x14\x34\x25\xd7\x7c\x87\x26\xcd\x93\x28\x47\xa9\x86\xe4\xbb\xa1\x2f\x75\xbc\x69\x9f\x1c\xc2\x4c\x7a\x44\x38\xc5\x5c\x79\x60\x3d\x31\xa7\xbd\x94\x1f\x36\x7c\x4e\x73\xe7\x51\x96\xb4\x5c\xd8\xba\x89\xbd\x5b\x99\x18\x02\x1a\xb6\x61\x6c\x39\xb6\xba\x5d\xaa\x9b\xbd\x58\xc1\xa3\xd5\x7b\xe3\xef\xf4\x9f\x6b\x7e\x40\x33\x13\xe6\x7d\xd2\x44\xd7\x98\x87\x3f\xd8\xa4\xf5\x14\x89\xf7\x29\x66\xde\xc8\xa1\x0f\xda\xe3\xef\x66\xd2\x99\x90\xd5\xcc\xa7\x57\xdf\xef\x7e\x4b\xe5\xfa\x66\x3d\xaa\xb7\x3c\x63\x73\x80\x15\x54\xbe\xef\x0d\x52\x24\x1e\x33\x52\xe9\x51\x18\x55\x39\xa0\x74\x53\xe5\x28\xbc\xf0\x45\xaf\x52\x34\x67\xe4\x90\x3c\x10\x39\x1f\x07\x54\x83\x25\xdd\xbb\x32\x9e\x2f\x5d\xca\xdf\x97\xb0\x39\x08\xb1\x02\xaf\x6f\x60\x43\xeb\xd1\xc7\x7c\x07\xa3\xcd\x84\x40\xf6\x13\xc1\x06\xf8\xfb\x2f\x58\x6f\x41\xc1\x1c\x9c\xf5\x96\x71\xd8\x08\xaf\x6f\xc7\x0a\x3a\x56\x90\x82\x97\xed\xee\x55\xac\x7e\xa1\xc0\x8b\x35\x6c\x63\x00\xb6\xbe\x72\x79\x1b\x66\x46\x12\x5f\x2f\x3b\x7b\xc2\x5a\x51\xf0\x73\xb7\xdb\x0a\xf1\xee\x6d\xce\x31\x1f\x44\xc6\xd1\x12\xe7\x7b\xb1\xb1\x98\x44\x7b\x29\x33\x26\x67\x8d\x66\xec\x42\xf2\x1f\xd4\x99\xe8\xe5\x82\x6b\x84\x89\xc1\xcc\x39\x63\x30\xf7\xaa\xe7\xb9\x05\xdd\x13\x24\x9b\x2a\x91\x31\x5f\xb4\xab\x5b\x30\xa7\x41\x17\x39\xcf\xa4\x82\x9f\x2f\x45\x07\x61\xbe\x60\x3e\x88\xde\x86\xa1\x90\x6c\xbb\xfa\x34\xa2\xf8\x08\x0a\x5e\xb7\x62\x05\x64\x26\xf4\x08\x3a\x0c\x50\xcd\xe0\x08\x5e\x9f\x11\x58\xe7\x5e\x3b\x07\x73\x76\x04\xd5\x7e\x88\x27\x58\x54\x3c\xd4\xc7\x3c\xca\xa4\xcd\x59\x8f\x28\xdb\x25\x6a\x2f\x98\xc9\xc6\xd0\xf1\xf8\xb9\x11\x0f\xfe\xc7\x08\x1a\x51\x99\x14\x34\x2e\x1a\xed\xca\xa5\x7c\x0f\x61\x18\xe0\xdf\xf6\x4f\x63\xd0\xb5\xff\xe0\x60\x33\x1a\x86\x09\xf5\x80\xb9\x28\x32\xce\x62\x60\x02\x9a\xcd\x04\x9a\x20\x8c\x36\xdc\xaa\x66\x9d\x8a\x09\x5d\xe5\xc0\x3d\x2c\x63\xbe\x5e\xaf\x5d\x05\x3d\x06\x4c\x71\xce\x06\x49\x5e\xed\xd9\x4a\x62\x9d\x59\x72\x4c\xd6\x90\x7c\xfc\x55\x24\x6f\xad\x2e\xed\xa5\xb8\x1d\x6b\x70\xcc\x8b\x0e\x05\x27\xed\x08\x85\x8b\xe3\xe2\xc7\x73\x3b\xbb\x82\x25\xea\x5c\x1c\x1b\xf1\x7f\x00\x00\x00\xff\xff\xf1\x6f\x30\x2a\xfa\x03\x00\x00")
+var _defaultToml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\x7d\x57\x7f\x6f\xdb\x46\x12\xfd\x9f\x9f\x62\x21\x03\x07\x09\x90\x48\xa5\x71\x8a\x9c\x0b\xe1\xce\x2d\xd0\x4b\x80\xb8\x0d\xea\x14\x57\x20\x30\xe4\x15\x39\x92\x36\x22\xb9\xcc\xee\xd2\x12\xfd\xe9\xfb\x66\x96\xa4\x14\xb7\x28\x02\x38\xe4\x72\x76\x7e\xbe\x79\x33\xfa\x5c\xe8\xa0\x37\xda\xd3\x43\x72\xa5\x86\x67\x15\xba\x86\xd4\x74\x63\xcb\x30\x57\x1b\x5d\xec\xc8\xcd\xd5\xce\xba\x6a\xae\xfc\xd7\xd2\x04\x9a\x41\x38\x9e\x2b\xe3\x95\xae\xd5\x87\xfb\x3b\x15\x1c\x91\x3a\xee\x4d\xbe\xe7\xc3\xaa\xc5\xff\x5b\xed\x03\x64\x82\x55\x47\x87\x6b\xca\xd6\x2a\xec\x49\x6d\x8d\xf3\x41\xb9\xb6\x56\xd3\x46\x07\x11\xd7\xaa\x30\x8e\xf2\x60\x5d\xc7\xca\xa3\x19\x16\xf1\xca\xd4\xea\xff\xb7\x1f\x54\x65\x0b\x52\xde\x42\x81\x0e\xca\xd3\x13\x39\x5d\xe2\x7f\x87\x07\xd5\x38\x9b\x93\xf7\xe4\x55\x0e\x67\xfc\x5e\x3b\xea\x0d\x95\x94\x48\x30\x2b\x35\xe1\x70\x26\x97\x51\xb2\xed\x44\x1c\xc0\xd7\xba\xa9\xd2\x62\xc3\xdf\xe9\xa4\xab\xa6\x24\xd5\x7a\xbd\x83\x0a\xeb\x24\x74\x35\xdd\x87\xd0\xdc\x64\xd9\x17\x53\x3f\xef\xdb\xb4\xa2\x8c\x8f\xb3\x41\x5b\xba\x0f\x55\x79\x95\xdb\xba\x46\x14\xa6\xde\x2d\x82\x5d\xe8\xc5\xf0\x75\x76\x03\xc5\xbd\xa9\xcf\x93\xaa\x43\x7c\x93\xb9\x9a\xb4\xf0\xff\xa6\xd1\xde\x1f\xad\x2b\xfe\x1b\xf2\x66\xba\xb7\x3e\xdc\x34\xd6\x85\x59\x56\x6c\x6a\x5d\xd1\x7f\x72\x44\xe3\x29\xac\xda\xb0\x7d\x5b\x6d\xae\xff\xd5\xf0\xeb\x27\x53\xd1\xea\x93\x6b\x69\xf2\xa0\xae\x94\xe8\xbb\x34\xd0\x40\xcb\xce\x91\x67\x1b\xac\x71\xc5\x7f\x14\x5b\x5b\xf1\x1f\xd6\xab\xa2\xfa\x55\x63\xf3\x03\x05\x44\xaf\xbc\x2f\x39\xc7\xab\xc2\x78\xbd\x29\x39\x3d\xd1\xaf\x55\xd5\x0d\x8f\x93\x87\x04\x66\x72\x5b\x35\x50\xee\x0d\xca\x69\xb7\xca\xa3\x68\x54\xa8\xc2\xe6\x6d\x45\x75\x60\x3c\x14\x92\x79\x55\x1a\x8f\xd7\xe9\xb3\x0f\x05\xf0\xf3\x6c\x9a\xb9\xaa\x6d\x2d\xe8\xa1\x13\xbe\x21\x4d\x52\x0d\x06\x80\x23\x5d\x28\x32\xa8\x9a\x53\x47\xdd\xfd\x20\xf0\x78\x3c\x7b\x07\x70\xf4\x66\x1f\x19\x4f\x48\x34\x0a\x1f\x94\x09\xc9\xa5\x3b\x28\x24\x5b\x9b\xb0\x9b\x95\x3e\x01\x3b\x8b\x8a\x2a\x80\x0a\xc0\xc8\x01\x08\x6f\x9e\x89\x01\x75\xf7\xa3\x9a\x2e\x21\xdd\xd6\xa5\xa9\x80\xb4\x62\x96\x40\x7c\x2d\x42\x6b\x11\x5a\xa9\xef\x96\xd7\x6f\xa1\xe6\xa5\x0a\x7a\x32\x28\x30\x23\x19\x35\x60\x5d\x95\xa9\xdb\x40\x3e\x89\x97\x4b\xb3\x25\xf9\xb2\x52\xaf\xae\xaf\x97\x49\xf2\xb9\x32\xce\x59\xf7\x90\x38\xda\x21\x66\xe8\x81\x93\x8c\x25\x0f\x30\x39\x6a\x4a\x93\xeb\x40\x29\x62\xfc\xe2\x53\xc4\x92\x0d\x72\x13\x44\x56\xe7\xad\x73\x54\xe7\x9d\xf8\x33\x82\x35\x1d\x85\xb2\x89\xb8\x88\x2e\x7b\x42\x3b\x30\x58\xdb\x06\x29\x85\x3b\xe3\x21\x1c\xc1\xd5\xab\x58\x27\x15\xb4\xdb\xe8\xb2\xf4\x6a\xd3\x71\x8b\x18\xc7\xed\xe2\xdb\xca\x8f\xbd\x65\x0a\x54\x11\x4e\x95\x67\x59\xee\xa7\xbe\xcc\x70\x89\xa0\xec\x45\x75\x0a\x2a\xda\x86\xa4\x32\x95\x7d\x22\xa6\x84\xb1\xc2\xc2\x0b\xf0\x86\xd5\xa3\xd0\xa5\xee\x6c\xcb\x55\x83\x7f\x75\x58\xeb\xa2\xe0\xe2\x41\xf3\x0a\x74\x51\x7a\xe2\xd2\x1d\x81\x02\xfa\x5b\xf3\xd3\xd2\xc2\x33\xf0\xd0\x6b\x46\x91\xbc\xc4\x4f\x9e\xa3\xa9\x50\xd0\x82\x09\x07\x75\x8a\x69\x97\x9e\x48\x21\xae\x80\xdf\x83\x57\x47\x20\x0c\xde\x75\xea\xfe\xb5\xe0\x58\x07\xc3\x58\x67\x15\xe8\x76\xce\x12\xf3\x96\xf6\xea\xce\xd4\xef\x7f\x9d\x0b\x96\x5f\x68\x43\x0a\xca\x4e\x1d\x88\x1a\x0f\xd0\x1f\xeb\xd2\xea\x42\x58\x0a\x2c\xc4\x4d\xe7\x87\x92\xa7\xbd\xd6\x87\x91\x82\xc4\x5f\xe1\x98\xba\x68\x2c\x72\x32\x1e\x4a\xdf\xff\x7b\xb9\x5c\xf2\x57\x2e\x6e\x04\x33\xbf\x6d\x5a\xce\x32\xbf\x8d\xf9\xe6\x63\x60\x7e\x6b\x4e\x83\x90\xce\x99\x00\xd7\x07\xea\x86\x13\x4f\xb9\xa3\xf0\xe2\xa4\x75\xec\x47\x00\x71\x88\x99\xc8\xb9\x2a\x2f\x8d\x34\x2e\x4a\xc4\x9d\x64\x76\x35\x32\xdd\x3a\x64\x1e\xf8\x31\x85\xc0\xaa\xff\xb0\xa6\x53\x63\x80\xe1\x1e\xf4\x08\x1b\x0c\x8f\xce\x05\x0f\x20\xfc\x53\x27\x05\xef\xeb\x76\x69\x62\x28\xee\xd5\x4b\x45\x40\xe7\x1b\x2e\x79\x41\xa5\x41\x47\x77\xac\xe9\x48\x9b\xbd\xb5\x07\x3f\xef\xc7\x09\xd7\xbf\xd2\x35\x52\x59\xc4\x02\x5e\x20\xaf\x97\x7d\x54\xf0\x31\x5b\x64\xba\x80\x67\xd9\xa0\x40\x38\xb1\x8b\x05\x12\x10\xc5\xd0\x44\xc7\xbb\xbb\xdb\x9f\x16\xf7\xef\x6e\xbf\x7b\xf3\x3d\xdb\xe4\x22\xc7\x94\xa9\xe9\x1f\x8b\x8f\x83\xfe\xc5\x3d\xae\xe8\x80\xbc\xdd\x70\xa3\x40\x78\x95\xa6\xe9\x6c\x2c\xf1\x60\x89\xc7\xa7\x0e\x81\xaa\x06\x79\x6c\x00\xc1\x21\x9e\x39\x72\x10\x9c\x19\xac\x4a\x63\x34\x20\x41\xb4\x18\xa0\xbb\xd1\xf9\xc1\x6e\xb7\x6a\xeb\x6c\xa5\x5e\xb1\x03\xb6\x2e\x92\x51\xd1\x4a\xbd\x91\x24\x7e\x6d\x09\xfc\xcd\xb4\x82\xd6\x61\xa8\x45\x41\x9f\x0c\x47\xc8\xe2\xf2\x05\x5d\x5c\x9f\x93\x6a\x50\xa8\x03\x35\x41\x1c\xeb\x3d\x4e\xd0\x8b\x3c\x6d\xe5\x2a\xd3\x54\x1c\xa5\x0f\xc9\xc6\xd4\xdc\x8b\x93\x65\x2a\xff\x26\x09\x4f\x23\x1c\xbc\x15\x0e\x01\xc5\x55\x24\x5d\x21\x23\x85\xfb\x5d\x1f\xc6\x56\x8d\xa0\x91\x21\xc6\x39\x1d\x48\xaa\x27\x37\xeb\x76\x59\x83\x80\x51\x47\x54\xaa\x7f\x5a\xc0\x28\x53\x77\x1a\x76\xcf\xb3\xa4\xd7\xdf\x33\xe4\x24\x11\x4d\x97\x3d\x12\x71\x0c\xf3\x7f\x2c\x6e\x01\xf9\x72\xf1\xdb\x80\xb0\x3d\x60\x18\x77\x8d\x01\xce\x43\x2b\xd7\x3b\x53\x9f\xc4\x67\xdd\x30\x47\xa7\xa2\x03\x05\x1d\x58\xf8\x78\x3c\xa6\x22\xd4\xf3\xaf\xb7\xad\x43\x3b\x65\x47\x73\x30\x99\x47\x6c\x21\x0b\xb6\x31\xb9\xcf\xfa\xdd\xc0\x67\xa7\x05\x77\x5c\x99\x25\xa7\xb5\x3c\xac\xff\x82\xf4\xd2\xee\x06\xba\x1e\xd1\x9a\xc6\x36\x4d\xf1\x4d\x3a\x9b\x00\x4a\x76\xf9\x40\xb5\x54\xd9\x30\xc5\x71\xb7\xc5\x75\x49\x5c\x66\x40\xab\xdb\x8f\xef\xcf\xf1\x3c\x0a\xe3\x22\xb3\x8b\xa0\x77\x10\x28\x1e\xa1\x6b\xca\x49\x76\xf9\x8d\xca\x32\xce\x53\x76\xb3\xd6\x6d\xd8\x7f\x62\xd5\x2b\x31\x30\x4b\x19\xe3\x58\x7b\x44\x17\x77\x43\x3f\xe8\x0b\xa6\x5b\xc0\x12\x88\xeb\x12\x31\xb7\x8e\x1e\xf5\xb4\xb1\xc7\x40\x50\x7d\x95\x80\xed\x76\x83\xb1\xbe\x67\x82\x68\x50\x5b\xd2\x95\x42\x3e\x98\x7d\x01\xed\x5f\x30\xce\x3b\x28\xdf\x59\x10\x71\x30\x25\x5b\xec\xc4\x96\x6e\x40\x0f\x4f\x54\xb0\xa7\x1f\x7f\xbd\xff\x74\xee\xd5\xaf\xad\x76\x1a\xc2\x35\x65\xbc\x90\x64\xbd\xa5\xac\xbf\x01\xb7\x97\x83\xa7\xc2\xf1\xea\x7c\x21\x39\x3f\xae\xc5\xf0\x4a\x31\x48\x07\x30\x9e\xc9\x99\x3d\xc8\x2d\x5c\x82\xdb\x3c\xb1\xe3\x3c\x97\x3d\xa5\x6c\x25\x18\x12\xee\xf9\x65\x68\x2c\x35\x5d\xbc\x3a\x5b\x95\xab\x60\x36\xd9\x4c\xb9\x4d\x0a\x2e\x43\x36\xea\xcf\x84\xcb\xb3\x12\xdb\xee\xe2\x48\x74\x90\x40\xb0\xfd\x1c\x38\x6e\x73\x46\xff\x9c\x61\xf7\xcd\xd8\x1c\x34\x3c\x26\xe3\xe3\xfa\x62\x70\x7f\xbf\x4c\x46\x6e\xc7\xb0\xdb\x09\x2e\x30\x36\x19\xe5\x3d\xbe\xe6\xe7\x95\xdb\x91\x6d\xa8\x96\x19\xad\xee\xdf\xff\xef\xdd\xef\x1f\x05\x4b\x10\x74\x36\x60\x27\x18\x7a\xbc\x47\xe1\x1a\x1f\x98\xb6\x02\x9d\xb0\xe6\x7f\xf1\xbc\xcd\x39\x1e\x8a\x60\x00\x9e\xb4\x3f\x0d\x4f\x1f\x60\xf8\x67\xec\xba\xd8\x0d\xb6\xb6\x2c\xed\x11\x67\xd8\x1e\x98\x1d\x7d\xdc\xbb\xe6\xf2\x82\xab\x60\x69\xac\x7a\xb2\x09\xcd\x55\xdf\xe1\x92\x67\x2a\x75\xc3\x43\x9e\x09\x6b\x96\x6c\xa3\x36\x00\x8c\x8d\xcb\xc8\x13\x0f\x23\x12\xb9\xc8\x1c\x2c\xc0\x05\x3d\x9e\x17\xb9\xb8\x93\xdd\xfd\x18\x07\x32\xfa\xcb\x82\x7f\x40\x36\x1d\xbb\x5c\x68\x83\x07\x83\x4d\x94\x42\x32\x0a\x47\x5e\x1b\x35\xc3\x96\xc8\x9d\x8d\xc5\x25\xb5\x67\x46\x6c\x83\x71\xa2\x03\x38\xb3\x61\xea\x63\x39\xe2\x25\x92\x63\x00\x6a\x04\x61\xa3\x9c\x6c\x1b\x88\x83\x81\x13\x97\x47\xe6\x72\xf4\x44\xe4\x62\x3e\xe0\x7b\x2b\xf5\x9a\x9d\xe0\xe5\xf7\x5b\xb3\xe3\xda\x3a\xcc\xe3\xe4\x73\x5f\x8f\x12\x2a\x4b\xa6\xcf\x88\x49\x96\x93\x79\x21\x03\x44\xf8\x1f\xdc\x06\xb4\xa8\x69\x41\x9b\x16\xa0\x32\xf5\xd6\x02\x06\xda\xa1\x0e\xc4\x53\x69\x96\x44\x1d\x88\x99\xbf\x4d\xfa\x22\x73\xae\xb8\xcc\x7f\x93\xfe\xc8\x37\x40\x95\x8e\x9b\xfb\xc5\x58\xc7\x3a\x0d\xa5\xf3\xd1\x7b\x5c\xbc\x28\x88\xa4\xea\xaf\xc0\x83\x4a\xd1\xf3\x0d\xf9\x09\xeb\xbd\xa8\xcf\x3f\x27\xee\x65\x8e\xd0\x0b\x68\x5e\x2f\x3f\xcc\xb0\x3a\x93\x38\x54\xc9\x5a\xcb\xf4\xe3\xf0\xbe\x96\x85\x5e\x70\x26\x4b\x99\x9c\x8d\x2d\x35\xb4\xb7\x61\x36\x6d\x9a\xb8\x79\x42\xed\xc8\x56\xe7\x5d\x1a\x43\x06\x0b\xc8\xc0\xb9\x93\x9f\x01\x1e\xc6\xaf\x1d\x9b\x76\xa2\x8a\xd6\xf1\xbe\x03\xcb\x28\x0b\xfb\x34\xbd\xa0\x2a\x13\x66\xc9\x85\x43\xb2\xbf\x7f\xeb\xcc\xd0\xdf\x52\x2c\x3f\x2c\x21\x63\xbd\xfd\x4d\xbf\x75\xce\x65\x77\xe5\xdf\xe0\xc8\x62\x1c\x6e\x73\xfc\x7c\x9b\xf7\xbf\x7e\x05\x38\x69\x54\xc2\xf8\x89\xc2\x9c\x7a\x86\x04\x57\x77\xbc\x76\x3e\xfc\x13\x63\xfe\x8d\xdf\xf8\x0f\x00\x00")
 
 func defaultTomlBytes() ([]byte, error) {
 	return bindataRead(
@@ -83,7 +83,7 @@ func defaultToml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "default.toml", size: 1018, mode: os.FileMode(436), modTime: time.Unix(1491489938, 0)}
+	info := bindataFileInfo{name: "default.toml", size: 4088, mode: os.FileMode(436), modTime: time.Unix(1491489938, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
@@ -0,0 +1,147 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Components which have their own loggers
+const (
+	ComponentMirror    = "mirror"
+	ComponentWorker    = "worker"
+	ComponentNPMClient = "npmclient"
+	ComponentDB        = "db"
+	ComponentServer    = "server"
+)
+
+// Config represents the [log] section of the config file
+type Config struct {
+	// Level is the level of components without their own (info if empty)
+	Level string `toml:"level"`
+	// Levels are the levels by component
+	Levels map[string]string `toml:"levels"`
+	// Format is text or json
+	Format string `toml:"format"`
+	// File is written instead of stderr, and rotated when it reaches MaxSize
+	// megabytes (100 if 0)
+	File       string `toml:"file"`
+	MaxSize    int    `toml:"max_size"`
+	MaxBackups int    `toml:"max_backups"`
+	MaxAge     int    `toml:"max_age"`
+	Compress   bool   `toml:"compress"`
+	// RateLimit is the number of times a message is logged every
+	// RateInterval seconds (60 if 0) before it is suppressed; 0 disables it
+	RateLimit    int `toml:"rate_limit"`
+	RateInterval int `toml:"rate_interval"`
+}
+
+// file is the rotated log file, which is reopened on SIGHUP
+var file *lumberjack.Logger
+
+// componentFormatter shows the component of a message as the prefix of the
+// text formatter
+type componentFormatter struct {
+	*prefixed.TextFormatter
+}
+
+// Format formats an entry with its component as the prefix
+func (f *componentFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if component, ok := entry.Data["component"]; ok {
+		data := make(logrus.Fields, len(entry.Data))
+		for k, v := range entry.Data {
+			data[k] = v
+		}
+		delete(data, "component")
+		data["prefix"] = component
+
+		clone := *entry
+		clone.Data = data
+		entry = &clone
+	}
+
+	return f.TextFormatter.Format(entry)
+}
+
+// Configure applies the config to the loggers of all components
+func Configure(config *Config) error {
+	base, err := parseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	byComponent := map[string]logrus.Level{}
+	for component, value := range config.Levels {
+		if byComponent[component], err = parseLevel(value); err != nil {
+			return fmt.Errorf("%v (%s)", err, component)
+		}
+	}
+
+	var formatter logrus.Formatter
+	switch config.Format {
+	case "", "text":
+		formatter = &componentFormatter{new(prefixed.TextFormatter)}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format: %s", config.Format)
+	}
+
+	if config.File != "" && file == nil {
+		path, _ := filepath.Abs(config.File)
+		file = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    config.MaxSize,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAge,
+			Compress:   config.Compress,
+			LocalTime:  true,
+		}
+		logger.SetOutput(file)
+		go reopenOnHangup()
+	}
+
+	interval := time.Duration(config.RateInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	limiter.configure(config.RateLimit, interval)
+
+	logger.SetFormatter(formatter)
+	mu.Lock()
+	level = base
+	levels = byComponent
+	mu.Unlock()
+
+	return nil
+}
+
+// parseLevel parses a level, which is info if empty
+func parseLevel(value string) (logrus.Level, error) {
+	if value == "" {
+		return logrus.InfoLevel, nil
+	}
+
+	lv, err := logrus.ParseLevel(value)
+	if err != nil {
+		return lv, fmt.Errorf("Unknown log level: %s", value)
+	}
+	return lv, nil
+}
+
+// reopenOnHangup closes the log file on SIGHUP so that the next message
+// opens the file again after it has been moved by logrotate
+func reopenOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		file.Close()
+	}
+}
@@ -1,78 +1,260 @@
 package log
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
-var logger = logrus.New()
+// Fields is the type of the fields of a logger
+type Fields = logrus.Fields
+
+// logger writes the messages of every component, which are filtered by the
+// level of their component before they reach it
+var logger = func() *logrus.Logger {
+	l := logrus.New()
+	l.Level = logrus.DebugLevel
+	return l
+}()
+
+var (
+	mu     sync.RWMutex
+	debug  bool
+	level  = logrus.InfoLevel
+	levels = map[string]logrus.Level{}
+)
+
+// std is the logger of the package-level functions
+var std = &Logger{}
 
 // InitLogger initializes existing Logger instance
 func InitLogger() {
 	formatter := new(prefixed.TextFormatter)
-	logger.Formatter = formatter
+	logger.SetFormatter(&componentFormatter{formatter})
 }
 
+// SetDebug logs debug messages of every component regardless of their levels
 func SetDebug() {
-	logger.Level = logrus.DebugLevel
+	mu.Lock()
+	debug = true
+	mu.Unlock()
+}
+
+// Logger logs the messages of a component with its fields
+type Logger struct {
+	component string
+	fields    Fields
+}
+
+// Component returns the logger of a component, whose messages have the
+// "component" field and the level configured for the component
+func Component(name string) *Logger {
+	return &Logger{component: name, fields: Fields{"component": name}}
+}
+
+// WithFields returns a child logger adding the fields to every message
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &Logger{component: l.component, fields: merged}
+}
+
+// WithField returns a child logger adding the field to every message
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+// Level returns the level of the component
+func (l *Logger) Level() logrus.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if debug {
+		return logrus.DebugLevel
+	}
+	if lv, ok := levels[l.component]; ok {
+		return lv
+	}
+	return level
+}
+
+// IsEnabled returns whether messages of the level are logged
+func (l *Logger) IsEnabled(lv logrus.Level) bool {
+	return lv <= l.Level()
+}
+
+// log writes a message unless its level is disabled or it is repeated more
+// often than the rate limit, in which case it is counted instead
+//
+// Messages are repeated if they have the same format (or text without a
+// format), so that messages such as "Failed to download: %s" are limited
+// together regardless of their arguments.
+func (l *Logger) log(lv logrus.Level, format string, args ...interface{}) {
+	if !l.IsEnabled(lv) {
+		return
+	}
+
+	var msg string
+	if format == "" {
+		msg = fmt.Sprint(args...)
+		format = msg
+	} else {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	entry := logger.WithFields(l.fields)
+	switch lv {
+	case logrus.FatalLevel:
+		limiter.flush(true)
+		entry.Fatal(msg)
+	case logrus.PanicLevel:
+		limiter.flush(true)
+		entry.Panic(msg)
+	}
+
+	report := func(suppressed int) {
+		entry.WithField("suppressed", suppressed).Log(lv, fmt.Sprintf("Suppressed %d messages like: %s", suppressed, format))
+	}
+	allowed, suppressed := limiter.allow(l.component+"\x00"+lv.String()+"\x00"+format, report)
+	if suppressed > 0 {
+		report(suppressed)
+	}
+	if allowed {
+		entry.Log(lv, msg)
+	}
+}
+
+// Close reports the messages suppressed by the rate limit that have not been
+// logged again, which is done before the process exits
+func Close() {
+	limiter.flush(true)
+}
+
+func (l *Logger) Print(args ...interface{}) {
+	l.log(logrus.InfoLevel, "", args...)
+}
+
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.log(logrus.InfoLevel, format, args...)
+}
+
+func (l *Logger) Info(args ...interface{}) {
+	l.log(logrus.InfoLevel, "", args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(logrus.InfoLevel, format, args...)
+}
+
+func (l *Logger) Debug(args ...interface{}) {
+	l.log(logrus.DebugLevel, "", args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(logrus.DebugLevel, format, args...)
+}
+
+func (l *Logger) Warn(args ...interface{}) {
+	l.log(logrus.WarnLevel, "", args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(logrus.WarnLevel, format, args...)
+}
+
+// Warningf is an alias of Warnf for libraries such as badger
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(logrus.WarnLevel, format, args...)
+}
+
+func (l *Logger) Error(args ...interface{}) {
+	l.log(logrus.ErrorLevel, "", args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(logrus.ErrorLevel, format, args...)
+}
+
+func (l *Logger) Fatal(args ...interface{}) {
+	l.log(logrus.FatalLevel, "", args...)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(logrus.FatalLevel, format, args...)
+}
+
+func (l *Logger) Panic(args ...interface{}) {
+	l.log(logrus.PanicLevel, "", args...)
+}
+
+func (l *Logger) Panicf(format string, args ...interface{}) {
+	l.log(logrus.PanicLevel, format, args...)
 }
 
-func WithFields(fields logrus.Fields) *logrus.Entry {
-	return logger.WithFields(fields)
+func WithFields(fields Fields) *Logger {
+	return std.WithFields(fields)
 }
 
 func Print(args ...interface{}) {
-	logger.Print(args...)
+	std.Print(args...)
 }
 
 func Printf(format string, args ...interface{}) {
-	logger.Printf(format, args...)
+	std.Printf(format, args...)
 }
 
 func Info(args ...interface{}) {
-	logger.Info(args...)
+	std.Info(args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	logger.Infof(format, args...)
+	std.Infof(format, args...)
 }
 
 func Debug(args ...interface{}) {
-	logger.Debug(args...)
+	std.Debug(args...)
 }
 
 func Debugf(format string, args ...interface{}) {
-	logger.Debugf(format, args...)
+	std.Debugf(format, args...)
 }
 
 func Warn(args ...interface{}) {
-	logger.Warn(args...)
+	std.Warn(args...)
 }
 
 func Warnf(format string, args ...interface{}) {
-	logger.Warnf(format, args...)
+	std.Warnf(format, args...)
 }
 
 func Error(args ...interface{}) {
-	logger.Error(args...)
+	std.Error(args...)
 }
 
 func Errorf(format string, args ...interface{}) {
-	logger.Errorf(format, args...)
+	std.Errorf(format, args...)
 }
 
 func Fatal(args ...interface{}) {
-	logger.Fatal(args...)
+	std.Fatal(args...)
 }
 
 func Fatalf(format string, args ...interface{}) {
-	logger.Fatalf(format, args...)
+	std.Fatalf(format, args...)
 }
 
 func Panic(args ...interface{}) {
-	logger.Panic(args...)
+	std.Panic(args...)
 }
 
 func Panicf(format string, args ...interface{}) {
-	logger.Panicf(format, args...)
+	std.Panicf(format, args...)
 }
@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger.SetOutput(&out)
+	defer Configure(&Config{})
+
+	if err := Configure(&Config{Level: "warn", Format: "json", Levels: map[string]string{ComponentWorker: "debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	Component(ComponentMirror).Info("hidden")
+	Component(ComponentWorker).WithField("worker", 1).Debugf("shown: %d", 1)
+	Warn("shown")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("TestComponentLevels: unexpected output %s", out.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["component"] != ComponentWorker || entry["worker"] != float64(1) || entry["msg"] != "shown: 1" {
+		t.Errorf("TestComponentLevels: unexpected entry %s", lines[0])
+	}
+
+	if err := Configure(&Config{Levels: map[string]string{ComponentDB: "verbose"}}); err == nil {
+		t.Error("TestComponentLevels: expected an error of an unknown level")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := &rateLimiter{}
+	r.configure(2, 50*time.Millisecond)
+	defer r.configure(0, time.Minute)
+
+	var allowed []bool
+	for i := 0; i < 4; i++ {
+		ok, suppressed := r.allow("Failed to download: %s", nil)
+		allowed = append(allowed, ok)
+		if suppressed != 0 {
+			t.Errorf("TestRateLimiter: unexpected suppressed count %d", suppressed)
+		}
+	}
+	if ok, _ := r.allow("another message", nil); !ok {
+		t.Error("TestRateLimiter: another message is limited")
+	}
+	if allowed[0] != true || allowed[1] != true || allowed[2] != false || allowed[3] != false {
+		t.Errorf("TestRateLimiter: unexpected results %v", allowed)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, suppressed := r.allow("Failed to download: %s", nil); !ok || suppressed != 2 {
+		t.Errorf("TestRateLimiter: expected the message to be logged with 2 suppressed, actual %t %d", ok, suppressed)
+	}
+}
+
+func TestRateLimiterFlush(t *testing.T) {
+	r := &rateLimiter{}
+	r.configure(1, 20*time.Millisecond)
+	defer r.configure(0, time.Minute)
+
+	// suppressed messages are reported after the interval without recurring
+	reported := make(chan int, 1)
+	for i := 0; i < 3; i++ {
+		r.allow("Failed to download: %s", func(suppressed int) { reported <- suppressed })
+	}
+	select {
+	case suppressed := <-reported:
+		if suppressed != 2 {
+			t.Errorf("TestRateLimiterFlush: expected 2 suppressed actual %d", suppressed)
+		}
+	case <-time.After(time.Second):
+		t.Error("TestRateLimiterFlush: suppressed messages were not reported")
+	}
+
+	// and when the logger is closed before the interval passes
+	r.configure(1, time.Hour)
+	r.allow("Failed to download: %s", nil)
+	r.allow("Failed to download: %s", func(suppressed int) { reported <- suppressed })
+	r.flush(true)
+	select {
+	case suppressed := <-reported:
+		if suppressed != 1 {
+			t.Errorf("TestRateLimiterFlush: expected 1 suppressed actual %d", suppressed)
+		}
+	default:
+		t.Error("TestRateLimiterFlush: suppressed messages were not reported on close")
+	}
+	if _, suppressed := r.allow("Failed to download: %s", nil); suppressed != 0 {
+		t.Errorf("TestRateLimiterFlush: reported messages were counted again %d", suppressed)
+	}
+}
@@ -0,0 +1,142 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateKeys is the number of messages counted before expired counts are dropped
+const maxRateKeys = 10000
+
+// rateCount counts a message in the current interval
+type rateCount struct {
+	start      time.Time
+	count      int
+	suppressed int
+	// report logs the number of suppressed messages
+	report func(suppressed int)
+}
+
+// rateLimiter suppresses messages logged more than limit times in an interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	interval time.Duration
+	counts   map[string]*rateCount
+	// stop stops the flush of the counts of the previous configuration
+	stop chan struct{}
+}
+
+var limiter = &rateLimiter{counts: map[string]*rateCount{}}
+
+// configure sets the limit, and flushes the counts of suppressed messages
+// every interval so that they are reported even if a message never recurs
+func (r *rateLimiter) configure(limit int, interval time.Duration) {
+	r.flush(true)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limit = limit
+	r.interval = interval
+	r.counts = map[string]*rateCount{}
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	if limit > 0 {
+		r.stop = make(chan struct{})
+		go r.run(interval, r.stop)
+	}
+}
+
+// run flushes the counts of the previous intervals until stop is closed
+func (r *rateLimiter) run(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush(false)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// allow returns whether a message is logged, and the number of times it was
+// suppressed in the previous interval, which is reported when the message is
+// logged again after the interval
+//
+// report is called with the number of suppressed messages if the interval
+// passes, or the limiter is flushed, before the message is logged again.
+func (r *rateLimiter) allow(key string, report func(int)) (bool, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.limit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	c := r.counts[key]
+	if c == nil {
+		if len(r.counts) >= maxRateKeys {
+			r.expire(now)
+		}
+		c = &rateCount{start: now}
+		r.counts[key] = c
+	}
+
+	suppressed := 0
+	if now.Sub(c.start) >= r.interval {
+		suppressed = c.suppressed
+		*c = rateCount{start: now}
+	}
+
+	c.count++
+	if c.count > r.limit {
+		c.suppressed++
+		c.report = report
+		return false, suppressed
+	}
+	return true, suppressed
+}
+
+// flush reports the suppressed messages of the previous intervals, or of all
+// intervals if all is set, and resets their counts
+func (r *rateLimiter) flush(all bool) {
+	r.mu.Lock()
+	now := time.Now()
+	var reports []func()
+	for key, c := range r.counts {
+		if c.suppressed == 0 || c.report == nil || (!all && now.Sub(c.start) < r.interval) {
+			continue
+		}
+
+		report, suppressed := c.report, c.suppressed
+		reports = append(reports, func() { report(suppressed) })
+		if all {
+			c.suppressed, c.report = 0, nil
+		} else {
+			delete(r.counts, key)
+		}
+	}
+	r.mu.Unlock()
+
+	// messages are logged without the lock, since they may be limited as well
+	for _, report := range reports {
+		report()
+	}
+}
+
+// expire drops the counts of previous intervals, except the ones with
+// suppressed messages which are dropped when they are flushed
+func (r *rateLimiter) expire(now time.Time) {
+	for key, c := range r.counts {
+		if c.suppressed == 0 && now.Sub(c.start) >= r.interval {
+			delete(r.counts, key)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -28,6 +32,9 @@ func getConfig(path string) *PocketConfig {
 		log.Fatalf("Error in config file: %s", err)
 
 	}
+	if err := log.Configure(&conf.Log); err != nil {
+		log.Fatalf("Error in config file: %s", err)
+	}
 
 	return &conf
 }
@@ -62,6 +69,10 @@ func main() {
 
 		return nil
 	}
+	app.After = func(c *cli.Context) error {
+		log.Close()
+		return nil
+	}
 
 	app.Commands = []cli.Command{
 		{
@@ -117,7 +128,12 @@ func main() {
 						server.Run()
 						return nil
 					}
+
+					client := npm.NewMirrorClient(pb, &conf.Mirror)
+					server.SetMirrorClient(client)
 					go server.Run()
+					client.Run(c.Bool("onetime"))
+					return nil
 				}
 
 				client := npm.NewMirrorClient(pb, &conf.Mirror)
@@ -126,22 +142,91 @@ func main() {
 			},
 		},
 		{
-			Name:  "migrate",
-			Usage: "Migrate the database from boltdb to gorm",
+			Name:      "migrate",
+			Usage:     "Copy the database from one store to another",
+			ArgsUsage: "--from <type:path> --to <type:path>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "from", Usage: "source store such as bolt:npm.db"},
+				cli.StringFlag{Name: "to", Usage: "destination store such as sqlite:npm.sqlite or gorm:mysql:dsn"},
+				cli.IntFlag{Name: "batch", Value: 1000, Usage: "number of packages per transaction"},
+				cli.BoolFlag{Name: "restart", Usage: "Ignore the progress of a previous migration"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.String("from") == "" || c.String("to") == "" {
+					return cli.NewExitError("Both --from and --to are required", -1)
+				}
+				from, err := db.ParseStoreSpec(c.String("from"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+				to, err := db.ParseStoreSpec(c.String("to"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+
+				if err := db.Migrate(from, to, c.Int("batch"), c.Bool("restart")); err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "recompress",
+			Usage: "Rewrite stored documents and file lists with the configured compression",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "config, c", Value: "config.toml"},
-				cli.StringFlag{Name: "bolt", Usage: "location of bolt database file", Value: "npm.db"},
+				cli.BoolFlag{Name: "report", Usage: "Only show the space saved by the compression"},
+				cli.IntFlag{Name: "batch", Value: 100, Usage: "number of packages per transaction"},
+				cli.DurationFlag{Name: "pause", Value: 100 * time.Millisecond, Usage: "pause between batches"},
 			},
 			Action: func(c *cli.Context) error {
 				conf := getConfig(c.String("config"))
-				if conf.DB.Type != "gorm" {
-					return cli.NewExitError("This only works when the type is set to gorm", -1)
+
+				// global database frontend
+				pb := db.NewPocketBase(&conf.DB)
+				if !c.Bool("report") {
+					count, err := pb.Recompress(c.Int("batch"), c.Duration("pause"))
+					if err != nil {
+						return cli.NewExitError(err.Error(), -1)
+					}
+					log.Infof("Recompressed %d packages", count)
 				}
 
+				report := pb.GetCompressionReport()
+				fmt.Printf("packages:  %d (%d documents)\n", report.Packages, report.Documents)
+				for codec, count := range report.Codecs {
+					fmt.Printf("  %-6s   %d\n", codec, count)
+				}
+				fmt.Printf("original:  %d bytes\n", report.OriginalSize)
+				fmt.Printf("stored:    %d bytes\n", report.StoredSize)
+				fmt.Printf("saved:     %.1f%%\n", report.Saved()*100)
+
+				return nil
+			},
+		},
+		{
+			Name:  "recount",
+			Usage: "Rebuild the counters of packages, documents, files and marks",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+			},
+			Action: func(c *cli.Context) error {
+				conf := getConfig(c.String("config"))
+
 				// global database frontend
 				pb := db.NewPocketBase(&conf.DB)
-				boltPath, _ := filepath.Abs(c.String("bolt"))
-				pb.Migrate(boltPath)
+				if err := pb.Recount(); err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+
+				stats := pb.GetStats()
+				log.WithFields(log.Fields{
+					"Packages":  stats.Packages,
+					"Marks":     stats.Marks,
+					"Documents": stats.Documents,
+					"Files":     stats.Files,
+				}).Info("Counters have been rebuilt")
 
 				return nil
 			},
@@ -151,23 +236,520 @@ func main() {
 			Usage: "Check consistency between database and on-disk data",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "config, c", Value: "config.toml"},
-				cli.BoolFlag{Name: "fix", Usage: "Fix errors (not implemented)"},
+				cli.BoolFlag{Name: "fix", Usage: "Reset inconsistent packages, remove orphan entries and download missing files again"},
 			},
 			Action: func(c *cli.Context) error {
 				conf := getConfig(c.String("config"))
+				fix := c.Bool("fix")
 
 				// global database frontend
 				pb := db.NewPocketBase(&conf.DB)
 				// database redundancy check
-				pb.Check()
+				dbReport, err := pb.Check(fix)
+				if err != nil {
+					log.Error(err)
+					return cli.NewExitError("Failed to check database", -1)
+				}
 
 				// file check
 				client := npm.NewMirrorClient(pb, &conf.Mirror)
-				client.Check()
+				fileReport := client.Check(fix)
+
+				summary, _ := json.MarshalIndent(map[string]interface{}{
+					"database": dbReport,
+					"files":    fileReport,
+				}, "", "  ")
+				fmt.Println(string(summary))
+
+				return nil
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "Remove tarballs which are not referenced by any document",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "Only show the tarballs that would be removed"},
+				cli.DurationFlag{Name: "grace", Value: 24 * time.Hour, Usage: "keep tarballs modified within this period"},
+			},
+			Action: func(c *cli.Context) error {
+				conf := getConfig(c.String("config"))
+				pb := db.NewPocketBase(&conf.DB)
+				client := npm.NewMirrorClient(pb, &conf.Mirror)
+
+				report, err := client.CollectGarbage(c.Bool("dry-run"), c.Duration("grace"))
+				if err != nil {
+					log.Error(err)
+					return cli.NewExitError("Failed to collect garbage", -1)
+				}
+
+				if report.DryRun {
+					for _, path := range report.Orphans {
+						fmt.Println(path)
+					}
+				}
+				fmt.Printf("scanned:    %d tarballs\n", report.Scanned)
+				fmt.Printf("referenced: %d\n", report.Referenced)
+				fmt.Printf("recent:     %d\n", report.Recent)
+				fmt.Printf("orphans:    %d (%d bytes)\n", len(report.Orphans), report.Size)
+				fmt.Printf("removed:    %d\n", report.Removed)
+
+				return nil
+			},
+		},
+		{
+			Name:  "dedupe",
+			Usage: "Move tarballs into the content-addressed layout to store identical tarballs once",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.BoolFlag{Name: "report", Usage: "Only show the space saved by the content-addressed layout"},
+			},
+			Action: func(c *cli.Context) error {
+				conf := getConfig(c.String("config"))
+				pb := db.NewPocketBase(&conf.DB)
+				client := npm.NewMirrorClient(pb, &conf.Mirror)
+
+				if !c.Bool("report") {
+					result, err := client.Dedupe()
+					if err != nil {
+						log.Error(err)
+						return cli.NewExitError("Failed to move tarballs", -1)
+					}
+					log.Infof("Moved %d tarballs and removed %d duplicates (%d missing)", result.Moved, result.Duplicates, result.Missing)
+				}
+
+				report := client.GetBlobReport()
+				fmt.Printf("tarballs:  %d (%d blobs)\n", report.Tarballs, report.Blobs)
+				fmt.Printf("original:  %d bytes\n", report.OriginalSize)
+				fmt.Printf("stored:    %d bytes\n", report.StoredSize)
+				fmt.Printf("saved:     %.1f%%\n", report.Saved()*100)
+
+				return nil
+			},
+		},
+		{
+			Name:      "prefetch",
+			Usage:     "Mirror the packages resolved by lockfiles and check their tarballs",
+			ArgsUsage: "<lockfile>...",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return cli.NewExitError("A lockfile is required", -1)
+				}
+
+				var locked []*npm.LockedPackage
+				for _, path := range c.Args() {
+					data, err := ioutil.ReadFile(path)
+					if err != nil {
+						return cli.NewExitError(err.Error(), -1)
+					}
+					packages, err := npm.ParseLockfile(data)
+					if err != nil {
+						return cli.NewExitError(fmt.Sprintf("Failed to parse %s: %v", path, err), -1)
+					}
+					log.Infof("%s: %d packages", path, len(packages))
+					locked = append(locked, packages...)
+				}
+
+				conf := getConfig(c.String("config"))
+				pb := db.NewPocketBase(&conf.DB)
+				client := npm.NewMirrorClient(pb, &conf.Mirror)
+				report := client.Prefetch(locked)
 
+				summary, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(summary))
+				if len(report.Missing) > 0 || len(report.Mismatched) > 0 {
+					return cli.NewExitError("Some locked packages are not available", -1)
+				}
 				return nil
 			},
 		},
+		{
+			Name:  "export",
+			Usage: "Write the documents and tarballs of packages to a bundle to carry across an air gap",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.StringFlag{Name: "packages, p", Usage: "file listing package names, one per line (required)"},
+				cli.StringFlag{Name: "out, o", Value: "bundle.tar", Usage: "path of the bundle"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.String("packages") == "" {
+					return cli.NewExitError("A package list is required", -1)
+				}
+				list, err := os.Open(c.String("packages"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+				names, err := npm.ReadPackageList(list)
+				list.Close()
+				if err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+
+				conf := getConfig(c.String("config"))
+				pb := db.NewPocketBase(&conf.DB)
+				client := npm.NewMirrorClient(pb, &conf.Mirror)
+				report, err := client.Export(names, c.String("out"))
+				if err != nil {
+					log.Error(err)
+					return cli.NewExitError("Failed to export packages", -1)
+				}
+
+				summary, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(summary))
+				return nil
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "Merge the packages of a bundle into the store after checking their shasums",
+			ArgsUsage: "<bundle>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return cli.NewExitError("A bundle is required", -1)
+				}
+
+				conf := getConfig(c.String("config"))
+				pb := db.NewPocketBase(&conf.DB)
+				client := npm.NewMirrorClient(pb, &conf.Mirror)
+				report, err := client.Import(c.Args().First())
+				if err != nil {
+					log.Error(err)
+					return cli.NewExitError("Failed to import the bundle", -1)
+				}
+
+				summary, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(summary))
+				if len(report.Invalid) > 0 {
+					return cli.NewExitError("Some packages in the bundle are invalid", -1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "log",
+			Usage: "Show the journal of mirrored, updated and deleted packages",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.StringFlag{Name: "since, s", Usage: "journal sequence, duration (24h) or time (2006-01-02 or RFC 3339)"},
+				cli.IntFlag{Name: "limit, n", Usage: "maximum number of entries (0 for all)"},
+				cli.BoolFlag{Name: "json", Usage: "Print an entry as JSON per line"},
+			},
+			Action: func(c *cli.Context) error {
+				conf := getConfig(c.String("config"))
+				query, err := db.ParseJournalSince(c.String("since"), time.Now())
+				if err != nil {
+					return cli.NewExitError(err.Error(), -1)
+				}
+				query.Limit = c.Int("limit")
+
+				// global database frontend
+				pb := db.NewPocketBase(&conf.DB)
+				enc := json.NewEncoder(os.Stdout)
+				pb.QueryJournal(query, func(entry *db.JournalEntry) bool {
+					if c.Bool("json") {
+						enc.Encode(entry)
+						return true
+					}
+
+					rev := entry.NewRevision
+					if entry.OldRevision != "" {
+						rev = entry.OldRevision + " -> " + entry.NewRevision
+					}
+					fmt.Printf("%d\t%s\t%d\t%s\t%s\t%s", entry.Sequence, entry.Time.Local().Format(time.RFC3339), entry.Upstream, entry.Action, entry.ID, rev)
+					if len(entry.Added) > 0 {
+						fmt.Printf("\t+%s", strings.Join(entry.Added, ",+"))
+					}
+					if len(entry.Removed) > 0 {
+						fmt.Printf("\t-%s", strings.Join(entry.Removed, ",-"))
+					}
+					fmt.Println()
+					return true
+				})
+
+				return nil
+			},
+		},
+		{
+			Name:  "downloads",
+			Usage: "Report the most downloaded packages and the packages never downloaded",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.StringFlag{Name: "period, p", Value: "all", Usage: "all, last-day, last-week, last-month, last-year, 2006-01-02 or 2006-01-02:2006-01-31"},
+				cli.IntFlag{Name: "top, n", Value: 20, Usage: "number of the most downloaded packages (0 for all)"},
+				cli.BoolFlag{Name: "unused", Usage: "List the names of the packages never downloaded"},
+			},
+			Action: func(c *cli.Context) error {
+				conf := getConfig(c.String("config"))
+				// counting started with the first download, so "all" covers every day
+				start, end := "0000-00-00", "9999-99-99"
+				if period := c.String("period"); period != "all" {
+					var err error
+					if start, end, err = db.ParseDownloadPeriod(period, time.Now()); err != nil {
+						return cli.NewExitError(err.Error(), -1)
+					}
+				}
+
+				// global database frontend
+				pb := db.NewPocketBase(&conf.DB)
+				report := pb.GetDownloadReport(start, end, c.Int("top"), c.Bool("unused"))
+				summary, _ := json.MarshalIndent(report, "", "  ")
+				fmt.Println(string(summary))
+
+				return nil
+			},
+		},
+		{
+			Name:      "advisories",
+			Usage:     "Import or refresh the local security advisory database",
+			ArgsUsage: "<file or directory of GitHub advisory JSON>...",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "config.toml"},
+				cli.BoolFlag{Name: "replace", Usage: "Remove all existing advisories before importing"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return cli.NewExitError("At least one advisory file or directory is required", -1)
+				}
+				conf := getConfig(c.String("config"))
+
+				// global database frontend
+				pb := db.NewPocketBase(&conf.DB)
+				if !pb.IsInitialized() {
+					pb.Init()
+				}
+
+				if c.Bool("replace") {
+					count := pb.ClearAdvisories()
+					log.Infof("Removed advisories of %d packages", count)
+				}
+
+				for _, path := range c.Args() {
+					path, _ = filepath.Abs(path)
+					advisories, err := npm.LoadAdvisories(path)
+					if err != nil {
+						return cli.NewExitError(err.Error(), -1)
+					}
+
+					count := 0
+					for name, items := range advisories {
+						if err := pb.PutAdvisories(name, items); err != nil {
+							log.Errorf("Failed to store advisories: %s %v", name, err)
+							continue
+						}
+						count += len(items)
+					}
+					log.Infof("Imported %d advisories for %d packages from %s", count, len(advisories), path)
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "block",
+			Usage: "Manage the package and version blocklist",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Block a package or a range of its versions",
+					ArgsUsage: "<name> [range]",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+						cli.StringFlag{Name: "reason, r", Usage: "reason for blocking (required)"},
+						cli.StringFlag{Name: "author, a", Value: os.Getenv("USER"), Usage: "author of the entry"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 || c.String("reason") == "" || c.String("author") == "" {
+							return cli.NewExitError("A name, a reason and an author are required", -1)
+						}
+						versions := c.Args().Get(1)
+						if err := npm.ValidateRange(versions); err != nil {
+							return cli.NewExitError(err.Error(), -1)
+						}
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						entry := &db.BlockEntry{
+							Name:    c.Args().First(),
+							Range:   versions,
+							Reason:  c.String("reason"),
+							Author:  c.String("author"),
+							Created: time.Now().UTC(),
+						}
+						if err := pb.AddBlockEntry(entry); err != nil {
+							return cli.NewExitError(err.Error(), -1)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "rm",
+					Usage:     "Remove an entry from the blocklist",
+					ArgsUsage: "<name> [range]",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return cli.NewExitError("A name is required", -1)
+						}
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						removed, err := pb.RemoveBlockEntry(c.Args().First(), c.Args().Get(1))
+						if err != nil {
+							return cli.NewExitError(err.Error(), -1)
+						}
+						if !removed {
+							return cli.NewExitError("No such entry", -1)
+						}
+						log.Info("Removed. Blocked versions have not been downloaded; re-sync the package to fetch them")
+
+						return nil
+					},
+				},
+				{
+					Name:  "ls",
+					Usage: "List the blocklist",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+					},
+					Action: func(c *cli.Context) error {
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						for _, entry := range pb.GetBlocklist() {
+							versions := entry.Range
+							if versions == "" {
+								versions = "*"
+							}
+							fmt.Printf("%s@%s\t%s\t%s\t%s\n", entry.Name, versions, entry.Author, entry.Created.Format(time.RFC3339), entry.Reason)
+						}
+
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "webhook",
+			Usage: "Manage webhooks notified of package updates",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Subscribe a url to changes of packages",
+					ArgsUsage: "<url>",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+						cli.StringSliceFlag{Name: "pattern, p", Usage: "package name glob such as @scope/* (all packages if none)"},
+						cli.StringSliceFlag{Name: "event, e", Usage: "update, publish, unpublish or delete (all events if none)"},
+						cli.StringFlag{Name: "secret, s", Usage: "secret to sign payloads with (random if empty)"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return cli.NewExitError("A url is required", -1)
+						}
+						hook, err := npm.NewWebhook(c.Args().First(), c.StringSlice("pattern"), c.StringSlice("event"), c.String("secret"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), -1)
+						}
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						if err := pb.PutWebhook(hook); err != nil {
+							log.Error(err)
+							return cli.NewExitError("Failed to add the webhook", -1)
+						}
+						fmt.Printf("id:     %s\n", hook.ID)
+						fmt.Printf("secret: %s\n", hook.Secret)
+
+						return nil
+					},
+				},
+				{
+					Name:      "rm",
+					Usage:     "Remove a webhook and its delivery history",
+					ArgsUsage: "<id>",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+					},
+					Action: func(c *cli.Context) error {
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						removed, err := pb.RemoveWebhook(c.Args().First())
+						if err != nil {
+							log.Error(err)
+							return cli.NewExitError("Failed to remove the webhook", -1)
+						}
+						if !removed {
+							return cli.NewExitError("No such webhook", -1)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:  "ls",
+					Usage: "List webhooks",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+					},
+					Action: func(c *cli.Context) error {
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						for _, hook := range pb.GetWebhooks() {
+							patterns, events := strings.Join(hook.Patterns, ","), strings.Join(hook.Events, ",")
+							if patterns == "" {
+								patterns = "*"
+							}
+							if events == "" {
+								events = "*"
+							}
+							fmt.Printf("%s\t%s\t%s\t%s\n", hook.ID, hook.URL, patterns, events)
+						}
+
+						return nil
+					},
+				},
+				{
+					Name:      "deliveries",
+					Usage:     "Show the recent deliveries of a webhook",
+					ArgsUsage: "<id>",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "config, c", Value: "config.toml"},
+					},
+					Action: func(c *cli.Context) error {
+						conf := getConfig(c.String("config"))
+
+						// global database frontend
+						pb := db.NewPocketBase(&conf.DB)
+						for _, delivery := range pb.GetDeliveries(c.Args().First()) {
+							status := "delivered"
+							if !delivery.Delivered {
+								status = "failed: " + delivery.Error
+							}
+							fmt.Printf("%d\t%s\t%s\t%s\t%d attempts\t%s\n", delivery.ID, delivery.Time.Local().Format(time.RFC3339), delivery.Package, strings.Join(delivery.Events, ","), delivery.Attempts, status)
+						}
+
+						return nil
+					},
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
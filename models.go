@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/ssut/pocketnpm/db"
+	"github.com/ssut/pocketnpm/log"
 	"github.com/ssut/pocketnpm/npm"
 )
 
@@ -9,4 +10,5 @@ type PocketConfig struct {
 	DB     db.DatabaseConfig `toml:"database"`
 	Mirror npm.MirrorConfig  `toml:"mirror"`
 	Server npm.ServerConfig  `toml:"server"`
+	Log    log.Config        `toml:"log"`
 }
@@ -0,0 +1,185 @@
+package npm
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats of the access log
+const (
+	AccessLogText     = "text"
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+)
+
+// Periods of the time based rotation of the access log
+const (
+	RotateHourly = "hourly"
+	RotateDaily  = "daily"
+)
+
+// newAccessLog opens the access log at the path with the formatter of the
+// configured format, which is written through a rotating file
+func newAccessLog(path string, config *AccessLogConfig) (*logrus.Logger, *lumberjack.Logger, error) {
+	var formatter logrus.Formatter
+	switch config.Format {
+	case "", AccessLogText:
+		formatter = &logrus.TextFormatter{
+			FullTimestamp:    true,
+			DisableColors:    true,
+			QuoteEmptyFields: true,
+		}
+	case AccessLogJSON:
+		formatter = &logrus.JSONFormatter{}
+	case AccessLogCombined:
+		formatter = &combinedFormatter{}
+	default:
+		return nil, nil, fmt.Errorf("Unknown access log format: %s", config.Format)
+	}
+	switch config.Rotate {
+	case "", RotateHourly, RotateDaily:
+	default:
+		return nil, nil, fmt.Errorf("Unknown access log rotation: %s", config.Rotate)
+	}
+
+	path, _ = filepath.Abs(path)
+	// lumberjack opens the file on the first write, so that it is checked here
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	file.Close()
+
+	out := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAge,
+		Compress:   config.Compress,
+		LocalTime:  true,
+	}
+	logger := logrus.New()
+	logger.Out = out
+	logger.Formatter = formatter
+
+	return logger, out, nil
+}
+
+// requestPackage returns the name of the package requested, which is split
+// into the name and the version parameters for scoped packages
+func requestPackage(ctx *fasthttp.RequestCtx) string {
+	name, _ := ctx.UserValue("name").(string)
+	if strings.HasPrefix(name, "@") && !strings.Contains(name, "/") {
+		if version, _ := ctx.UserValue("version").(string); version != "" && version != "-" {
+			name += "/" + version
+		}
+	}
+	return name
+}
+
+// setDocumentCache records for the access log whether the document of a
+// request was taken from the cache
+func setDocumentCache(ctx *fasthttp.RequestCtx, cached bool) {
+	if cached {
+		ctx.SetUserValue("cache", "hit")
+	} else {
+		ctx.SetUserValue("cache", "miss")
+	}
+}
+
+// accessFields returns the fields of the access log of a request
+//
+// Cache is "hit" when the document was taken from the cache and "miss" when
+// it was read from the store, and is empty when no document was read.
+// NotModified is whether the client already has the content (304).
+func accessFields(ctx *fasthttp.RequestCtx, elapsed time.Duration) logrus.Fields {
+	status := ctx.Response.StatusCode()
+	// the body of streamed responses is not read, and redirected ones only
+	// have the header
+	size := ctx.Response.Header.ContentLength()
+	if !ctx.Response.IsBodyStream() && len(ctx.Response.Body()) > size {
+		size = len(ctx.Response.Body())
+	}
+	if size < 0 {
+		size = 0
+	}
+	cache, _ := ctx.UserValue("cache").(string)
+
+	return logrus.Fields{
+		"IP":          ctx.RemoteIP().String(),
+		"Method":      string(ctx.Method()),
+		"Path":        string(ctx.RequestURI()),
+		"Protocol":    string(ctx.Request.Header.Protocol()),
+		"StatusCode":  status,
+		"Bytes":       size,
+		"Elapsed":     elapsed.String(),
+		"Referer":     string(ctx.Referer()),
+		"User-Agent":  string(ctx.UserAgent()),
+		"Npm-Session": string(ctx.Request.Header.Peek("Npm-Session")),
+		"Npm-Command": string(ctx.Request.Header.Peek("Npm-Command")),
+		"Cache":       cache,
+		"NotModified": status == 304,
+		"Package":     requestPackage(ctx),
+	}
+}
+
+// combinedFormatter formats access logs in the Combined Log Format followed by
+// the npm session, the npm command, the cache status, the package and the
+// elapsed time
+type combinedFormatter struct{}
+
+// Format formats an entry of the access log
+func (f *combinedFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	field := func(key string) string {
+		value := fmt.Sprint(entry.Data[key])
+		if value == "" || entry.Data[key] == nil {
+			return "-"
+		}
+		return strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1)
+	}
+
+	return []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %s %s \"%s\" \"%s\" \"%s\" \"%s\" %s %s %s\n",
+		field("IP"), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		field("Method"), field("Path"), field("Protocol"), field("StatusCode"), field("Bytes"),
+		field("Referer"), field("User-Agent"), field("Npm-Session"), field("Npm-Command"),
+		field("Cache"), field("Package"), field("Elapsed"))), nil
+}
+
+// rotateAccessLog rotates the access log at the start of every hour or day
+func (server *PocketServer) rotateAccessLog() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Hour).Add(time.Hour)
+		if server.serverConfig.AccessLog.Rotate == RotateDaily {
+			next = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		}
+		time.Sleep(next.Sub(now))
+
+		if err := server.accessLog.Rotate(); err != nil {
+			serverLog.Errorf("Failed to rotate the access log: %v", err)
+		}
+	}
+}
+
+// reopenAccessLog closes the access log on SIGHUP so that the next request
+// opens the file again after it has been moved by logrotate
+func (server *PocketServer) reopenAccessLog() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := server.accessLog.Close(); err != nil {
+			serverLog.Errorf("Failed to close the access log: %v", err)
+		}
+		serverLog.Info("Reopening the access log")
+	}
+}
@@ -0,0 +1,72 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAccessLog(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	request := func(server *PocketServer) {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI("/@s/b?write=true")
+		ctx.Request.Header.Set("Referer", "http://example.com/")
+		ctx.Request.Header.Set("Npm-Session", "abc")
+		ctx.Request.Header.Set("Npm-Command", "install")
+		ctx.Request.Header.SetUserAgent(`npm/10 "quoted"`)
+		ctx.SetUserValue("name", "@s")
+		ctx.SetUserValue("version", "b")
+		server.logging(func(ctx *fasthttp.RequestCtx) {
+			setDocumentCache(ctx, false)
+			ctx.WriteString("document")
+		})(&ctx)
+	}
+
+	path := filepath.Join(base, "access.log")
+	logger, out, err := newAccessLog(path, &AccessLogConfig{Format: AccessLogJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(&PocketServer{logger: logger, accessLog: out})
+	out.Close()
+
+	var entry map[string]interface{}
+	raw, _ := ioutil.ReadFile(path)
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["Method"] != "GET" || entry["Path"] != "/@s/b?write=true" || entry["Bytes"] != float64(8) || entry["Package"] != "@s/b" ||
+		entry["Cache"] != "miss" || entry["NotModified"] != false || entry["Npm-Session"] != "abc" || entry["Npm-Command"] != "install" || entry["Referer"] != "http://example.com/" {
+		t.Errorf("TestAccessLog: unexpected json entry %s", raw)
+	}
+
+	path = filepath.Join(base, "combined.log")
+	logger, out, err = newAccessLog(path, &AccessLogConfig{Format: AccessLogCombined})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(&PocketServer{logger: logger, accessLog: out})
+	out.Close()
+
+	raw, _ = ioutil.ReadFile(path)
+	line := string(raw)
+	expected := `"GET /@s/b?write=true HTTP/1.1" 200 8 "http://example.com/" "npm/10 \"quoted\"" "abc" "install" miss @s/b `
+	if !strings.HasPrefix(line, "0.0.0.0 - - [") || !strings.Contains(line, expected) {
+		t.Errorf("TestAccessLog: unexpected combined entry %s", line)
+	}
+
+	if _, _, err := newAccessLog(path, &AccessLogConfig{Format: "xml"}); err == nil {
+		t.Error("TestAccessLog: expected an error of an unknown format")
+	}
+}
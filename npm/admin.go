@@ -0,0 +1,158 @@
+package npm
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// SetMirrorClient attaches the mirror client running in the same process
+// so that it can be controlled through the admin API
+func (server *PocketServer) SetMirrorClient(client *MirrorClient) {
+	server.mirror = client
+}
+
+// withMirror rejects requests when no mirror client is running in the process
+func (server *PocketServer) withMirror(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		if server.mirror == nil {
+			ctx.SetStatusCode(503)
+			server.writeJSON(ctx, map[string]string{
+				"error": "Mirroring is not running in this process",
+			})
+			return
+		}
+
+		next(ctx)
+	})
+}
+
+// resyncPackage marks a package as incomplete and queues it for mirroring
+//
+// POST /-/admin/resync/:name
+func (server *PocketServer) resyncPackage(ctx *fasthttp.RequestCtx) {
+	name, rest := splitPackagePath(ctx.UserValue("path").(string))
+	if name == "" || len(rest) > 0 {
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	var err error
+	if server.mirror != nil {
+		err = server.mirror.Resync(name)
+	} else {
+		// the package will be mirrored by the next run of the mirror process
+		err = server.db.ResetPackage(name)
+	}
+	if err != nil {
+		serverLog.Errorf("Failed to resync a package: %s %v", name, err)
+		ctx.SetStatusCode(500)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx.SetStatusCode(202)
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok":     true,
+		"id":     name,
+		"queued": server.mirror != nil,
+	})
+}
+
+// getMirrorStatus returns the state of the update loop, the queue and in-flight workers
+//
+// GET /-/admin/mirror?limit=100
+func (server *PocketServer) getMirrorStatus(ctx *fasthttp.RequestCtx) {
+	limit, err := ctx.QueryArgs().GetUint("limit")
+	if err != nil {
+		limit = 100
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, server.mirror.Status(limit))
+}
+
+// controlMirror pauses or resumes the update loop, or triggers an immediate poll of changes
+//
+// POST /-/admin/mirror/(pause|resume|poll)
+func (server *PocketServer) controlMirror(ctx *fasthttp.RequestCtx) {
+	action := ctx.UserValue("action").(string)
+	switch action {
+	case "pause":
+		server.mirror.Pause()
+	case "resume":
+		server.mirror.Resume()
+	case "poll":
+		server.mirror.Poll()
+	default:
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok":     true,
+		"action": action,
+		"paused": server.mirror.Paused(),
+	})
+}
+
+// purgeCache drops cached entries of a package, or the entire cache if no name is given
+//
+// DELETE /-/admin/cache?name=...
+func (server *PocketServer) purgeCache(ctx *fasthttp.RequestCtx) {
+	name := string(ctx.QueryArgs().Peek("name"))
+	before := server.db.CacheLen()
+	server.db.PurgeCache(name)
+	serverLog.Infof("Cache: purged %q", name)
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok":      true,
+		"entries": before - server.db.CacheLen(),
+	})
+}
+
+// getJournal lists the journal of mirrored, updated and deleted packages
+//
+// since is either a journal sequence, a duration such as 24h or a time.
+//
+// GET /-/admin/log?since=...&limit=1000
+func (server *PocketServer) getJournal(ctx *fasthttp.RequestCtx) {
+	query, err := db.ParseJournalSince(string(ctx.QueryArgs().Peek("since")), time.Now())
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	query.Limit, err = ctx.QueryArgs().GetUint("limit")
+	if err != nil {
+		query.Limit = 1000
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		last := query.Since
+		count := 0
+
+		w.WriteString(`{"entries":[`)
+		server.db.QueryJournal(query, func(entry *db.JournalEntry) bool {
+			if count > 0 {
+				w.WriteByte(',')
+			}
+			count++
+			last = entry.Sequence
+
+			enc.Encode(entry)
+			return true
+		})
+		w.WriteString(`],"last_seq":` + strconv.Itoa(last) + "}")
+	})
+}
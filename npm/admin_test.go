@@ -0,0 +1,104 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestAdminHandlers(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","versions":{}}`, "1", nil, nil)
+
+	server := &PocketServer{
+		db:           pb,
+		storage:      client.storage,
+		serverConfig: &ServerConfig{AdminToken: "secret"},
+		mirrorConfig: client.config,
+		router:       fasthttprouter.New(),
+		apiRouter:    fasthttprouter.New(),
+		couchRouter:  fasthttprouter.New(),
+	}
+	server.addRoutes()
+
+	request := func(method string, path string, token string) (int, map[string]interface{}) {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI(path)
+		if token != "" {
+			ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+		server.handler(&ctx)
+
+		var body map[string]interface{}
+		json.Unmarshal(ctx.Response.Body(), &body)
+		return ctx.Response.StatusCode(), body
+	}
+
+	// every admin route requires the token
+	for _, path := range []string{"/-/admin/mirror/pause", "/-/admin/resync/test"} {
+		if status, _ := request("POST", path, ""); status != 403 {
+			t.Errorf("TestAdminHandlers: %s expected 403 without a token actual %d", path, status)
+		}
+		if status, _ := request("POST", path, "wrong"); status != 403 {
+			t.Errorf("TestAdminHandlers: %s expected 403 with a wrong token actual %d", path, status)
+		}
+	}
+	if status, _ := request("DELETE", "/-/admin/cache", ""); status != 403 {
+		t.Errorf("TestAdminHandlers: expected 403 for purge without a token actual %d", status)
+	}
+
+	// the mirror can't be controlled when it is not running in the process
+	if status, _ := request("POST", "/-/admin/mirror/pause", "secret"); status != 503 {
+		t.Errorf("TestAdminHandlers: expected 503 without a mirror client actual %d", status)
+	}
+	if status, body := request("POST", "/-/admin/resync/test", "secret"); status != 202 || body["queued"] != false {
+		t.Errorf("TestAdminHandlers: unexpected resync without a mirror client %d %v", status, body)
+	}
+
+	server.SetMirrorClient(client)
+	if status, body := request("POST", "/-/admin/mirror/pause", "secret"); status != 200 || body["paused"] != true || !client.Paused() {
+		t.Errorf("TestAdminHandlers: unexpected pause %d %v", status, body)
+	}
+	if status, body := request("POST", "/-/admin/mirror/resume", "secret"); status != 200 || body["paused"] != false || client.Paused() {
+		t.Errorf("TestAdminHandlers: unexpected resume %d %v", status, body)
+	}
+	if status, _ := request("POST", "/-/admin/mirror/unknown", "secret"); status != 404 {
+		t.Errorf("TestAdminHandlers: expected 404 for an unknown action actual %d", status)
+	}
+
+	pb.PutCompleted(pack, `{"_id":"test","versions":{}}`, "1", nil, nil)
+	if status, body := request("POST", "/-/admin/resync/test", "secret"); status != 202 || body["queued"] != true {
+		t.Errorf("TestAdminHandlers: unexpected resync %d %v", status, body)
+	}
+	incomplete := pb.GetIncompletePackages()
+	if len(incomplete) != 1 || incomplete[0].ID != "test" || !client.takeResynced() {
+		t.Errorf("TestAdminHandlers: package was not queued for resync %v", incomplete)
+	}
+
+	pb.GetCachedDocument("test", false)
+	if _, _, cached, _ := pb.GetCachedDocument("test", false); !cached {
+		t.Fatal("TestAdminHandlers: document was not cached")
+	}
+	if status, body := request("DELETE", "/-/admin/cache?name=test", "secret"); status != 200 || body["ok"] != true {
+		t.Errorf("TestAdminHandlers: unexpected purge %d %v", status, body)
+	}
+	if _, _, cached, _ := pb.GetCachedDocument("test", false); cached {
+		t.Errorf("TestAdminHandlers: document is still cached after the purge")
+	}
+}
@@ -0,0 +1,571 @@
+package npm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// githubAdvisory covers both the OSV format used by github/advisory-database
+// and the format of the GitHub REST API (/advisories)
+type githubAdvisory struct {
+	// OSV
+	ID        string   `json:"id"`
+	Aliases   []string `json:"aliases"`
+	Summary   string   `json:"summary"`
+	Details   string   `json:"details"`
+	Published string   `json:"published"`
+	Modified  string   `json:"modified"`
+	Affected  []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []struct {
+				Introduced   string `json:"introduced"`
+				Fixed        string `json:"fixed"`
+				LastAffected string `json:"last_affected"`
+			} `json:"events"`
+		} `json:"ranges"`
+		Versions []string `json:"versions"`
+	} `json:"affected"`
+	References []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"references"`
+	DatabaseSpecific struct {
+		Severity string   `json:"severity"`
+		CWEIDs   []string `json:"cwe_ids"`
+	} `json:"database_specific"`
+
+	// REST API
+	GHSAID      string `json:"ghsa_id"`
+	CVEID       string `json:"cve_id"`
+	HTMLURL     string `json:"html_url"`
+	Description string `json:"description"`
+	Severity    string `json:"severity"`
+	PublishedAt string `json:"published_at"`
+	UpdatedAt   string `json:"updated_at"`
+	CWEs        []struct {
+		CWEID string `json:"cwe_id"`
+	} `json:"cwes"`
+	Vulnerabilities []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		VulnerableVersionRange string      `json:"vulnerable_version_range"`
+		FirstPatchedVersion    interface{} `json:"first_patched_version"`
+	} `json:"vulnerabilities"`
+}
+
+// LoadAdvisories reads a GitHub advisory export and returns npm advisories grouped by package
+//
+// The path can be a JSON file containing a single advisory or an array of them,
+// or a directory (such as a checkout of github/advisory-database) which is walked for JSON files.
+func LoadAdvisories(path string) (map[string][]*db.Advisory, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	if stat.IsDir() {
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		paths = []string{path}
+	}
+
+	all := map[string][]*db.Advisory{}
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []*githubAdvisory
+		if trimmed := strings.TrimSpace(string(b)); strings.HasPrefix(trimmed, "[") {
+			err = ffjson.Unmarshal(b, &items)
+		} else {
+			var item githubAdvisory
+			err = ffjson.Unmarshal(b, &item)
+			items = []*githubAdvisory{&item}
+		}
+		if err != nil {
+			serverLog.Warnf("Failed to decode advisory file: %s (%v)", p, err)
+			continue
+		}
+
+		for _, item := range items {
+			for name, advisory := range item.toAdvisories() {
+				all[name] = append(all[name], advisory)
+			}
+		}
+	}
+
+	return all, nil
+}
+
+// toAdvisories converts the advisory into one advisory per affected npm package
+func (a *githubAdvisory) toAdvisories() map[string]*db.Advisory {
+	base := db.Advisory{
+		ID:       a.ID,
+		Title:    a.Summary,
+		Overview: a.Details,
+		Severity: normalizeSeverity(a.DatabaseSpecific.Severity),
+		CWEs:     a.DatabaseSpecific.CWEIDs,
+		Created:  parseTime(a.Published),
+		Updated:  parseTime(a.Modified),
+	}
+	for _, alias := range a.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			base.CVEs = append(base.CVEs, alias)
+		}
+	}
+	for _, ref := range a.References {
+		if ref.Type == "ADVISORY" || base.URL == "" {
+			base.URL = ref.URL
+		}
+	}
+
+	if a.GHSAID != "" {
+		base.ID = a.GHSAID
+		base.Title = a.Summary
+		base.Overview = a.Description
+		base.Severity = normalizeSeverity(a.Severity)
+		base.URL = a.HTMLURL
+		base.Created = parseTime(a.PublishedAt)
+		base.Updated = parseTime(a.UpdatedAt)
+		base.CWEs = nil
+		for _, cwe := range a.CWEs {
+			base.CWEs = append(base.CWEs, cwe.CWEID)
+		}
+		if a.CVEID != "" {
+			base.CVEs = []string{a.CVEID}
+		}
+	}
+
+	ranges := map[string][]string{}
+	bounds := map[string][]*affectedRange{}
+
+	for _, affected := range a.Affected {
+		if !strings.EqualFold(affected.Package.Ecosystem, "npm") {
+			continue
+		}
+		name := affected.Package.Name
+
+		for _, r := range affected.Ranges {
+			if r.Type != "SEMVER" && r.Type != "ECOSYSTEM" {
+				continue
+			}
+
+			var current []string
+			var bound *affectedRange
+			for _, event := range r.Events {
+				switch {
+				case event.Introduced != "":
+					if len(current) > 0 {
+						ranges[name] = append(ranges[name], strings.Join(current, " "))
+						bounds[name] = append(bounds[name], bound)
+					}
+					current = []string{}
+					bound = &affectedRange{}
+					if event.Introduced != "0" {
+						current = append(current, ">="+event.Introduced)
+						bound.Introduced = event.Introduced
+					}
+				case event.Fixed != "":
+					if bound == nil {
+						bound = &affectedRange{}
+					}
+					bound.Fixed = event.Fixed
+					current = append(current, "<"+event.Fixed)
+					ranges[name] = append(ranges[name], strings.Join(current, " "))
+					bounds[name] = append(bounds[name], bound)
+					current, bound = nil, nil
+				case event.LastAffected != "":
+					if bound == nil {
+						bound = &affectedRange{}
+					}
+					current = append(current, "<="+event.LastAffected)
+					ranges[name] = append(ranges[name], strings.Join(current, " "))
+					bounds[name] = append(bounds[name], bound)
+					current, bound = nil, nil
+				}
+			}
+			if current != nil {
+				r := strings.Join(current, " ")
+				if r == "" {
+					r = "*"
+				}
+				ranges[name] = append(ranges[name], r)
+				bounds[name] = append(bounds[name], bound)
+			}
+		}
+		ranges[name] = append(ranges[name], affected.Versions...)
+	}
+
+	for _, vuln := range a.Vulnerabilities {
+		if !strings.EqualFold(vuln.Package.Ecosystem, "npm") {
+			continue
+		}
+		name := vuln.Package.Name
+
+		r := strings.TrimSpace(vuln.VulnerableVersionRange)
+		if r == "" {
+			continue
+		}
+		bound := &affectedRange{}
+		if parsed, err := parseRange(r); err == nil {
+			r = parsed.String()
+			if len(parsed) == 1 {
+				for _, c := range parsed[0] {
+					if c.Operator == ">=" || c.Operator == ">" {
+						bound.Introduced = c.Version.String()
+					}
+				}
+			}
+		}
+		ranges[name] = append(ranges[name], r)
+
+		switch patched := vuln.FirstPatchedVersion.(type) {
+		case string:
+			bound.Fixed = patched
+		case map[string]interface{}:
+			if identifier, ok := patched["identifier"].(string); ok {
+				bound.Fixed = identifier
+			}
+		}
+		bounds[name] = append(bounds[name], bound)
+	}
+
+	advisories := map[string]*db.Advisory{}
+	for name, r := range ranges {
+		if len(r) == 0 {
+			serverLog.Debugf("Skipping advisory %s of %s without vulnerable versions", base.ID, name)
+			continue
+		}
+
+		advisory := base
+		advisory.VulnerableVersions = strings.Join(r, " || ")
+		advisory.PatchedVersions = patchedVersions(bounds[name])
+		advisories[name] = &advisory
+	}
+
+	return advisories
+}
+
+// affectedRange is a vulnerable range of a package bounded by the version
+// introducing the vulnerability and the version fixing it
+type affectedRange struct {
+	Introduced string
+	Fixed      string
+}
+
+// patchedVersions returns the patched range of the affected ranges
+//
+// Each fixed version is patched only up to the version introducing the next
+// range, so that a later vulnerable range is not reported as patched.
+func patchedVersions(bounds []*affectedRange) string {
+	sorted := make([]*affectedRange, 0, len(bounds))
+	for _, bound := range bounds {
+		if bound != nil {
+			sorted = append(sorted, bound)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareVersions(sorted[i].Introduced, sorted[j].Introduced) < 0
+	})
+
+	var patched []string
+	for i, bound := range sorted {
+		if bound.Fixed == "" {
+			continue
+		}
+
+		r := ">=" + bound.Fixed
+		if i+1 < len(sorted) && sorted[i+1].Introduced != "" {
+			next := sorted[i+1].Introduced
+			if compareVersions(next, bound.Fixed) <= 0 {
+				continue
+			}
+			r += " <" + next
+		}
+		patched = append(patched, r)
+	}
+
+	if len(patched) == 0 {
+		return "<0.0.0"
+	}
+	return strings.Join(patched, " || ")
+}
+
+// compareVersions compares two versions, where an empty or invalid version
+// comes first
+func compareVersions(a, b string) int {
+	va, errA := parseSemver(a)
+	vb, errB := parseSemver(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
+
+func normalizeSeverity(severity string) string {
+	severity = strings.ToLower(severity)
+	switch severity {
+	case "medium":
+		return "moderate"
+	case "low", "moderate", "high", "critical":
+		return severity
+	}
+	return "info"
+}
+
+func parseTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
+
+// advisoryID returns a numeric id for the advisory of the package as npm
+// expects numbers
+//
+// An advisory affecting several packages gets an id per package, since npm
+// reports each of them as a separate advisory.
+func advisoryID(advisory *db.Advisory, name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(advisory.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// readAuditBody returns the request body, decompressing it if needed
+func readAuditBody(ctx *fasthttp.RequestCtx) ([]byte, error) {
+	if strings.Contains(string(ctx.Request.Header.Peek("Content-Encoding")), "gzip") {
+		return ctx.Request.BodyGunzip()
+	}
+	return ctx.PostBody(), nil
+}
+
+// matchAdvisories returns the advisories of the package affecting the version
+func (server *PocketServer) matchAdvisories(name string, version string) (matched []*db.Advisory) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return
+	}
+
+	for _, advisory := range server.db.GetAdvisories(name) {
+		if advisory.VulnerableVersions == "" {
+			continue
+		}
+		r, err := parseRange(advisory.VulnerableVersions)
+		if err != nil {
+			serverLog.Debugf("Invalid range in advisory %s: %s", advisory.ID, advisory.VulnerableVersions)
+			continue
+		}
+		if r.Match(v) {
+			matched = append(matched, advisory)
+		}
+	}
+
+	return
+}
+
+// bulkAdvisories implements /-/npm/v1/security/advisories/bulk used by npm >= 7
+//
+// The request body is a map of package names to the list of installed versions.
+func (server *PocketServer) bulkAdvisories(ctx *fasthttp.RequestCtx) {
+	body, err := readAuditBody(ctx)
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var request map[string][]string
+	if err := ffjson.Unmarshal(body, &request); err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{"error": err.Error()})
+		return
+	}
+
+	output := map[string][]map[string]interface{}{}
+	for name, versions := range request {
+		seen := map[string]bool{}
+		for _, version := range versions {
+			for _, advisory := range server.matchAdvisories(name, version) {
+				if seen[advisory.ID] {
+					continue
+				}
+				seen[advisory.ID] = true
+
+				output[name] = append(output[name], map[string]interface{}{
+					"id":                  advisoryID(advisory, name),
+					"url":                 advisory.URL,
+					"title":               advisory.Title,
+					"severity":            advisory.Severity,
+					"vulnerable_versions": advisory.VulnerableVersions,
+					"cwe":                 advisory.CWEs,
+					"cvss": map[string]interface{}{
+						"score":        0,
+						"vectorString": nil,
+					},
+				})
+			}
+		}
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, output)
+}
+
+// auditDependency is a node of the dependency tree sent by npm 6 audit
+type auditDependency struct {
+	Version      string                      `json:"version"`
+	Dev          bool                        `json:"dev"`
+	Optional     bool                        `json:"optional"`
+	Dependencies map[string]*auditDependency `json:"dependencies"`
+}
+
+type auditFinding struct {
+	Version  string   `json:"version"`
+	Paths    []string `json:"paths"`
+	Dev      bool     `json:"dev"`
+	Optional bool     `json:"optional"`
+	Bundled  bool     `json:"bundled"`
+}
+
+// auditQuick implements /-/npm/v1/security/audits/quick used by npm 6
+func (server *PocketServer) auditQuick(ctx *fasthttp.RequestCtx) {
+	body, err := readAuditBody(ctx)
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var request auditDependency
+	if err := ffjson.Unmarshal(body, &request); err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{"error": err.Error()})
+		return
+	}
+
+	advisories := map[uint32]map[string]interface{}{}
+	findings := map[uint32]map[string]*auditFinding{}
+	counts := map[string]int{"dependencies": 0, "devDependencies": 0, "optionalDependencies": 0}
+
+	var walk func(deps map[string]*auditDependency, parents []string)
+	walk = func(deps map[string]*auditDependency, parents []string) {
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			dep := deps[name]
+			if dep == nil {
+				continue
+			}
+			path := append(append([]string{}, parents...), name)
+
+			switch {
+			case dep.Dev:
+				counts["devDependencies"]++
+			case dep.Optional:
+				counts["optionalDependencies"]++
+			default:
+				counts["dependencies"]++
+			}
+
+			for _, advisory := range server.matchAdvisories(name, dep.Version) {
+				id := advisoryID(advisory, name)
+				if _, ok := advisories[id]; !ok {
+					advisories[id] = map[string]interface{}{
+						"id":                  id,
+						"github_advisory_id":  advisory.ID,
+						"title":               advisory.Title,
+						"module_name":         name,
+						"severity":            advisory.Severity,
+						"vulnerable_versions": advisory.VulnerableVersions,
+						"patched_versions":    advisory.PatchedVersions,
+						"overview":            advisory.Overview,
+						"recommendation":      fmt.Sprintf("Upgrade to version %s", advisory.PatchedVersions),
+						"url":                 advisory.URL,
+						"cwe":                 strings.Join(advisory.CWEs, ", "),
+						"cves":                advisory.CVEs,
+						"created":             advisory.Created,
+						"updated":             advisory.Updated,
+						"access":              "public",
+					}
+					findings[id] = map[string]*auditFinding{}
+				}
+
+				finding, ok := findings[id][dep.Version]
+				if !ok {
+					finding = &auditFinding{Version: dep.Version, Dev: dep.Dev, Optional: dep.Optional}
+					findings[id][dep.Version] = finding
+				}
+				finding.Paths = append(finding.Paths, strings.Join(path, ">"))
+			}
+
+			walk(dep.Dependencies, path)
+		}
+	}
+	walk(request.Dependencies, nil)
+
+	vulnerabilities := map[string]int{"info": 0, "low": 0, "moderate": 0, "high": 0, "critical": 0}
+	output := map[string]interface{}{}
+	for id, advisory := range advisories {
+		var list []*auditFinding
+		for _, finding := range findings[id] {
+			list = append(list, finding)
+			vulnerabilities[advisory["severity"].(string)] += len(finding.Paths)
+		}
+		advisory["findings"] = list
+		output[fmt.Sprint(id)] = advisory
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, map[string]interface{}{
+		"actions":    []interface{}{},
+		"advisories": output,
+		"muted":      []interface{}{},
+		"metadata": map[string]interface{}{
+			"vulnerabilities":      vulnerabilities,
+			"dependencies":         counts["dependencies"],
+			"devDependencies":      counts["devDependencies"],
+			"optionalDependencies": counts["optionalDependencies"],
+			"totalDependencies":    counts["dependencies"] + counts["devDependencies"] + counts["optionalDependencies"],
+		},
+	})
+}
@@ -0,0 +1,96 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestToAdvisories(t *testing.T) {
+	tests := []struct {
+		advisory   string
+		vulnerable map[string]string
+		patched    map[string]string
+	}{
+		{
+			advisory:   `{"id":"GHSA-1","affected":[{"package":{"ecosystem":"npm","name":"a"},"ranges":[{"type":"SEMVER","events":[{"introduced":"0"},{"fixed":"1.2.3"},{"introduced":"2.0.0"},{"fixed":"2.1.0"}]}]}]}`,
+			vulnerable: map[string]string{"a": "<1.2.3 || >=2.0.0 <2.1.0"},
+			patched:    map[string]string{"a": ">=1.2.3 <2.0.0 || >=2.1.0"},
+		},
+		{
+			advisory:   `{"id":"GHSA-2","affected":[{"package":{"ecosystem":"npm","name":"a"},"ranges":[{"type":"SEMVER","events":[{"introduced":"1.0.0"},{"last_affected":"1.5.0"}]}]},{"package":{"ecosystem":"npm","name":"b"},"ranges":[{"type":"SEMVER","events":[{"introduced":"0"},{"fixed":"3.0.0"}]}]}]}`,
+			vulnerable: map[string]string{"a": ">=1.0.0 <=1.5.0", "b": "<3.0.0"},
+			patched:    map[string]string{"a": "<0.0.0", "b": ">=3.0.0"},
+		},
+		{
+			advisory:   `{"id":"GHSA-3","affected":[{"package":{"ecosystem":"npm","name":"a"}},{"package":{"ecosystem":"npm","name":"b"},"ranges":[{"type":"GIT","events":[{"introduced":"0"}]}]}]}`,
+			vulnerable: map[string]string{},
+		},
+		{
+			advisory:   `{"ghsa_id":"GHSA-4","vulnerabilities":[{"package":{"ecosystem":"npm","name":"a"},"vulnerable_version_range":">= 2.0.0, < 2.1.0","first_patched_version":{"identifier":"2.1.0"}},{"package":{"ecosystem":"npm","name":"a"},"vulnerable_version_range":"< 1.2.3","first_patched_version":"1.2.3"},{"package":{"ecosystem":"npm","name":"b"},"vulnerable_version_range":""}]}`,
+			vulnerable: map[string]string{"a": ">=2.0.0 <2.1.0 || <1.2.3"},
+			patched:    map[string]string{"a": ">=1.2.3 <2.0.0 || >=2.1.0"},
+		},
+	}
+
+	for i, test := range tests {
+		var item githubAdvisory
+		if err := ffjson.Unmarshal([]byte(test.advisory), &item); err != nil {
+			t.Fatal(err)
+		}
+
+		advisories := item.toAdvisories()
+		if len(advisories) != len(test.vulnerable) {
+			t.Errorf("toAdvisories(%d): unexpected advisories %v", i, advisories)
+			continue
+		}
+		for name, advisory := range advisories {
+			if advisory.VulnerableVersions != test.vulnerable[name] || advisory.PatchedVersions != test.patched[name] {
+				t.Errorf("toAdvisories(%d): unexpected ranges of %s: %s / %s", i, name, advisory.VulnerableVersions, advisory.PatchedVersions)
+			}
+		}
+	}
+}
+
+func TestAuditQuick(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	pb.PutAdvisories("a", []*db.Advisory{{ID: "GHSA-1", Severity: "high", VulnerableVersions: "<2.0.0"}})
+	pb.PutAdvisories("b", []*db.Advisory{{ID: "GHSA-1", Severity: "high", VulnerableVersions: "<2.0.0"}})
+
+	server := &PocketServer{db: pb, storage: client.storage, serverConfig: &ServerConfig{}}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetBodyString(`{"dependencies":{"a":{"version":"1.0.0"},"b":{"version":"1.0.0"},"c":null}}`)
+	server.auditQuick(&ctx)
+
+	var result struct {
+		Advisories map[string]struct {
+			ModuleName string `json:"module_name"`
+		} `json:"advisories"`
+		Metadata struct {
+			Dependencies int `json:"dependencies"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &result); err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string]bool{}
+	for _, advisory := range result.Advisories {
+		modules[advisory.ModuleName] = true
+	}
+	if len(result.Advisories) != 2 || !modules["a"] || !modules["b"] || result.Metadata.Dependencies != 2 {
+		t.Errorf("TestAuditQuick: unexpected result %s", ctx.Response.Body())
+	}
+}
@@ -0,0 +1,135 @@
+package npm
+
+import (
+	"encoding/hex"
+	"os"
+
+	pbar "gopkg.in/cheggaaa/pb.v1"
+)
+
+// validShasum returns whether the shasum can be used as a key of a blob
+func validShasum(shasum string) bool {
+	if len(shasum) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(shasum)
+	return err == nil
+}
+
+// key returns the key of the tarball at the url path in the storage
+func (c *MirrorClient) key(path string) string {
+	if shasum := c.db.GetBlob(path); shasum != "" {
+		return blobKey(shasum)
+	}
+
+	return tarballKey(path)
+}
+
+// DedupeReport represents the result of moving tarballs into the content-addressed layout
+type DedupeReport struct {
+	Packages   int   `json:"packages"`
+	Moved      int   `json:"moved"`
+	Duplicates int   `json:"duplicates"`
+	Missing    int   `json:"missing"`
+	Saved      int64 `json:"saved"`
+}
+
+// Dedupe moves the tarballs stored at their url paths into the content-addressed layout
+//
+// A tarball is linked to its blob and indexed before the original path is
+// removed, so an interrupted run can be resumed without losing tarballs.
+func (c *MirrorClient) Dedupe() (*DedupeReport, error) {
+	c.initialize()
+
+	mirrorLog.Infof("Loading all files")
+	files := c.db.GetAllFiles()
+	report := &DedupeReport{}
+
+	bar := pbar.StartNew(len(files))
+	defer bar.Finish()
+
+	for name, items := range files {
+		blobs := c.db.GetBlobs(name)
+		var moved []string
+		for _, item := range items {
+			if _, ok := blobs[item.Path]; ok {
+				continue
+			}
+
+			legacy := tarballKey(item.Path)
+			shasum, size, err := hashBlob(c.storage, legacy)
+			if os.IsNotExist(err) {
+				report.Missing++
+				continue
+			} else if err != nil {
+				return report, err
+			}
+
+			if _, err := c.storage.Stat(blobKey(shasum)); err == nil {
+				report.Duplicates++
+				report.Saved += size
+			} else {
+				if err := c.storage.Link(legacy, blobKey(shasum)); err != nil {
+					return report, err
+				}
+				report.Moved++
+			}
+
+			blobs[item.Path] = shasum
+			moved = append(moved, legacy)
+		}
+
+		if len(moved) > 0 {
+			if err := c.db.PutBlobs(name, blobs); err != nil {
+				return report, err
+			}
+			for _, legacy := range moved {
+				c.storage.Remove(legacy)
+			}
+		}
+		report.Packages++
+		bar.Increment()
+	}
+
+	return report, nil
+}
+
+// BlobReport shows how much space the content-addressed layout saves
+type BlobReport struct {
+	Tarballs     int   `json:"tarballs"`
+	Blobs        int   `json:"blobs"`
+	OriginalSize int64 `json:"original_size"`
+	StoredSize   int64 `json:"stored_size"`
+}
+
+// Saved returns the ratio of the space saved
+func (report *BlobReport) Saved() float64 {
+	if report.OriginalSize == 0 {
+		return 0
+	}
+
+	return 1 - float64(report.StoredSize)/float64(report.OriginalSize)
+}
+
+// GetBlobReport returns the sizes of the content-addressed tarballs with and without deduplication
+func (c *MirrorClient) GetBlobReport() *BlobReport {
+	report := &BlobReport{}
+	sizes := map[string]int64{}
+	c.db.ForEachBlob(func(path string, shasum string) bool {
+		size, ok := sizes[shasum]
+		if !ok {
+			if info, err := c.storage.Stat(blobKey(shasum)); err == nil {
+				size = info.Size
+			}
+			sizes[shasum] = size
+			report.Blobs++
+			report.StoredSize += size
+		}
+
+		report.Tarballs++
+		report.OriginalSize += size
+		return true
+	})
+
+	return report
+}
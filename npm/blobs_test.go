@@ -0,0 +1,69 @@
+package npm
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ssut/pocketnpm/db"
+)
+
+func TestDedupe(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb := db.NewPocketBase(&db.DatabaseConfig{
+		Type:          "bolt",
+		Path:          filepath.Join(base, "npm.db"),
+		MaxCacheSize:  1024,
+		CacheLifetime: 60,
+	})
+	defer pb.Close()
+	client := NewMirrorClient(pb, &MirrorConfig{Path: filepath.Join(base, "registry")})
+	client.initialize()
+
+	// a fork with the same tarball
+	packages := map[string]string{
+		"test": "/test/-/test-0.0.1.tgz",
+		"fork": "/fork/-/fork-0.0.1.tgz",
+	}
+	for name, path := range packages {
+		pack := &db.BarePackage{ID: name, Revision: "1"}
+		pb.PutPackages([]*db.BarePackage{pack})
+		pb.PutCompleted(pack, `{"_id":"`+name+`"}`, "1", []*url.URL{{Path: path}}, nil)
+
+		legacy := getLocalPath(client.config.Path, path)
+		os.MkdirAll(filepath.Dir(legacy), 0755)
+		ioutil.WriteFile(legacy, []byte("tarball"), 0644)
+	}
+
+	report, err := client.Dedupe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &DedupeReport{Packages: 2, Moved: 1, Duplicates: 1, Saved: int64(len("tarball"))}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("TestDedupe: expected %+v actual %+v", expected, report)
+	}
+
+	for _, path := range packages {
+		if _, err := os.Stat(getLocalPath(client.config.Path, path)); !os.IsNotExist(err) {
+			t.Errorf("TestDedupe: %s was not removed", path)
+		}
+		key := client.key(path)
+		if content, err := ioutil.ReadFile(filepath.Join(client.config.Path, key)); err != nil || string(content) != "tarball" {
+			t.Errorf("TestDedupe: %s is not resolved to the blob: %s", path, key)
+		}
+	}
+
+	blobs := client.GetBlobReport()
+	if blobs.Tarballs != 2 || blobs.Blobs != 1 || blobs.Saved() != 0.5 {
+		t.Errorf("TestDedupe: unexpected report %+v", blobs)
+	}
+}
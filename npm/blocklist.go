@@ -0,0 +1,126 @@
+package npm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// ValidateRange returns an error if the semver range can not be parsed
+func ValidateRange(r string) error {
+	_, err := parseRange(r)
+	return err
+}
+
+// isWholePackage reports whether the blocklist range covers every version
+func isWholePackage(r string) bool {
+	r = strings.TrimSpace(r)
+	return r == "" || r == "*" || r == "x"
+}
+
+// blockedBy returns the blocklist entry matching the version, or nil
+func blockedBy(entries []*db.BlockEntry, version string) *db.BlockEntry {
+	for _, entry := range entries {
+		if isWholePackage(entry.Range) || satisfies(version, entry.Range) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// packageBlockedBy returns the entry blocking the whole package, or nil
+func packageBlockedBy(entries []*db.BlockEntry) *db.BlockEntry {
+	for _, entry := range entries {
+		if isWholePackage(entry.Range) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func blockReason(entry *db.BlockEntry) string {
+	return fmt.Sprintf("blocked by %s: %s", entry.Author, entry.Reason)
+}
+
+// getBlocklist returns all blocklist entries
+//
+// GET /-/admin/blocklist
+func (server *PocketServer) getBlocklist(ctx *fasthttp.RequestCtx) {
+	entries := server.db.GetBlocklist()
+	if entries == nil {
+		entries = []*db.BlockEntry{}
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, entries)
+}
+
+// addBlockEntry blocks a package or a range of its versions
+//
+// POST /-/admin/blocklist (body: {"name": "...", "range": "...", "reason": "...", "author": "..."})
+func (server *PocketServer) addBlockEntry(ctx *fasthttp.RequestCtx) {
+	var entry db.BlockEntry
+	if err := ffjson.Unmarshal(ctx.PostBody(), &entry); err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if entry.Name == "" || entry.Reason == "" || entry.Author == "" {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": "name, reason and author are required",
+		})
+		return
+	}
+	if err := ValidateRange(entry.Range); err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	entry.Created = time.Now().UTC()
+
+	if err := server.db.AddBlockEntry(&entry); err != nil {
+		serverLog.Errorf("Failed to add a blocklist entry: %s %v", entry.Name, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	serverLog.Infof("Blocklist: %s@%s has been blocked by %s (%s)", entry.Name, entry.Range, entry.Author, entry.Reason)
+
+	ctx.SetStatusCode(201)
+	server.writeJSON(ctx, &entry)
+}
+
+// removeBlockEntry removes an entry from the blocklist
+//
+// DELETE /-/admin/blocklist?name=...&range=...
+func (server *PocketServer) removeBlockEntry(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	name, versions := string(args.Peek("name")), string(args.Peek("range"))
+
+	removed, err := server.db.RemoveBlockEntry(name, versions)
+	if err != nil {
+		serverLog.Errorf("Failed to remove a blocklist entry: %s %v", name, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	if !removed {
+		server.raiseNotFound(ctx)
+		return
+	}
+	serverLog.Infof("Blocklist: %s@%s has been unblocked", name, versions)
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok": true,
+	})
+}
@@ -0,0 +1,422 @@
+package npm
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	pbar "gopkg.in/cheggaaa/pb.v1"
+)
+
+// bundleManifestName is the name of the manifest, the last entry of a bundle
+const bundleManifestName = "manifest.json"
+
+// BundleManifest describes the packages of a bundle
+type BundleManifest struct {
+	Format   int              `json:"format"`
+	Created  time.Time        `json:"created"`
+	Registry string           `json:"registry"`
+	Sequence int              `json:"sequence"`
+	Packages []*BundlePackage `json:"packages"`
+}
+
+// BundlePackage is a package in a bundle
+type BundlePackage struct {
+	ID       string        `json:"id"`
+	Revision string        `json:"rev"`
+	Document *BundleFile   `json:"document"`
+	Tarballs []*BundleFile `json:"tarballs"`
+}
+
+// BundleFile is an entry of a bundle with its shasum
+type BundleFile struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Size   int64  `json:"size"`
+	Shasum string `json:"shasum"`
+}
+
+// BundleReport represents the result of an export or an import
+type BundleReport struct {
+	Packages int   `json:"packages"`
+	Tarballs int   `json:"tarballs"`
+	Size     int64 `json:"size"`
+	// Sequence is the sequence of the mirror the bundle was exported from
+	Sequence int `json:"sequence"`
+	// Missing counts tarballs that were not in the storage of the exporting mirror
+	Missing int `json:"missing"`
+	// Incomplete lists packages left out of an export since some of their tarballs are missing
+	Incomplete []string `json:"incomplete,omitempty"`
+	// Skipped lists packages that are not mirrored, or already up to date on import
+	Skipped []string `json:"skipped,omitempty"`
+	// Outdated lists packages whose local document is newer than the bundle on import
+	Outdated []string `json:"outdated,omitempty"`
+	// Invalid lists packages whose entries do not match the manifest
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// ReadPackageList reads package names, one per line, ignoring blank lines and # comments
+func ReadPackageList(r io.Reader) ([]string, error) {
+	var names []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+// writeBundleEntry writes an entry to the bundle and returns it with its shasum
+func writeBundleEntry(tw *tar.Writer, name string, size int64, r io.Reader) (*BundleFile, error) {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	hash := sha1.New()
+	n, err := io.Copy(io.MultiWriter(tw, hash), r)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("Size mismatch: %s (expected %d, got %d)", name, size, n)
+	}
+
+	return &BundleFile{Name: name, Size: size, Shasum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Export writes the documents and tarballs of the packages to a tar bundle
+//
+// The manifest with the shasums of all entries is written last, so the
+// bundle can be written in a single pass.
+func (c *MirrorClient) Export(names []string, out string) (*BundleReport, error) {
+	c.initialize()
+
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+
+	manifest := &BundleManifest{
+		Format:   1,
+		Created:  time.Now().UTC(),
+		Registry: c.config.Registry,
+		Sequence: c.db.GetSequence(),
+	}
+	report := &BundleReport{Sequence: manifest.Sequence}
+
+	bar := pbar.StartNew(len(names))
+	defer bar.Finish()
+
+	for _, name := range names {
+		bar.Increment()
+
+		document, files, err := c.db.GetDocument(name, true)
+		if err != nil || document == "" || document == "{}" {
+			mirrorLog.Warnf("Not mirrored: %s", name)
+			report.Skipped = append(report.Skipped, name)
+			continue
+		}
+
+		// packages are only exported with all of their tarballs, since they are imported as completed
+		infos := make([]*BlobInfo, len(files))
+		missing := 0
+		for i, file := range files {
+			infos[i], err = c.storage.Stat(c.key(file.Path))
+			if os.IsNotExist(err) {
+				mirrorLog.Warnf("Missing tarball: %s", file.Path)
+				missing++
+			} else if err != nil {
+				return report, err
+			}
+		}
+		if missing > 0 {
+			report.Missing += missing
+			report.Incomplete = append(report.Incomplete, name)
+			continue
+		}
+
+		pack := &BundlePackage{ID: name, Revision: c.db.GetRevision(name)}
+		pack.Document, err = writeBundleEntry(tw, path.Join("documents", name+".json"), int64(len(document)), strings.NewReader(document))
+		if err != nil {
+			return report, err
+		}
+
+		for i, file := range files {
+			r, err := c.storage.Open(c.key(file.Path))
+			if err != nil {
+				return report, err
+			}
+			tarball, err := writeBundleEntry(tw, path.Join("tarballs", file.Path), infos[i].Size, r)
+			r.Close()
+			if err != nil {
+				return report, err
+			}
+
+			tarball.URL = file.String()
+			pack.Tarballs = append(pack.Tarballs, tarball)
+			report.Tarballs++
+			report.Size += tarball.Size
+		}
+
+		manifest.Packages = append(manifest.Packages, pack)
+		report.Packages++
+	}
+
+	raw, _ := json.MarshalIndent(manifest, "", "  ")
+	if _, err := writeBundleEntry(tw, bundleManifestName, int64(len(raw)), strings.NewReader(string(raw))); err != nil {
+		return report, err
+	}
+	if err := tw.Close(); err != nil {
+		return report, err
+	}
+
+	return report, f.Close()
+}
+
+// revisionGeneration returns the generation of a CouchDB revision such as
+// "3-a1b2" which counts its updates, or 0 if it has none
+func revisionGeneration(rev string) int {
+	generation, err := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return generation
+}
+
+// readBundleManifest finds the manifest of a bundle
+func readBundleManifest(bundle string) (*BundleManifest, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No manifest in the bundle: %s", bundle)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Name == bundleManifestName {
+			var manifest BundleManifest
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, err
+			}
+			return &manifest, nil
+		}
+	}
+}
+
+// Import merges the packages of a bundle into the store
+//
+// Every entry is checked against the shasum in the manifest while being staged,
+// and a package is only merged when its document and all of its tarballs are
+// valid. Packages with the same revision already mirrored are skipped, and
+// packages whose local revision is of the same or a later generation are left
+// untouched and reported as outdated.
+func (c *MirrorClient) Import(bundle string) (*BundleReport, error) {
+	c.initialize()
+	c.webhooks.Reload()
+
+	manifest, err := readBundleManifest(bundle)
+	if err != nil {
+		return nil, err
+	}
+	report := &BundleReport{Sequence: manifest.Sequence}
+
+	files := map[string]*BundleFile{}
+	var packages []*BundlePackage
+	for _, pack := range manifest.Packages {
+		if !validBundlePackage(pack) {
+			id := ""
+			if pack != nil {
+				id = pack.ID
+			}
+			mirrorLog.Errorf("Package without a document or with an empty tarball entry in the bundle: %q", id)
+			report.Invalid = append(report.Invalid, id)
+			continue
+		}
+
+		packages = append(packages, pack)
+		files[pack.Document.Name] = pack.Document
+		for _, tarball := range pack.Tarballs {
+			files[tarball.Name] = tarball
+		}
+	}
+
+	// entries are staged in temporary files until their packages are merged
+	staged := map[string]string{}
+	defer func() {
+		for _, name := range staged {
+			os.Remove(name)
+		}
+	}()
+
+	f, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+
+		file, ok := files[header.Name]
+		if !ok {
+			continue
+		}
+
+		out, err := downloadTemp(c.config.Path, header.Name)
+		if err != nil {
+			return report, err
+		}
+		hash := sha1.New()
+		n, err := io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		staged[header.Name] = out.Name()
+		if err != nil {
+			return report, err
+		}
+
+		if sum := hex.EncodeToString(hash.Sum(nil)); n != file.Size || sum != file.Shasum {
+			mirrorLog.Warnf("Shasum mismatch: %s (expected %s, got %s)", header.Name, file.Shasum, sum)
+			os.Remove(out.Name())
+			delete(staged, header.Name)
+		}
+	}
+
+	for _, pack := range packages {
+		if err := c.importPackage(pack, staged, report); err != nil {
+			return report, err
+		}
+	}
+	c.webhooks.Wait()
+
+	return report, nil
+}
+
+// validBundlePackage reports whether the manifest entry has a document and
+// no empty tarball entries, which a damaged manifest may have
+func validBundlePackage(pack *BundlePackage) bool {
+	if pack == nil || pack.Document == nil {
+		return false
+	}
+	for _, tarball := range pack.Tarballs {
+		if tarball == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// importPackage merges a package with its staged entries
+func (c *MirrorClient) importPackage(pack *BundlePackage, staged map[string]string, report *BundleReport) error {
+	urls := map[string]*url.URL{}
+	for _, file := range append([]*BundleFile{pack.Document}, pack.Tarballs...) {
+		if file != pack.Document {
+			// tarballs are stored at their url paths, which must stay in the storage
+			u, err := url.Parse(file.URL)
+			if err != nil || strings.Contains(u.Path, "..") {
+				mirrorLog.Warnf("Invalid tarball url in the bundle: %s (%s)", pack.ID, file.URL)
+				report.Invalid = append(report.Invalid, pack.ID)
+				return nil
+			}
+			urls[file.Name] = u
+		}
+		if _, ok := staged[file.Name]; !ok {
+			mirrorLog.Warnf("Invalid package in the bundle: %s (%s)", pack.ID, file.Name)
+			report.Invalid = append(report.Invalid, pack.ID)
+			return nil
+		}
+	}
+
+	if document, _, err := c.db.GetDocument(pack.ID, false); err == nil && document != "" && document != "{}" {
+		rev := c.db.GetRevision(pack.ID)
+		if rev == pack.Revision {
+			report.Skipped = append(report.Skipped, pack.ID)
+			return nil
+		}
+		if generation := revisionGeneration(rev); generation > 0 && generation >= revisionGeneration(pack.Revision) {
+			mirrorLog.Warnf("Local document is newer than the bundle: %s (%s, bundle %s)", pack.ID, rev, pack.Revision)
+			report.Outdated = append(report.Outdated, pack.ID)
+			return nil
+		}
+	}
+
+	raw, err := ioutil.ReadFile(staged[pack.Document.Name])
+	if err != nil {
+		return err
+	}
+
+	var downloads []*url.URL
+	sizes := map[string]int64{}
+	blobs := map[string]string{}
+	for _, tarball := range pack.Tarballs {
+		u := urls[tarball.Name]
+		key := tarballKey(u.Path)
+		if c.config.ContentAddressed {
+			blobs[u.Path] = tarball.Shasum
+			key = blobKey(tarball.Shasum)
+		}
+		if err := c.storage.PutFile(key, staged[tarball.Name], tarball.Shasum); err != nil {
+			return err
+		}
+		delete(staged, tarball.Name)
+
+		downloads = append(downloads, u)
+		sizes[u.Path] = tarball.Size
+		report.Tarballs++
+		report.Size += tarball.Size
+	}
+
+	if len(blobs) > 0 || len(c.db.GetBlobs(pack.ID)) > 0 {
+		if err := c.db.PutBlobs(pack.ID, blobs); err != nil {
+			return err
+		}
+	}
+	bare := &db.BarePackage{ID: pack.ID, Revision: pack.Revision}
+	c.db.PutPackages([]*db.BarePackage{bare})
+	entry, succeed := c.db.PutCompletedEntry(bare, string(raw), pack.Revision, downloads, sizes)
+	if !succeed {
+		return fmt.Errorf("Failed to store %s", pack.ID)
+	}
+	c.webhooks.Notify(entry)
+	report.Packages++
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package npm
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ssut/pocketnpm/db"
+)
+
+// newTestMirror creates a mirror client with a bolt database under base
+func newTestMirror(t *testing.T, base string, config *MirrorConfig) (*db.PocketBase, *MirrorClient) {
+	if err := os.MkdirAll(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pb := db.NewPocketBase(&db.DatabaseConfig{
+		Type:          "bolt",
+		Path:          filepath.Join(base, "npm.db"),
+		MaxCacheSize:  1024,
+		CacheLifetime: 60,
+	})
+	config.Path = filepath.Join(base, "registry")
+	client := NewMirrorClient(pb, config)
+	client.initialize()
+
+	return pb, client
+}
+
+func TestBundle(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	src, srcClient := newTestMirror(t, filepath.Join(base, "src"), &MirrorConfig{})
+	defer src.Close()
+	dst, dstClient := newTestMirror(t, filepath.Join(base, "dst"), &MirrorConfig{ContentAddressed: true})
+	defer dst.Close()
+
+	tarball, _ := url.Parse("https://registry.npmjs.org/test/-/test-0.0.1.tgz")
+	document := `{"_id":"test","versions":{"0.0.1":{"dist":{"tarball":"https://registry.npmjs.org/test/-/test-0.0.1.tgz"}}}}`
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	src.PutPackages([]*db.BarePackage{pack})
+	src.PutCompleted(pack, document, "1", []*url.URL{tarball}, nil)
+	legacy := getLocalPath(srcClient.config.Path, tarball.Path)
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	ioutil.WriteFile(legacy, []byte("tarball"), 0644)
+
+	// a package whose tarball is missing is left out
+	broken, _ := url.Parse("https://registry.npmjs.org/broken/-/broken-0.0.1.tgz")
+	brokenPack := &db.BarePackage{ID: "broken", Revision: "1"}
+	src.PutPackages([]*db.BarePackage{brokenPack})
+	src.PutCompleted(brokenPack, `{"_id":"broken","versions":{}}`, "1", []*url.URL{broken}, nil)
+
+	names, _ := ReadPackageList(strings.NewReader("# packages\ntest\nbroken\n\nmissing # not mirrored\n"))
+	bundle := filepath.Join(base, "bundle.tar")
+	report, err := srcClient.Export(names, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &BundleReport{Packages: 1, Tarballs: 1, Size: int64(len("tarball")), Missing: 1, Incomplete: []string{"broken"}, Skipped: []string{"missing"}}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("TestBundle: expected export %+v actual %+v", expected, report)
+	}
+
+	report, err = dstClient.Import(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &BundleReport{Packages: 1, Tarballs: 1, Size: int64(len("tarball"))}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("TestBundle: expected import %+v actual %+v", expected, report)
+	}
+
+	if doc, files, _ := dst.GetDocument("test", true); doc != document || len(files) != 1 {
+		t.Errorf("TestBundle: unexpected document %s %v", doc, files)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dstClient.config.Path, dstClient.key(tarball.Path)))
+	if err != nil || string(content) != "tarball" {
+		t.Errorf("TestBundle: unexpected tarball %q %v", content, err)
+	}
+
+	// nothing changes when the same bundle is imported again
+	report, _ = dstClient.Import(bundle)
+	if report.Packages != 0 || !reflect.DeepEqual(report.Skipped, []string{"test"}) {
+		t.Errorf("TestBundle: unexpected import of the same bundle %+v", report)
+	}
+
+	// a newer local document is not replaced by an older bundle
+	updated := `{"_id":"test","versions":{"0.0.1":{},"0.0.2":{}}}`
+	dst.PutCompleted(pack, updated, "2-a", []*url.URL{tarball}, nil)
+	report, _ = dstClient.Import(bundle)
+	if report.Packages != 0 || !reflect.DeepEqual(report.Outdated, []string{"test"}) {
+		t.Errorf("TestBundle: unexpected import of an older bundle %+v", report)
+	}
+	if doc, _, _ := dst.GetDocument("test", false); doc != updated {
+		t.Errorf("TestBundle: the newer document was replaced %s", doc)
+	}
+}
+
+func TestImportInvalidManifest(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	// entries of a damaged manifest are skipped instead of failing the import
+	manifest := []byte(`{"format":1,"packages":[{"id":"nodoc","rev":"1"},null,{"id":"notarball","rev":"1","document":{"name":"notarball.json"},"tarballs":[null]}]}`)
+	bundle := filepath.Join(base, "bundle.tar")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if _, err := writeBundleEntry(tw, bundleManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	f.Close()
+
+	report, err := client.Import(bundle)
+	if err != nil {
+		t.Fatalf("TestImportInvalidManifest: unexpected error %v", err)
+	}
+	if report.Packages != 0 || !reflect.DeepEqual(report.Invalid, []string{"nodoc", "", "notarball"}) {
+		t.Errorf("TestImportInvalidManifest: unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,144 @@
+package npm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/valyala/fasthttp"
+)
+
+// splitPackagePath splits a path such as "/@scope/name/dist-tags/beta" into
+// the package name and the remaining segments
+func splitPackagePath(path string) (name string, rest []string) {
+	path = strings.Replace(strings.Trim(path, "/"), "%2f", "/", -1)
+	path = strings.Replace(path, "%2F", "/", -1)
+	segments := strings.Split(path, "/")
+
+	if strings.HasPrefix(segments[0], "@") && len(segments) > 1 {
+		return segments[0] + "/" + segments[1], segments[2:]
+	}
+	return segments[0], segments[1:]
+}
+
+// getDistTags returns dist-tags of the document as published upstream
+func getDistTags(document string) map[string]string {
+	var doc struct {
+		DistTags map[string]string `json:"dist-tags"`
+	}
+	ffjson.Unmarshal([]byte(document), &doc)
+
+	return doc.DistTags
+}
+
+// applyDistTags replaces dist-tags of the document with the local overrides
+func applyDistTags(doc map[string]interface{}, overrides map[string]string) {
+	tags, _ := doc["dist-tags"].(map[string]interface{})
+	if tags == nil {
+		tags = map[string]interface{}{}
+		doc["dist-tags"] = tags
+	}
+
+	versions, _ := doc["versions"].(map[string]interface{})
+	for tag, version := range overrides {
+		if _, ok := versions[version]; version == "" || !ok {
+			delete(tags, tag)
+			continue
+		}
+		tags[tag] = version
+	}
+}
+
+func (server *PocketServer) writeDistTags(ctx *fasthttp.RequestCtx, name string) {
+	doc, _, err := server.db.GetDocument(name, false)
+	if err != nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	root, err := decodeDocument(doc)
+	if err != nil {
+		ctx.SetStatusCode(500)
+		return
+	}
+	server.getPolicy(name).apply(root)
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, root["dist-tags"])
+}
+
+// handleDistTags implements the dist-tags API used by `npm dist-tag`
+//
+// GET    /-/package/:name/dist-tags
+// PUT    /-/package/:name/dist-tags/:tag (body: "version")
+// DELETE /-/package/:name/dist-tags/:tag
+func (server *PocketServer) handleDistTags(ctx *fasthttp.RequestCtx) {
+	name, rest := splitPackagePath(ctx.UserValue("path").(string))
+	if len(rest) == 0 || rest[0] != "dist-tags" || len(rest) > 2 {
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	method := string(ctx.Method())
+	if method == "GET" {
+		server.writeDistTags(ctx, name)
+		return
+	}
+
+	if len(rest) != 2 || rest[1] == "" {
+		server.raiseNotFound(ctx)
+		return
+	}
+	tag := rest[1]
+
+	doc, _, err := server.db.GetDocument(name, false)
+	if err != nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	switch method {
+	case "PUT", "POST":
+		var version string
+		if err := ffjson.Unmarshal(ctx.PostBody(), &version); err != nil {
+			version = strings.TrimSpace(string(ctx.PostBody()))
+		}
+
+		var parsed struct {
+			Versions map[string]interface{} `json:"versions"`
+		}
+		ffjson.Unmarshal([]byte(doc), &parsed)
+		if _, ok := parsed.Versions[version]; !ok {
+			ctx.SetStatusCode(400)
+			server.writeJSON(ctx, map[string]string{
+				"error": fmt.Sprintf("Version does not exist: %s@%s", name, version),
+			})
+			return
+		}
+
+		err = server.db.SetDistTag(name, tag, version)
+	case "DELETE":
+		_, hide := getDistTags(doc)[tag]
+		err = server.db.DeleteDistTag(name, tag, hide)
+	default:
+		ctx.SetStatusCode(405)
+		return
+	}
+
+	if err != nil {
+		serverLog.Errorf("Failed to update dist-tags: %s %v", name, err)
+		ctx.SetStatusCode(500)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	server.writeDistTags(ctx, name)
+}
@@ -0,0 +1,145 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func newDistTagsServer(pb *db.PocketBase, client *MirrorClient) *PocketServer {
+	server := &PocketServer{
+		db:           pb,
+		storage:      client.storage,
+		serverConfig: &ServerConfig{AdminToken: "secret"},
+		mirrorConfig: client.config,
+		router:       fasthttprouter.New(),
+		apiRouter:    fasthttprouter.New(),
+		couchRouter:  fasthttprouter.New(),
+	}
+	server.addRoutes()
+	return server
+}
+
+// requestDistTags sends a request to the dist-tags API and returns the status and the tags
+func requestDistTags(server *PocketServer, method string, path string, body string) (int, map[string]string) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.Set("Authorization", "Bearer secret")
+	ctx.Request.SetBodyString(body)
+	server.handler(&ctx)
+
+	var tags map[string]string
+	json.Unmarshal(ctx.Response.Body(), &tags)
+	return ctx.Response.StatusCode(), tags
+}
+
+func TestDistTagsHandlers(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-disttags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","dist-tags":{"latest":"2.0.0","beta":"2.0.0"},"versions":{"1.0.0":{},"2.0.0":{}}}`, "1", nil, nil)
+	server := newDistTagsServer(pb, client)
+
+	if status, tags := requestDistTags(server, "GET", "/-/package/test/dist-tags", ""); status != 200 || tags["latest"] != "2.0.0" || tags["beta"] != "2.0.0" {
+		t.Errorf("TestDistTagsHandlers: unexpected tags %d %v", status, tags)
+	}
+	if status, _ := requestDistTags(server, "GET", "/-/package/missing/dist-tags", ""); status != 404 {
+		t.Errorf("TestDistTagsHandlers: expected 404 for a missing package actual %d", status)
+	}
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("PUT")
+	ctx.Request.SetRequestURI("/-/package/test/dist-tags/latest")
+	ctx.Request.SetBodyString(`"1.0.0"`)
+	server.handler(&ctx)
+	if ctx.Response.StatusCode() != 403 {
+		t.Errorf("TestDistTagsHandlers: expected 403 without a token actual %d", ctx.Response.StatusCode())
+	}
+
+	if status, tags := requestDistTags(server, "PUT", "/-/package/test/dist-tags/latest", `"1.0.0"`); status != 200 || tags["latest"] != "1.0.0" {
+		t.Errorf("TestDistTagsHandlers: unexpected tags after put %d %v", status, tags)
+	}
+	if status, _ := requestDistTags(server, "PUT", "/-/package/test/dist-tags/latest", `"3.0.0"`); status != 400 {
+		t.Errorf("TestDistTagsHandlers: expected 400 for a missing version actual %d", status)
+	}
+	if status, tags := requestDistTags(server, "DELETE", "/-/package/test/dist-tags/beta", ""); status != 200 || tags["latest"] != "1.0.0" || tags["beta"] != "" {
+		t.Errorf("TestDistTagsHandlers: unexpected tags after delete %d %v", status, tags)
+	}
+
+	// the upstream tag stays hidden
+	overrides := pb.GetDistTags("test")
+	if version, ok := overrides["beta"]; !ok || version != "" || overrides["latest"] != "1.0.0" {
+		t.Errorf("TestDistTagsHandlers: unexpected overrides %v", overrides)
+	}
+	if status, tags := requestDistTags(server, "GET", "/-/package/test/dist-tags", ""); status != 200 || len(tags) != 1 || tags["latest"] != "1.0.0" {
+		t.Errorf("TestDistTagsHandlers: unexpected tags %d %v", status, tags)
+	}
+}
+
+func TestDistTagsSurviveUpdate(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-disttags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_changes":
+			w.Write([]byte(`{"results":[{"seq":2,"id":"test","changes":[{"rev":"2"}]}],"last_seq":2}`))
+		case "/test":
+			w.Write([]byte(`{"_id":"test","_rev":"2","dist-tags":{"latest":"3.0.0"},"versions":{"1.0.0":{},"2.0.0":{},"3.0.0":{}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer registry.Close()
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{Registry: registry.URL, MaxConnections: 1, Interval: 3600})
+	defer pb.Close()
+
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","_rev":"1","dist-tags":{"latest":"2.0.0"},"versions":{"1.0.0":{},"2.0.0":{}}}`, "1", nil, nil)
+	pb.SetSequence(1)
+	pb.SetDistTag("test", "latest", "1.0.0")
+
+	go client.Update()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if doc, _, _ := pb.GetDocument("test", false); strings.Contains(doc, "3.0.0") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("TestDistTagsSurviveUpdate: the package was not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Pause()
+
+	if overrides := pb.GetDistTags("test"); overrides["latest"] != "1.0.0" {
+		t.Errorf("TestDistTagsSurviveUpdate: overrides were lost %v", overrides)
+	}
+	server := newDistTagsServer(pb, client)
+	if status, tags := requestDistTags(server, "GET", "/-/package/test/dist-tags", ""); status != 200 || tags["latest"] != "1.0.0" {
+		t.Errorf("TestDistTagsSurviveUpdate: unexpected tags %d %v", status, tags)
+	}
+}
@@ -0,0 +1,188 @@
+package npm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// defaultDownloadsInterval is the interval in seconds at which download counts are flushed
+const defaultDownloadsInterval = 60
+
+// isDownloadsPath returns whether the path belongs to the downloads api
+// (api.npmjs.org/downloads), which shadows versions of the package named "downloads"
+func isDownloadsPath(path []byte) bool {
+	return bytes.HasPrefix(path, []byte("/downloads/point/")) || bytes.HasPrefix(path, []byte("/downloads/range/"))
+}
+
+// downloadCounter counts tarball downloads in memory until they are flushed
+type downloadCounter struct {
+	mu     sync.Mutex
+	counts map[db.DownloadKey]int
+}
+
+func newDownloadCounter() *downloadCounter {
+	return &downloadCounter{counts: map[db.DownloadKey]int{}}
+}
+
+// add counts a download of the version at the time
+func (c *downloadCounter) add(name string, version string, t time.Time) {
+	key := db.DownloadKey{Name: name, Version: version, Day: t.UTC().Format(db.DayFormat)}
+
+	c.mu.Lock()
+	c.counts[key]++
+	c.mu.Unlock()
+}
+
+// flush adds the counts to the database, and keeps them for the next flush on failure
+func (c *downloadCounter) flush(pb *db.PocketBase) {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = map[db.DownloadKey]int{}
+	c.mu.Unlock()
+
+	if err := pb.AddDownloads(counts); err != nil {
+		serverLog.Errorf("Failed to flush download counts: %v", err)
+
+		c.mu.Lock()
+		for key, count := range counts {
+			c.counts[key] += count
+		}
+		c.mu.Unlock()
+	}
+}
+
+// flushDownloads flushes the download counts every interval
+//
+// Counts since the last flush are lost when the server is killed.
+func (server *PocketServer) flushDownloads() {
+	interval := server.serverConfig.DownloadsInterval
+	if interval == 0 {
+		interval = defaultDownloadsInterval
+	}
+
+	for range time.Tick(time.Duration(interval) * time.Second) {
+		server.downloads.flush(server.db)
+	}
+}
+
+// countDownload counts a tarball download that has been served
+func (server *PocketServer) countDownload(ctx *fasthttp.RequestCtx, name string, version string) {
+	if server.downloads == nil || ctx.Response.StatusCode() >= 400 {
+		return
+	}
+
+	server.downloads.add(name, version, time.Now())
+}
+
+type downloadsPoint struct {
+	Downloads int    `json:"downloads"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Package   string `json:"package,omitempty"`
+}
+
+type downloadsDay struct {
+	Downloads int    `json:"downloads"`
+	Day       string `json:"day"`
+}
+
+type downloadsRange struct {
+	Start     string          `json:"start"`
+	End       string          `json:"end"`
+	Package   string          `json:"package,omitempty"`
+	Downloads []*downloadsDay `json:"downloads"`
+}
+
+// getDownloadsPoint serves /downloads/point/:period[/:package] like api.npmjs.org
+func (server *PocketServer) getDownloadsPoint(ctx *fasthttp.RequestCtx) {
+	server.serveDownloads(ctx, func(name string, start string, end string, days []*downloadsDay) interface{} {
+		point := &downloadsPoint{Start: start, End: end, Package: name}
+		for _, day := range days {
+			point.Downloads += day.Downloads
+		}
+		return point
+	})
+}
+
+// getDownloadsRange serves /downloads/range/:period[/:package] like api.npmjs.org
+func (server *PocketServer) getDownloadsRange(ctx *fasthttp.RequestCtx) {
+	server.serveDownloads(ctx, func(name string, start string, end string, days []*downloadsDay) interface{} {
+		return &downloadsRange{Start: start, End: end, Package: name, Downloads: days}
+	})
+}
+
+// serveDownloads parses the period and the packages of a downloads request,
+// and writes the results made from the downloads of every day of the period
+//
+// The downloads of all packages are served without a package, and packages
+// separated by commas are served as an object by name, where unknown
+// packages are null.
+func (server *PocketServer) serveDownloads(ctx *fasthttp.RequestCtx, result func(string, string, string, []*downloadsDay) interface{}) {
+	path := strings.SplitN(strings.TrimPrefix(ctx.UserValue("path").(string), "/"), "/", 2)
+	start, end, err := db.ParseDownloadPeriod(path[0], time.Now())
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if len(path) == 1 || path[1] == "" {
+		totals := server.db.GetTotalDownloads(start, end)
+		server.writeJSON(ctx, result("", start, end, downloadDays(start, end, func(day string) int {
+			return totals[day]
+		})))
+		return
+	}
+
+	names := strings.Split(path[1], ",")
+	results := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if server.db.GetRevision(name) == "" {
+			results[name] = nil
+			continue
+		}
+
+		versions := server.db.GetDownloads(name, start, end)
+		results[name] = result(name, start, end, downloadDays(start, end, func(day string) int {
+			count := 0
+			for _, n := range versions[day] {
+				count += n
+			}
+			return count
+		}))
+	}
+
+	if len(names) > 1 {
+		server.writeJSON(ctx, results)
+		return
+	}
+	if results[names[0]] == nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": fmt.Sprintf("package %s not found", names[0]),
+		})
+		return
+	}
+	server.writeJSON(ctx, results[names[0]])
+}
+
+// downloadDays returns the downloads of every day from the first to the last day
+func downloadDays(start string, end string, count func(string) int) []*downloadsDay {
+	first, _ := time.Parse(db.DayFormat, start)
+	last, _ := time.Parse(db.DayFormat, end)
+
+	days := []*downloadsDay{}
+	for t := first; !t.After(last); t = t.AddDate(0, 0, 1) {
+		day := t.Format(db.DayFormat)
+		days = append(days, &downloadsDay{Downloads: count(day), Day: day})
+	}
+	return days
+}
@@ -0,0 +1,93 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestIsDownloadsPath(t *testing.T) {
+	cases := map[string]bool{
+		"/downloads/point/last-week":        true,
+		"/downloads/range/last-week/@s/b":   true,
+		"/downloads":                        false,
+		"/downloads/1.0.0":                  false,
+		"/downloads/-/downloads-1.0.0.tgz":  false,
+		"/-/downloads/point/last-week/test": false,
+	}
+	for path, expected := range cases {
+		if actual := isDownloadsPath([]byte(path)); actual != expected {
+			t.Errorf("isDownloadsPath(%s): expected %t, actual %t", path, expected, actual)
+		}
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-downloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	tarball, _ := url.Parse("https://registry.npmjs.org/test/-/test-0.0.1.tgz")
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","versions":{"0.0.1":{"dist":{"tarball":"`+tarball.String()+`"}}}}`, "1", []*url.URL{tarball}, nil)
+	legacy := getLocalPath(client.config.Path, tarball.Path)
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	ioutil.WriteFile(legacy, []byte("tarball"), 0644)
+
+	server := &PocketServer{db: pb, storage: client.storage, serverConfig: &ServerConfig{}, mirrorConfig: client.config, downloads: newDownloadCounter()}
+	for _, file := range []string{"test-0.0.1.tgz", "test-0.0.1.tgz", "test-0.0.2.tgz"} {
+		var ctx fasthttp.RequestCtx
+		ctx.SetUserValue("name", "test")
+		ctx.SetUserValue("version", "-")
+		ctx.SetUserValue("tarball", file)
+		server.downloadPackage(&ctx)
+	}
+	server.downloads.flush(pb)
+
+	today := time.Now().UTC().Format(db.DayFormat)
+	request := func(handler fasthttp.RequestHandler, path string) (int, []byte) {
+		var ctx fasthttp.RequestCtx
+		ctx.SetUserValue("path", path)
+		handler(&ctx)
+		return ctx.Response.StatusCode(), ctx.Response.Body()
+	}
+
+	var point downloadsPoint
+	status, body := request(server.getDownloadsPoint, "/last-week/test")
+	if err := json.Unmarshal(body, &point); err != nil || status != 200 || point.Downloads != 2 || point.Package != "test" || point.End != today {
+		t.Errorf("TestDownloads: unexpected point %d %s", status, body)
+	}
+
+	var ranged downloadsRange
+	status, body = request(server.getDownloadsRange, "/last-week")
+	if err := json.Unmarshal(body, &ranged); err != nil || status != 200 || len(ranged.Downloads) != 7 ||
+		ranged.Downloads[6].Day != today || ranged.Downloads[6].Downloads != 2 || ranged.Downloads[0].Downloads != 0 {
+		t.Errorf("TestDownloads: unexpected range %d %s", status, body)
+	}
+
+	var bulk map[string]*downloadsPoint
+	status, body = request(server.getDownloadsPoint, "/last-day/test,missing")
+	if err := json.Unmarshal(body, &bulk); err != nil || status != 200 || bulk["test"].Downloads != 2 || bulk["missing"] != nil {
+		t.Errorf("TestDownloads: unexpected bulk %d %s", status, body)
+	}
+
+	if status, body = request(server.getDownloadsPoint, "/last-week/missing"); status != 404 {
+		t.Errorf("TestDownloads: unexpected response of a missing package %d %s", status, body)
+	}
+	if status, body = request(server.getDownloadsPoint, "/yesterday/test"); status != 400 {
+		t.Errorf("TestDownloads: unexpected response of an invalid period %d %s", status, body)
+	}
+}
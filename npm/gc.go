@@ -0,0 +1,80 @@
+package npm
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// GCReport represents the result of a garbage collection of tarballs
+type GCReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Scanned    int      `json:"scanned"`
+	Referenced int      `json:"referenced"`
+	Recent     int      `json:"recent"`
+	Orphans    []string `json:"orphans"`
+	Size       int64    `json:"size"`
+	Removed    int      `json:"removed"`
+}
+
+// findOrphanTarballs walks the storage and returns the keys of tarballs which
+// are not referenced and have not been modified since the cutoff
+func findOrphanTarballs(storage BlobStorage, referenced map[string]bool, cutoff time.Time, report *GCReport) error {
+	return storage.Walk(func(key string, info *BlobInfo) error {
+		if !strings.HasSuffix(key, ".tgz") {
+			return nil
+		}
+
+		report.Scanned++
+		if referenced[key] {
+			report.Referenced++
+			return nil
+		}
+		// the file may be a download whose package has not been completed yet
+		if info.Modified.After(cutoff) {
+			report.Recent++
+			return nil
+		}
+
+		report.Orphans = append(report.Orphans, key)
+		report.Size += info.Size
+		return nil
+	})
+}
+
+// CollectGarbage removes tarballs which are not referenced by any document
+//
+// Tarballs modified within the grace period are kept. If dryRun is set,
+// orphan tarballs are only reported.
+func (c *MirrorClient) CollectGarbage(dryRun bool, grace time.Duration) (*GCReport, error) {
+	c.initialize()
+
+	mirrorLog.Infof("Loading all files")
+	referenced := map[string]bool{}
+	for _, items := range c.db.GetAllFiles() {
+		for _, item := range items {
+			referenced[c.key(item.Path)] = true
+		}
+	}
+
+	mirrorLog.Infof("Walking the storage for %d referenced files", len(referenced))
+	report := &GCReport{DryRun: dryRun, Orphans: []string{}}
+	if err := findOrphanTarballs(c.storage, referenced, time.Now().Add(-grace), report); err != nil {
+		return report, err
+	}
+	sort.Strings(report.Orphans)
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, key := range report.Orphans {
+		if err := c.storage.Remove(key); err != nil {
+			mirrorLog.Warnf("Failed to remove %s: %v", key, err)
+			continue
+		}
+		report.Removed++
+	}
+
+	return report, nil
+}
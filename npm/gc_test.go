@@ -0,0 +1,51 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindOrphanTarballs(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	old := time.Now().Add(-48 * time.Hour)
+	files := map[string]time.Time{
+		"t/test/-/test-0.0.1.tgz": old,
+		"t/test/-/test-0.0.2.tgz": old,
+		"t/test/-/test-0.0.3.tgz": time.Now(),
+		"t/test/package.json":     old,
+	}
+	for name, modified := range files {
+		path := filepath.Join(base, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, modified, modified)
+	}
+
+	referenced := map[string]bool{
+		tarballKey("/test/-/test-0.0.1.tgz"): true,
+	}
+	report := &GCReport{}
+	if err := findOrphanTarballs(newLocalStorage(base), referenced, time.Now().Add(-24*time.Hour), report); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &GCReport{
+		Scanned:    3,
+		Referenced: 1,
+		Recent:     1,
+		Orphans:    []string{"t/test/-/test-0.0.2.tgz"},
+		Size:       int64(len("t/test/-/test-0.0.2.tgz")),
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("TestFindOrphanTarballs: expected %+v actual %+v", expected, report)
+	}
+}
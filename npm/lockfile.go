@@ -0,0 +1,529 @@
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// LockedPackage is a package version resolved by a lockfile
+type LockedPackage struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
+}
+
+// ParseLockfile parses a package-lock.json (v1, v2, v3), npm-shrinkwrap.json,
+// yarn.lock (classic and berry) or pnpm-lock.yaml
+//
+// The format is detected from the content. Packages that are not installed
+// from a registry, such as links, workspaces and git dependencies, are left out.
+func ParseLockfile(data []byte) ([]*LockedPackage, error) {
+	trimmed := bytes.TrimSpace(data)
+	var locked []*LockedPackage
+	var err error
+
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		locked, err = parseNPMLockfile(trimmed)
+	case bytes.Contains(data, []byte("\nlockfileVersion:")) || bytes.HasPrefix(trimmed, []byte("lockfileVersion:")):
+		locked, err = parsePNPMLockfile(parseIndented(data))
+	case bytes.Contains(data, []byte("\n__metadata:")) || bytes.HasPrefix(trimmed, []byte("__metadata:")):
+		locked = parseYarnBerryLockfile(parseIndented(data))
+	default:
+		locked = parseYarnLockfile(parseIndented(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return uniqueLocked(locked), nil
+}
+
+// uniqueLocked removes duplicates of the same version, and sorts the packages
+func uniqueLocked(locked []*LockedPackage) []*LockedPackage {
+	seen := map[string]bool{}
+	var unique []*LockedPackage
+	for _, pkg := range locked {
+		if _, err := parseSemver(pkg.Version); err != nil {
+			continue
+		}
+		if key := pkg.Name + "@" + pkg.Version; !seen[key] {
+			seen[key] = true
+			unique = append(unique, pkg)
+		}
+	}
+
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].Name != unique[j].Name {
+			return unique[i].Name < unique[j].Name
+		}
+		return unique[i].Version < unique[j].Version
+	})
+	return unique
+}
+
+// splitSpec splits "name@version", where the name may be scoped
+func splitSpec(spec string) (string, string) {
+	if i := strings.LastIndex(spec, "@"); i > 0 {
+		return spec[:i], spec[i+1:]
+	}
+
+	return spec, ""
+}
+
+// npmLockEntry is a package of package-lock.json
+type npmLockEntry struct {
+	Name         string                   `json:"name"`
+	Version      string                   `json:"version"`
+	Resolved     string                   `json:"resolved"`
+	Integrity    string                   `json:"integrity"`
+	Link         bool                     `json:"link"`
+	InBundle     bool                     `json:"inBundle"`
+	Bundled      bool                     `json:"bundled"`
+	Dependencies map[string]*npmLockEntry `json:"dependencies"`
+}
+
+func parseNPMLockfile(data []byte) ([]*LockedPackage, error) {
+	var lockfile struct {
+		LockfileVersion int                      `json:"lockfileVersion"`
+		Packages        map[string]*npmLockEntry `json:"packages"`
+		Dependencies    json.RawMessage          `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lockfile); err != nil {
+		return nil, err
+	}
+
+	var locked []*LockedPackage
+	add := func(name string, entry *npmLockEntry) {
+		if entry.Link || entry.InBundle || entry.Bundled {
+			return
+		}
+		version := entry.Version
+		// aliases such as "npm:real@1.0.0" in lockfile v1
+		if strings.HasPrefix(version, "npm:") {
+			name, version = splitSpec(strings.TrimPrefix(version, "npm:"))
+		}
+		locked = append(locked, &LockedPackage{Name: name, Version: version, Resolved: entry.Resolved, Integrity: entry.Integrity})
+	}
+
+	// lockfile v2 and v3 list every package under "packages"
+	if lockfile.Packages != nil {
+		for path, entry := range lockfile.Packages {
+			i := strings.LastIndex(path, "node_modules/")
+			if i < 0 {
+				continue
+			}
+			name := entry.Name
+			if name == "" {
+				name = path[i+len("node_modules/"):]
+			}
+			add(name, entry)
+		}
+		return locked, nil
+	}
+
+	// lockfile v1 nests dependencies
+	var dependencies map[string]*npmLockEntry
+	if len(lockfile.Dependencies) > 0 {
+		if err := json.Unmarshal(lockfile.Dependencies, &dependencies); err != nil {
+			return nil, err
+		}
+	}
+	var walk func(map[string]*npmLockEntry)
+	walk = func(dependencies map[string]*npmLockEntry) {
+		for name, entry := range dependencies {
+			add(name, entry)
+			walk(entry.Dependencies)
+		}
+	}
+	walk(dependencies)
+
+	return locked, nil
+}
+
+// parseYarnLockfile reads yarn.lock of yarn classic, whose entries look like
+//
+//	"name@^1.0.0", name@^1.1.0:
+//	  version "1.2.0"
+//	  resolved "https://registry.yarnpkg.com/name/-/name-1.2.0.tgz#shasum"
+//	  integrity sha512-...
+func parseYarnLockfile(root lockNode) []*LockedPackage {
+	var locked []*LockedPackage
+	for key, value := range root {
+		entry, ok := value.(lockNode)
+		if !ok {
+			continue
+		}
+		resolved := entry.str("resolved")
+		// git, file and link dependencies have no registry tarball
+		if !strings.HasSuffix(strings.SplitN(resolved, "#", 2)[0], ".tgz") {
+			continue
+		}
+
+		spec := strings.Trim(strings.SplitN(key, ",", 2)[0], `" `)
+		// aliases such as "alias@npm:real@^1.0.0"
+		if i := strings.Index(spec, "@npm:"); i > 0 {
+			spec = spec[i+len("@npm:"):]
+		}
+		name, _ := splitSpec(spec)
+		integrity := entry.str("integrity")
+		if parts := strings.SplitN(resolved, "#", 2); integrity == "" && len(parts) == 2 {
+			if sum, err := hex.DecodeString(parts[1]); err == nil {
+				integrity = "sha1-" + base64.StdEncoding.EncodeToString(sum)
+			}
+		}
+		locked = append(locked, &LockedPackage{Name: name, Version: entry.str("version"), Resolved: resolved, Integrity: integrity})
+	}
+
+	return locked
+}
+
+// parseYarnBerryLockfile reads yarn.lock of yarn 2 and later
+//
+// The checksums of berry are hashes of its zip archives, so they can not be
+// compared with tarballs.
+func parseYarnBerryLockfile(root lockNode) []*LockedPackage {
+	var locked []*LockedPackage
+	for key, value := range root {
+		entry, ok := value.(lockNode)
+		if !ok || key == "__metadata" {
+			continue
+		}
+
+		name, spec := splitSpec(entry.str("resolution"))
+		if !strings.HasPrefix(spec, "npm:") {
+			continue
+		}
+		locked = append(locked, &LockedPackage{Name: name, Version: strings.TrimPrefix(spec, "npm:")})
+	}
+
+	return locked
+}
+
+// parsePNPMLockfile reads the packages of pnpm-lock.yaml, whose keys are
+// "/name/1.0.0_peer" (v5), "/name@1.0.0(peer)" (v6) or "name@1.0.0" (v9)
+func parsePNPMLockfile(root lockNode) ([]*LockedPackage, error) {
+	packages, ok := root["packages"].(lockNode)
+	if !ok {
+		return nil, nil
+	}
+
+	// versions are separated by a slash until lockfile v6
+	lockfileVersion, _ := strconv.ParseFloat(root.str("lockfileVersion"), 64)
+	slashed := lockfileVersion < 6
+
+	var locked []*LockedPackage
+	for key, value := range packages {
+		entry, _ := value.(lockNode)
+		resolution, _ := entry["resolution"].(lockNode)
+		// directories and git repositories are resolved without an integrity
+		if resolution.str("integrity") == "" {
+			continue
+		}
+
+		spec := strings.TrimPrefix(key, "/")
+		var name, version string
+		if slashed {
+			if i := strings.LastIndex(spec, "/"); i > 0 {
+				name, version = spec[:i], strings.SplitN(spec[i+1:], "_", 2)[0]
+			}
+		} else {
+			if i := strings.Index(spec, "("); i > 0 {
+				spec = spec[:i]
+			}
+			name, version = splitSpec(spec)
+		}
+		if entry.str("name") != "" {
+			name, version = entry.str("name"), entry.str("version")
+		}
+
+		locked = append(locked, &LockedPackage{Name: name, Version: version, Resolved: resolution.str("tarball"), Integrity: resolution.str("integrity")})
+	}
+
+	return locked, nil
+}
+
+// lockNode is a mapping of a yaml or yarn lockfile
+type lockNode map[string]interface{}
+
+func (node lockNode) str(key string) string {
+	value, _ := node[key].(string)
+	return value
+}
+
+// parseIndented parses the subset of yaml used by lockfiles, and the format
+// of yarn classic, into nested mappings
+//
+// Lines are either "key:" opening a mapping indented below, "key: value" or
+// "key value" (yarn classic). Values may be quoted or {flow: mappings}, and
+// sequences are skipped.
+func parseIndented(data []byte) lockNode {
+	type level struct {
+		indent int
+		node   lockNode
+	}
+	root := lockNode{}
+	stack := []level{{-1, root}}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || strings.HasPrefix(content, "#") || strings.HasPrefix(content, "-") {
+			continue
+		}
+		indent := len(line) - len(content)
+		for len(stack) > 1 && indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1].node
+
+		if strings.HasSuffix(content, ":") {
+			child := lockNode{}
+			parent[unquote(content[:len(content)-1])] = child
+			stack = append(stack, level{indent, child})
+			continue
+		}
+
+		key, value := splitLockLine(content)
+		if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+			parent[key] = parseFlowMapping(value[1 : len(value)-1])
+		} else {
+			parent[key] = unquote(value)
+		}
+	}
+
+	return root
+}
+
+// splitLockLine splits "key: value" or "key value" outside of quotes
+func splitLockLine(content string) (string, string) {
+	quote := byte(0)
+	space := -1
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && i+1 < len(content) && content[i+1] == ' ':
+			return unquote(content[:i]), strings.TrimSpace(content[i+2:])
+		case c == ' ' && space < 0:
+			space = i
+		}
+	}
+	if space < 0 {
+		return unquote(content), ""
+	}
+
+	return unquote(content[:space]), strings.TrimSpace(content[space+1:])
+}
+
+// parseFlowMapping parses the inside of "{key: value, key: value}"
+func parseFlowMapping(content string) lockNode {
+	node := lockNode{}
+	for _, item := range strings.Split(content, ",") {
+		key, value := splitLockLine(strings.TrimSpace(item))
+		node[key] = unquote(value)
+	}
+
+	return node
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
+
+// integrityHashes returns the hashes of an integrity string such as "sha512-..."
+// supported by this mirror, by algorithm
+func integrityHashes(integrity string) map[string]string {
+	hashes := map[string]string{}
+	for _, item := range strings.Fields(integrity) {
+		parts := strings.SplitN(item, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "sha1", "sha256", "sha512":
+			// options such as "sha512-...?foo" are ignored
+			hashes[parts[0]] = strings.SplitN(parts[1], "?", 2)[0]
+		}
+	}
+
+	return hashes
+}
+
+// verifyIntegrity checks the tarball in the storage against an integrity string
+//
+// Tarballs are only checked for existence when the integrity is empty.
+func verifyIntegrity(storage BlobStorage, key string, integrity string) (bool, error) {
+	hashes := integrityHashes(integrity)
+	if len(hashes) == 0 {
+		if integrity != "" {
+			return false, fmt.Errorf("Unsupported integrity: %s", integrity)
+		}
+		_, err := storage.Stat(key)
+		return err == nil, err
+	}
+
+	r, err := storage.Open(key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	hashers := map[string]hash.Hash{}
+	var writers []io.Writer
+	for algorithm := range hashes {
+		switch algorithm {
+		case "sha1":
+			hashers[algorithm] = sha1.New()
+		case "sha256":
+			hashers[algorithm] = sha256.New()
+		case "sha512":
+			hashers[algorithm] = sha512.New()
+		}
+		writers = append(writers, hashers[algorithm])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return false, err
+	}
+
+	for algorithm, expected := range hashes {
+		if base64.StdEncoding.EncodeToString(hashers[algorithm].Sum(nil)) != expected {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// LockStatus represents whether a locked package can be served by this mirror
+type LockStatus struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Document is whether the document of the package has the version
+	Document bool `json:"document"`
+	Tarball  bool `json:"tarball"`
+	// Integrity is whether the tarball matches the integrity of the lockfile
+	Integrity   bool   `json:"integrity"`
+	Blocked     bool   `json:"blocked"`
+	Quarantined bool   `json:"quarantined"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Available reports whether the locked package can be installed from this mirror
+func (status *LockStatus) Available() bool {
+	return status.Document && status.Tarball && status.Integrity
+}
+
+// checkLocked checks the version and the tarball of a locked package in the
+// store and the storage
+func checkLocked(pb *db.PocketBase, storage BlobStorage, pkg *LockedPackage) *LockStatus {
+	status := &LockStatus{Name: pkg.Name, Version: pkg.Version}
+	info := pb.GetVersion(pkg.Name, pkg.Version)
+	if info == nil {
+		return status
+	}
+	status.Document = true
+	if info.Tarball == "" {
+		return status
+	}
+
+	key := tarballKey(info.Tarball)
+	if shasum := pb.GetBlob(info.Tarball); shasum != "" {
+		key = blobKey(shasum)
+	}
+	if _, err := storage.Stat(key); err != nil {
+		return status
+	}
+	status.Tarball = true
+
+	status.Integrity, _ = verifyIntegrity(storage, key, pkg.Integrity)
+	return status
+}
+
+// lockfileCheckPath is the path of the lockfile check
+const lockfileCheckPath = "/-/pocketnpm/lockfile/check"
+
+// lockfileRequestConfig raises the limit of the request body for the lockfile
+// check only, since lockfiles of large projects exceed the default limit
+func lockfileRequestConfig(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	uri := header.RequestURI()
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	if header.IsPost() && string(uri) == lockfileCheckPath {
+		return fasthttp.RequestConfig{MaxRequestBodySize: 64 * 1024 * 1024}
+	}
+
+	return fasthttp.RequestConfig{}
+}
+
+// checkLockfile tells whether every package resolved by a lockfile can be
+// installed from this mirror, from the store and the tarballs only
+//
+// POST /-/pocketnpm/lockfile/check (body: package-lock.json, yarn.lock or pnpm-lock.yaml)
+func (server *PocketServer) checkLockfile(ctx *fasthttp.RequestCtx) {
+	locked, err := ParseLockfile(ctx.PostBody())
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ok := true
+	entries := make([]*LockStatus, len(locked))
+	policies := map[string]*documentPolicy{}
+	for i, pkg := range locked {
+		status := checkLocked(server.db, server.storage, pkg)
+		policy, cached := policies[pkg.Name]
+		if !cached {
+			policy = server.getPolicy(pkg.Name)
+			policies[pkg.Name] = policy
+		}
+		if !policy.empty() {
+			var published time.Time
+			if info := server.db.GetVersion(pkg.Name, pkg.Version); info != nil {
+				published = info.Published
+			}
+			status.Blocked, status.Quarantined, status.Reason = policy.check(pkg.Version, published)
+		}
+
+		ok = ok && status.Available() && !status.Blocked && !status.Quarantined
+		entries[i] = status
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok":      ok,
+		"total":   len(entries),
+		"entries": entries,
+	})
+}
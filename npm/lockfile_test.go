@@ -0,0 +1,261 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// integrity and shasum of "tarball"
+const (
+	tarballIntegrity = "sha512-WBQM9fuLkpBn60cFcU9GUnOBEyhwVxbOpyle0gD/abK/W01QtcFtEsDGj3RZYWrpP2UxasHjQ2plCE6FrzLYdg=="
+	tarballShasum    = "e10f6e70661d167ef514ab6e6d98607438c6a8c6"
+)
+
+var lockfiles = map[string]string{
+	"npm v1": `{
+  "lockfileVersion": 1,
+  "dependencies": {
+    "a": {"version": "1.0.0", "resolved": "https://registry.npmjs.org/a/-/a-1.0.0.tgz", "integrity": "sha512-a",
+      "dependencies": {"@s/b": {"version": "2.0.0", "integrity": "sha512-b"}}},
+    "alias": {"version": "npm:c@3.0.0"},
+    "local": {"version": "file:../local"}
+  }
+}`,
+	"npm v3": `{
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "app"},
+    "node_modules/a": {"version": "1.0.0", "resolved": "https://registry.npmjs.org/a/-/a-1.0.0.tgz", "integrity": "sha512-a"},
+    "node_modules/a/node_modules/@s/b": {"version": "2.0.0", "integrity": "sha512-b"},
+    "node_modules/alias": {"name": "c", "version": "3.0.0"},
+    "node_modules/local": {"resolved": "packages/local", "link": true},
+    "packages/local": {"version": "0.0.0"}
+  }
+}`,
+	"yarn classic": `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+"@s/b@^2.0.0":
+  version "2.0.0"
+  resolved "https://registry.yarnpkg.com/@s/b/-/b-2.0.0.tgz#0123456789abcdef0123456789abcdef01234567"
+
+a@^1.0.0, a@~1.0.0:
+  version "1.0.0"
+  resolved "https://registry.yarnpkg.com/a/-/a-1.0.0.tgz#0123456789abcdef0123456789abcdef01234567"
+  integrity sha512-a
+  dependencies:
+    "@s/b" "^2.0.0"
+
+alias@npm:c@^3.0.0:
+  version "3.0.0"
+  resolved "https://registry.yarnpkg.com/c/-/c-3.0.0.tgz#0123456789abcdef0123456789abcdef01234567"
+  integrity sha512-c
+
+local@file:../local:
+  version "0.0.0"
+`,
+	"yarn berry": `__metadata:
+  version: 6
+  cacheKey: 8
+
+"@s/b@npm:^2.0.0":
+  version: 2.0.0
+  resolution: "@s/b@npm:2.0.0"
+  checksum: 0123
+
+"a@npm:^1.0.0, a@npm:~1.0.0":
+  version: 1.0.0
+  resolution: "a@npm:1.0.0"
+  dependencies:
+    "@s/b": ^2.0.0
+
+"app@workspace:.":
+  version: 0.0.0-use.local
+  resolution: "app@workspace:."
+`,
+	"pnpm v5": `lockfileVersion: 5.4
+
+specifiers:
+  a: ^1.0.0
+
+packages:
+
+  /a/1.0.0_@s+b@2.0.0:
+    resolution: {integrity: sha512-a}
+    dependencies:
+      '@s/b': 2.0.0
+    dev: false
+
+  /@s/b/2.0.0:
+    resolution: {integrity: sha512-b}
+
+  file:../local:
+    resolution: {directory: ../local, type: directory}
+    name: local
+    version: 0.0.0
+`,
+	"pnpm v9": `lockfileVersion: '9.0'
+
+importers:
+  .:
+    dependencies:
+      a:
+        specifier: ^1.0.0
+        version: 1.0.0(@s/b@2.0.0)
+
+packages:
+
+  '@s/b@2.0.0':
+    resolution: {integrity: sha512-b}
+
+  a@1.0.0:
+    resolution: {integrity: sha512-a, tarball: https://registry.npmjs.org/a/-/a-1.0.0.tgz}
+
+snapshots:
+
+  a@1.0.0(@s/b@2.0.0):
+    dependencies:
+      '@s/b': 2.0.0
+`,
+}
+
+func TestParseLockfile(t *testing.T) {
+	for format, lockfile := range lockfiles {
+		locked, err := ParseLockfile([]byte(lockfile))
+		if err != nil {
+			t.Errorf("TestParseLockfile: %s %v", format, err)
+			continue
+		}
+
+		var specs []string
+		for _, pkg := range locked {
+			specs = append(specs, pkg.Name+"@"+pkg.Version)
+		}
+		expected := []string{"@s/b@2.0.0", "a@1.0.0", "c@3.0.0"}
+		if format == "yarn berry" || format == "pnpm v5" || format == "pnpm v9" {
+			expected = expected[:2]
+		}
+		if !reflect.DeepEqual(specs, expected) {
+			t.Errorf("TestParseLockfile: %s expected %v actual %v", format, expected, specs)
+		}
+	}
+
+	locked, _ := ParseLockfile([]byte(lockfiles["yarn classic"]))
+	if locked[0].Integrity != "sha1-ASNFZ4mrze8BI0VniavN7wEjRWc=" {
+		t.Errorf("TestParseLockfile: unexpected integrity from the shasum %s", locked[0].Integrity)
+	}
+}
+
+func TestCheckLocked(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-lockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	tarball, _ := url.Parse("https://registry.npmjs.org/test/-/test-0.0.1.tgz")
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","versions":{"0.0.1":{"dist":{"tarball":"`+tarball.String()+`","shasum":"`+tarballShasum+`","integrity":"sha512-a"}}}}`, "1", []*url.URL{tarball}, nil)
+	legacy := getLocalPath(client.config.Path, tarball.Path)
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	ioutil.WriteFile(legacy, []byte("tarball"), 0644)
+
+	cases := []struct {
+		pkg      *LockedPackage
+		expected LockStatus
+	}{
+		{&LockedPackage{Name: "test", Version: "0.0.1", Integrity: tarballIntegrity}, LockStatus{Document: true, Tarball: true, Integrity: true}},
+		{&LockedPackage{Name: "test", Version: "0.0.1"}, LockStatus{Document: true, Tarball: true, Integrity: true}},
+		{&LockedPackage{Name: "test", Version: "0.0.1", Integrity: "sha1-4Q9ucGYdFn71FKtubZhgdDjGqMY="}, LockStatus{Document: true, Tarball: true, Integrity: true}},
+		// the integrity of the document is not trusted over the tarball
+		{&LockedPackage{Name: "test", Version: "0.0.1", Integrity: "sha512-a"}, LockStatus{Document: true, Tarball: true}},
+		{&LockedPackage{Name: "test", Version: "0.0.1", Integrity: "md5-a"}, LockStatus{Document: true, Tarball: true}},
+		{&LockedPackage{Name: "test", Version: "0.0.2"}, LockStatus{}},
+	}
+	for _, c := range cases {
+		c.expected.Name, c.expected.Version = c.pkg.Name, c.pkg.Version
+		if status := checkLocked(pb, client.storage, c.pkg); !reflect.DeepEqual(*status, c.expected) {
+			t.Errorf("TestCheckLocked: %+v expected %+v actual %+v", c.pkg, c.expected, status)
+		}
+	}
+}
+
+func TestCheckLockfile(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-lockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	tarball, _ := url.Parse("https://registry.npmjs.org/test/-/test-0.0.1.tgz")
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","versions":{"0.0.1":{"dist":{"tarball":"`+tarball.String()+`"}},"0.0.2":{}}}`, "1", []*url.URL{tarball}, nil)
+	legacy := getLocalPath(client.config.Path, tarball.Path)
+	os.MkdirAll(filepath.Dir(legacy), 0755)
+	ioutil.WriteFile(legacy, []byte("tarball"), 0644)
+	pb.AddBlockEntry(&db.BlockEntry{Name: "test", Range: "0.0.2", Reason: "malware", Author: "test"})
+
+	server := &PocketServer{db: pb, storage: client.storage, serverConfig: &ServerConfig{}}
+	lockfile := `{"lockfileVersion": 3, "packages": {
+		"node_modules/test": {"version": "0.0.1", "integrity": "` + tarballIntegrity + `"},
+		"node_modules/other/node_modules/test": {"version": "0.0.2"}
+	}}`
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetBodyString(lockfile)
+	server.checkLockfile(&ctx)
+
+	var result struct {
+		OK      bool          `json:"ok"`
+		Entries []*LockStatus `json:"entries"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &result); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*LockStatus{
+		{Name: "test", Version: "0.0.1", Document: true, Tarball: true, Integrity: true},
+		{Name: "test", Version: "0.0.2", Document: true, Blocked: true, Reason: result.Entries[1].Reason},
+	}
+	if result.OK || !reflect.DeepEqual(result.Entries, expected) || result.Entries[1].Reason == "" {
+		t.Errorf("TestCheckLockfile: unexpected result %s", ctx.Response.Body())
+	}
+}
+
+func TestLockfileRequestConfig(t *testing.T) {
+	cases := []struct {
+		method   string
+		uri      string
+		expected int
+	}{
+		{"POST", "/-/pocketnpm/lockfile/check", 64 * 1024 * 1024},
+		{"POST", "/-/pocketnpm/lockfile/check?verbose=1", 64 * 1024 * 1024},
+		{"GET", "/-/pocketnpm/lockfile/check", 0},
+		{"POST", "/-/admin/webhooks", 0},
+		{"PUT", "/test", 0},
+	}
+	for _, c := range cases {
+		var header fasthttp.RequestHeader
+		header.SetMethod(c.method)
+		header.SetRequestURI(c.uri)
+		if actual := lockfileRequestConfig(&header).MaxRequestBodySize; actual != c.expected {
+			t.Errorf("TestLockfileRequestConfig: %s %s expected %d actual %d", c.method, c.uri, c.expected, actual)
+		}
+	}
+}
@@ -5,20 +5,68 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/ssut/pocketnpm/db"
 	"github.com/ssut/pocketnpm/log"
 	pbar "gopkg.in/cheggaaa/pb.v1"
 )
 
+// mirrorLog logs the messages of the mirror client, which also exports, imports and prefetches packages
+var mirrorLog = log.Component(log.ComponentMirror)
+
 type MirrorClient struct {
 	db        *db.PocketBase
 	config    *MirrorConfig
 	npmClient *NPMClient
+	storage   BlobStorage
+	webhooks  *WebhookDispatcher
+
+	mu      sync.Mutex
+	paused  bool
+	trigger chan struct{}
+	run     *mirrorRun
+	// resynced is set when packages have been reset to be mirrored again
+	resynced bool
+	// failures keeps the latest packages that failed in any run
+	failures []MirrorFailure
+}
+
+// maxMirrorFailures is the number of failures kept for the status
+const maxMirrorFailures = 50
+
+// mirrorRun contains the progress of a running Start call
+type mirrorRun struct {
+	packages   []*db.BarePackage
+	workers    []*MirrorWorker
+	dispatched int64
+	completed  int64
+	failed     int64
+	started    time.Time
+}
+
+// MirrorFailure represents a package that failed to be mirrored
+type MirrorFailure struct {
+	ID     string    `json:"id"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// MirrorStatus represents the state of the mirror client
+type MirrorStatus struct {
+	Paused     bool           `json:"paused"`
+	Running    bool           `json:"running"`
+	Started    *time.Time     `json:"started,omitempty"`
+	Total      int            `json:"total"`
+	Dispatched int64          `json:"dispatched"`
+	Completed  int64          `json:"completed"`
+	Failed     int64          `json:"failed"`
+	Queue      []string       `json:"queue"`
+	Workers    []WorkerStatus `json:"workers"`
+	// Failures lists the latest failures of any run, the latest first
+	Failures []MirrorFailure `json:"failures"`
 }
 
 // NewMirrorClient creates an instance of MirrorClient
@@ -28,20 +76,30 @@ func NewMirrorClient(db *db.PocketBase, config *MirrorConfig) *MirrorClient {
 	// Check for directory exists or not
 	// If not, try to create an empty directory for it
 	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
-		log.Debugf("Directory does not exist: %s", config.Path)
+		mirrorLog.Debugf("Directory does not exist: %s", config.Path)
 		err = os.MkdirAll(config.Path, 0755)
 		if err != nil {
-			log.Fatalf("Failed to create directory: %s", config.Path)
+			mirrorLog.Fatalf("Failed to create directory: %s", config.Path)
 		} else {
-			log.Debugf("Directory has been created: %s", config.Path)
+			mirrorLog.Debugf("Directory has been created: %s", config.Path)
 		}
 	}
 
+	storage, err := NewBlobStorage(config)
+	if err != nil {
+		mirrorLog.Fatalf("Failed to open storage: %v", err)
+	}
+
 	npmClient := NewNPMClient(config.Registry, config.Path)
+	npmClient.storage = storage
+	npmClient.contentAddressed = config.ContentAddressed
 	client := &MirrorClient{
 		config:    config,
 		db:        db,
 		npmClient: npmClient,
+		storage:   storage,
+		webhooks:  NewWebhookDispatcher(db, &config.Webhooks),
+		trigger:   make(chan struct{}, 1),
 	}
 
 	return client
@@ -57,25 +115,26 @@ func (c *MirrorClient) initDocument(allDocs *AllDocsResponse) {
 		}
 	}
 
-	log.Debug("Putting packages..")
+	mirrorLog.Debug("Putting packages..")
 	c.db.PutPackages(packages)
 	c.db.SetSequence(allDocs.Sequence)
-	log.Debug("Succeed")
+	mirrorLog.Debug("Succeed")
 }
 
 func (c *MirrorClient) FirstRun() {
 	allDocs := c.npmClient.GetAllDocs()
-	log.Infof("Total documents found: %d", allDocs.TotalRows)
+	mirrorLog.Infof("Total documents found: %d", allDocs.TotalRows)
 
-	log.Debug("Store all documents by given properties")
+	mirrorLog.Debug("Store all documents by given properties")
 	c.initDocument(allDocs)
 }
 
 func (c *MirrorClient) Start() {
 	// Load all packages with its revision
 	packages := c.db.GetIncompletePackages()
+	c.webhooks.Reload()
 
-	log.Debugf("Packages to queue: %d", len(packages))
+	mirrorLog.Debugf("Packages to queue: %d", len(packages))
 
 	// Array of workers
 	var workers = make([]*MirrorWorker, c.config.MaxConnections)
@@ -88,12 +147,26 @@ func (c *MirrorClient) Start() {
 	var wg sync.WaitGroup
 
 	// Create mirror workers
-	log.Debugf("Starting %d workers", c.config.MaxConnections)
+	mirrorLog.Debugf("Starting %d workers", c.config.MaxConnections)
 	for i := 0; i < c.config.MaxConnections; i++ {
-		workers[i] = NewMirrorWorker(i, c.npmClient, workerQueue, resultQueue, &wg)
+		workers[i] = NewMirrorWorker(i, c.npmClient, c.db, workerQueue, resultQueue, &wg)
 		workers[i].Start()
 	}
 
+	run := &mirrorRun{
+		packages: packages,
+		workers:  workers,
+		started:  time.Now(),
+	}
+	c.mu.Lock()
+	c.run = run
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.run = nil
+		c.mu.Unlock()
+	}()
+
 	// Result handler
 	go func(db *db.PocketBase, wg *sync.WaitGroup) {
 		for {
@@ -104,34 +177,59 @@ func (c *MirrorClient) Start() {
 			}
 
 			if result.Deleted {
-				path := getLocalPath(c.config.Path, result.Package.ID)
-				os.RemoveAll(path)
-				db.DeletePackage(result.Package.ID)
-				log.WithFields(logrus.Fields{
+				c.storage.RemoveAll(tarballKey(result.Package.ID))
+				c.webhooks.Notify(db.DeletePackage(result.Package.ID))
+				mirrorLog.WithFields(log.Fields{
 					"worker": result.WorkerID,
 				}).Infof("Deleted: %s", result.Package.ID)
+				atomic.AddInt64(&run.completed, 1)
 				wg.Done()
 				continue
 			}
 
 			var files []*url.URL
+			sizes := map[string]int64{}
+			blobs := map[string]string{}
+			missing := 0
 			for _, dist := range result.Distributions {
 				if !dist.Completed {
+					missing++
 					continue
 				}
 				file, _ := url.Parse(dist.Tarball)
 				files = append(files, file)
+
+				key := tarballKey(file.Path)
+				if c.config.ContentAddressed && validShasum(dist.SHA1) {
+					blobs[file.Path] = dist.SHA1
+					key = blobKey(dist.SHA1)
+				}
+				if info, err := c.storage.Stat(key); err == nil {
+					sizes[file.Path] = info.Size
+				}
 			}
-			succeed := db.PutCompleted(result.Package, result.Document, result.DocumentRevision, files)
+			// the index is only written when it changes since it costs a transaction
+			if len(blobs) > 0 || len(db.GetBlobs(result.Package.ID)) > 0 {
+				if err := db.PutBlobs(result.Package.ID, blobs); err != nil {
+					mirrorLog.Errorf("Failed to store blobs: %s %v", result.Package.ID, err)
+				}
+			}
+			entry, succeed := db.PutCompletedEntry(result.Package, result.Document, result.DocumentRevision, files, sizes)
+			atomic.AddInt64(&run.completed, 1)
 			wg.Done()
 			if succeed {
-				log.WithFields(logrus.Fields{
+				c.webhooks.Notify(entry)
+				mirrorLog.WithFields(log.Fields{
 					"sameRev": result.Package.Revision == result.DocumentRevision,
 					"files":   len(result.Distributions),
 					"worker":  result.WorkerID,
 				}).Infof("Mirrored: %s", result.Package.ID)
+				if missing > 0 {
+					c.addFailure(run, result.Package.ID, fmt.Sprintf("%d of %d tarballs failed to download", missing, len(result.Distributions)))
+				}
 			} else {
-				log.Errorf("Failed to mirror: %s", result.Package.ID)
+				mirrorLog.Errorf("Failed to mirror: %s", result.Package.ID)
+				c.addFailure(run, result.Package.ID, "Failed to store the document")
 			}
 		}
 	}(c.db, &wg)
@@ -154,31 +252,49 @@ func (c *MirrorClient) Start() {
 	for _, pkg := range packages {
 		wg.Add(1)
 		workQueue <- pkg
+		atomic.AddInt64(&run.dispatched, 1)
 	}
-	log.Debug("Successfully dispatched all queues")
+	mirrorLog.Debug("Successfully dispatched all queues")
 
 	// Wait for jobs to be finished
 	wg.Wait()
 
 	// Wait for all workers complete
-	log.Debugf("Stopping %d workers", len(workers))
+	mirrorLog.Debugf("Stopping %d workers", len(workers))
 	for _, worker := range workers {
 		wg.Add(1)
 		worker.Stop()
 	}
 	wg.Wait()
-	log.Info("Done")
+	mirrorLog.Info("Done")
 }
 
 func (c *MirrorClient) Update() {
 	interval := time.Duration(c.config.Interval) * time.Second
+
+	// changes are polled on start, and then after every interval
+	var delay time.Duration
 	for {
+		c.wait(delay)
+		delay = interval
+
 		// Load changes
 		since := c.db.GetSequence()
 		changes := c.npmClient.GetChangesSince(since)
+		if changes == nil {
+			continue
+		}
+
+		resynced := c.takeResynced()
 		if since == changes.LastSequence {
-			log.Info("Update: currently up to date. no packages will be updated")
-			time.Sleep(interval)
+			// packages reset through the admin API are mirrored without waiting for changes
+			if resynced {
+				mirrorLog.Info("Update: no changes, mirroring resynced packages")
+				c.Start()
+				continue
+			}
+
+			mirrorLog.Info("Update: currently up to date. no packages will be updated")
 			continue
 		}
 
@@ -203,51 +319,202 @@ func (c *MirrorClient) Update() {
 			i++
 		}
 
-		log.Infof("Update: %d packages will be updated", len(packages))
+		mirrorLog.Infof("Update: %d packages will be updated", len(packages))
 
 		// Put all packages
 		c.db.PutPackages(packages)
 		// Update sequence
 		c.db.SetSequence(changes.LastSequence)
-		log.Debugf("Update: Sequence has been set to %d (was %d)", changes.LastSequence, since)
+		mirrorLog.Debugf("Update: Sequence has been set to %d (was %d)", changes.LastSequence, since)
 
 		// Start worker
 		c.Start()
-		log.Info("Update: finish")
+		mirrorLog.Info("Update: finish")
+	}
+}
+
+// wait blocks until the interval has passed or a poll is triggered, and while the client is paused
+func (c *MirrorClient) wait(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.trigger:
+	}
+
+	for c.Paused() {
+		<-c.trigger
+	}
+}
+
+// Pause method pauses the update loop after the current run
+func (c *MirrorClient) Pause() {
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+	mirrorLog.Info("Update: paused")
+}
+
+// Resume method resumes the update loop and polls changes immediately
+func (c *MirrorClient) Resume() {
+	c.mu.Lock()
+	c.paused = false
+	c.mu.Unlock()
+	mirrorLog.Info("Update: resumed")
+	c.Poll()
+}
+
+// Paused method returns whether the update loop is paused
+func (c *MirrorClient) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// Poll method triggers a poll of changes without waiting for the interval
+//
+// If a run is in progress, the poll starts right after it.
+func (c *MirrorClient) Poll() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Resync method marks the package as incomplete and queues it for the next poll
+func (c *MirrorClient) Resync(name string) error {
+	if err := c.db.ResetPackage(name); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.resynced = true
+	c.mu.Unlock()
+	mirrorLog.Infof("Resync: %s has been queued", name)
+	c.Poll()
+	return nil
+}
+
+// takeResynced returns whether packages have been resynced since the last call
+func (c *MirrorClient) takeResynced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resynced := c.resynced
+	c.resynced = false
+	return resynced
+}
 
-		time.Sleep(interval)
+// addFailure records a package that failed in the run
+func (c *MirrorClient) addFailure(run *mirrorRun, id string, reason string) {
+	atomic.AddInt64(&run.failed, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, MirrorFailure{ID: id, Reason: reason, Time: time.Now()})
+	if len(c.failures) > maxMirrorFailures {
+		c.failures = c.failures[len(c.failures)-maxMirrorFailures:]
 	}
 }
 
+// Status method returns the state of the update loop and the current run
+func (c *MirrorClient) Status(limit int) *MirrorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := &MirrorStatus{
+		Paused:   c.paused,
+		Queue:    []string{},
+		Workers:  []WorkerStatus{},
+		Failures: make([]MirrorFailure, len(c.failures)),
+	}
+	for i, failure := range c.failures {
+		status.Failures[len(c.failures)-1-i] = failure
+	}
+
+	run := c.run
+	if run == nil {
+		return status
+	}
+
+	status.Running = true
+	status.Started = &run.started
+	status.Total = len(run.packages)
+	status.Dispatched = atomic.LoadInt64(&run.dispatched)
+	status.Completed = atomic.LoadInt64(&run.completed)
+	status.Failed = atomic.LoadInt64(&run.failed)
+
+	for i := int(status.Dispatched); i < len(run.packages) && len(status.Queue) < limit; i++ {
+		status.Queue = append(status.Queue, run.packages[i].ID)
+	}
+	for _, worker := range run.workers {
+		if ws := worker.Status(); ws.Package != "" {
+			status.Workers = append(status.Workers, ws)
+		}
+	}
+
+	return status
+}
+
 func (c *MirrorClient) initialize() {
 	if !c.db.IsInitialized() {
-		log.Debug("Database has not been initialized. Init..")
+		mirrorLog.Debug("Database has not been initialized. Init..")
 		c.db.Init()
 	} else {
-		log.Debug("Database has already been initialized.")
+		mirrorLog.Debug("Database has already been initialized.")
 	}
 
 	if !c.db.IsInitialized() {
-		log.Fatal("Failed to initialize database")
+		mirrorLog.Fatal("Failed to initialize database")
+	}
+}
+
+// backfillVersions stores the versions of packages mirrored before versions were
+// stored, which the server, the checks and the journal rely on
+func backfillVersions(pb *db.PocketBase, storage BlobStorage) {
+	count, err := pb.BackfillVersions(1000, func(path string) int64 {
+		key := tarballKey(path)
+		if shasum := pb.GetBlob(path); shasum != "" {
+			key = blobKey(shasum)
+		}
+		if info, err := storage.Stat(key); err == nil {
+			return info.Size
+		}
+		return 0
+	})
+	if err != nil {
+		mirrorLog.Errorf("Failed to store versions: %v", err)
+	} else if count > 0 {
+		mirrorLog.Infof("Stored versions of %d packages", count)
 	}
 }
 
 func (c *MirrorClient) Run(onetime bool) {
 	c.initialize()
 
-	log.Debug("Loading stats..")
+	mirrorLog.Debug("Loading stats..")
 	stats := c.db.GetStats()
-	log.WithFields(logrus.Fields{
+	mirrorLog.WithFields(log.Fields{
 		"Packages":  stats.Packages,
 		"Marks":     stats.Marks,
 		"Documents": stats.Documents,
 		"Files":     stats.Files,
 	}).Debug("Status for database")
 
+	// mirrors following this one need a change for every package
+	if count, err := c.db.BackfillChanges(1000); err != nil {
+		mirrorLog.Errorf("Failed to build the change log: %v", err)
+	} else if count > 0 {
+		mirrorLog.Infof("Recorded %d packages in the change log", count)
+	}
+	backfillVersions(c.db, c.storage)
+	// deliveries pending when the process stopped
+	c.webhooks.Notify(nil)
+
 	seq := c.db.GetSequence()
 
 	if seq == 0 {
-		log.WithFields(logrus.Fields{
+		mirrorLog.WithFields(log.Fields{
 			"sequence": seq,
 			"marked":   0,
 		}).Info("State marked as first run")
@@ -258,7 +525,7 @@ func (c *MirrorClient) Run(onetime bool) {
 	markedCount := c.db.GetCountOfMarks(true)
 
 	if seq > 0 && markedCount < stats.Packages {
-		log.WithFields(logrus.Fields{
+		mirrorLog.WithFields(log.Fields{
 			"sequence": seq,
 			"marked":   markedCount,
 		}).Info("Continue")
@@ -266,13 +533,16 @@ func (c *MirrorClient) Run(onetime bool) {
 	}
 
 	if onetime {
+		c.webhooks.Wait()
 		return
 	}
 
 	seq = c.db.GetSequence()
+	markedCount = c.db.GetCountOfMarks(true)
 
-	if seq > 0 && markedCount == stats.Packages {
-		log.WithFields(logrus.Fields{
+	// the update loop also serves the admin API, so it runs even if some packages failed
+	if seq > 0 {
+		mirrorLog.WithFields(log.Fields{
 			"sequence": seq,
 			"marked":   markedCount,
 		}).Info("State marked as run for updates")
@@ -283,38 +553,115 @@ func (c *MirrorClient) Run(onetime bool) {
 	<-exit
 }
 
-func (c *MirrorClient) Check() {
+// documentShasums returns the shasums of the tarballs of the stored document by url path
+func documentShasums(pb *db.PocketBase, name string) map[string]string {
+	shasums := map[string]string{}
+	doc, _, err := pb.GetDocument(name, false)
+	if err != nil {
+		return shasums
+	}
+
+	for _, dist := range getDistributions(doc) {
+		if u, err := url.Parse(dist.Tarball); err == nil {
+			shasums[u.Path] = dist.SHA1
+		}
+	}
+	return shasums
+}
+
+// FileCheckReport represents the result of a check of the downloaded files
+type FileCheckReport struct {
+	Packages     int      `json:"packages"`
+	Files        int      `json:"files"`
+	Missing      []string `json:"missing"`
+	Mismatched   []string `json:"mismatched"`
+	Redownloaded []string `json:"redownloaded"`
+	Reset        []string `json:"reset"`
+}
+
+// Check checks that the tarballs of all packages exist and match their shasums
+//
+// If fix is set, missing and mismatched tarballs are downloaded again, and
+// packages whose tarballs cannot be downloaded are marked as incomplete.
+func (c *MirrorClient) Check(fix bool) *FileCheckReport {
 	c.initialize()
+	backfillVersions(c.db, c.storage)
 
 	// Load all files
-	log.Infof("Loading all files")
+	mirrorLog.Infof("Loading all files")
 	files := c.db.GetAllFiles()
 
-	var errs []string
+	report := &FileCheckReport{
+		Missing:      []string{},
+		Mismatched:   []string{},
+		Redownloaded: []string{},
+		Reset:        []string{},
+	}
 
 	count := len(files)
-	log.Infof("Checking files for %d packages", count)
+	mirrorLog.Infof("Checking files for %d packages", count)
 	bar := pbar.StartNew(count)
 
-	// Check file exists
 	for name, items := range files {
+		shasums := map[string]string{}
+		for _, version := range c.db.GetVersions(name) {
+			shasums[version.Tarball] = version.Shasum
+		}
+		// tarballs without a version are checked against the document
+		for _, item := range items {
+			if _, ok := shasums[item.Path]; !ok {
+				for path, shasum := range documentShasums(c.db, name) {
+					if _, ok := shasums[path]; !ok {
+						shasums[path] = shasum
+					}
+				}
+				break
+			}
+		}
+
+		reset := false
 		bar.Total += int64(len(items))
 		for _, item := range items {
-			path := getLocalPath(c.config.Path, item.Path)
-			if _, err := os.Stat(path); os.IsNotExist(err) {
-				errstr := fmt.Sprintf("%s: %s", name, path)
-				errs = append(errs, errstr)
+			report.Files++
+			key := c.key(item.Path)
+			shasum := shasums[item.Path]
+
+			ok, err := verifyBlob(c.storage, key, shasum)
+			if !ok {
+				if os.IsNotExist(err) {
+					report.Missing = append(report.Missing, key)
+				} else {
+					report.Mismatched = append(report.Mismatched, key)
+				}
+
+				if fix {
+					if c.npmClient.Download(item, shasum) {
+						if c.config.ContentAddressed && validShasum(shasum) {
+							c.db.PutBlob(item.Path, shasum)
+						}
+						report.Redownloaded = append(report.Redownloaded, key)
+					} else {
+						mirrorLog.Warnf("Failed to download %s: %s", name, item.String())
+						reset = true
+					}
+				}
 			}
 
 			bar.Increment()
 		}
+
+		if reset {
+			if err := c.db.ResetPackage(name); err != nil {
+				mirrorLog.Errorf("Failed to reset %s: %v", name, err)
+			} else {
+				report.Reset = append(report.Reset, name)
+			}
+		}
+		report.Packages++
 		bar.Increment()
 	}
 	bar.Finish()
 
-	// Write errors
-	log.Debugf("Creating missing report of file checks: report.txt")
-	out, _ := os.Create("report.log")
-	defer out.Close()
-	out.WriteString(strings.Join(errs[:], "\n"))
+	mirrorLog.Infof("%d missing and %d mismatched files found", len(report.Missing), len(report.Mismatched))
+	return report
 }
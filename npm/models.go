@@ -5,15 +5,66 @@ type MirrorConfig struct {
 	MaxConnections int    `toml:"concurrency"`
 	Path           string `toml:"path"`
 	Interval       int    `toml:"interval"`
+	// ContentAddressed stores tarballs by their shasums so that identical tarballs are stored once
+	ContentAddressed bool          `toml:"content_addressed"`
+	Storage          StorageConfig `toml:"storage"`
+	Webhooks         WebhookConfig `toml:"webhooks"`
+}
+
+// WebhookConfig controls the delivery of webhooks, which are managed with
+// `pocketnpm webhook` or /-/admin/webhooks
+type WebhookConfig struct {
+	Attempts int `toml:"attempts"`
+	// Timeout of a request in seconds
+	Timeout     int `toml:"timeout"`
+	Concurrency int `toml:"concurrency"`
+	// History is the number of deliveries kept per webhook
+	History int `toml:"history"`
+}
+
+// StorageConfig selects where tarballs are stored
+type StorageConfig struct {
+	// Type is either local (under MirrorConfig.Path) or s3
+	Type      string `toml:"type"`
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	Prefix    string `toml:"prefix"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	Secure    bool   `toml:"secure"`
+	// Redirect sends clients to presigned urls instead of proxying tarballs
+	Redirect      bool `toml:"redirect"`
+	PresignExpiry int  `toml:"presign_expiry"`
 }
 
 type ServerConfig struct {
-	Bind         string `toml:"bind"`
-	Scheme       string `toml:"scheme"`
-	Host         string `toml:"host"`
-	Port         int    `toml:"port"`
-	EnableXAccel bool   `toml:"x_accel_redirect"`
-	LogPath      string `toml:"logpath"`
+	Bind           string `toml:"bind"`
+	Scheme         string `toml:"scheme"`
+	Host           string `toml:"host"`
+	Port           int    `toml:"port"`
+	EnableXAccel   bool   `toml:"x_accel_redirect"`
+	LogPath        string `toml:"logpath"`
+	AdminToken     string `toml:"admin_token"`
+	QuarantineDays int    `toml:"quarantine_days"`
+	// DownloadsInterval is the interval in seconds at which download counts
+	// are flushed to the database, or a negative number not to count them
+	DownloadsInterval int             `toml:"downloads_interval"`
+	AccessLog         AccessLogConfig `toml:"access_log"`
+}
+
+// AccessLogConfig represents the format and the rotation of the access log
+// written to LogPath
+type AccessLogConfig struct {
+	// Format is text, json or combined
+	Format string `toml:"format"`
+	// MaxSize is the size in megabytes at which the log is rotated (100 if 0)
+	MaxSize int `toml:"max_size"`
+	// Rotate rotates the log hourly or daily regardless of its size
+	Rotate     string `toml:"rotate"`
+	MaxBackups int    `toml:"max_backups"`
+	MaxAge     int    `toml:"max_age"`
+	Compress   bool   `toml:"compress"`
 }
 
 type AllDocsResponse struct {
@@ -1,18 +1,18 @@
 package npm
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/pquerna/ffjson/ffjson"
-	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 
 	"path"
@@ -20,10 +20,16 @@ import (
 	"github.com/ssut/pocketnpm/log"
 )
 
+// npmLog logs the messages of the registry client
+var npmLog = log.Component(log.ComponentNPMClient)
+
 type NPMClient struct {
 	httpClient *fasthttp.Client
 	registry   string
 	path       string
+	storage    BlobStorage
+	// tarballs are downloaded into the content-addressed layout
+	contentAddressed bool
 }
 
 func NewNPMClient(registry string, path string) *NPMClient {
@@ -35,6 +41,7 @@ func NewNPMClient(registry string, path string) *NPMClient {
 		httpClient: httpClient,
 		registry:   registry,
 		path:       path,
+		storage:    newLocalStorage(path),
 	}
 
 	return client
@@ -49,7 +56,7 @@ func (c *NPMClient) attemptGet(url string, maxAttempts int, returnStream bool) (
 		if returnStream || strings.Contains(url, "%") {
 			resp, err = http.Get(url)
 			if err != nil {
-				log.Error(err)
+				npmLog.Error(err)
 				return resp, nil, err
 			}
 
@@ -64,7 +71,7 @@ func (c *NPMClient) attemptGet(url string, maxAttempts int, returnStream bool) (
 		}
 
 		if err != nil && attempts < maxAttempts {
-			log.WithFields(logrus.Fields{
+			npmLog.WithFields(log.Fields{
 				"attempts": attempts,
 			}).Warnf("http error: %s", err)
 			continue
@@ -93,22 +100,22 @@ func (c *NPMClient) GetAllDocs() *AllDocsResponse {
 	q.Add("update_seq", "true")
 	u.RawQuery = q.Encode()
 
-	log.Debugf("Get: %s", u.String())
+	npmLog.Debugf("Get: %s", u.String())
 	statusCode, body, err := c.httpClient.Get(nil, u.String())
 	if err != nil {
-		log.Fatal(err)
+		npmLog.Fatal(err)
 		return nil
 	}
 	if statusCode != fasthttp.StatusOK {
-		log.Fatalf("Unexpected status code: %d", statusCode)
+		npmLog.Fatalf("Unexpected status code: %d", statusCode)
 		return nil
 	}
 
-	log.Debugf("Unmarshaling the entire document (%d B)", len(body))
+	npmLog.Debugf("Unmarshaling the entire document (%d B)", len(body))
 	var resp AllDocsResponse
 	if err := ffjson.Unmarshal(body, &resp); err != nil {
-		log.Print(err)
-		log.Fatalf("Could not decode JSON data: %s", err)
+		npmLog.Print(err)
+		npmLog.Fatalf("Could not decode JSON data: %s", err)
 		return nil
 	}
 
@@ -133,14 +140,14 @@ func (c *NPMClient) GetDocument(id string) string {
 
 	resp, body, err := c.attemptGet(docURL, 3, false)
 
-	log.Debugf("Get: %s", docURL)
+	npmLog.Debugf("Get: %s", docURL)
 
 	if err != nil {
-		log.Error(err)
+		npmLog.Error(err)
 		return ""
 	}
 	if resp.StatusCode != fasthttp.StatusOK {
-		log.Errorf("Unexpected status code: %d (%s)", resp.StatusCode, docURL)
+		npmLog.Errorf("Unexpected status code: %d (%s)", resp.StatusCode, docURL)
 		return strconv.FormatInt(int64(resp.StatusCode), 10)
 	}
 
@@ -154,64 +161,74 @@ func (c *NPMClient) GetChangesSince(seq int) *ChangesResponse {
 	q.Add("since", strconv.FormatInt(int64(seq), 10))
 	u.RawQuery = q.Encode()
 
-	log.Debugf("Get: %s", u.String())
+	npmLog.Debugf("Get: %s", u.String())
 	statusCode, body, err := c.httpClient.Get(nil, u.String())
 	if err != nil {
-		log.Error(err)
+		npmLog.Error(err)
 		return nil
 	}
 	if statusCode != fasthttp.StatusOK {
-		log.Errorf("Unexpected status code: %d", statusCode)
+		npmLog.Errorf("Unexpected status code: %d", statusCode)
 		return nil
 	}
 
 	var resp ChangesResponse
 	if err := ffjson.Unmarshal(body, &resp); err != nil {
-		log.Errorf("Could not decode JSON data: %s", err)
+		npmLog.Errorf("Could not decode JSON data: %s", err)
 		return nil
 	}
 
 	return &resp
 }
 
+// Download downloads a tarball into the storage unless it exists with the shasum
 func (c *NPMClient) Download(url *url.URL, shasum string) bool {
-	path := getLocalPath(c.path, url.Path)
-	err := os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
-		log.Fatalf("Directory is not writable: %s (%q)", path, err)
+	key := tarballKey(url.Path)
+	// content-addressed tarballs are found by their shasums, so they must match
+	verified := c.contentAddressed && validShasum(shasum)
+	if verified {
+		key = blobKey(shasum)
 	}
 
-	var out *os.File
-	_, err = os.Stat(path)
+	if ok, _ := verifyBlob(c.storage, key, shasum); ok {
+		return true
+	}
 
+	out, err := downloadTemp(c.path, key)
 	if err != nil {
-		out, err = os.Create(path)
-		if err != nil {
-			log.Fatalf("Failed to create a file: %s (%q)", path, err)
-		}
-	} else {
-		out, err = os.OpenFile(path, os.O_RDWR, 0666)
+		npmLog.Fatalf("Failed to create a file: %s (%q)", key, err)
 	}
+	defer os.Remove(out.Name())
 	defer out.Close()
 
-	if _, err := out.Stat(); err == nil {
-		fileHash, err := hashSHA1(out)
-		if err == nil && fileHash == shasum {
-			return true
-		}
-	}
-
 	resp, body, err := c.attemptGet(url.String(), 3, true)
 	if _, ok := body.(io.ReadCloser); !ok {
 		return false
 	}
 	defer body.(io.ReadCloser).Close()
 
-	if resp.StatusCode == fasthttp.StatusOK {
-		size := resp.ContentLength
-		n, _ := io.Copy(out, body.(io.ReadCloser))
-		return size == n
+	if resp.StatusCode != fasthttp.StatusOK {
+		return false
+	}
+
+	hash := sha1.New()
+	size := resp.ContentLength
+	n, _ := io.Copy(io.MultiWriter(out, hash), body.(io.ReadCloser))
+	if size != n {
+		return false
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if verified && sum != shasum {
+		npmLog.Warnf("Shasum mismatch: %s (expected %s, got %s)", url.Path, shasum, sum)
+		return false
+	}
+	out.Close()
+
+	if err := c.storage.PutFile(key, out.Name(), sum); err != nil {
+		npmLog.Errorf("Failed to store %s: %v", key, err)
+		return false
 	}
 
-	return false
+	return true
 }
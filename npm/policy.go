@@ -0,0 +1,185 @@
+package npm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+)
+
+// documentPolicy contains local rules applied to documents before they are served
+type documentPolicy struct {
+	blocked    []*db.BlockEntry
+	overrides  map[string]string
+	reviews    map[string]*db.VersionReview
+	quarantine time.Duration
+	now        time.Time
+}
+
+func (server *PocketServer) getPolicy(name string) *documentPolicy {
+	return &documentPolicy{
+		blocked:    server.db.GetBlockEntries(name),
+		overrides:  server.db.GetDistTags(name),
+		reviews:    server.db.GetVersionReviews(name),
+		quarantine: time.Duration(server.serverConfig.QuarantineDays) * 24 * time.Hour,
+		now:        time.Now(),
+	}
+}
+
+// empty reports whether the policy leaves every document untouched
+func (p *documentPolicy) empty() bool {
+	return len(p.blocked) == 0 && len(p.overrides) == 0 && len(p.reviews) == 0 && p.quarantine == 0
+}
+
+// hidden reports whether the version must not be served and the reason why
+func (p *documentPolicy) hidden(version string, published time.Time) (bool, string) {
+	blocked, quarantined, reason := p.check(version, published)
+	return blocked || quarantined, reason
+}
+
+// check reports whether the version is blocked or quarantined and the reason why
+func (p *documentPolicy) check(version string, published time.Time) (blocked bool, quarantined bool, reason string) {
+	if entry := blockedBy(p.blocked, version); entry != nil {
+		return true, false, blockReason(entry)
+	}
+
+	if review, ok := p.reviews[version]; ok {
+		if review.Status == db.ReviewBlocked {
+			return true, false, fmt.Sprintf("blocked by an administrator: %s", review.Reason)
+		}
+		return false, false, ""
+	}
+
+	if p.quarantine > 0 && !published.IsZero() && p.now.Sub(published) < p.quarantine {
+		release := published.Add(p.quarantine).UTC().Format(time.RFC3339)
+		return false, true, fmt.Sprintf("quarantined until %s", release)
+	}
+
+	return false, false, ""
+}
+
+// hiddenVersions returns hidden versions of the document with the reasons
+func (p *documentPolicy) hiddenVersions(versions []string, times map[string]interface{}) map[string]string {
+	hidden := map[string]string{}
+	for _, version := range versions {
+		published, _ := times[version].(string)
+		if ok, reason := p.hidden(version, parseTime(published)); ok {
+			hidden[version] = reason
+		}
+	}
+
+	return hidden
+}
+
+// apply rewrites the decoded document and returns a stamp identifying the changes
+func (p *documentPolicy) apply(doc map[string]interface{}) string {
+	versions, _ := doc["versions"].(map[string]interface{})
+	times, _ := doc["time"].(map[string]interface{})
+
+	keys := make([]string, 0, len(versions))
+	for version := range versions {
+		keys = append(keys, version)
+	}
+	hidden := p.hiddenVersions(keys, times)
+
+	for version := range hidden {
+		delete(versions, version)
+		delete(times, version)
+	}
+	applyDistTags(doc, p.overrides)
+
+	// make sure that no tag points at a hidden version
+	tags, _ := doc["dist-tags"].(map[string]interface{})
+	for tag, target := range tags {
+		version, _ := target.(string)
+		if _, ok := versions[version]; ok {
+			continue
+		}
+		if replacement := pickVersion(versions, version); replacement != "" {
+			tags[tag] = replacement
+		} else {
+			delete(tags, tag)
+		}
+	}
+
+	var parts []string
+	for tag, version := range p.overrides {
+		parts = append(parts, "tag:"+tag+"="+version)
+	}
+	for version := range hidden {
+		parts = append(parts, "hidden:"+version)
+	}
+	sort.Strings(parts)
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(parts, ",")))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// pickVersion returns the highest version below the target, which is stable
+// unless the target is a prerelease. An empty string is returned if there is none.
+func pickVersion(versions map[string]interface{}, target string) string {
+	t, err := parseSemver(target)
+
+	var best *semver
+	var picked string
+	for version := range versions {
+		v, verr := parseSemver(version)
+		if verr != nil {
+			continue
+		}
+		if err == nil && (v.Compare(t) >= 0 || (len(v.Prerelease) > 0 && len(t.Prerelease) == 0)) {
+			continue
+		}
+		if err != nil && len(v.Prerelease) > 0 {
+			continue
+		}
+		if best == nil || v.Compare(best) > 0 {
+			best, picked = v, version
+		}
+	}
+
+	return picked
+}
+
+// checkVersion reports whether the version of the package may be served
+func (server *PocketServer) checkVersion(name string, version string) (bool, string) {
+	policy := server.getPolicy(name)
+	if policy.empty() {
+		return true, ""
+	}
+
+	var published time.Time
+	if info := server.db.GetVersion(name, version); info != nil {
+		published = info.Published
+	} else if policy.quarantine > 0 {
+		// packages mirrored before versions were stored
+		doc, _, err := server.db.GetDocument(name, false)
+		if err == nil {
+			var parsed struct {
+				Time map[string]string `json:"time"`
+			}
+			ffjson.Unmarshal([]byte(doc), &parsed)
+			published = parseTime(parsed.Time[version])
+		}
+	}
+
+	hidden, reason := policy.hidden(version, published)
+	return !hidden, reason
+}
+
+// tarballVersion extracts the version from a tarball name such as "react-16.0.0.tgz"
+func tarballVersion(name string, tarball string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	version := strings.TrimPrefix(tarball, name+"-")
+	version = strings.TrimSuffix(version, ".tgz")
+	version = strings.TrimSuffix(version, ".tar")
+	return version
+}
@@ -0,0 +1,150 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestDocumentPolicy(t *testing.T) {
+	now := time.Date(2017, 4, 10, 0, 0, 0, 0, time.UTC)
+	document := `{
+		"name": "test",
+		"dist-tags": {"latest": "1.2.0", "next": "2.0.0-rc.1"},
+		"versions": {"1.0.0": {}, "1.1.0": {}, "1.2.0": {}, "2.0.0-rc.1": {}},
+		"time": {
+			"1.0.0": "2017-01-01T00:00:00.000Z",
+			"1.1.0": "2017-02-01T00:00:00.000Z",
+			"1.2.0": "2017-04-09T00:00:00.000Z",
+			"2.0.0-rc.1": "2017-04-09T00:00:00.000Z"
+		}
+	}`
+
+	policy := &documentPolicy{
+		reviews: map[string]*db.VersionReview{
+			"1.1.0":      {Status: db.ReviewBlocked},
+			"2.0.0-rc.1": {Status: db.ReviewApproved},
+		},
+		quarantine: 7 * 24 * time.Hour,
+		now:        now,
+	}
+
+	doc, err := decodeDocument(document)
+	if err != nil {
+		t.Fatalf("TestDocumentPolicy: unexpected error %v", err)
+	}
+	policy.apply(doc)
+
+	versions := doc["versions"].(map[string]interface{})
+	if len(versions) != 2 || versions["1.0.0"] == nil || versions["2.0.0-rc.1"] == nil {
+		t.Errorf("TestDocumentPolicy: unexpected versions %v", versions)
+	}
+
+	expected := map[string]interface{}{"latest": "1.0.0", "next": "2.0.0-rc.1"}
+	if tags := doc["dist-tags"]; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("TestDocumentPolicy: expected dist-tags %v actual %v", expected, tags)
+	}
+}
+
+func TestTarballVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		tarball  string
+		expected string
+	}{
+		{name: "react", tarball: "react-16.0.0.tgz", expected: "16.0.0"},
+		{name: "@types/node", tarball: "node-8.0.0-beta.1.tgz", expected: "8.0.0-beta.1"},
+	}
+
+	for i, test := range tests {
+		actual := tarballVersion(test.name, test.tarball)
+		if actual != test.expected {
+			t.Errorf("tarballVersion(%d): expected %s actual %s", i, test.expected, actual)
+		}
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	now := time.Date(2017, 4, 10, 0, 0, 0, 0, time.UTC)
+	versions := []*db.VersionInfo{
+		{Version: "1.0.0", Published: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Version: "1.1.0", Published: time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Version: "1.2.0", Published: time.Date(2017, 4, 9, 0, 0, 0, 0, time.UTC), Tags: []string{"latest"}},
+		{Version: "2.0.0-rc.1", Published: time.Date(2017, 4, 9, 0, 0, 0, 0, time.UTC), Tags: []string{"next"}},
+	}
+	policy := &documentPolicy{
+		overrides: map[string]string{"beta": "1.0.0", "next": ""},
+		reviews: map[string]*db.VersionReview{
+			"1.1.0":      {Status: db.ReviewBlocked},
+			"2.0.0-rc.1": {Status: db.ReviewApproved},
+		},
+		quarantine: 7 * 24 * time.Hour,
+		now:        now,
+	}
+
+	cases := map[string]string{
+		"1.0.0":      "1.0.0",
+		"1.1.0":      "",
+		"2.0.0-rc.1": "2.0.0-rc.1",
+		"latest":     "1.0.0",
+		"beta":       "1.0.0",
+		"next":       "",
+		"^1.0.0":     "1.0.0",
+		"~1.1.0":     "",
+		"3":          "",
+	}
+	for spec, expected := range cases {
+		actual := ""
+		if info := resolveVersion(versions, policy, spec); info != nil {
+			actual = info.Version
+		}
+		if actual != expected {
+			t.Errorf("TestResolveVersion: %s expected %q actual %q", spec, expected, actual)
+		}
+	}
+}
+
+func TestGetDocumentByVersion(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	pack := &db.BarePackage{ID: "test", Revision: "1"}
+	pb.PutPackages([]*db.BarePackage{pack})
+	pb.PutCompleted(pack, `{"_id":"test","dist-tags":{"latest":"1.1.0"},"versions":{`+
+		`"1.0.0":{"version":"1.0.0","dist":{"tarball":"https://registry.npmjs.org/test/-/test-1.0.0.tgz"}},`+
+		`"1.1.0":{"version":"1.1.0"}}}`, "1", nil, nil)
+	pb.AddBlockEntry(&db.BlockEntry{Name: "test", Range: "1.1.0", Reason: "malware", Author: "test"})
+
+	server := &PocketServer{db: pb, storage: client.storage, serverConfig: &ServerConfig{Scheme: "http", Host: "mirror"}}
+	cases := []struct {
+		version  string
+		status   int
+		expected string
+	}{
+		{"1.0.0", 200, `{"version":"1.0.0","dist":{"tarball":"http://mirror/test/-/test-1.0.0.tgz"}}`},
+		{"latest", 200, `{"version":"1.0.0","dist":{"tarball":"http://mirror/test/-/test-1.0.0.tgz"}}`},
+		{"^1.0.0", 200, `{"version":"1.0.0","dist":{"tarball":"http://mirror/test/-/test-1.0.0.tgz"}}`},
+		{"1.1.0", 404, "{}"},
+		{"2.0.0", 404, "{}"},
+	}
+	for _, c := range cases {
+		var ctx fasthttp.RequestCtx
+		ctx.SetUserValue("name", "test")
+		ctx.SetUserValue("version", c.version)
+		server.getDocumentByVersion(&ctx)
+		if status, body := ctx.Response.StatusCode(), string(ctx.Response.Body()); status != c.status || body != c.expected {
+			t.Errorf("TestGetDocumentByVersion: %s expected %d %s actual %d %s", c.version, c.status, c.expected, status, body)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package npm
+
+import (
+	"github.com/ssut/pocketnpm/db"
+)
+
+// PrefetchReport represents the result of prefetching locked packages
+type PrefetchReport struct {
+	Locked    int `json:"locked"`
+	Available int `json:"available"`
+	// Queued lists the packages that were mirrored
+	Queued []string `json:"queued,omitempty"`
+	// Missing lists name@version of versions or tarballs that are still missing
+	Missing []string `json:"missing,omitempty"`
+	// Mismatched lists name@version of tarballs not matching the integrity of the lockfile
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+// checkPrefetch checks every locked package, and returns the report with the
+// names of the packages that are not available
+func (c *MirrorClient) checkPrefetch(locked []*LockedPackage) (*PrefetchReport, []string) {
+	report := &PrefetchReport{Locked: len(locked)}
+	var names []string
+	seen := map[string]bool{}
+
+	for _, pkg := range locked {
+		status := checkLocked(c.db, c.storage, pkg)
+		switch {
+		case status.Available():
+			report.Available++
+			continue
+		case status.Tarball:
+			report.Mismatched = append(report.Mismatched, pkg.Name+"@"+pkg.Version)
+		default:
+			report.Missing = append(report.Missing, pkg.Name+"@"+pkg.Version)
+		}
+
+		if !seen[pkg.Name] {
+			seen[pkg.Name] = true
+			names = append(names, pkg.Name)
+		}
+	}
+
+	return report, names
+}
+
+// Prefetch mirrors the packages of the locked versions that are not available,
+// and checks every locked tarball against its integrity afterwards
+//
+// The packages are queued like updates: they are marked as incomplete and
+// mirrored by Start along with any other incomplete package.
+func (c *MirrorClient) Prefetch(locked []*LockedPackage) *PrefetchReport {
+	c.initialize()
+	// lockfiles of several projects share most of their packages
+	locked = uniqueLocked(locked)
+
+	_, names := c.checkPrefetch(locked)
+	if len(names) > 0 {
+		packages := make([]*db.BarePackage, len(names))
+		for i, name := range names {
+			packages[i] = &db.BarePackage{ID: name, Revision: c.db.GetRevision(name)}
+		}
+		mirrorLog.Infof("Prefetch: %d packages will be mirrored", len(packages))
+
+		c.db.PutPackages(packages)
+		c.Start()
+		c.webhooks.Wait()
+	}
+
+	report, _ := c.checkPrefetch(locked)
+	report.Queued = names
+	return report
+}
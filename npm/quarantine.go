@@ -0,0 +1,122 @@
+package npm
+
+import (
+	"fmt"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// getQuarantine returns admin decisions and currently hidden versions of a package
+//
+// GET /-/admin/quarantine/:name
+func (server *PocketServer) getQuarantine(ctx *fasthttp.RequestCtx) {
+	name, rest := splitPackagePath(ctx.UserValue("path").(string))
+	if name == "" || len(rest) > 0 {
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	doc, _, err := server.db.GetDocument(name, false)
+	if err != nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var parsed struct {
+		Versions map[string]interface{} `json:"versions"`
+		Time     map[string]interface{} `json:"time"`
+	}
+	ffjson.Unmarshal([]byte(doc), &parsed)
+
+	versions := make([]string, 0, len(parsed.Versions))
+	for version := range parsed.Versions {
+		versions = append(versions, version)
+	}
+
+	policy := server.getPolicy(name)
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, map[string]interface{}{
+		"name":    name,
+		"reviews": policy.reviews,
+		"hidden":  policy.hiddenVersions(versions, parsed.Time),
+	})
+}
+
+// reviewVersion approves or blocks a version
+//
+// POST /-/admin/quarantine/:name/:version/(approve|block) (body: {"reason": "..."})
+func (server *PocketServer) reviewVersion(ctx *fasthttp.RequestCtx) {
+	name, rest := splitPackagePath(ctx.UserValue("path").(string))
+	if len(rest) != 2 {
+		server.raiseNotFound(ctx)
+		return
+	}
+	version, action := rest[0], rest[1]
+
+	var status string
+	switch action {
+	case "approve":
+		status = db.ReviewApproved
+	case "block":
+		status = db.ReviewBlocked
+	default:
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if len(ctx.PostBody()) > 0 {
+		if err := ffjson.Unmarshal(ctx.PostBody(), &body); err != nil {
+			ctx.SetStatusCode(400)
+			server.writeJSON(ctx, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	if err := server.db.SetVersionReview(name, version, status, body.Reason); err != nil {
+		serverLog.Errorf("Failed to review a version: %s@%s %v", name, version, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	serverLog.Infof("Review: %s@%s has been %s", name, version, status)
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok":      true,
+		"id":      fmt.Sprintf("%s@%s", name, version),
+		"status":  status,
+		"reason":  body.Reason,
+		"version": version,
+	})
+}
+
+// resetReview removes the decision on a version so that the quarantine period applies again
+//
+// DELETE /-/admin/quarantine/:name/:version
+func (server *PocketServer) resetReview(ctx *fasthttp.RequestCtx) {
+	name, rest := splitPackagePath(ctx.UserValue("path").(string))
+	if len(rest) != 1 {
+		server.raiseNotFound(ctx)
+		return
+	}
+	version := rest[0]
+
+	if err := server.db.DeleteVersionReview(name, version); err != nil {
+		serverLog.Errorf("Failed to reset a review: %s@%s %v", name, version, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok": true,
+		"id": fmt.Sprintf("%s@%s", name, version),
+	})
+}
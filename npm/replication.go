@@ -0,0 +1,119 @@
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// isReplicationPath returns whether the path belongs to the CouchDB compatible
+// api that other mirrors use as their registry
+//
+// Paths under "/registry/" shadow versions of the package named "registry",
+// except for its tarballs.
+func isReplicationPath(path []byte) bool {
+	switch string(path) {
+	case "/_all_docs", "/_changes":
+		return true
+	}
+
+	return bytes.HasPrefix(path, []byte("/registry/")) && !bytes.HasPrefix(path, []byte("/registry/-/"))
+}
+
+// getRegistryPath serves the replication api under "/registry/" like replicate.npmjs.com
+func (server *PocketServer) getRegistryPath(ctx *fasthttp.RequestCtx) {
+	path := ctx.UserValue("path").(string)
+	switch path {
+	case "/_all_docs":
+		server.getAllDocs(ctx)
+	case "/_changes":
+		server.getChanges(ctx)
+	default:
+		ctx.SetUserValue("name", strings.TrimPrefix(path, "/"))
+		server.getDocument(ctx)
+	}
+}
+
+// getAllDocs lists the packages which have a document with their revisions
+//
+// Packages are listed from the change log, and update_seq is taken before
+// listing them so that a mirror following the changes from there misses nothing.
+func (server *PocketServer) getAllDocs(ctx *fasthttp.RequestCtx) {
+	seq := server.db.GetChangeSequence()
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		total := 0
+
+		w.WriteString(`{"rows":[`)
+		server.db.ForEachChange(0, func(change *db.Change) bool {
+			if change.Deleted {
+				return true
+			}
+			if total > 0 {
+				w.WriteByte(',')
+			}
+			total++
+
+			row := docsRow{ID: change.ID, Key: change.ID}
+			row.Value.Revision = change.Revision
+			enc.Encode(&row)
+			return true
+		})
+		w.WriteString(`],"offset":0,"total_rows":` + strconv.Itoa(total))
+		if string(ctx.QueryArgs().Peek("update_seq")) == "true" {
+			w.WriteString(`,"update_seq":` + strconv.Itoa(seq))
+		}
+		w.WriteString("}")
+	})
+}
+
+// changesRow is a result of the _changes feed
+type changesRow struct {
+	Sequence int              `json:"seq"`
+	ID       string           `json:"id"`
+	Changes  []changeRevision `json:"changes"`
+	Deleted  bool             `json:"deleted,omitempty"`
+}
+
+type changeRevision struct {
+	Revision string `json:"rev"`
+}
+
+// getChanges lists the changes after the sequence given by since
+func (server *PocketServer) getChanges(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	since, _ := strconv.Atoi(string(args.Peek("since")))
+	limit, _ := strconv.Atoi(string(args.Peek("limit")))
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		last := since
+		count := 0
+
+		w.WriteString(`{"results":[`)
+		server.db.ForEachChange(since, func(change *db.Change) bool {
+			if count > 0 {
+				w.WriteByte(',')
+			}
+			count++
+			last = change.Sequence
+
+			enc.Encode(&changesRow{
+				Sequence: change.Sequence,
+				ID:       change.ID,
+				Changes:  []changeRevision{{Revision: change.Revision}},
+				Deleted:  change.Deleted,
+			})
+			return limit <= 0 || count < limit
+		})
+		w.WriteString(`],"last_seq":` + strconv.Itoa(last) + "}")
+	})
+}
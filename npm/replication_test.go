@@ -0,0 +1,85 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestIsReplicationPath(t *testing.T) {
+	tests := map[string]bool{
+		"/_all_docs":                      true,
+		"/_changes":                       true,
+		"/registry/_changes":              true,
+		"/registry/lodash":                true,
+		"/registry/@types/node":           true,
+		"/registry":                       false,
+		"/registry/-/registry-0.1.0.tgz":  false,
+		"/lodash":                         false,
+		"/lodash/-/lodash-4.17.21.tgz":    false,
+		"/-/npm/v1/security/audits/quick": false,
+		"/_all_docs/lodash":               false,
+	}
+
+	for path, expected := range tests {
+		if actual := isReplicationPath([]byte(path)); actual != expected {
+			t.Errorf("isReplicationPath(%s): expected %t, actual %t", path, expected, actual)
+		}
+	}
+}
+
+func TestGetRegistryPath(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	for _, name := range []string{"test", "@s/test"} {
+		pack := &db.BarePackage{ID: name, Revision: "1"}
+		pb.PutPackages([]*db.BarePackage{pack})
+		pb.PutCompleted(pack, `{"_id":"`+name+`","versions":{}}`, "1", nil, nil)
+	}
+
+	server := &PocketServer{
+		db:           pb,
+		storage:      client.storage,
+		serverConfig: &ServerConfig{},
+		mirrorConfig: client.config,
+		router:       fasthttprouter.New(),
+		apiRouter:    fasthttprouter.New(),
+		couchRouter:  fasthttprouter.New(),
+	}
+	server.addRoutes()
+
+	cases := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/registry/test", 200, `"_id":"test"`},
+		{"/registry/@s/test", 200, `"_id":"@s/test"`},
+		{"/registry/missing", 404, ""},
+		{"/registry/_all_docs", 200, ""},
+		{"/registry/_changes", 200, ""},
+	}
+	for _, c := range cases {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(c.path)
+		server.handler(&ctx)
+		if status := ctx.Response.StatusCode(); status != c.status {
+			t.Errorf("TestGetRegistryPath: %s expected %d actual %d", c.path, c.status, status)
+		}
+		if c.contains != "" && !strings.Contains(string(ctx.Response.Body()), c.contains) {
+			t.Errorf("TestGetRegistryPath: %s unexpected body %s", c.path, ctx.Response.Body())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package npm
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxSearchSize limits the results of a search like the registry
+const maxSearchSize = 250
+
+// maxSearchFrom limits the offset of a search, since the names before it are
+// matched on every request
+const maxSearchFrom = 5000
+
+type searchPackage struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Keywords    []interface{}     `json:"keywords,omitempty"`
+	Date        interface{}       `json:"date,omitempty"`
+	Links       map[string]string `json:"links"`
+}
+
+type searchObject struct {
+	Package     *searchPackage     `json:"package"`
+	Score       map[string]float64 `json:"score"`
+	SearchScore float64            `json:"searchScore"`
+}
+
+type searchResponse struct {
+	Objects []*searchObject `json:"objects"`
+	Total   int             `json:"total"`
+	Time    string          `json:"time"`
+}
+
+// searchPackages searches the names of mirrored packages like the registry
+// search, which `npm search` and the web ui use
+//
+// GET /-/v1/search?text=...&size=20&from=0
+//
+// Only names are matched, and packages are scored by their position in the
+// results: names starting with the text come first.
+func (server *PocketServer) searchPackages(ctx *fasthttp.RequestCtx) {
+	text := string(ctx.QueryArgs().Peek("text"))
+	size, err := ctx.QueryArgs().GetUint("size")
+	if err != nil || size > maxSearchSize {
+		size = 20
+	}
+	from, err := ctx.QueryArgs().GetUint("from")
+	if err != nil {
+		from = 0
+	} else if from > maxSearchFrom {
+		from = maxSearchFrom
+	}
+
+	response := &searchResponse{Objects: []*searchObject{}, Time: time.Now().UTC().Format(time.RFC3339)}
+	if text == "" {
+		server.writeJSON(ctx, response)
+		return
+	}
+
+	names := server.db.SearchPackages(text, from+size)
+	if from < len(names) {
+		for i, name := range names[from:] {
+			pack := server.describePackage(name)
+			if pack == nil {
+				continue
+			}
+
+			score := 1 - float64(from+i)/float64(len(names))
+			response.Objects = append(response.Objects, &searchObject{
+				Package:     pack,
+				Score:       map[string]float64{"final": score},
+				SearchScore: score,
+			})
+		}
+	}
+	response.Total = len(names)
+
+	server.writeJSON(ctx, response)
+}
+
+// describePackage returns the latest version of a package, or nil if it is
+// blocked or has no document
+func (server *PocketServer) describePackage(name string) *searchPackage {
+	policy := server.getPolicy(name)
+	if packageBlockedBy(policy.blocked) != nil {
+		return nil
+	}
+	doc, _, err := server.db.GetDocument(name, false)
+	if err != nil {
+		return nil
+	}
+	root, err := decodeDocument(doc)
+	if err != nil {
+		return nil
+	}
+	if !policy.empty() {
+		policy.apply(root)
+	}
+
+	pack := &searchPackage{Name: name, Links: map[string]string{
+		"npm": "/-/web/#/package/" + name,
+	}}
+	if tags, ok := root["dist-tags"].(map[string]interface{}); ok {
+		pack.Version, _ = tags["latest"].(string)
+	}
+	if times, ok := root["time"].(map[string]interface{}); ok && pack.Version != "" {
+		pack.Date = times[pack.Version]
+	}
+	latest := root
+	if versions, ok := root["versions"].(map[string]interface{}); ok {
+		if version, ok := versions[pack.Version].(map[string]interface{}); ok {
+			latest = version
+		}
+	}
+	pack.Description, _ = latest["description"].(string)
+	pack.Keywords, _ = latest["keywords"].([]interface{})
+
+	return pack
+}
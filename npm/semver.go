@@ -0,0 +1,381 @@
+package npm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver represents a parsed semantic version
+type semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease []string
+}
+
+// comparator represents a single operator-version pair of a range such as ">=1.2.3"
+type comparator struct {
+	Operator string
+	Version  *semver
+}
+
+// versionRange represents a npm-style semver range
+//
+// The outer slice is a set of alternatives joined by "||", and each inner
+// slice is a set of comparators that all have to match.
+type versionRange [][]*comparator
+
+func parseSemver(version string) (*semver, error) {
+	v := strings.TrimSpace(version)
+	v = strings.TrimPrefix(strings.TrimPrefix(v, "="), "v")
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var pre []string
+	if i := strings.Index(v, "-"); i >= 0 {
+		pre = strings.Split(v[i+1:], ".")
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid version: %s", version)
+	}
+
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid version: %s", version)
+		}
+		nums[i] = n
+	}
+
+	return &semver{
+		Major:      nums[0],
+		Minor:      nums[1],
+		Patch:      nums[2],
+		Prerelease: pre,
+	}, nil
+}
+
+// String returns the version in semver syntax
+func (v *semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 depending on the precedence of the versions
+func (v *semver) Compare(o *semver) int {
+	if c := compareInt(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// a version without prerelease has higher precedence
+	if len(v.Prerelease) == 0 || len(o.Prerelease) == 0 {
+		return compareInt(len(o.Prerelease), len(v.Prerelease))
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		a, b := v.Prerelease[i], o.Prerelease[i]
+		if a == b {
+			continue
+		}
+		an, aerr := strconv.Atoi(a)
+		bn, berr := strconv.Atoi(b)
+		switch {
+		case aerr == nil && berr == nil:
+			return compareInt(an, bn)
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		case a < b:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	return compareInt(len(v.Prerelease), len(o.Prerelease))
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// parseRange parses a npm-style semver range
+//
+// Supported forms are comparators (<, <=, >, >=, =), hyphen ranges (1.0.0 - 2.0.0),
+// x-ranges (1.x, 1.2.*), tilde (~1.2.3), caret (^1.2.3) and "||" alternatives.
+func parseRange(r string) (versionRange, error) {
+	var result versionRange
+
+	for _, set := range strings.Split(r, "||") {
+		tokens := strings.Fields(set)
+
+		// join detached operators (">= 1.0.0") and hyphen ranges
+		var joined []string
+		for i := 0; i < len(tokens); i++ {
+			token := tokens[i]
+			if strings.Trim(token, "<>=~^") == "" && i+1 < len(tokens) {
+				token += tokens[i+1]
+				i++
+			} else if i+2 < len(tokens) && tokens[i+1] == "-" {
+				token += " - " + tokens[i+2]
+				i += 2
+			}
+			joined = append(joined, strings.TrimSuffix(token, ","))
+		}
+
+		var comparators []*comparator
+		for _, token := range joined {
+			cs, err := parseComparators(token)
+			if err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, cs...)
+		}
+		result = append(result, comparators)
+	}
+
+	return result, nil
+}
+
+// parsePartial parses a possibly incomplete version like "1", "1.2" or "1.x"
+// and returns the filled version and the number of specified parts
+func parsePartial(version string) (*semver, int, error) {
+	v := strings.TrimPrefix(strings.TrimPrefix(version, "="), "v")
+	if v == "" || v == "*" || v == "x" || v == "X" {
+		return &semver{}, 0, nil
+	}
+
+	main := v
+	suffix := ""
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		main, suffix = v[:i], v[i:]
+	}
+
+	parts := strings.Split(main, ".")
+	specified := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		specified++
+	}
+	if specified > 3 {
+		return nil, 0, fmt.Errorf("Invalid version: %s", version)
+	}
+
+	filled := make([]string, 3)
+	for i := range filled {
+		if i < specified {
+			filled[i] = parts[i]
+		} else {
+			filled[i] = "0"
+		}
+	}
+
+	if specified < 3 {
+		suffix = ""
+	}
+	parsed, err := parseSemver(strings.Join(filled, ".") + suffix)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parsed, specified, nil
+}
+
+func parseComparators(token string) ([]*comparator, error) {
+	// hyphen range
+	if parts := strings.SplitN(token, " - ", 2); len(parts) == 2 {
+		from, _, err := parsePartial(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		to, specified, err := parsePartial(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		upper := &comparator{Operator: "<=", Version: to}
+		if specified < 3 && specified > 0 {
+			upper = &comparator{Operator: "<", Version: bump(to, specified)}
+		} else if specified == 0 {
+			return []*comparator{{Operator: ">=", Version: from}}, nil
+		}
+		return []*comparator{{Operator: ">=", Version: from}, upper}, nil
+	}
+
+	operator := ""
+	for _, op := range []string{">=", "<=", ">", "<", "=", "~>", "~", "^"} {
+		if strings.HasPrefix(token, op) {
+			operator = op
+			break
+		}
+	}
+	version, specified, err := parsePartial(strings.TrimSpace(token[len(operator):]))
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "~", "~>":
+		if specified < 2 {
+			return xRange(version, specified), nil
+		}
+		return []*comparator{
+			{Operator: ">=", Version: version},
+			{Operator: "<", Version: bump(version, 2)},
+		}, nil
+	case "^":
+		if specified == 0 {
+			return nil, nil
+		}
+		// ^0.2.3 := >=0.2.3 <0.3.0, ^0.0.3 := >=0.0.3 <0.0.4
+		position := 1
+		if version.Major == 0 && specified > 1 {
+			position = 2
+			if version.Minor == 0 && specified > 2 {
+				position = 3
+			}
+		}
+		return []*comparator{
+			{Operator: ">=", Version: version},
+			{Operator: "<", Version: bump(version, position)},
+		}, nil
+	case "", "=":
+		return xRange(version, specified), nil
+	}
+
+	if specified == 0 {
+		if operator == "<" || operator == ">" {
+			// nothing satisfies "<*" or ">*"
+			return []*comparator{{Operator: "<", Version: &semver{}}}, nil
+		}
+		return nil, nil
+	}
+	if specified < 3 {
+		switch operator {
+		case ">":
+			return []*comparator{{Operator: ">=", Version: bump(version, specified)}}, nil
+		case "<=":
+			return []*comparator{{Operator: "<", Version: bump(version, specified)}}, nil
+		}
+	}
+
+	return []*comparator{{Operator: operator, Version: version}}, nil
+}
+
+// xRange returns comparators for a partial version such as "1.2" (>=1.2.0 <1.3.0)
+func xRange(version *semver, specified int) []*comparator {
+	switch specified {
+	case 0:
+		return nil
+	case 3:
+		return []*comparator{{Operator: "=", Version: version}}
+	}
+
+	return []*comparator{
+		{Operator: ">=", Version: version},
+		{Operator: "<", Version: bump(version, specified)},
+	}
+}
+
+// bump increases the given position (1-based) of the version and resets the rest
+func bump(version *semver, position int) *semver {
+	v := &semver{Major: version.Major, Minor: version.Minor, Patch: version.Patch}
+	switch position {
+	case 1:
+		v.Major, v.Minor, v.Patch = v.Major+1, 0, 0
+	case 2:
+		v.Minor, v.Patch = v.Minor+1, 0
+	default:
+		v.Patch++
+	}
+	// the lowest possible prerelease so that e.g. 2.0.0-rc.1 stays below "<2.0.0"
+	v.Prerelease = []string{"0"}
+	return v
+}
+
+func (c *comparator) match(v *semver) bool {
+	cmp := v.Compare(c.Version)
+	switch c.Operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp == 0
+}
+
+// Match reports whether the version satisfies the range
+//
+// Unlike npm, prereleases are not excluded from ranges without a prerelease
+// tag. This is intended since ranges are used to find affected versions.
+func (r versionRange) Match(v *semver) bool {
+	for _, set := range r {
+		matched := true
+		for _, c := range set {
+			if !c.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// satisfies reports whether the version satisfies the range, both given as string
+func satisfies(version string, r string) bool {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false
+	}
+	parsed, err := parseRange(r)
+	if err != nil {
+		return false
+	}
+	return parsed.Match(v)
+}
+
+// String returns the range in npm syntax
+func (r versionRange) String() string {
+	sets := make([]string, len(r))
+	for i, set := range r {
+		comparators := make([]string, len(set))
+		for j, c := range set {
+			comparators[j] = c.Operator + c.Version.String()
+		}
+		sets[i] = strings.Join(comparators, " ")
+		if sets[i] == "" {
+			sets[i] = "*"
+		}
+	}
+	return strings.Join(sets, " || ")
+}
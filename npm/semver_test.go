@@ -0,0 +1,63 @@
+package npm
+
+import "testing"
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		version  string
+		r        string
+		expected bool
+	}{
+		{version: "1.2.3", r: "*", expected: true},
+		{version: "1.2.3", r: "", expected: true},
+		{version: "1.2.3", r: "1.2.3", expected: true},
+		{version: "1.2.4", r: "1.2.3", expected: false},
+		{version: "1.2.3", r: "<1.2.3", expected: false},
+		{version: "1.2.3-beta.1", r: "<1.2.3", expected: true},
+		{version: "1.5.0", r: ">=1.0.0 <1.2.3 || >=1.4.0 <1.6.0", expected: true},
+		{version: "1.3.0", r: ">=1.0.0 <1.2.3 || >=1.4.0 <1.6.0", expected: false},
+		{version: "1.1.0", r: ">= 1.0.0, < 1.2.3", expected: true},
+		{version: "0.2.9", r: "^0.2.3", expected: true},
+		{version: "0.3.0", r: "^0.2.3", expected: false},
+		{version: "1.9.0", r: "^1.2.3", expected: true},
+		{version: "2.0.0-rc.1", r: "^1.2.3", expected: false},
+		{version: "1.2.9", r: "~1.2.3", expected: true},
+		{version: "1.3.0", r: "~1.2.3", expected: false},
+		{version: "1.9.9", r: "1.x", expected: true},
+		{version: "2.0.0", r: "1.x", expected: false},
+		{version: "2.5.0", r: "1.0.0 - 2", expected: true},
+		{version: "3.0.0", r: "1.0.0 - 2", expected: false},
+		{version: "1.2.9", r: "<=1.2", expected: true},
+		{version: "invalid", r: "*", expected: false},
+	}
+
+	for i, test := range tests {
+		actual := satisfies(test.version, test.r)
+		if actual != test.expected {
+			t.Errorf("satisfies(%d): %s %s expected %v actual %v", i, test.version, test.r, test.expected, actual)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.10.0",
+	}
+
+	for i := 1; i < len(ordered); i++ {
+		a, _ := parseSemver(ordered[i-1])
+		b, _ := parseSemver(ordered[i])
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("Compare: expected %s < %s", ordered[i-1], ordered[i])
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package npm
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,44 +20,45 @@ import (
 	"github.com/ssut/pocketnpm/db"
 	"github.com/ssut/pocketnpm/log"
 	"github.com/valyala/fasthttp"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// serverLog logs the messages of the server and its apis
+var serverLog = log.Component(log.ComponentServer)
+
 // PocketServer type contains essential shared items to run a npm server
 type PocketServer struct {
 	db           *db.PocketBase
 	serverConfig *ServerConfig
 	mirrorConfig *MirrorConfig
 	router       *fasthttprouter.Router
+	apiRouter    *fasthttprouter.Router
+	couchRouter  *fasthttprouter.Router // CouchDB compatible api for other mirrors
 	logger       *logrus.Logger
+	accessLog    *lumberjack.Logger
+	mirror       *MirrorClient
+	storage      BlobStorage
+	downloads    *downloadCounter
 }
 
 // NewPocketServer initializes new instance of PocketServer
 func NewPocketServer(db *db.PocketBase, serverConfig *ServerConfig, mirrorConfig *MirrorConfig) *PocketServer {
 	mirrorConfig.Path, _ = filepath.Abs(mirrorConfig.Path)
 	if _, err := os.Stat(mirrorConfig.Path); os.IsNotExist(err) {
-		log.Fatalf("Directory does not exist: %s", mirrorConfig.Path)
+		serverLog.Fatalf("Directory does not exist: %s", mirrorConfig.Path)
+	}
+	storage, err := NewBlobStorage(mirrorConfig)
+	if err != nil {
+		serverLog.Fatalf("Failed to open storage: %v", err)
 	}
 
-	logger := logrus.New()
+	var logger *logrus.Logger
+	var accessLog *lumberjack.Logger
 	if logPath := serverConfig.LogPath; logPath != "" {
-		logPath, _ = filepath.Abs(logPath)
-		file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+		logger, accessLog, err = newAccessLog(logPath, &serverConfig.AccessLog)
 		if err != nil {
-			file, err = os.Create(logPath)
-		}
-
-		if err == nil {
-			logger.Out = file
-			logger.Formatter = &logrus.TextFormatter{
-				FullTimestamp:  true,
-				DisableColors:  true,
-				QuoteEmptyFields: true,
-			}
-		} else {
-			log.Warnf("Failed to open log file: %s", logPath)
+			serverLog.Warnf("Failed to open log file: %s (%v)", logPath, err)
 		}
-	} else {
-		logger = nil
 	}
 
 	server := &PocketServer{
@@ -63,7 +66,14 @@ func NewPocketServer(db *db.PocketBase, serverConfig *ServerConfig, mirrorConfig
 		serverConfig: serverConfig,
 		mirrorConfig: mirrorConfig,
 		router:       fasthttprouter.New(),
+		apiRouter:    fasthttprouter.New(),
+		couchRouter:  fasthttprouter.New(),
 		logger:       logger,
+		accessLog:    accessLog,
+		storage:      storage,
+	}
+	if serverConfig.DownloadsInterval >= 0 {
+		server.downloads = newDownloadCounter()
 	}
 	server.addRoutes()
 
@@ -73,8 +83,41 @@ func NewPocketServer(db *db.PocketBase, serverConfig *ServerConfig, mirrorConfig
 // Run runs server
 func (server *PocketServer) Run() {
 	addr := fmt.Sprintf("%s:%d", server.serverConfig.Bind, server.serverConfig.Port)
-	log.Infof("Listening on %s", addr)
-	log.Fatal(fasthttp.ListenAndServe(addr, server.router.Handler))
+	serverLog.Infof("Listening on %s", addr)
+	// the mirror client does it before mirroring if it runs in this process
+	if server.mirror == nil {
+		go backfillVersions(server.db, server.storage)
+	}
+	if server.downloads != nil {
+		go server.flushDownloads()
+	}
+	if server.accessLog != nil {
+		go server.reopenAccessLog()
+		if server.serverConfig.AccessLog.Rotate != "" {
+			go server.rotateAccessLog()
+		}
+	}
+	s := &fasthttp.Server{
+		Handler:        server.handler,
+		HeaderReceived: lockfileRequestConfig,
+	}
+	serverLog.Fatal(s.ListenAndServe(addr))
+}
+
+// handler dispatches requests under "/-/" and the downloads api to the api
+// router and the replication api to its router since they can not share the
+// first path segment with the "/:name" routes
+func (server *PocketServer) handler(ctx *fasthttp.RequestCtx) {
+	if bytes.HasPrefix(ctx.Path(), []byte("/-/")) || isDownloadsPath(ctx.Path()) {
+		server.apiRouter.Handler(ctx)
+		return
+	}
+	if isReplicationPath(ctx.Path()) {
+		server.couchRouter.Handler(ctx)
+		return
+	}
+
+	server.router.Handler(ctx)
 }
 
 func (server *PocketServer) addRoutes() {
@@ -85,6 +128,42 @@ func (server *PocketServer) addRoutes() {
 	server.router.GET("/:name/:version/:tarball/:extra", server.logging(server.downloadPackage))
 	server.router.NotFound = server.raiseNotFound
 	server.router.PanicHandler = server.handlePanic
+
+	server.apiRouter.POST("/-/npm/v1/security/audits/quick", server.logging(server.auditQuick))
+	server.apiRouter.POST("/-/npm/v1/security/advisories/bulk", server.logging(server.bulkAdvisories))
+	server.apiRouter.GET("/-/package/*path", server.logging(server.handleDistTags))
+	server.apiRouter.PUT("/-/package/*path", server.logging(server.authorize(server.handleDistTags)))
+	server.apiRouter.DELETE("/-/package/*path", server.logging(server.authorize(server.handleDistTags)))
+	server.apiRouter.GET("/-/admin/quarantine/*path", server.logging(server.authorize(server.getQuarantine)))
+	server.apiRouter.POST("/-/admin/quarantine/*path", server.logging(server.authorize(server.reviewVersion)))
+	server.apiRouter.DELETE("/-/admin/quarantine/*path", server.logging(server.authorize(server.resetReview)))
+	server.apiRouter.GET("/-/admin/blocklist", server.logging(server.authorize(server.getBlocklist)))
+	server.apiRouter.POST("/-/admin/blocklist", server.logging(server.authorize(server.addBlockEntry)))
+	server.apiRouter.DELETE("/-/admin/blocklist", server.logging(server.authorize(server.removeBlockEntry)))
+	server.apiRouter.POST("/-/admin/resync/*path", server.logging(server.authorize(server.resyncPackage)))
+	server.apiRouter.GET("/-/admin/mirror", server.logging(server.authorize(server.withMirror(server.getMirrorStatus))))
+	server.apiRouter.POST("/-/admin/mirror/:action", server.logging(server.authorize(server.withMirror(server.controlMirror))))
+	server.apiRouter.DELETE("/-/admin/cache", server.logging(server.authorize(server.purgeCache)))
+	server.apiRouter.POST(lockfileCheckPath, server.logging(server.checkLockfile))
+	server.apiRouter.GET("/-/admin/log", server.logging(server.authorize(server.getJournal)))
+	server.apiRouter.GET("/-/admin/webhooks", server.logging(server.authorize(server.getWebhooks)))
+	server.apiRouter.POST("/-/admin/webhooks", server.logging(server.authorize(server.addWebhook)))
+	server.apiRouter.DELETE("/-/admin/webhooks/:id", server.logging(server.authorize(server.removeWebhook)))
+	server.apiRouter.GET("/-/admin/webhooks/:id/deliveries", server.logging(server.authorize(server.getDeliveries)))
+	server.apiRouter.GET("/-/v1/search", server.logging(server.searchPackages))
+	server.apiRouter.GET("/-/pocketnpm/status", server.logging(server.getOverview))
+	server.apiRouter.GET("/-/web", server.logging(server.getWeb))
+	server.apiRouter.GET("/-/web/*path", server.logging(server.getWeb))
+	server.apiRouter.GET("/downloads/point/*path", server.logging(server.getDownloadsPoint))
+	server.apiRouter.GET("/downloads/range/*path", server.logging(server.getDownloadsRange))
+	server.apiRouter.NotFound = server.raiseNotFound
+	server.apiRouter.PanicHandler = server.handlePanic
+
+	server.couchRouter.GET("/_all_docs", server.logging(server.getAllDocs))
+	server.couchRouter.GET("/_changes", server.logging(server.getChanges))
+	server.couchRouter.GET("/registry/*path", server.logging(server.getRegistryPath))
+	server.couchRouter.NotFound = server.raiseNotFound
+	server.couchRouter.PanicHandler = server.handlePanic
 }
 
 func (server *PocketServer) logging(next fasthttp.RequestHandler) fasthttp.RequestHandler {
@@ -100,13 +179,28 @@ func (server *PocketServer) logging(next fasthttp.RequestHandler) fasthttp.Reque
 			return
 		}
 
-		server.logger.WithFields(logrus.Fields{
-			"IP":         ctx.RemoteIP().String(),
-			"StatusCode": ctx.Response.StatusCode(),
-			"Elapsed":    elapsed.String(),
-			"User-Agent": string(ctx.UserAgent()),
-		}).Info(fmt.Sprintf(`%s %s`, ctx.Method(), ctx.Path()))
+		server.logger.WithFields(accessFields(ctx, elapsed)).Info(fmt.Sprintf(`%s %s`, ctx.Method(), ctx.Path()))
+	})
+}
 
+// authorize only allows requests bearing the admin token
+//
+// All requests are rejected if no token is configured.
+func (server *PocketServer) authorize(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return fasthttp.RequestHandler(func(ctx *fasthttp.RequestCtx) {
+		token := server.serverConfig.AdminToken
+		header := ctx.Request.Header.Peek("Authorization")
+		given := bytes.TrimPrefix(header, []byte("Bearer "))
+
+		if token == "" || len(header) == len(given) || subtle.ConstantTimeCompare(given, []byte(token)) != 1 {
+			ctx.SetStatusCode(403)
+			server.writeJSON(ctx, map[string]string{
+				"error": "Forbidden",
+			})
+			return
+		}
+
+		next(ctx)
 	})
 }
 
@@ -117,7 +211,7 @@ func (server *PocketServer) raiseNotFound(ctx *fasthttp.RequestCtx) {
 
 func (server *PocketServer) handlePanic(ctx *fasthttp.RequestCtx, panic interface{}) {
 	ctx.SetStatusCode(500)
-	log.Debugf("%v: %s", panic, debug.Stack())
+	serverLog.Debugf("%v: %s", panic, debug.Stack())
 }
 
 func (server *PocketServer) writeJSON(ctx *fasthttp.RequestCtx, content interface{}) {
@@ -129,27 +223,62 @@ func (server *PocketServer) writeJSON(ctx *fasthttp.RequestCtx, content interfac
 	ctx.SetBody(json)
 }
 
-func (server *PocketServer) sendFile(ctx *fasthttp.RequestCtx, path string, name string) {
-	stat, err := os.Stat(path)
+// sendFile sends the tarball stored at the key
+//
+// Tarballs in an S3 storage are either proxied or redirected to presigned urls.
+func (server *PocketServer) sendFile(ctx *fasthttp.RequestCtx, key string, name string) {
+	if s3, ok := server.storage.(*s3Storage); ok && server.mirrorConfig.Storage.Redirect {
+		u, err := s3.URL(key, name)
+		if err != nil {
+			serverLog.Error(err)
+			ctx.SetStatusCode(500)
+			return
+		}
+		ctx.Redirect(u.String(), 302)
+		return
+	}
+
+	stat, err := server.storage.Stat(key)
 	if err != nil {
-		log.Debug(err)
+		serverLog.Debug(err)
 		ctx.SetStatusCode(404)
 		return
 	}
 
-	size := strconv.FormatInt(stat.Size(), 10)
+	size := strconv.FormatInt(stat.Size, 10)
 
 	ctx.SetContentType("application/octet-stream")
 	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
 	ctx.Response.Header.Set("Content-Length", size)
 
-	if server.serverConfig.EnableXAccel {
-		internalPath := strings.Replace(path, server.mirrorConfig.Path, "/_internal", 1)
-		ctx.Response.Header.Set("X-Accel-Redirect", internalPath)
+	if local, ok := server.storage.(*localStorage); ok {
+		path := local.path(key)
+		if server.serverConfig.EnableXAccel {
+			internalPath := strings.Replace(path, server.mirrorConfig.Path, "/_internal", 1)
+			ctx.Response.Header.Set("X-Accel-Redirect", internalPath)
+			return
+		}
+
+		ctx.SendFile(path)
+		return
+	}
+
+	body, err := server.storage.Open(key)
+	if err != nil {
+		serverLog.Debug(err)
+		ctx.SetStatusCode(404)
 		return
 	}
+	ctx.SetBodyStream(body, int(stat.Size))
+}
+
+// tarballURL returns the url of the tarball on this server
+func (server *PocketServer) tarballURL(tarball string) string {
+	u, _ := url.Parse(tarball)
+	u.Scheme = server.serverConfig.Scheme
+	u.Host = server.serverConfig.Host
 
-	ctx.SendFile(path)
+	return u.String()
 }
 
 func (server *PocketServer) replaceAttachments(document string) string {
@@ -159,12 +288,8 @@ func (server *PocketServer) replaceAttachments(document string) string {
 
 	var i int
 	for _, dist := range dists {
-		u, _ := url.Parse(dist.Tarball)
-		u.Scheme = server.serverConfig.Scheme
-		u.Host = server.serverConfig.Host
-
 		replaces[i] = dist.Tarball
-		replaces[i+1] = u.String()
+		replaces[i+1] = server.tarballURL(dist.Tarball)
 		i += 2
 	}
 
@@ -174,21 +299,55 @@ func (server *PocketServer) replaceAttachments(document string) string {
 	return document
 }
 
-func (server *PocketServer) getDocumentByName(ctx *fasthttp.RequestCtx, name string) string {
-	rev := server.db.GetRevision(name)
-	etag := fmt.Sprintf(`"%s"`, rev)
+// replaceTarball replaces the tarball url of a version manifest like replaceAttachments
+func (server *PocketServer) replaceTarball(manifest string) string {
+	var parsed struct {
+		Dist struct {
+			Tarball string `json:"tarball"`
+		} `json:"dist"`
+	}
+	if err := json.Unmarshal([]byte(manifest), &parsed); err != nil || parsed.Dist.Tarball == "" {
+		return manifest
+	}
+
+	return strings.Replace(manifest, parsed.Dist.Tarball, server.tarballURL(parsed.Dist.Tarball), -1)
+}
+
+// checkETag sets the ETag header and reports whether the client already has the content
+func (server *PocketServer) checkETag(ctx *fasthttp.RequestCtx, etag string) bool {
 	ctx.Response.Header.Set("ETag", etag)
 
 	if cacheHeader := ctx.Request.Header.Peek("If-None-Match"); cacheHeader != nil {
 		if string(cacheHeader) == etag {
 			ctx.SetStatusCode(304)
-			return ""
+			return true
 		}
 	} else {
 		ctx.Response.Header.Set("Cache-Control", "must-revalidate")
 	}
 
-	doc, _, err := server.db.GetDocument(name, false)
+	return false
+}
+
+func (server *PocketServer) getDocumentByName(ctx *fasthttp.RequestCtx, name string) string {
+	rev := server.db.GetRevision(name)
+	policy := server.getPolicy(name)
+	etag := fmt.Sprintf(`"%s"`, rev)
+
+	if entry := packageBlockedBy(policy.blocked); entry != nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": fmt.Sprintf("Package is %s", blockReason(entry)),
+		})
+		return ""
+	}
+
+	// the document is not needed to revalidate unless local policies apply
+	if policy.empty() && server.checkETag(ctx, etag) {
+		return ""
+	}
+
+	doc, _, cached, err := server.db.GetCachedDocument(name, false)
 	if err != nil {
 		ctx.SetStatusCode(404)
 		server.writeJSON(ctx, map[string]string{
@@ -196,12 +355,30 @@ func (server *PocketServer) getDocumentByName(ctx *fasthttp.RequestCtx, name str
 		})
 		return ""
 	}
+	setDocumentCache(ctx, cached)
 	doc = server.replaceAttachments(doc)
 
+	if !policy.empty() {
+		if root, err := decodeDocument(doc); err == nil {
+			stamp := policy.apply(root)
+			doc, _ = encodeDocument(root)
+			etag = fmt.Sprintf(`"%s-%s"`, rev, stamp)
+		}
+
+		if server.checkETag(ctx, etag) {
+			return ""
+		}
+	}
+
 	return doc
 }
 
 func (server *PocketServer) getIndex(ctx *fasthttp.RequestCtx) {
+	if acceptsHTML(ctx) {
+		ctx.Redirect("/-/web/", 302)
+		return
+	}
+
 	stat := server.db.GetStats()
 	markedCount := server.db.GetCountOfMarks(true)
 	sequence := server.db.GetSequence()
@@ -232,59 +409,117 @@ func (server *PocketServer) getDocumentByVersion(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	doc := server.getDocumentByName(ctx, name)
-
-	if doc == "" {
+	policy := server.getPolicy(name)
+	if entry := packageBlockedBy(policy.blocked); entry != nil {
+		ctx.SetStatusCode(404)
+		server.writeJSON(ctx, map[string]string{
+			"error": fmt.Sprintf("Package is %s", blockReason(entry)),
+		})
 		return
 	}
 
-	var jsonDoc interface{}
-	ffjson.Unmarshal([]byte(doc), &jsonDoc)
-	root := jsonDoc.(map[string]interface{})
-	distTags := root["dist-tags"].(map[string]interface{})
-	versions := root["versions"].(map[string]interface{})
-	versionKeys := make([]string, 0, len(versions))
-	for k := range versions {
-		versionKeys = append(versionKeys, k)
+	// exact versions are read from their own entries, and the others are
+	// resolved from all versions
+	var info *db.VersionInfo
+	if exact := server.db.GetVersion(name, version); exact != nil {
+		info = resolveVersion([]*db.VersionInfo{exact}, policy, version)
+	} else {
+		info = resolveVersion(server.db.LookupVersions(name), policy, version)
+	}
+	if info == nil {
+		server.raiseNotFound(ctx)
+		return
 	}
 
-	var versionDoc interface{}
+	etag := fmt.Sprintf(`"%s-%s"`, server.db.GetRevision(name), info.Version)
+	if server.checkETag(ctx, etag) {
+		return
+	}
 
-	// found in dist-tags or version tree
-	if val, ok := distTags[version]; ok {
-		versionDoc = versions[val.(string)]
-	} else if val, ok := versions[version]; ok {
-		versionDoc = val
-	} else {
-		// parse special version name such as "^1.0.0" (above 1.0.0), "~1.0.0"("=1.0.0"), and just "2" (above 2.0.0).
-		filter := string(version[0])
-		versionStr := version[1:len(version)]
-		if filter == "~" || filter == "=" {
-			versionDoc = versions[versionStr]
-		} else { // ^ (above)
-			if filter != "^" {
-				versionStr = version
-			}
-			key := strings.Split(versionStr, ".")[0]
-			sort.Slice(versionKeys, func(i, j int) bool {
-				return versionKeys[i] > versionKeys[j]
+	manifest := info.Manifest
+	if len(manifest) == 0 {
+		// versions stored without their manifests are served from the document
+		doc, _, cached, err := server.db.GetCachedDocument(name, false)
+		if err != nil {
+			ctx.SetStatusCode(404)
+			server.writeJSON(ctx, map[string]string{
+				"error": err.Error(),
 			})
+			return
+		}
+		setDocumentCache(ctx, cached)
+		if manifest = getManifest(doc, info.Version); manifest == nil {
+			server.raiseNotFound(ctx)
+			return
+		}
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(server.replaceTarball(string(manifest)))
+}
 
-			for _, ver := range versionKeys {
-				if strings.HasPrefix(ver, key) {
-					versionDoc = versions[ver]
-					break
+// resolveVersion returns the version which an exact version, a dist-tag or a
+// range refers to, or nil if there is none
+//
+// Hidden versions are skipped, and dist-tags pointing at them fall back to the
+// highest version below like in documents.
+func resolveVersion(versions []*db.VersionInfo, policy *documentPolicy, spec string) *db.VersionInfo {
+	visible := map[string]*db.VersionInfo{}
+	for _, info := range versions {
+		if hidden, _ := policy.hidden(info.Version, info.Published); !hidden {
+			visible[info.Version] = info
+		}
+	}
+
+	if info, ok := visible[spec]; ok {
+		return info
+	}
+
+	target, overridden := policy.overrides[spec]
+	if !overridden {
+		for _, info := range versions {
+			for _, tag := range info.Tags {
+				if tag == spec {
+					target = info.Version
 				}
 			}
 		}
 	}
+	if target != "" {
+		if info, ok := visible[target]; ok {
+			return info
+		}
+		if overridden {
+			return nil
+		}
 
-	if versionDoc == nil {
-		server.raiseNotFound(ctx)
-		return
+		candidates := make(map[string]interface{}, len(visible))
+		for version := range visible {
+			candidates[version] = nil
+		}
+		return visible[pickVersion(candidates, target)]
+	}
+	if overridden {
+		return nil
 	}
 
-	server.writeJSON(ctx, versionDoc)
+	r, err := parseRange(spec)
+	if err != nil {
+		return nil
+	}
+	var best *semver
+	var picked *db.VersionInfo
+	for version, info := range visible {
+		v, err := parseSemver(version)
+		if err != nil || !r.Match(v) {
+			continue
+		}
+		if best == nil || v.Compare(best) > 0 {
+			best, picked = v, info
+		}
+	}
+
+	return picked
 }
 
 func (server *PocketServer) downloadPackage(ctx *fasthttp.RequestCtx) {
@@ -314,13 +549,20 @@ func (server *PocketServer) downloadPackage(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	path := fmt.Sprintf("%s/-/%s", name, tarball)
-	local := getLocalPath(server.mirrorConfig.Path, path)
-	// Illegal access
-	if !strings.Contains(local, server.mirrorConfig.Path) {
-		server.raiseNotFound(ctx)
+	if ok, reason := server.checkVersion(name, tarballVersion(name, tarball)); !ok {
+		ctx.SetStatusCode(403)
+		server.writeJSON(ctx, map[string]string{
+			"error": fmt.Sprintf("%s@%s is %s", name, tarballVersion(name, tarball), reason),
+		})
 		return
 	}
 
-	server.sendFile(ctx, local, tarball)
+	path := fmt.Sprintf("/%s/-/%s", name, tarball)
+	key := tarballKey(path)
+	if shasum := server.db.GetBlob(path); shasum != "" {
+		key = blobKey(shasum)
+	}
+
+	server.sendFile(ctx, key, tarball)
+	server.countDownload(ctx, name, tarballVersion(name, tarball))
 }
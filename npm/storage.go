@@ -0,0 +1,340 @@
+package npm
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+)
+
+// BlobInfo describes a stored tarball
+type BlobInfo struct {
+	Size     int64
+	Modified time.Time
+	// Shasum is empty when the storage cannot tell it without reading the tarball
+	Shasum string
+}
+
+// BlobStorage stores tarballs by keys, which are slash separated paths such
+// as "t/test/-/test-0.0.1.tgz"
+//
+// Stat and Open return an error satisfying os.IsNotExist for missing keys.
+type BlobStorage interface {
+	Stat(key string) (*BlobInfo, error)
+	Open(key string) (io.ReadCloser, error)
+	// PutFile moves a downloaded file to the key
+	PutFile(key string, path string, shasum string) error
+	// Link stores the tarball at src under dst as well
+	Link(src string, dst string) error
+	Remove(key string) error
+	// RemoveAll removes all tarballs under the directory
+	RemoveAll(dir string) error
+	Walk(fn func(key string, info *BlobInfo) error) error
+}
+
+// tarballKey returns the key of the tarball at the url path
+func tarballKey(path string) string {
+	return filepath.ToSlash(getLocalPath("", path))
+}
+
+// blobKey returns the key of a tarball in the content-addressed layout
+//
+// Tarballs are keyed by sha1 since every version has a shasum, while
+// integrity (sha512) is missing on old versions.
+func blobKey(shasum string) string {
+	return ".blobs/" + shasum[:2] + "/" + shasum[2:4] + "/" + shasum + ".tgz"
+}
+
+// NewBlobStorage creates the storage of tarballs configured for the mirror
+func NewBlobStorage(config *MirrorConfig) (BlobStorage, error) {
+	switch config.Storage.Type {
+	case "", "local":
+		return newLocalStorage(config.Path), nil
+	case "s3":
+		return newS3Storage(&config.Storage)
+	}
+
+	return nil, fmt.Errorf("Unknown storage type: %s", config.Storage.Type)
+}
+
+// localStorage stores tarballs under a directory
+type localStorage struct {
+	base string
+}
+
+func newLocalStorage(base string) *localStorage {
+	return &localStorage{base: base}
+}
+
+// path returns the local path of the key
+func (storage *localStorage) path(key string) string {
+	return filepath.Join(storage.base, filepath.FromSlash(key))
+}
+
+func (storage *localStorage) Stat(key string) (*BlobInfo, error) {
+	info, err := os.Stat(storage.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobInfo{Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (storage *localStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(storage.path(key))
+}
+
+func (storage *localStorage) PutFile(key string, path string, shasum string) error {
+	dst := storage.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(path, dst)
+}
+
+func (storage *localStorage) Link(src string, dst string) error {
+	path := storage.path(dst)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.Link(storage.path(src), path)
+}
+
+func (storage *localStorage) Remove(key string) error {
+	path := storage.path(key)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	removeEmptyDirs(storage.base, path)
+
+	return nil
+}
+
+func (storage *localStorage) RemoveAll(dir string) error {
+	return os.RemoveAll(storage.path(dir))
+}
+
+func (storage *localStorage) Walk(fn func(string, *BlobInfo) error) error {
+	return filepath.Walk(storage.base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		key, _ := filepath.Rel(storage.base, path)
+		return fn(filepath.ToSlash(key), &BlobInfo{Size: info.Size(), Modified: info.ModTime()})
+	})
+}
+
+// removeEmptyDirs removes the parent directories of path up to base as long as they are empty
+func removeEmptyDirs(base string, path string) {
+	for dir := filepath.Dir(path); dir != base && strings.HasPrefix(dir, base); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// s3Storage stores tarballs in a bucket of an S3 compatible storage such as MinIO
+//
+// The shasum of a tarball is kept in the metadata of the object so that
+// existing tarballs can be verified without downloading them.
+type s3Storage struct {
+	client *minio.Client
+	config *StorageConfig
+}
+
+func newS3Storage(config *StorageConfig) (*s3Storage, error) {
+	client, err := minio.NewWithRegion(config.Endpoint, config.AccessKey, config.SecretKey, config.Secure, config.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("Bucket does not exist: %s", config.Bucket)
+	}
+
+	return &s3Storage{client: client, config: config}, nil
+}
+
+// object returns the name of the object of the key
+func (storage *s3Storage) object(key string) string {
+	if prefix := strings.Trim(storage.config.Prefix, "/"); prefix != "" {
+		return prefix + "/" + key
+	}
+
+	return key
+}
+
+// notExist converts errors of missing objects to os.ErrNotExist
+func notExist(err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+		return os.ErrNotExist
+	}
+
+	return err
+}
+
+func (storage *s3Storage) Stat(key string) (*BlobInfo, error) {
+	stat, err := storage.client.StatObject(storage.config.Bucket, storage.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, notExist(err)
+	}
+
+	return &BlobInfo{
+		Size:     stat.Size,
+		Modified: stat.LastModified,
+		Shasum:   stat.Metadata.Get("X-Amz-Meta-Sha1"),
+	}, nil
+}
+
+func (storage *s3Storage) Open(key string) (io.ReadCloser, error) {
+	object, err := storage.client.GetObject(storage.config.Bucket, storage.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notExist(err)
+	}
+	// GetObject does not send a request until the object is read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, notExist(err)
+	}
+
+	return object, nil
+}
+
+func (storage *s3Storage) PutFile(key string, path string, shasum string) error {
+	defer os.Remove(path)
+
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if shasum != "" {
+		opts.UserMetadata = map[string]string{"sha1": shasum}
+	}
+	_, err := storage.client.FPutObject(storage.config.Bucket, storage.object(key), path, opts)
+	return err
+}
+
+func (storage *s3Storage) Link(src string, dst string) error {
+	source := minio.NewSourceInfo(storage.config.Bucket, storage.object(src), nil)
+	destination, err := minio.NewDestinationInfo(storage.config.Bucket, storage.object(dst), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return storage.client.CopyObject(destination, source)
+}
+
+func (storage *s3Storage) Remove(key string) error {
+	return storage.client.RemoveObject(storage.config.Bucket, storage.object(key))
+}
+
+func (storage *s3Storage) RemoveAll(dir string) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	for object := range storage.client.ListObjectsV2(storage.config.Bucket, storage.object(dir)+"/", true, done) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if err := storage.client.RemoveObject(storage.config.Bucket, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *s3Storage) Walk(fn func(string, *BlobInfo) error) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	prefix := storage.object("")
+	for object := range storage.client.ListObjectsV2(storage.config.Bucket, prefix, true, done) {
+		if object.Err != nil {
+			return object.Err
+		}
+		// listings do not contain metadata
+		info := &BlobInfo{Size: object.Size, Modified: object.LastModified}
+		if err := fn(strings.TrimPrefix(object.Key, prefix), info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// URL returns a presigned url to download the tarball with the file name
+func (storage *s3Storage) URL(key string, name string) (*url.URL, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	expiry := time.Duration(storage.config.PresignExpiry) * time.Minute
+	if expiry <= 0 {
+		expiry = 15 * time.Minute
+	}
+
+	return storage.client.PresignedGetObject(storage.config.Bucket, storage.object(key), expiry, params)
+}
+
+// verifyBlob returns whether the tarball exists and matches the shasum, which is not checked when empty
+func verifyBlob(storage BlobStorage, key string, shasum string) (bool, error) {
+	if shasum == "" {
+		_, err := storage.Stat(key)
+		return err == nil, err
+	}
+
+	sum, _, err := hashBlob(storage, key)
+	if err != nil {
+		return false, err
+	}
+
+	return sum == shasum, nil
+}
+
+// hashBlob returns the shasum and the size of the tarball
+func hashBlob(storage BlobStorage, key string) (string, int64, error) {
+	info, err := storage.Stat(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if info.Shasum != "" {
+		return info.Shasum, info.Size, nil
+	}
+
+	r, err := storage.Open(key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), info.Size, nil
+}
+
+// downloadTemp returns a temporary file in the directory for downloads that are moved to a storage
+func downloadTemp(base string, key string) (*os.File, error) {
+	dir := filepath.Join(base, ".tmp")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return ioutil.TempFile(dir, filepath.Base(key)+".*.part")
+}
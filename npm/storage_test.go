@@ -0,0 +1,97 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testStorage puts, links, lists and removes tarballs in the storage
+func testStorage(t *testing.T, storage BlobStorage) {
+	temp, err := ioutil.TempFile("", "pocketnpm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp.WriteString("tarball")
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	key := tarballKey("/test/-/test-0.0.1.tgz")
+	shasum := "e10f6e70661d167ef514ab6e6d98607438c6a8c6"
+	if err := storage.PutFile(key, temp.Name(), shasum); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Link(key, blobKey(shasum)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := storage.Stat(key)
+	if err != nil || info.Size != int64(len("tarball")) {
+		t.Errorf("testStorage: unexpected stat %+v %v", info, err)
+	}
+	r, err := storage.Open(blobKey(shasum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "tarball" {
+		t.Errorf("testStorage: unexpected content %q", content)
+	}
+
+	keys := map[string]bool{}
+	storage.Walk(func(key string, info *BlobInfo) error {
+		keys[key] = true
+		return nil
+	})
+	if !keys[key] || !keys[blobKey(shasum)] {
+		t.Errorf("testStorage: tarballs are not listed %v", keys)
+	}
+
+	if err := storage.Remove(blobKey(shasum)); err != nil {
+		t.Error(err)
+	}
+	if err := storage.RemoveAll(tarballKey("test")); err != nil {
+		t.Error(err)
+	}
+	for _, key := range []string{key, blobKey(shasum)} {
+		if _, err := storage.Stat(key); !os.IsNotExist(err) {
+			t.Errorf("testStorage: %s was not removed (%v)", key, err)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	testStorage(t, newLocalStorage(base))
+}
+
+// TestS3Storage runs against an S3 compatible storage such as a local MinIO:
+//
+//	POCKETNPM_S3_ENDPOINT=localhost:9000 POCKETNPM_S3_BUCKET=test \
+//	POCKETNPM_S3_ACCESS_KEY=minioadmin POCKETNPM_S3_SECRET_KEY=minioadmin go test ./npm/
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("POCKETNPM_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("POCKETNPM_S3_ENDPOINT is not set")
+	}
+
+	storage, err := newS3Storage(&StorageConfig{
+		Type:      "s3",
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("POCKETNPM_S3_BUCKET"),
+		Prefix:    "pocketnpm-test",
+		AccessKey: os.Getenv("POCKETNPM_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("POCKETNPM_S3_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, storage)
+}
@@ -1,9 +1,12 @@
 package npm
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"io"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"crypto/sha1"
@@ -12,6 +15,7 @@ import (
 )
 
 type distribution struct {
+	Version   string
 	SHA1      string
 	Tarball   string
 	Completed bool
@@ -49,18 +53,35 @@ func getDistributions(document string) []*distribution {
 	var distributions []*distribution
 
 	versions := doc.(map[string]interface{})["versions"].(map[string]interface{})
-	for _, version := range versions {
+	for name, version := range versions {
 		dist := version.(map[string]interface{})["dist"].(map[string]interface{})
 		distributions = append(distributions, &distribution{
+			Version:   name,
 			SHA1:      dist["shasum"].(string),
 			Tarball:   dist["tarball"].(string),
 			Completed: false,
 		})
 	}
+	sort.Slice(distributions, func(i, j int) bool {
+		return distributions[i].Version < distributions[j].Version
+	})
 
 	return distributions
 }
 
+// getManifest returns the manifest of the version in the document, or nil if
+// there is none, without decoding the other versions
+func getManifest(document string, version string) json.RawMessage {
+	var doc struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if err := json.Unmarshal([]byte(document), &doc); err != nil {
+		return nil
+	}
+
+	return doc.Versions[version]
+}
+
 func checkValidDist(dist *distribution) bool {
 	// check the length of sha1 checksum
 	if len(dist.SHA1) < 40 {
@@ -84,3 +105,32 @@ func hashSHA1(f file) (sha1str string, err error) {
 	f.Seek(0, 0)
 	return
 }
+
+// decodeDocument decodes a registry document into a generic map
+//
+// Numbers are kept as json.Number so that re-encoding does not change them.
+func decodeDocument(document string) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(document))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return doc, nil
+}
+
+// encodeDocument encodes a document decoded by decodeDocument
+func encodeDocument(doc map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
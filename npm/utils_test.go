@@ -49,11 +49,13 @@ func TestGetDistributions(t *testing.T) {
 			document: `{"_id": "test", "versions": {"0.0.1": {"dist": {"shasum": "3a16ee0d835eee3fbf97760efdfdbbe8fbfd4b3b", "tarball": "https://registry.npmjs.org/react/-/react.tgz"}}, "0.0.2": {"dist": {"shasum": "095de887016e2739a0773755f4ee6d8886c72ff3", "tarball": "https://registry.npmjs.org/react/-/react.tgz"}}}}`,
 			expected: []*distribution{
 				{
+					Version:   "0.0.1",
 					SHA1:      "3a16ee0d835eee3fbf97760efdfdbbe8fbfd4b3b",
 					Tarball:   "https://registry.npmjs.org/react/-/react.tgz",
 					Completed: false,
 				},
 				{
+					Version:   "0.0.2",
 					SHA1:      "095de887016e2739a0773755f4ee6d8886c72ff3",
 					Tarball:   "https://registry.npmjs.org/react/-/react.tgz",
 					Completed: false,
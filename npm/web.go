@@ -0,0 +1,92 @@
+package npm
+
+import (
+	"embed"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// webFiles contains the web ui, which is a single page rendered in the
+// browser from the registry api
+//
+//go:embed web
+var webFiles embed.FS
+
+// recentChanges is the number of journal entries shown on the dashboard
+const recentChanges = 20
+
+// MirrorOverview represents the state of the mirror shown on the dashboard
+type MirrorOverview struct {
+	Sequence  int `json:"sequence"`
+	Packages  int `json:"packages"`
+	Documents int `json:"docs"`
+	Available int `json:"available"`
+	// Completion is the percentage of the packages that have been mirrored
+	Completion float64            `json:"completion"`
+	Changes    []*db.JournalEntry `json:"changes"`
+	// Mirror is nil unless mirroring is running in this process
+	Mirror *MirrorStatus `json:"mirror"`
+}
+
+// getWeb serves the files of the web ui under /-/web/
+func (server *PocketServer) getWeb(ctx *fasthttp.RequestCtx) {
+	name, _ := ctx.UserValue("path").(string)
+	if name == "" {
+		ctx.Redirect("/-/web/", 302)
+		return
+	}
+	if name == "/" {
+		name = "/index.html"
+	}
+
+	content, err := webFiles.ReadFile(path.Join("web", path.Clean(name)))
+	if err != nil {
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	ctx.SetContentType(contentType)
+	ctx.SetBody(content)
+}
+
+// getOverview returns the state of the mirror with the latest changes
+//
+// GET /-/pocketnpm/status
+func (server *PocketServer) getOverview(ctx *fasthttp.RequestCtx) {
+	stat := server.db.GetStats()
+	overview := &MirrorOverview{
+		Sequence:  server.db.GetSequence(),
+		Packages:  stat.Packages,
+		Documents: stat.Documents,
+		Available: server.db.GetCountOfMarks(true),
+		Changes:   []*db.JournalEntry{},
+	}
+	if overview.Packages > 0 {
+		overview.Completion = float64(overview.Available) * 100 / float64(overview.Packages)
+	}
+
+	query := &db.JournalQuery{Since: server.db.GetJournalSequence() - recentChanges}
+	server.db.QueryJournal(query, func(entry *db.JournalEntry) bool {
+		overview.Changes = append([]*db.JournalEntry{entry}, overview.Changes...)
+		return true
+	})
+	if server.mirror != nil {
+		overview.Mirror = server.mirror.Status(0)
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, overview)
+}
+
+// acceptsHTML returns whether the request comes from a browser
+func acceptsHTML(ctx *fasthttp.RequestCtx) bool {
+	return strings.Contains(string(ctx.Request.Header.Peek("Accept")), "text/html")
+}
@@ -0,0 +1,300 @@
+// PocketNPM web ui: a single page rendered from the registry api of the server
+(function () {
+  'use strict';
+
+  var main = document.getElementById('main');
+  var query = document.getElementById('query');
+
+  function escape(text) {
+    return String(text === undefined || text === null ? '' : text)
+      .replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+      .replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+  }
+
+  function getJSON(url) {
+    return fetch(url, { headers: { Accept: 'application/json' } }).then(function (res) {
+      return res.json().then(function (body) {
+        if (!res.ok) {
+          throw new Error(body.error || res.status + ' ' + res.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  function packageLink(name) {
+    return '<a href="#/package/' + escape(name) + '">' + escape(name) + '</a>';
+  }
+
+  function formatDate(value) {
+    if (!value) {
+      return '';
+    }
+    var date = new Date(value);
+    return isNaN(date) ? '' : date.toISOString().slice(0, 10);
+  }
+
+  function formatNumber(value) {
+    return Number(value || 0).toLocaleString();
+  }
+
+  function showError(err) {
+    main.innerHTML = '<p class="error">' + escape(err.message || err) + '</p>';
+  }
+
+  // markdown renders the subset of markdown used by most readmes
+  //
+  // The text is escaped first, so only the markup produced here is html.
+  function safeURL(url) {
+    url = url.replace(/&amp;/g, '&');
+    if (/^(https?:|mailto:|#|\/|\.{0,2}\/?[\w-])/i.test(url) && !/^\s*(javascript|data|vbscript):/i.test(url)) {
+      return escape(url);
+    }
+    return '#';
+  }
+
+  function inline(text) {
+    var codes = [];
+    text = text.replace(/`([^`]+)`/g, function (_, code) {
+      codes.push('<code>' + code + '</code>');
+      return '\u0000' + (codes.length - 1) + '\u0000';
+    });
+    text = text
+      .replace(/!\[([^\]]*)\]\(([^)\s]+)[^)]*\)/g, function (_, alt, url) {
+        return '<img alt="' + alt + '" src="' + safeURL(url) + '">';
+      })
+      .replace(/\[([^\]]+)\]\(([^)\s]+)[^)]*\)/g, function (_, label, url) {
+        return '<a href="' + safeURL(url) + '" rel="nofollow noopener">' + label + '</a>';
+      })
+      .replace(/(^|[\s(])(https?:\/\/[^\s<)]+)/g, function (_, lead, url) {
+        return lead + '<a href="' + safeURL(url) + '" rel="nofollow noopener">' + url + '</a>';
+      })
+      .replace(/\*\*([^*]+)\*\*/g, '<strong>$1</strong>')
+      .replace(/__([^_]+)__/g, '<strong>$1</strong>')
+      .replace(/(^|\W)\*([^*\s][^*]*)\*/g, '$1<em>$2</em>')
+      .replace(/(^|\W)_([^_\s][^_]*)_(?=\W|$)/g, '$1<em>$2</em>')
+      .replace(/~~([^~]+)~~/g, '<del>$1</del>');
+    return text.replace(/\u0000(\d+)\u0000/g, function (_, i) {
+      return codes[i];
+    });
+  }
+
+  function markdown(source) {
+    var lines = escape(source).replace(/\r\n?/g, '\n').split('\n');
+    var html = [];
+    var paragraph = [];
+    var list = null;
+
+    function flush() {
+      if (paragraph.length) {
+        html.push('<p>' + inline(paragraph.join(' ')) + '</p>');
+        paragraph = [];
+      }
+      if (list) {
+        html.push('</' + list + '>');
+        list = null;
+      }
+    }
+
+    for (var i = 0; i < lines.length; i++) {
+      var line = lines[i];
+      var match;
+
+      if ((match = /^\s*(```|~~~)/.exec(line))) {
+        flush();
+        var code = [];
+        for (i++; i < lines.length && lines[i].trim().indexOf(match[1]) !== 0; i++) {
+          code.push(lines[i]);
+        }
+        html.push('<pre><code>' + code.join('\n') + '</code></pre>');
+      } else if ((match = /^(#{1,6})\s+(.*?)\s*#*$/.exec(line))) {
+        flush();
+        var level = match[1].length;
+        html.push('<h' + level + '>' + inline(match[2]) + '</h' + level + '>');
+      } else if (/^\s*([-*_])(\s*\1){2,}\s*$/.test(line)) {
+        flush();
+        html.push('<hr>');
+      } else if ((match = /^\s*&gt;\s?(.*)$/.exec(line))) {
+        flush();
+        html.push('<blockquote>' + inline(match[1]) + '</blockquote>');
+      } else if ((match = /^\s*([-*+]|\d+[.)])\s+(.*)$/.exec(line))) {
+        var type = /\d/.test(match[1]) ? 'ol' : 'ul';
+        if (paragraph.length || list !== type) {
+          flush();
+          html.push('<' + type + '>');
+          list = type;
+        }
+        html.push('<li>' + inline(match[2]) + '</li>');
+      } else if (/^ {4}/.test(line) && !paragraph.length && !list) {
+        var block = [];
+        for (; i < lines.length && (/^ {4}/.test(lines[i]) || lines[i] === ''); i++) {
+          block.push(lines[i].slice(4));
+        }
+        i--;
+        html.push('<pre><code>' + block.join('\n').replace(/\n+$/, '') + '</code></pre>');
+      } else if (line.trim() === '') {
+        flush();
+      } else if (list && /^\s+/.test(line)) {
+        html[html.length - 1] = html[html.length - 1].replace(/<\/li>$/, ' ' + inline(line.trim()) + '</li>');
+      } else {
+        if (list) {
+          flush();
+        }
+        paragraph.push(line.trim());
+      }
+    }
+    flush();
+
+    return html.join('\n');
+  }
+
+  function renderSearch(text) {
+    query.value = text;
+    if (!text) {
+      main.innerHTML = '<p class="muted">Search the packages of this mirror by name.</p>';
+      return;
+    }
+
+    main.innerHTML = '<p class="muted">Searching...</p>';
+    getJSON('/-/v1/search?size=50&text=' + encodeURIComponent(text)).then(function (result) {
+      if (!result.objects.length) {
+        main.innerHTML = '<p class="muted">No packages found for ' + escape(text) + '.</p>';
+        return;
+      }
+
+      main.innerHTML = '<p class="muted">' + formatNumber(result.total) + ' packages</p><ul class="results">' +
+        result.objects.map(function (object) {
+          var pack = object.package;
+          return '<li><div class="name">' + packageLink(pack.name) + ' <span class="muted">' + escape(pack.version) + '</span></div>' +
+            '<div>' + escape(pack.description) + '</div>' +
+            '<div class="muted">' + formatDate(pack.date) + '</div></li>';
+        }).join('') + '</ul>';
+    }).catch(showError);
+  }
+
+  function dependencyList(title, deps) {
+    var names = Object.keys(deps || {});
+    if (!names.length) {
+      return '';
+    }
+    return '<section><h2>' + escape(title) + ' (' + names.length + ')</h2><div class="deps">' +
+      names.sort().map(function (name) {
+        return '<span title="' + escape(deps[name]) + '">' + packageLink(name) + '</span>';
+      }).join('') + '</div></section>';
+  }
+
+  function renderPackage(name) {
+    query.value = '';
+    main.innerHTML = '<p class="muted">Loading ' + escape(name) + '...</p>';
+
+    Promise.all([
+      getJSON('/' + name),
+      getJSON('/downloads/point/last-week/' + name).catch(function () { return null; })
+    ]).then(function (results) {
+      var doc = results[0];
+      var downloads = results[1];
+      var tags = doc['dist-tags'] || {};
+      var versions = doc.versions || {};
+      var times = doc.time || {};
+      var latest = versions[tags.latest] || {};
+      var readme = doc.readme || latest.readme || '';
+
+      var versionRows = Object.keys(versions).sort(function (a, b) {
+        return String(times[b] || '').localeCompare(String(times[a] || ''));
+      }).map(function (version) {
+        var dist = versions[version].dist || {};
+        var download = dist.tarball ? '<a href="' + safeURL(escape(dist.tarball)) + '">tarball</a>' : '';
+        return '<tr><td>' + escape(version) + '</td><td>' + formatDate(times[version]) + '</td><td>' + download + '</td></tr>';
+      }).join('');
+
+      var tagRows = Object.keys(tags).map(function (tag) {
+        return '<tr><td>' + escape(tag) + '</td><td>' + escape(tags[tag]) + '</td></tr>';
+      }).join('');
+
+      main.innerHTML = '<h1>' + escape(doc.name || name) + '</h1>' +
+        '<p class="muted">' + escape(tags.latest || '') + (latest.license ? ' • ' + escape(latest.license) : '') +
+        (times.modified ? ' • updated ' + formatDate(times.modified) : '') + '</p>' +
+        '<p>' + escape(doc.description || latest.description || '') + '</p>' +
+        '<div class="package"><div class="readme">' +
+        (readme ? markdown(readme) : '<p class="muted">No readme.</p>') +
+        '</div><aside>' +
+        '<section><h2>Install</h2><code>npm install ' + escape(doc.name || name) + '</code></section>' +
+        (downloads ? '<section><h2>Weekly downloads</h2>' + formatNumber(downloads.downloads) + '</section>' : '') +
+        '<section><h2>Dist tags</h2><table>' + tagRows + '</table></section>' +
+        '<section><h2>Versions (' + Object.keys(versions).length + ')</h2><div class="versions"><table>' + versionRows + '</table></div></section>' +
+        dependencyList('Dependencies', latest.dependencies) +
+        dependencyList('Peer dependencies', latest.peerDependencies) +
+        dependencyList('Dev dependencies', latest.devDependencies) +
+        '</aside></div>';
+    }).catch(showError);
+  }
+
+  function card(label, value, extra) {
+    return '<div class="card"><div class="muted">' + escape(label) + '</div><div class="value">' + value + '</div>' + (extra || '') + '</div>';
+  }
+
+  function renderStatus() {
+    query.value = '';
+    main.innerHTML = '<p class="muted">Loading...</p>';
+
+    getJSON('/-/pocketnpm/status').then(function (status) {
+      var mirror = status.mirror;
+      var completion = status.completion.toFixed(2);
+      var html = '<h1>Mirror status</h1><div class="cards">' +
+        card('Sequence', formatNumber(status.sequence)) +
+        card('Completion', completion + '%', '<div class="progress"><div style="width:' + completion + '%"></div></div>') +
+        card('Packages', formatNumber(status.available) + ' / ' + formatNumber(status.packages)) +
+        card('Documents', formatNumber(status.docs));
+
+      if (mirror) {
+        var state = mirror.paused ? 'paused' : mirror.running ? 'running' : 'idle';
+        html += card('Mirror', escape(state), mirror.running ? '<div class="muted">' + formatNumber(mirror.completed) + ' / ' + formatNumber(mirror.total) + '</div>' : '') +
+          card('Failures', formatNumber(mirror.failed), '<div class="muted">in this run</div>');
+      }
+      html += '</div>';
+
+      if (mirror && mirror.failures.length) {
+        html += '<h2>Recent failures</h2><table><tr><th>Time</th><th>Package</th><th>Reason</th></tr>' +
+          mirror.failures.map(function (failure) {
+            return '<tr><td>' + escape(new Date(failure.time).toLocaleString()) + '</td><td>' + packageLink(failure.id) + '</td><td>' + escape(failure.reason) + '</td></tr>';
+          }).join('') + '</table>';
+      } else if (!mirror) {
+        html += '<p class="muted">Mirroring is not running in the server process.</p>';
+      }
+
+      html += '<h2>Recent changes</h2>';
+      if (!status.changes.length) {
+        html += '<p class="muted">No changes yet.</p>';
+      } else {
+        html += '<table><tr><th>Time</th><th>Action</th><th>Package</th><th>Versions</th></tr>' +
+          status.changes.map(function (entry) {
+            var versions = (entry.added || []).map(function (v) { return '<span class="added">+' + escape(v) + '</span>'; })
+              .concat((entry.removed || []).map(function (v) { return '<span class="removed">-' + escape(v) + '</span>'; }));
+            return '<tr><td>' + escape(new Date(entry.time).toLocaleString()) + '</td><td>' + escape(entry.action) + '</td><td>' +
+              packageLink(entry.id) + '</td><td>' + versions.join(' ') + '</td></tr>';
+          }).join('') + '</table>';
+      }
+
+      main.innerHTML = html;
+    }).catch(showError);
+  }
+
+  function route() {
+    var hash = decodeURIComponent(location.hash.replace(/^#\/?/, ''));
+    if (hash.indexOf('package/') === 0) {
+      renderPackage(hash.slice('package/'.length));
+    } else if (hash === 'status') {
+      renderStatus();
+    } else {
+      renderSearch(hash.indexOf('search/') === 0 ? hash.slice('search/'.length) : '');
+    }
+    window.scrollTo(0, 0);
+  }
+
+  document.getElementById('search').addEventListener('submit', function (event) {
+    event.preventDefault();
+    location.hash = '#/search/' + encodeURIComponent(query.value.trim());
+  });
+  window.addEventListener('hashchange', route);
+  route();
+})();
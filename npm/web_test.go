@@ -0,0 +1,100 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+func TestGetWeb(t *testing.T) {
+	server := &PocketServer{}
+	cases := map[string]int{
+		"/":                200,
+		"/app.js":          200,
+		"/style.css":       200,
+		"/missing.js":      404,
+		"/../web.go":       404,
+		"/../../README.md": 404,
+	}
+	for path, expected := range cases {
+		var ctx fasthttp.RequestCtx
+		ctx.SetUserValue("path", path)
+		server.getWeb(&ctx)
+		if status := ctx.Response.StatusCode(); status != expected {
+			t.Errorf("TestGetWeb: %s expected %d actual %d", path, expected, status)
+		}
+	}
+
+	var ctx fasthttp.RequestCtx
+	ctx.SetUserValue("path", "/")
+	server.getWeb(&ctx)
+	if contentType := string(ctx.Response.Header.ContentType()); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("TestGetWeb: unexpected content type %s", contentType)
+	}
+}
+
+func TestSearchPackages(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb, client := newTestMirror(t, base, &MirrorConfig{})
+	defer pb.Close()
+
+	for _, name := range []string{"test", "other-test", "@s/test", "removed-test", "blocked-test", "unrelated"} {
+		pack := &db.BarePackage{ID: name, Revision: "1"}
+		pb.PutPackages([]*db.BarePackage{pack})
+		pb.PutCompleted(pack, `{"_id":"`+name+`","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"description":"a `+name+`"}}}`, "1", nil, nil)
+	}
+	pb.DeletePackage("removed-test")
+	pb.AddBlockEntry(&db.BlockEntry{Name: "blocked-test", Reason: "malware", Author: "test"})
+
+	server := &PocketServer{db: pb, storage: client.storage, serverConfig: &ServerConfig{}}
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/-/v1/search?text=test")
+	server.searchPackages(&ctx)
+
+	var result searchResponse
+	if err := json.Unmarshal(ctx.Response.Body(), &result); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, object := range result.Objects {
+		names = append(names, object.Package.Name)
+	}
+	if strings.Join(names, ",") != "test,@s/test,other-test" || result.Objects[0].Package.Version != "1.0.0" ||
+		result.Objects[0].Package.Description != "a test" {
+		t.Errorf("TestSearchPackages: unexpected result %s", ctx.Response.Body())
+	}
+	if names := pb.SearchPackages("test", 2); strings.Join(names, ",") != "test,@s/test" {
+		t.Errorf("TestSearchPackages: unexpected limited result %v", names)
+	}
+
+	var offset fasthttp.RequestCtx
+	offset.Request.SetRequestURI("/-/v1/search?text=test&from=1000000000")
+	server.searchPackages(&offset)
+	if err := json.Unmarshal(offset.Response.Body(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 0 {
+		t.Errorf("TestSearchPackages: unexpected result past the offset %s", offset.Response.Body())
+	}
+
+	var status fasthttp.RequestCtx
+	server.getOverview(&status)
+	var overview MirrorOverview
+	if err := json.Unmarshal(status.Response.Body(), &overview); err != nil {
+		t.Fatal(err)
+	}
+	if overview.Packages != 5 || overview.Available != 5 || overview.Completion != 100 ||
+		len(overview.Changes) != 7 || overview.Changes[0].ID != "removed-test" || overview.Mirror != nil {
+		t.Errorf("TestSearchPackages: unexpected overview %s", status.Response.Body())
+	}
+}
@@ -0,0 +1,541 @@
+package npm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/ffjson/ffjson"
+	"github.com/ssut/pocketnpm/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Event types of webhooks
+const (
+	// WebhookUpdate is sent when a new revision of a package is mirrored
+	WebhookUpdate = "update"
+	// WebhookPublish is sent when versions are added
+	WebhookPublish = "publish"
+	// WebhookUnpublish is sent when versions are removed, including by a deletion
+	WebhookUnpublish = "unpublish"
+	// WebhookDelete is sent when a package is deleted
+	WebhookDelete = "delete"
+)
+
+var webhookEventTypes = []string{WebhookUpdate, WebhookPublish, WebhookUnpublish, WebhookDelete}
+
+// webhookEvents returns the event types of a journal entry
+func webhookEvents(entry *db.JournalEntry) (events []string) {
+	if entry.Action == db.JournalDeleted {
+		events = append(events, WebhookDelete)
+	} else {
+		events = append(events, WebhookUpdate)
+	}
+	if len(entry.Added) > 0 {
+		events = append(events, WebhookPublish)
+	}
+	if len(entry.Removed) > 0 {
+		events = append(events, WebhookUnpublish)
+	}
+
+	return
+}
+
+// matchWebhook returns the events of the entry the webhook subscribes to
+func matchWebhook(hook *db.Webhook, entry *db.JournalEntry) (events []string) {
+	if len(hook.Patterns) > 0 {
+		matched := false
+		for _, pattern := range hook.Patterns {
+			if ok, _ := path.Match(pattern, entry.ID); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+
+	for _, event := range webhookEvents(entry) {
+		if len(hook.Events) == 0 || containsString(hook.Events, event) {
+			events = append(events, event)
+		}
+	}
+
+	return
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewWebhook validates a subscription and returns a webhook with a new id,
+// and a random secret if none is given
+func NewWebhook(rawurl string, patterns []string, events []string, secret string) (*db.Webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid url: %q", rawurl)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern: %q", pattern)
+		}
+	}
+	for _, event := range events {
+		if !containsString(webhookEventTypes, event) {
+			return nil, fmt.Errorf("Invalid event: %q (expected one of %s)", event, strings.Join(webhookEventTypes, ", "))
+		}
+	}
+	if secret == "" {
+		secret = randomHex(20)
+	}
+
+	return &db.Webhook{
+		ID:       randomHex(8),
+		URL:      rawurl,
+		Patterns: patterns,
+		Events:   events,
+		Secret:   secret,
+		Created:  time.Now().UTC(),
+	}, nil
+}
+
+// signWebhook returns the signature of a payload sent as X-Pocketnpm-Signature
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Delivery int      `json:"delivery"`
+	Events   []string `json:"events"`
+	*db.JournalEntry
+}
+
+// webhookJob is a delivery waiting in the queue
+type webhookJob struct {
+	hook     *db.Webhook
+	delivery *db.WebhookDelivery
+	payload  []byte
+}
+
+// webhookBatch is the number of journal entries read at a time
+const webhookBatch = 100
+
+// WebhookDispatcher delivers journal entries to the webhooks subscribing to them
+//
+// The journal is the queue of the dispatcher: mirroring only signals that
+// entries have been appended, and the dispatcher reads them after a cursor
+// stored in the database. The cursor only moves past entries whose deliveries
+// are done, so deliveries pending on exit are sent after a restart, and the
+// dispatcher waits for the workers instead of dropping deliveries when they fall behind.
+type WebhookDispatcher struct {
+	db      *db.PocketBase
+	config  *WebhookConfig
+	client  *http.Client
+	queue   chan *webhookJob
+	wake    chan struct{}
+	wg      sync.WaitGroup
+	backoff time.Duration
+
+	// dispatchMu serializes reads of the journal
+	dispatchMu sync.Mutex
+
+	hooksMu sync.Mutex
+	hooks   []*db.Webhook
+	loaded  bool
+
+	mu sync.Mutex
+	// started is set once the cursor has been loaded
+	started bool
+	// first is the sequence of the first entry notified before the dispatcher started
+	first int
+	// queued is the sequence of the last entry queued for delivery
+	queued int
+	// pending counts the deliveries in progress by sequence
+	pending map[int]int
+	// cursor is the sequence stored in the database
+	cursor int
+}
+
+// NewWebhookDispatcher starts the workers delivering webhooks
+func NewWebhookDispatcher(pb *db.PocketBase, config *WebhookConfig) *WebhookDispatcher {
+	if config.Attempts <= 0 {
+		config.Attempts = 5
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+	if config.History <= 0 {
+		config.History = 100
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 4
+	}
+
+	d := &WebhookDispatcher{
+		db:      pb,
+		config:  config,
+		client:  &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+		queue:   make(chan *webhookJob, 1024),
+		wake:    make(chan struct{}, 1),
+		backoff: time.Second,
+		pending: map[int]int{},
+	}
+	for i := 0; i < config.Concurrency; i++ {
+		go d.work()
+	}
+	go d.run()
+
+	return d
+}
+
+// Reload method loads the webhooks used for the next deliveries
+//
+// Webhooks are loaded once per mirror run, so that changes made by the server
+// process apply from the next run.
+func (d *WebhookDispatcher) Reload() {
+	hooks := d.db.GetWebhooks()
+
+	d.hooksMu.Lock()
+	d.hooks, d.loaded = hooks, true
+	d.hooksMu.Unlock()
+}
+
+// loadedHooks returns the webhooks loaded by Reload, which are loaded now if it has not been called
+func (d *WebhookDispatcher) loadedHooks() []*db.Webhook {
+	d.hooksMu.Lock()
+	defer d.hooksMu.Unlock()
+	if !d.loaded {
+		d.hooks, d.loaded = d.db.GetWebhooks(), true
+	}
+
+	return d.hooks
+}
+
+// Notify method signals that the entry has been appended to the journal
+//
+// It never blocks, and nil only wakes the dispatcher up to send deliveries
+// pending from a previous run.
+func (d *WebhookDispatcher) Notify(entry *db.JournalEntry) {
+	if entry != nil {
+		d.mu.Lock()
+		if !d.started && (d.first == 0 || entry.Sequence < d.first) {
+			d.first = entry.Sequence
+		}
+		d.mu.Unlock()
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until all entries of the journal are delivered
+func (d *WebhookDispatcher) Wait() {
+	d.dispatch()
+	d.wg.Wait()
+}
+
+func (d *WebhookDispatcher) run() {
+	for range d.wake {
+		d.dispatch()
+	}
+}
+
+// start loads the cursor, which starts at the first notified entry when no
+// webhooks have been dispatched before so that the history is not sent
+func (d *WebhookDispatcher) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		return
+	}
+
+	cursor, ok := d.db.GetWebhookCursor()
+	if !ok {
+		cursor = d.db.GetJournalSequence()
+		if d.first > 0 && d.first-1 < cursor {
+			cursor = d.first - 1
+		}
+		if err := d.db.SetWebhookCursor(cursor); err != nil {
+			mirrorLog.Errorf("Failed to store the webhook cursor: %d %v", cursor, err)
+		}
+	}
+	d.started, d.queued, d.cursor = true, cursor, cursor
+}
+
+// dispatch queues the deliveries of the entries after the last queued one,
+// waiting while the queue is full
+func (d *WebhookDispatcher) dispatch() {
+	d.dispatchMu.Lock()
+	defer d.dispatchMu.Unlock()
+
+	d.start()
+	hooks := d.loadedHooks()
+
+	for {
+		// entries are read in batches since deliveries are not queued within a read transaction
+		d.mu.Lock()
+		query := &db.JournalQuery{Since: d.queued, Limit: webhookBatch}
+		d.mu.Unlock()
+
+		var entries []*db.JournalEntry
+		d.db.QueryJournal(query, func(entry *db.JournalEntry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		if len(entries) == 0 {
+			return
+		}
+
+		for _, entry := range entries {
+			jobs := d.jobs(hooks, entry)
+
+			d.mu.Lock()
+			d.queued = entry.Sequence
+			if len(jobs) > 0 {
+				d.pending[entry.Sequence] = len(jobs)
+			}
+			d.mu.Unlock()
+
+			for _, job := range jobs {
+				d.wg.Add(1)
+				d.queue <- job
+			}
+		}
+		d.advance()
+	}
+}
+
+// jobs returns the deliveries of the entry to the webhooks subscribing to it
+func (d *WebhookDispatcher) jobs(hooks []*db.Webhook, entry *db.JournalEntry) (jobs []*webhookJob) {
+	for _, hook := range hooks {
+		events := matchWebhook(hook, entry)
+		if len(events) == 0 {
+			continue
+		}
+
+		delivery := &db.WebhookDelivery{
+			ID:      d.db.NextDeliveryID(),
+			Webhook: hook.ID,
+			Events:  events,
+			Package: entry.ID,
+			Journal: entry.Sequence,
+			Time:    time.Now().UTC(),
+		}
+		payload, _ := json.Marshal(&webhookPayload{
+			Delivery:     delivery.ID,
+			Events:       events,
+			JournalEntry: entry,
+		})
+		jobs = append(jobs, &webhookJob{hook: hook, delivery: delivery, payload: payload})
+	}
+
+	return
+}
+
+// done marks a delivery of the entry as done
+func (d *WebhookDispatcher) done(seq int) {
+	d.mu.Lock()
+	if d.pending[seq]--; d.pending[seq] <= 0 {
+		delete(d.pending, seq)
+	}
+	d.mu.Unlock()
+
+	d.advance()
+}
+
+// advance stores the cursor in front of the first entry with deliveries in progress
+func (d *WebhookDispatcher) advance() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cursor := d.queued
+	for seq := range d.pending {
+		if seq-1 < cursor {
+			cursor = seq - 1
+		}
+	}
+	if cursor == d.cursor {
+		return
+	}
+
+	if err := d.db.SetWebhookCursor(cursor); err != nil {
+		mirrorLog.Errorf("Failed to store the webhook cursor: %d %v", cursor, err)
+		return
+	}
+	d.cursor = cursor
+}
+
+func (d *WebhookDispatcher) work() {
+	for job := range d.queue {
+		d.deliver(job)
+		d.record(job.delivery)
+		d.done(job.delivery.Journal)
+		d.wg.Done()
+	}
+}
+
+// deliver posts the payload, retrying with an exponential backoff until the
+// endpoint responds with a 2xx status
+func (d *WebhookDispatcher) deliver(job *webhookJob) {
+	delivery := job.delivery
+	backoff := d.backoff
+
+	for delivery.Attempts < d.config.Attempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		delivery.Attempts++
+
+		req, err := http.NewRequest("POST", job.hook.URL, bytes.NewReader(job.payload))
+		if err != nil {
+			delivery.Error = err.Error()
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "PocketNPM Webhook")
+		req.Header.Set("X-Pocketnpm-Delivery", fmt.Sprint(delivery.ID))
+		req.Header.Set("X-Pocketnpm-Event", strings.Join(delivery.Events, ","))
+		req.Header.Set("X-Pocketnpm-Signature", signWebhook(job.hook.Secret, job.payload))
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			delivery.Error = err.Error()
+			continue
+		}
+		resp.Body.Close()
+
+		delivery.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			delivery.Delivered = true
+			delivery.Error = ""
+			return
+		}
+		delivery.Error = resp.Status
+	}
+
+	mirrorLog.Warnf("Failed to deliver a webhook to %s after %d attempts: %s", job.hook.URL, delivery.Attempts, delivery.Error)
+}
+
+func (d *WebhookDispatcher) record(delivery *db.WebhookDelivery) {
+	if err := d.db.PutDelivery(delivery, d.config.History); err != nil {
+		mirrorLog.Errorf("Failed to store a webhook delivery: %d %v", delivery.ID, err)
+	}
+}
+
+// getWebhooks lists the webhooks without their secrets
+//
+// GET /-/admin/webhooks
+func (server *PocketServer) getWebhooks(ctx *fasthttp.RequestCtx) {
+	hooks := server.db.GetWebhooks()
+	if hooks == nil {
+		hooks = []*db.Webhook{}
+	}
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, hooks)
+}
+
+// addWebhook subscribes to changes of packages, and returns the webhook with its secret
+//
+// POST /-/admin/webhooks (body: {"url": "...", "patterns": ["@scope/*"], "events": ["publish"], "secret": "..."})
+func (server *PocketServer) addWebhook(ctx *fasthttp.RequestCtx) {
+	var body db.Webhook
+	if err := ffjson.Unmarshal(ctx.PostBody(), &body); err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	hook, err := NewWebhook(body.URL, body.Patterns, body.Events, body.Secret)
+	if err != nil {
+		ctx.SetStatusCode(400)
+		server.writeJSON(ctx, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := server.db.PutWebhook(hook); err != nil {
+		serverLog.Errorf("Failed to add a webhook: %s %v", hook.URL, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	serverLog.Infof("Webhook: %s has been added (%s)", hook.ID, hook.URL)
+
+	ctx.SetStatusCode(201)
+	server.writeJSON(ctx, hook)
+}
+
+// removeWebhook removes a webhook and its delivery history
+//
+// DELETE /-/admin/webhooks/:id
+func (server *PocketServer) removeWebhook(ctx *fasthttp.RequestCtx) {
+	id := ctx.UserValue("id").(string)
+	removed, err := server.db.RemoveWebhook(id)
+	if err != nil {
+		serverLog.Errorf("Failed to remove a webhook: %s %v", id, err)
+		ctx.SetStatusCode(500)
+		return
+	}
+	if !removed {
+		server.raiseNotFound(ctx)
+		return
+	}
+	serverLog.Infof("Webhook: %s has been removed", id)
+
+	server.writeJSON(ctx, map[string]interface{}{
+		"ok": true,
+	})
+}
+
+// getDeliveries lists the recent deliveries of a webhook, the latest first
+//
+// GET /-/admin/webhooks/:id/deliveries
+func (server *PocketServer) getDeliveries(ctx *fasthttp.RequestCtx) {
+	id := ctx.UserValue("id").(string)
+	if server.db.GetWebhook(id) == nil {
+		server.raiseNotFound(ctx)
+		return
+	}
+
+	deliveries := server.db.GetDeliveries(id)
+	if deliveries == nil {
+		deliveries = []*db.WebhookDelivery{}
+	}
+
+	ctx.SetContentType("application/json")
+	server.writeJSON(ctx, deliveries)
+}
@@ -0,0 +1,118 @@
+package npm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ssut/pocketnpm/db"
+)
+
+func TestMatchWebhook(t *testing.T) {
+	entry := &db.JournalEntry{Action: db.JournalUpdated, ID: "@scope/test", Added: []string{"1.0.1"}}
+	cases := []struct {
+		hook     *db.Webhook
+		expected []string
+	}{
+		{&db.Webhook{}, []string{WebhookUpdate, WebhookPublish}},
+		{&db.Webhook{Patterns: []string{"@scope/*"}, Events: []string{WebhookPublish}}, []string{WebhookPublish}},
+		{&db.Webhook{Patterns: []string{"*"}}, nil},
+		{&db.Webhook{Events: []string{WebhookDelete}}, nil},
+	}
+	for _, c := range cases {
+		if events := matchWebhook(c.hook, entry); !reflect.DeepEqual(events, c.expected) {
+			t.Errorf("TestMatchWebhook: %+v expected %v actual %v", c.hook, c.expected, events)
+		}
+	}
+
+	if _, err := NewWebhook("ftp://host/", nil, nil, ""); err == nil {
+		t.Error("TestMatchWebhook: expected an invalid url")
+	}
+	if _, err := NewWebhook("http://host/", nil, []string{"publish", "star"}, ""); err == nil {
+		t.Error("TestMatchWebhook: expected an invalid event")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	base, err := ioutil.TempDir("", "pocketnpm-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	pb := db.NewPocketBase(&db.DatabaseConfig{
+		Type:          "bolt",
+		Path:          filepath.Join(base, "npm.db"),
+		MaxCacheSize:  1024,
+		CacheLifetime: 60,
+	})
+	defer pb.Close()
+
+	// the endpoint fails once per delivery before accepting it
+	var requests int32
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		signatures = append(signatures, r.Header.Get("X-Pocketnpm-Signature"), signWebhook("secret", body))
+		if atomic.AddInt32(&requests, 1)%2 == 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	hook, _ := NewWebhook(server.URL, []string{"test"}, nil, "secret")
+	pb.PutWebhook(hook)
+
+	dispatcher := NewWebhookDispatcher(pb, &WebhookConfig{Concurrency: 1, History: 2})
+	dispatcher.backoff = time.Millisecond
+	update := func(id string, rev int) *db.JournalEntry {
+		pack := &db.BarePackage{ID: id, Revision: fmt.Sprint(rev)}
+		pb.PutPackages([]*db.BarePackage{pack})
+		entry, _ := pb.PutCompletedEntry(pack, `{"_id":"`+id+`","versions":{}}`, pack.Revision, nil, nil)
+		return entry
+	}
+	for i := 0; i < 3; i++ {
+		dispatcher.Notify(update("test", i+1))
+		dispatcher.Notify(update("other", i+1))
+	}
+	dispatcher.Wait()
+
+	for i := 0; i < len(signatures); i += 2 {
+		if signatures[i] != signatures[i+1] {
+			t.Errorf("TestWebhookDelivery: expected signature %s actual %s", signatures[i+1], signatures[i])
+		}
+	}
+
+	deliveries := pb.GetDeliveries(hook.ID)
+	if len(deliveries) != 2 {
+		t.Fatalf("TestWebhookDelivery: expected 2 deliveries actual %d", len(deliveries))
+	}
+	for i, delivery := range deliveries {
+		if !delivery.Delivered || delivery.Attempts != 2 || delivery.StatusCode != 200 || delivery.Journal != 5-2*i {
+			t.Errorf("TestWebhookDelivery: unexpected delivery %+v", delivery)
+		}
+	}
+	if cursor, _ := pb.GetWebhookCursor(); cursor != 6 {
+		t.Errorf("TestWebhookDelivery: expected cursor 6 actual %d", cursor)
+	}
+
+	// entries journaled while no dispatcher was running are delivered by the next one
+	update("test", 4)
+	dispatcher = NewWebhookDispatcher(pb, &WebhookConfig{Concurrency: 1, History: 2})
+	dispatcher.backoff = time.Millisecond
+	dispatcher.Wait()
+	if deliveries := pb.GetDeliveries(hook.ID); len(deliveries) != 2 || deliveries[0].Journal != 7 {
+		t.Errorf("TestWebhookDelivery: unexpected deliveries after a restart %+v", deliveries)
+	}
+
+	if removed, _ := pb.RemoveWebhook(hook.ID); !removed || len(pb.GetDeliveries(hook.ID)) != 0 {
+		t.Error("TestWebhookDelivery: the webhook was not removed")
+	}
+}
@@ -3,13 +3,16 @@ package npm
 import (
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/pquerna/ffjson/ffjson"
-	"github.com/sirupsen/logrus"
 	"github.com/ssut/pocketnpm/db"
 	"github.com/ssut/pocketnpm/log"
 )
 
+// workerLog logs the messages of the mirror workers
+var workerLog = log.Component(log.ComponentWorker)
+
 // MirrorWorker contains channels used to act as a worker
 type MirrorWorker struct {
 	ID          int
@@ -20,6 +23,19 @@ type MirrorWorker struct {
 	QuitChan    chan bool
 
 	npmClient *NPMClient
+	db        *db.PocketBase
+	logger    *log.Logger
+
+	mu      sync.Mutex
+	current string
+	started time.Time
+}
+
+// WorkerStatus represents the package a worker is working on
+type WorkerStatus struct {
+	ID      int       `json:"id"`
+	Package string    `json:"package,omitempty"`
+	Started time.Time `json:"started,omitempty"`
 }
 
 // MirrorWorkResult contains the result of worker action
@@ -33,7 +49,7 @@ type MirrorWorkResult struct {
 }
 
 // NewMirrorWorker creates a worker with given parameters
-func NewMirrorWorker(id int, npmClient *NPMClient, workerQueue chan chan *db.BarePackage, resultQueue chan *MirrorWorkResult, wg *sync.WaitGroup) *MirrorWorker {
+func NewMirrorWorker(id int, npmClient *NPMClient, pb *db.PocketBase, workerQueue chan chan *db.BarePackage, resultQueue chan *MirrorWorkResult, wg *sync.WaitGroup) *MirrorWorker {
 	worker := &MirrorWorker{
 		ID:          id,
 		Work:        make(chan *db.BarePackage),
@@ -42,6 +58,8 @@ func NewMirrorWorker(id int, npmClient *NPMClient, workerQueue chan chan *db.Bar
 		WaitGroup:   wg,
 		QuitChan:    make(chan bool),
 		npmClient:   npmClient,
+		db:          pb,
+		logger:      workerLog.WithField("worker", id),
 	}
 
 	return worker
@@ -61,21 +79,21 @@ func (w *MirrorWorker) Start() {
 				//   - if it doesnt match, fix it
 				//   - the revision will be updated when updating database content
 				// - parse all urls in the document
-				// - download all packages ends with `.tgz`
+				// - download all packages ends with `.tgz` unless the version is blocked
 				// then, result handler:
 				// - put document into the bucket Documents
 				// - put file list into the bucket Files
 				// - mark the package as completed (commit)
-				log.WithFields(logrus.Fields{
-					"worker": w.ID,
-				}).Infof("Mirroring: %s", work.ID)
+				logger := w.logger.WithField("name", work.ID)
+				logger.Infof("Mirroring: %s", work.ID)
+				w.setCurrent(work.ID)
 				document := w.npmClient.GetDocument(work.ID)
 				distributions := []*distribution{}
 
 				var doc DocumentResponse
 				err := ffjson.Unmarshal([]byte(document), &doc)
 				if err != nil {
-					log.Warnf("Failed to decode JSON document: %s (%v)", work.ID, err)
+					logger.Warnf("Failed to decode JSON document: %s (%v)", work.ID, err)
 
 					// doc has been deleted
 					if document == "404" {
@@ -87,27 +105,29 @@ func (w *MirrorWorker) Start() {
 							WorkerID:         w.ID,
 							Deleted:          true,
 						}
+						w.setCurrent("")
 						continue
 					}
 				}
 
 				// find possible urls
 				distributions = getDistributions(document)
+				blocked := w.db.GetBlockEntries(work.ID)
 
 				// download all files here
-				log.WithFields(logrus.Fields{
-					"name":   work.ID,
-					"worker": w.ID,
-				}).Debugf("Total files to download: %d", len(distributions))
+				logger.Debugf("Total files to download: %d", len(distributions))
 				for _, dist := range distributions {
 					file, _ := url.Parse(dist.Tarball)
 
+					if entry := blockedBy(blocked, dist.Version); entry != nil {
+						logger.Debugf("Skipping blocked version: %s (%s)", dist.Version, entry.Reason)
+						continue
+					}
+
 					if checkValidDist(dist) {
 						dist.Completed = w.npmClient.Download(file, dist.SHA1)
 						if !dist.Completed {
-							log.WithFields(logrus.Fields{
-								"ID": work.ID,
-							}).Warnf("Failed to download: %s", file.Path)
+							logger.Warnf("Failed to download: %s", file.Path)
 						}
 					}
 				}
@@ -119,6 +139,7 @@ func (w *MirrorWorker) Start() {
 					Distributions:    distributions,
 					WorkerID:         w.ID,
 				}
+				w.setCurrent("")
 			case <-w.QuitChan:
 				w.WaitGroup.Done()
 				return
@@ -127,6 +148,26 @@ func (w *MirrorWorker) Start() {
 	}()
 }
 
+func (w *MirrorWorker) setCurrent(name string) {
+	w.mu.Lock()
+	w.current = name
+	w.started = time.Now()
+	w.mu.Unlock()
+}
+
+// Status method returns the package the worker is currently working on
+func (w *MirrorWorker) Status() WorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := WorkerStatus{ID: w.ID}
+	if w.current != "" {
+		status.Package = w.current
+		status.Started = w.started
+	}
+	return status
+}
+
 // Stop function tells the worker to stop listening for work requests
 //
 // Note that the worker will only stop after it has finished its work